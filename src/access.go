@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var (
+	errProjectRequired  = errors.New("project_id required")
+	errNotProjectMember = errors.New("not a member of this project")
+	errResourceNotFound = errors.New("resource not found")
+)
+
+type accessContextKey struct{}
+
+// requestAccess describes the authenticated caller and, for project-scoped
+// routes, the project the request was authorized against.
+type requestAccess struct {
+	UserID    string
+	SessionID string
+	CSRFToken string
+	ProjectID string
+	Role      projectRole
+}
+
+// projectResolver extracts the project a request targets. Resolvers must not
+// consume the request body without restoring it.
+type projectResolver func(r *http.Request) (string, error)
+
+type accessPolicy struct {
+	resolveProject projectResolver
+	page           bool
+}
+
+// requireSession lets authenticated API callers through and rejects everyone
+// else with 401. Like every guard here, it also rejects state-changing
+// requests that don't carry the session's CSRF token.
+func requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return authorize(accessPolicy{}, next)
+}
+
+// requireProjectAccess authenticates the caller and verifies they own or are a
+// member of the project returned by resolve. Cross-project access gets a 403.
+// The caller's role is attached for handlers that need finer-grained checks.
+func requireProjectAccess(resolve projectResolver, next http.HandlerFunc) http.HandlerFunc {
+	return authorize(accessPolicy{resolveProject: resolve}, next)
+}
+
+// requirePageSession is the HTML flavour of requireSession: anonymous visitors
+// are sent back to the landing page.
+func requirePageSession(next http.HandlerFunc) http.HandlerFunc {
+	return authorize(accessPolicy{page: true}, next)
+}
+
+// requireProjectPage guards project pages addressed by ?id=, redirecting
+// visitors that are not members back to the project list.
+func requireProjectPage(next http.HandlerFunc) http.HandlerFunc {
+	return authorize(accessPolicy{resolveProject: projectFromQuery("id"), page: true}, next)
+}
+
+func authorize(policy accessPolicy, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := loadSession(r)
+		if err != nil {
+			if !errors.Is(err, errNoSession) && !errors.Is(err, errSessionExpired) {
+				log.Printf("access: failed to load session: %v", err)
+			}
+			if errors.Is(err, errSessionExpired) {
+				clearSessionCookie(w)
+			}
+			if policy.page {
+				http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+				return
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if requiresCSRF(r.Method) {
+			if err := checkCSRF(r, session); err != nil {
+				http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+
+		userID := session.UserID
+		access := requestAccess{UserID: userID, SessionID: session.ID, CSRFToken: session.CSRFToken}
+		if policy.resolveProject != nil {
+			projectID, err := policy.resolveProject(r)
+			var role projectRole
+			if err == nil {
+				role, err = lookupProjectRole(projectID, userID)
+			}
+			if err != nil {
+				denyProjectAccess(w, r, policy, err)
+				return
+			}
+			access.ProjectID = projectID
+			access.Role = role
+		}
+
+		ctx := context.WithValue(r.Context(), accessContextKey{}, access)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func denyProjectAccess(w http.ResponseWriter, r *http.Request, policy accessPolicy, err error) {
+	if policy.page {
+		http.Redirect(w, r, "/projects", http.StatusTemporaryRedirect)
+		return
+	}
+
+	switch {
+	case errors.Is(err, errProjectRequired):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errResourceNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, errNotProjectMember):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	default:
+		log.Printf("access: failed to authorize %s: %v", r.URL.Path, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+	}
+}
+
+// accessFromRequest returns the identity attached by authorize. Handlers that
+// are registered without a guard get the zero value.
+func accessFromRequest(r *http.Request) requestAccess {
+	access, _ := r.Context().Value(accessContextKey{}).(requestAccess)
+	return access
+}
+
+func projectFromQuery(param string) projectResolver {
+	return func(r *http.Request) (string, error) {
+		projectID := strings.TrimSpace(r.URL.Query().Get(param))
+		if projectID == "" {
+			return "", errProjectRequired
+		}
+		return projectID, nil
+	}
+}
+
+// projectFromQueryOrBody reads project_id from the query string on reads and
+// from the JSON body on writes, restoring the body for the handler.
+func projectFromQueryOrBody(r *http.Request) (string, error) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return projectFromQuery("project_id")(r)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(raw))
+
+	var body struct {
+		ProjectID string `json:"project_id"`
+	}
+	if len(bytes.TrimSpace(raw)) > 0 {
+		_ = json.Unmarshal(raw, &body)
+	}
+	if body.ProjectID == "" {
+		return projectFromQuery("project_id")(r)
+	}
+	return body.ProjectID, nil
+}
+
+// projectFromPath resolves /prefix/{projectID}/... style routes.
+func projectFromPath(prefix string) projectResolver {
+	return func(r *http.Request) (string, error) {
+		projectID, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		if projectID == "" {
+			return "", errProjectRequired
+		}
+		return projectID, nil
+	}
+}
+
+// projectFromRecordPath resolves /prefix/{id}/... routes by looking up the
+// owning project of the referenced row.
+func projectFromRecordPath(prefix, table string) projectResolver {
+	query := `SELECT project_id FROM ` + table + ` WHERE id = ?`
+	return func(r *http.Request) (string, error) {
+		recordID, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		if recordID == "" {
+			return "", errResourceNotFound
+		}
+
+		var projectID string
+		if err := db.QueryRow(query, recordID).Scan(&projectID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return "", errResourceNotFound
+			}
+			return "", err
+		}
+		return projectID, nil
+	}
+}
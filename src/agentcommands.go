@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"replychat/src/agents"
+)
+
+// Commands accepted in agent.command WebSocket messages.
+const (
+	agentCommandCancel = "cancel"
+	agentCommandPause  = "pause"
+	agentCommandResume = "resume"
+	agentCommandRetry  = "retry"
+	agentCommandRerun  = "rerun"
+)
+
+var (
+	errUnknownAgentCommand = errors.New("unknown agent command")
+	errUnknownAgent        = errors.New("unknown agent")
+	errAgentRequired       = errors.New("agentId is required")
+	errIssueRequired       = errors.New("issueId is required")
+	errNoRunSelected       = errors.New("cancel needs a runId, agentId or issueId")
+	errNothingToCancel     = errors.New("no matching run is in flight")
+	errIssueRunning        = errors.New("an agent is working on the issue; cancel the run first")
+	errNoRunToRetry        = errors.New("the issue has no agent run to retry")
+	errIssueNotFailed      = errors.New("only failed or blocked issues can be retried")
+	errRerunTarget         = errors.New("rerun needs an issueId or a runId")
+	errPromptRequired      = errors.New("prompt is required")
+)
+
+// agentCommand is the payload of an agent.command message.
+type agentCommand struct {
+	Command string `json:"command"`
+	AgentID string `json:"agentId,omitempty"`
+	IssueID string `json:"issueId,omitempty"`
+	RunID   string `json:"runId,omitempty"`
+	Prompt  string `json:"prompt,omitempty"`
+}
+
+// agentCommandResult reports a command's outcome in the agent.status event
+// that follows it.
+type agentCommandResult struct {
+	Command   string `json:"command"`
+	AgentID   string `json:"agentId,omitempty"`
+	IssueID   string `json:"issueId,omitempty"`
+	RunID     string `json:"runId,omitempty"`
+	OK        bool   `json:"ok"`
+	Message   string `json:"message,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ActorID   string `json:"actorId"`
+	ActorName string `json:"actorName,omitempty"`
+}
+
+// handleAgentCommand serves the agent.command WebSocket message. Every
+// command, including refused ones, is answered with an agent.status event
+// carrying the result and the project's fresh agent statuses.
+func handleAgentCommand(c *Client, msg map[string]interface{}) {
+	var cmd agentCommand
+	if raw, err := json.Marshal(msg["payload"]); err == nil {
+		json.Unmarshal(raw, &cmd)
+	}
+	cmd.Command = strings.ToLower(strings.TrimSpace(cmd.Command))
+
+	result := agentCommandResult{
+		Command:   cmd.Command,
+		AgentID:   cmd.AgentID,
+		IssueID:   cmd.IssueID,
+		RunID:     cmd.RunID,
+		ActorID:   c.userID,
+		ActorName: lookupUserName(c.userID),
+	}
+	var err error
+	if role, roleErr := lookupProjectRole(c.projectID, c.userID); roleErr != nil || !role.can(permRunAgents) {
+		err = errPermissionDenied
+	} else {
+		result.Message, err = runAgentCommand(c.projectID, c.userID, cmd)
+	}
+	if err != nil {
+		log.Printf("agent: %s command from %s in project %s failed: %v", cmd.Command, c.userID, c.projectID, err)
+		result.Error = err.Error()
+	} else {
+		log.Printf("agent: %s in project %s: %s", c.userID, c.projectID, result.Message)
+		result.OK = true
+	}
+	broadcastAgentCommandResult(c.projectID, result)
+}
+
+// validate checks that cmd is a known command with the fields it needs.
+func (cmd agentCommand) validate() error {
+	if cmd.AgentID != "" {
+		if _, ok := agentDisplayNames[cmd.AgentID]; !ok {
+			return fmt.Errorf("%w: %s", errUnknownAgent, cmd.AgentID)
+		}
+	}
+	switch cmd.Command {
+	case agentCommandCancel:
+		if cmd.RunID == "" && cmd.AgentID == "" && cmd.IssueID == "" {
+			return errNoRunSelected
+		}
+	case agentCommandPause, agentCommandResume:
+		if cmd.AgentID == "" {
+			return errAgentRequired
+		}
+	case agentCommandRetry:
+		if cmd.IssueID == "" {
+			return errIssueRequired
+		}
+	case agentCommandRerun:
+		if strings.TrimSpace(cmd.Prompt) == "" {
+			return errPromptRequired
+		}
+		if cmd.IssueID == "" && cmd.RunID == "" && cmd.AgentID == "" {
+			return errRerunTarget
+		}
+	default:
+		return fmt.Errorf("%w: %q", errUnknownAgentCommand, cmd.Command)
+	}
+	return nil
+}
+
+// runAgentCommand carries out cmd for userID in projectID and describes
+// what it did.
+func runAgentCommand(projectID, userID string, cmd agentCommand) (string, error) {
+	if err := cmd.validate(); err != nil {
+		return "", err
+	}
+	actor := lookupUserName(userID)
+	if actor == "" {
+		actor = "A teammate"
+	}
+
+	switch cmd.Command {
+	case agentCommandCancel:
+		sel := agents.RunSelector{RunID: cmd.RunID, AgentType: cmd.AgentID, IssueID: cmd.IssueID}
+		runs := agents.CancelRuns(projectID, sel, fmt.Errorf("%w by %s", agents.ErrRunCancelled, actor))
+		if len(runs) == 0 {
+			return "", errNothingToCancel
+		}
+		return fmt.Sprintf("%s cancelled %d run(s)", actor, len(runs)), nil
+
+	case agentCommandPause, agentCommandResume:
+		if err := setAgentQueuePaused(projectID, cmd.AgentID, userID, cmd.Command == agentCommandPause); err != nil {
+			return "", err
+		}
+		if cmd.Command == agentCommandPause {
+			return fmt.Sprintf("%s paused %s's queue", actor, agentDisplayNames[cmd.AgentID]), nil
+		}
+		return fmt.Sprintf("%s resumed %s's queue", actor, agentDisplayNames[cmd.AgentID]), nil
+
+	case agentCommandRetry:
+		if err := requireProjectIssue(projectID, cmd.IssueID); err != nil {
+			return "", err
+		}
+		// A later run may have finished the issue; retry only what is stuck.
+		var status string
+		if err := db.QueryRow(`SELECT status FROM issues WHERE id = ?`, cmd.IssueID).Scan(&status); err != nil {
+			return "", err
+		}
+		if status != "failed" && status != "blocked" {
+			return "", errIssueNotFailed
+		}
+		runs, err := agents.ListRunRecords(db, projectID, agents.RunFilter{IssueID: cmd.IssueID}, 1)
+		if err != nil {
+			return "", err
+		}
+		if len(runs) == 0 {
+			return "", errNoRunToRetry
+		}
+		if err := requeueIssue(cmd.IssueID, runs[0].AgentID, nil); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s queued the issue for %s again", actor, agentDisplayNames[runs[0].AgentID]), nil
+
+	case agentCommandRerun:
+		prompt := strings.TrimSpace(cmd.Prompt)
+		issueID, agentID := cmd.IssueID, cmd.AgentID
+		if cmd.RunID != "" {
+			run, err := agents.LoadRunRecord(db, cmd.RunID)
+			if err != nil {
+				return "", err
+			}
+			if run.ProjectID != projectID {
+				return "", agents.ErrRunRecordNotFound
+			}
+			if issueID == "" {
+				issueID = run.IssueID
+			}
+			if agentID == "" {
+				agentID = run.AgentID
+			}
+		}
+		if issueID == "" {
+			if agentID == "" {
+				return "", errRerunTarget
+			}
+			agents.RunAgent(db, hubPublisher(), projectID, agentID, prompt)
+			return fmt.Sprintf("%s asked %s to run again with an edited prompt", actor, agentDisplayNames[agentID]), nil
+		}
+		if err := requireProjectIssue(projectID, issueID); err != nil {
+			return "", err
+		}
+		if agentID == "" {
+			db.QueryRow(`SELECT COALESCE(assigned_agent_id, '') FROM issues WHERE id = ?`, issueID).Scan(&agentID)
+		}
+		if agentID == "" {
+			return "", errAgentRequired
+		}
+		if err := requeueIssue(issueID, agentID, &prompt); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s queued the issue for %s with an edited prompt", actor, agentDisplayNames[agentID]), nil
+	}
+	return "", fmt.Errorf("%w: %q", errUnknownAgentCommand, cmd.Command)
+}
+
+// requireProjectIssue checks that issueID names an issue in projectID.
+func requireProjectIssue(projectID, issueID string) error {
+	if issueID == "" {
+		return errIssueRequired
+	}
+	var owner string
+	err := db.QueryRow(`SELECT project_id FROM issues WHERE id = ?`, issueID).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != projectID) {
+		return errResourceNotFound
+	}
+	return err
+}
+
+// requeueIssue puts an issue that no agent is working on back in agentID's
+// queue with its retries reset. A non-nil prompt replaces the task prompt
+// the agent is given, for this and later runs.
+func requeueIssue(issueID, agentID string, prompt *string) error {
+	query := `UPDATE issues SET status = 'todo', attempts = 0, last_error = NULL, retry_at = NULL, assigned_agent_id = ?`
+	args := []interface{}{agentID}
+	if prompt != nil {
+		query += `, agent_prompt = ?`
+		args = append(args, *prompt)
+	}
+	res, err := db.Exec(query+` WHERE id = ? AND status != 'inProgress'`, append(args, issueID)...)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return errIssueRunning
+	}
+	if err := queueIssue(issueID, agentID); err != nil {
+		return err
+	}
+	broadcastIssueChange(issueID)
+	return nil
+}
+
+// setAgentQueuePaused pauses or resumes agentID's queue in projectID. A
+// paused queue keeps its issues but starts none of them; runs in flight
+// are not affected.
+func setAgentQueuePaused(projectID, agentID, userID string, paused bool) error {
+	if !paused {
+		_, err := db.Exec(`DELETE FROM agent_pauses WHERE project_id = ? AND agent_id = ?`, projectID, agentID)
+		return err
+	}
+	_, err := db.Exec(`
+		INSERT INTO agent_pauses (project_id, agent_id, paused_by, paused_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (project_id, agent_id) DO NOTHING
+	`, projectID, agentID, userID, time.Now())
+	return err
+}
+
+// broadcastAgentCommandResult publishes result with the project's agent
+// statuses as an agent.status event.
+func broadcastAgentCommandResult(projectID string, result agentCommandResult) {
+	if globalHub == nil {
+		return
+	}
+	stats, err := collectQueueStatsForProject(projectID)
+	if err != nil {
+		log.Printf("agent status: failed to collect stats for %s: %v", projectID, err)
+		stats = nil
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"type": "agent.status",
+		"payload": map[string]interface{}{
+			"projectId": projectID,
+			"statuses":  stats,
+			"command":   result,
+		},
+	})
+	if err != nil {
+		log.Printf("agent status: failed to marshal command result: %v", err)
+		return
+	}
+	if !globalHub.publishWithin(projectID, data, 500*time.Millisecond) {
+		log.Printf("agent status: dropping command result for project %s", projectID)
+	}
+}
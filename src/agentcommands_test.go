@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAgentCommandValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		cmd  agentCommand
+		want error
+	}{
+		{"unknown command", agentCommand{Command: "explode", AgentID: "qa_tester"}, errUnknownAgentCommand},
+		{"empty command", agentCommand{}, errUnknownAgentCommand},
+		{"unknown agent", agentCommand{Command: agentCommandPause, AgentID: "intern"}, errUnknownAgent},
+		{"cancel without a selector", agentCommand{Command: agentCommandCancel}, errNoRunSelected},
+		{"cancel a run", agentCommand{Command: agentCommandCancel, RunID: "r1"}, nil},
+		{"pause without an agent", agentCommand{Command: agentCommandPause}, errAgentRequired},
+		{"resume without an agent", agentCommand{Command: agentCommandResume}, errAgentRequired},
+		{"pause", agentCommand{Command: agentCommandPause, AgentID: "qa_tester"}, nil},
+		{"retry without an issue", agentCommand{Command: agentCommandRetry, AgentID: "qa_tester"}, errIssueRequired},
+		{"retry", agentCommand{Command: agentCommandRetry, IssueID: "i1"}, nil},
+		{"rerun without a prompt", agentCommand{Command: agentCommandRerun, IssueID: "i1", Prompt: "  "}, errPromptRequired},
+		{"rerun without a target", agentCommand{Command: agentCommandRerun, Prompt: "try again"}, errRerunTarget},
+		{"rerun a run", agentCommand{Command: agentCommandRerun, RunID: "r1", Prompt: "try again"}, nil},
+	}
+	for _, tc := range cases {
+		err := tc.cmd.validate()
+		if tc.want == nil && err != nil || tc.want != nil && !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
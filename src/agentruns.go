@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"replychat/src/agents"
+)
+
+const (
+	defaultAgentRunLimit = 50
+	maxAgentRunLimit     = 200
+)
+
+// agentRunsAPIHandler lists a project's most recent agent runs without their
+// raw output, plan and result. ?issue_id=, ?agent_id= and ?status= narrow the
+// list and ?limit= caps it.
+func agentRunsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	limit := defaultAgentRunLimit
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxAgentRunLimit)
+	}
+
+	filter := agents.RunFilter{
+		IssueID: strings.TrimSpace(query.Get("issue_id")),
+		AgentID: strings.TrimSpace(query.Get("agent_id")),
+		Status:  strings.TrimSpace(query.Get("status")),
+	}
+	records, err := agents.ListRunRecords(db, accessFromRequest(r).ProjectID, filter, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	runs := make([]agents.RunRecord, 0, len(records))
+	for _, record := range records {
+		runs = append(runs, record.ForList())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"runs": runs,
+	})
+}
+
+// agentRunAPIHandler serves /api/agent-runs/{id} with everything recorded
+// about the run.
+func agentRunAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/agent-runs/"), "/")
+
+	record, err := agents.LoadRunRecord(db, id)
+	switch {
+	case errors.Is(err, agents.ErrRunRecordNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"run": record,
+	})
+}
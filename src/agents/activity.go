@@ -0,0 +1,151 @@
+package agents
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"replychat/src/projectfs"
+)
+
+// Activity statuses.
+const (
+	ActivityOK     = "ok"
+	ActivityFailed = "failed"
+)
+
+// Activity is one entry of a project's activity log: workspace operations
+// such as pushes, with their outcome.
+type Activity struct {
+	ID        string                 `json:"id"`
+	ProjectID string                 `json:"projectId"`
+	Kind      string                 `json:"kind"`
+	ActorID   string                 `json:"actorId,omitempty"`
+	Summary   string                 `json:"summary"`
+	Status    string                 `json:"status"`
+	Error     string                 `json:"error,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	CreatedAt time.Time              `json:"createdAt"`
+}
+
+// RecordActivity stores a and publishes it as an activity.created event.
+func RecordActivity(db *sql.DB, publisher Publisher, a Activity) {
+	if db == nil || a.ProjectID == "" {
+		return
+	}
+	a.ID = uuid.New().String()
+	a.CreatedAt = time.Now()
+	if a.Status == "" {
+		a.Status = ActivityOK
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO activity (id, project_id, kind, actor_id, summary, status, error, details, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, a.ID, a.ProjectID, a.Kind, a.ActorID, a.Summary, a.Status, a.Error, marshalEnvelope(a.Details), a.CreatedAt)
+	if err != nil {
+		log.Printf("db: failed to record %s activity for project %s: %v", a.Kind, a.ProjectID, err)
+		return
+	}
+
+	p := newMessageProcessor(db, publisher)
+	p.publish(a.ProjectID, marshalEvent("activity.created", map[string]interface{}{"activity": a}))
+}
+
+// ListActivity returns up to limit of a project's most recent activities,
+// newest first.
+func ListActivity(db *sql.DB, projectID string, limit int) ([]Activity, error) {
+	rows, err := db.Query(`
+		SELECT id, project_id, kind, actor_id, summary, status, error, details, created_at
+		FROM activity
+		WHERE project_id = ?
+		ORDER BY created_at DESC
+		LIMIT ?
+	`, projectID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	activities := make([]Activity, 0)
+	for rows.Next() {
+		var (
+			a                        Activity
+			actorID, errText, detail sql.NullString
+		)
+		if err := rows.Scan(&a.ID, &a.ProjectID, &a.Kind, &actorID, &a.Summary, &a.Status, &errText, &detail, &a.CreatedAt); err != nil {
+			log.Printf("db: skipping activity: %v", err)
+			continue
+		}
+		a.ActorID, a.Error = actorID.String, errText.String
+		if detail.Valid && detail.String != "" {
+			if err := json.Unmarshal([]byte(detail.String), &a.Details); err != nil {
+				log.Printf("db: activity %s has invalid details: %v", a.ID, err)
+			}
+		}
+		activities = append(activities, a)
+	}
+	return activities, rows.Err()
+}
+
+// PushWorkspace pushes the branch checked out at workspacePath when the
+// project's push policy calls for it on trigger, and records the outcome in
+// the project's activity. It returns a nil result when the policy does not
+// push, or when there is no remote and the push was not requested by hand.
+func PushWorkspace(db *sql.DB, publisher Publisher, projectID, workspacePath, trigger, actorID string) (*projectfs.PushResult, error) {
+	settings, err := projectfs.LoadSettings(db, projectID)
+	if err != nil {
+		return nil, err
+	}
+	if trigger == projectfs.PushRequested && settings.PushPolicyOrDefault() == projectfs.PushNever {
+		return nil, projectfs.ErrPushDisabled
+	}
+	if !projectfs.IsRepository(workspacePath) {
+		return nil, nil
+	}
+	branch, err := projectfs.DefaultBranch(workspacePath)
+	if err != nil {
+		return nil, err
+	}
+	remoteBranch, ok := settings.PushTarget(trigger, branch)
+	if !ok {
+		return nil, nil
+	}
+
+	result, err := projectfs.PushWorkspace(workspacePath, remoteBranch)
+	if errors.Is(err, projectfs.ErrNoRemote) && trigger != projectfs.PushRequested {
+		return nil, nil
+	}
+	if result != nil {
+		result.Trigger = trigger
+	}
+
+	activity := Activity{
+		ProjectID: projectID,
+		Kind:      "push",
+		ActorID:   actorID,
+		Summary:   fmt.Sprintf("Pushed %s to origin/%s", branch, remoteBranch),
+		Details: map[string]interface{}{
+			"branch":       branch,
+			"remoteBranch": remoteBranch,
+			"trigger":      trigger,
+			"policy":       settings.PushPolicyOrDefault(),
+		},
+	}
+	if result != nil {
+		activity.Details["commitId"] = result.CommitID
+	}
+	if err != nil {
+		activity.Status = ActivityFailed
+		activity.Summary = fmt.Sprintf("Failed to push %s to origin/%s", branch, remoteBranch)
+		activity.Error = err.Error()
+		log.Printf("git: push of %s for project %s failed: %v", branch, projectID, err)
+	}
+	RecordActivity(db, publisher, activity)
+	return result, err
+}
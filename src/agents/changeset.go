@@ -0,0 +1,653 @@
+package agents
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"replychat/src/projectfs"
+
+	"github.com/google/uuid"
+)
+
+// Change set statuses, stored in artifacts.status.
+const (
+	ChangeSetPending           = "pending"
+	ChangeSetApproved          = "approved"
+	ChangeSetPartiallyApproved = "partially_approved"
+	ChangeSetRejected          = "rejected"
+	// changeSetApplying marks a set while its approval is being written so
+	// two reviewers cannot apply it twice.
+	changeSetApplying = "applying"
+)
+
+// changeSetType is the artifacts.type of a change set.
+const changeSetType = "change_set"
+
+var (
+	ErrChangeSetNotFound    = errors.New("change set not found")
+	ErrChangeSetReviewed    = errors.New("change set was already reviewed")
+	ErrUnknownChangeSetFile = errors.New("file is not part of the change set")
+	// ErrChangeSetConflict means every approved file changed in the
+	// workspace since the set was proposed; the set stays pending.
+	ErrChangeSetConflict = errors.New("every approved file changed since the change set was proposed")
+)
+
+// ChangedFile is one file in a change set. Content and Mode hold the
+// proposed file; BeforeHash identifies the workspace file the diff was taken
+// against so an approval can tell when it has changed since.
+type ChangedFile struct {
+	Path       string      `json:"path"`
+	Status     string      `json:"status"` // added, modified or deleted
+	Diff       string      `json:"diff,omitempty"`
+	Content    []byte      `json:"content,omitempty"`
+	Mode       fs.FileMode `json:"mode,omitempty"`
+	BeforeHash string      `json:"beforeHash,omitempty"`
+	// Decision is set on review: approved, rejected, or conflict when the
+	// workspace file changed before it could be written.
+	Decision string `json:"decision,omitempty"`
+}
+
+// ChangeSet is an agent's workspace change held for review. It is stored as
+// an artifacts row whose content is the JSON encoding of changeSetContent.
+type ChangeSet struct {
+	ID         string        `json:"id"`
+	ProjectID  string        `json:"projectId"`
+	IssueID    string        `json:"issueId,omitempty"`
+	AgentID    string        `json:"agentId"`
+	AgentName  string        `json:"agentName,omitempty"`
+	MessageID  string        `json:"messageId,omitempty"`
+	Title      string        `json:"title"`
+	Summary    string        `json:"summary"`
+	Notes      []string      `json:"notes,omitempty"`
+	Files      []ChangedFile `json:"files"`
+	Status     string        `json:"status"`
+	ApprovedBy string        `json:"approvedBy,omitempty"`
+	ApprovedAt *time.Time    `json:"approvedAt,omitempty"`
+	RejectedBy string        `json:"rejectedBy,omitempty"`
+	RejectedAt *time.Time    `json:"rejectedAt,omitempty"`
+	CreatedAt  time.Time     `json:"createdAt"`
+}
+
+type changeSetContent struct {
+	Summary string        `json:"summary"`
+	Notes   []string      `json:"notes,omitempty"`
+	Files   []ChangedFile `json:"files"`
+}
+
+// ForClient returns a copy without file contents, and without diffs unless
+// withDiffs is set.
+func (cs ChangeSet) ForClient(withDiffs bool) ChangeSet {
+	files := make([]ChangedFile, len(cs.Files))
+	for i, f := range cs.Files {
+		f.Content = nil
+		f.BeforeHash = ""
+		if !withDiffs {
+			f.Diff = ""
+		}
+		files[i] = f
+	}
+	cs.Files = files
+	cs.AgentName = agentDisplayNames[cs.AgentID]
+	return cs
+}
+
+// fileState identifies a file's content and permission bits.
+type fileState struct {
+	hash string
+	mode fs.FileMode
+}
+
+func statFile(path string) (fileState, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fileState{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return fileState{}, fmt.Errorf("%s is not a regular file", path)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fileState{}, err
+	}
+	sum := sha256.Sum256(content)
+	return fileState{hash: hex.EncodeToString(sum[:]), mode: info.Mode().Perm()}, nil
+}
+
+func copyFile(src, dst string) (fileState, error) {
+	state, err := statFile(src)
+	if err != nil {
+		return state, err
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return state, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return state, err
+	}
+	if err := os.WriteFile(dst, content, state.mode); err != nil {
+		return state, err
+	}
+	return state, os.Chmod(dst, state.mode)
+}
+
+// changeStage is a scratch copy of a workspace. In review mode plans and
+// tool calls are applied to it, and the difference from the workspace
+// becomes a change set.
+type changeStage struct {
+	root          string
+	Path          string
+	workspacePath string
+	before        map[string]fileState
+}
+
+func newChangeStage(workspacePath string) (*changeStage, error) {
+	files, err := projectfs.ListFiles(workspacePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list workspace: %w", err)
+	}
+	root, err := os.MkdirTemp("", "changeset-")
+	if err != nil {
+		return nil, err
+	}
+	// Keep the workspace's directory name so normalizePlanPath still strips
+	// host paths that end in it.
+	stage := &changeStage{
+		root:          root,
+		Path:          filepath.Join(root, filepath.Base(filepath.Clean(workspacePath))),
+		workspacePath: workspacePath,
+		before:        make(map[string]fileState, len(files)),
+	}
+	if err := os.MkdirAll(stage.Path, 0o755); err != nil {
+		stage.Close()
+		return nil, err
+	}
+	for _, rel := range files {
+		native := filepath.FromSlash(rel)
+		state, err := copyFile(filepath.Join(workspacePath, native), filepath.Join(stage.Path, native))
+		if err != nil {
+			stage.Close()
+			return nil, fmt.Errorf("failed to stage %s: %w", rel, err)
+		}
+		stage.before[rel] = state
+	}
+	return stage, nil
+}
+
+// Close removes the staged copy.
+func (s *changeStage) Close() {
+	if s != nil && s.root != "" {
+		os.RemoveAll(s.root)
+	}
+}
+
+// changes compares the staged copy with the workspace as it was staged and
+// returns every file that differs, with a diff for each.
+func (s *changeStage) changes() ([]ChangedFile, error) {
+	after, err := projectfs.ListFiles(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list staged changes: %w", err)
+	}
+	paths := make(map[string]bool, len(after)+len(s.before))
+	for rel := range s.before {
+		paths[rel] = true
+	}
+	staged := make(map[string]bool, len(after))
+	for _, rel := range after {
+		staged[rel] = true
+		paths[rel] = true
+	}
+
+	diffRoot := filepath.Join(s.root, "diff")
+	for _, side := range []string{"a", "b"} {
+		if err := os.MkdirAll(filepath.Join(diffRoot, side), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	var files []ChangedFile
+	for rel := range paths {
+		native := filepath.FromSlash(rel)
+		old, existed := s.before[rel]
+		var current fileState
+		if staged[rel] {
+			if current, err = statFile(filepath.Join(s.Path, native)); err != nil {
+				return nil, err
+			}
+			if existed && current == old {
+				continue
+			}
+		}
+
+		file := ChangedFile{Path: rel, BeforeHash: old.hash}
+		switch {
+		case !existed:
+			file.Status = "added"
+		case !staged[rel]:
+			file.Status = "deleted"
+		default:
+			file.Status = "modified"
+		}
+		if staged[rel] {
+			if file.Content, err = os.ReadFile(filepath.Join(s.Path, native)); err != nil {
+				return nil, err
+			}
+			file.Mode = current.mode
+			if _, err := copyFile(filepath.Join(s.Path, native), filepath.Join(diffRoot, "b", native)); err != nil {
+				return nil, err
+			}
+		}
+		if existed {
+			if _, err := copyFile(filepath.Join(s.workspacePath, native), filepath.Join(diffRoot, "a", native)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	if len(files) > 0 {
+		out, err := projectfs.DiffTrees(diffRoot, "a", "b")
+		if err != nil {
+			log.Printf("git: failed to diff staged changes: %v", err)
+		}
+		diffs := splitTreeDiff(out)
+		for i := range files {
+			files[i].Diff = diffs[files[i].Path]
+		}
+	}
+	return files, nil
+}
+
+// splitTreeDiff splits DiffTrees output into one diff per file.
+func splitTreeDiff(out string) map[string]string {
+	diffs := map[string]string{}
+	var path string
+	var section strings.Builder
+	flush := func() {
+		if path != "" {
+			diffs[path] = section.String()
+		}
+		section.Reset()
+	}
+	for _, line := range strings.SplitAfter(out, "\n") {
+		if header, ok := strings.CutPrefix(line, "diff --git "); ok {
+			flush()
+			// The header is "a/<path> b/<path>", or b/ twice for a new file.
+			header = strings.TrimSuffix(header, "\n")
+			path = ""
+			if len(header) > 4 {
+				path = header[2 : (len(header)-1)/2]
+			}
+		}
+		section.WriteString(line)
+	}
+	flush()
+	return diffs
+}
+
+// stagedSummary rewords an applyResult summary for changes held for review.
+// The web client parses this form like "updated workspace (...)".
+func stagedSummary(summary string) string {
+	return strings.Replace(summary, " updated workspace (", " proposed changes for review (", 1)
+}
+
+// proposeChangeSet stores the staged changes as a pending change set and
+// announces it. It returns nil when nothing changed, along with a note for
+// the agent's message.
+func (p *MessageProcessor) proposeChangeSet(stage *changeStage, projectID, agentType, issueID, messageID, title, summary string, notes []string) (*ChangeSet, string) {
+	files, err := stage.changes()
+	if err != nil {
+		log.Printf("agent: failed to collect staged changes for project %s: %v", projectID, err)
+		return nil, fmt.Sprintf("Could not prepare changes for review: %v", err)
+	}
+	if len(files) == 0 {
+		return nil, ""
+	}
+
+	cs := &ChangeSet{
+		ID:        uuid.New().String(),
+		ProjectID: projectID,
+		IssueID:   issueID,
+		AgentID:   agentType,
+		MessageID: messageID,
+		Title:     title,
+		Summary:   summary,
+		Notes:     notes,
+		Files:     files,
+		Status:    ChangeSetPending,
+		CreatedAt: time.Now(),
+	}
+	content, err := json.Marshal(changeSetContent{Summary: summary, Notes: notes, Files: files})
+	if err != nil {
+		return nil, fmt.Sprintf("Could not prepare changes for review: %v", err)
+	}
+	_, err = p.db.Exec(`
+		INSERT INTO artifacts (id, project_id, issue_id, type, title, content, version, created_by, status, message_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, 1, ?, ?, ?, ?)
+	`, cs.ID, projectID, issueID, changeSetType, title, string(content), agentType, cs.Status, messageID, cs.CreatedAt)
+	if err != nil {
+		log.Printf("db: failed to save change set for project %s: %v", projectID, err)
+		return nil, fmt.Sprintf("Could not save changes for review: %v", err)
+	}
+
+	p.publish(projectID, marshalEvent("changeset.created", map[string]interface{}{
+		"changeSet": cs.ForClient(false),
+	}))
+	return cs, fmt.Sprintf("%d file(s) are waiting for review; nothing was written to the workspace", len(files))
+}
+
+const changeSetColumns = `id, project_id, issue_id, title, content, created_by, status, message_id,
+	approved_by, approved_at, rejected_by, rejected_at, created_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanChangeSet(row rowScanner) (*ChangeSet, error) {
+	var (
+		cs                                                    ChangeSet
+		projectID, issueID, messageID, approvedBy, rejectedBy sql.NullString
+		approvedAt, rejectedAt                                sql.NullTime
+		content                                               string
+	)
+	if err := row.Scan(&cs.ID, &projectID, &issueID, &cs.Title, &content, &cs.AgentID, &cs.Status, &messageID,
+		&approvedBy, &approvedAt, &rejectedBy, &rejectedAt, &cs.CreatedAt); err != nil {
+		return nil, err
+	}
+	cs.ProjectID, cs.IssueID, cs.MessageID = projectID.String, issueID.String, messageID.String
+	cs.ApprovedBy, cs.RejectedBy = approvedBy.String, rejectedBy.String
+	if approvedAt.Valid {
+		cs.ApprovedAt = &approvedAt.Time
+	}
+	if rejectedAt.Valid {
+		cs.RejectedAt = &rejectedAt.Time
+	}
+
+	var body changeSetContent
+	if err := json.Unmarshal([]byte(content), &body); err != nil {
+		return nil, fmt.Errorf("invalid change set %s: %w", cs.ID, err)
+	}
+	cs.Summary, cs.Notes, cs.Files = body.Summary, body.Notes, body.Files
+	return &cs, nil
+}
+
+// LoadChangeSet returns the change set with id.
+func LoadChangeSet(db *sql.DB, id string) (*ChangeSet, error) {
+	row := db.QueryRow(`SELECT `+changeSetColumns+` FROM artifacts WHERE id = ? AND type = ?`, id, changeSetType)
+	cs, err := scanChangeSet(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrChangeSetNotFound
+	}
+	return cs, err
+}
+
+// ListChangeSets returns a project's change sets, newest first, optionally
+// filtered by status.
+func ListChangeSets(db *sql.DB, projectID, status string) ([]ChangeSet, error) {
+	query := `SELECT ` + changeSetColumns + ` FROM artifacts WHERE project_id = ? AND type = ?`
+	args := []interface{}{projectID, changeSetType}
+	if status != "" {
+		query += ` AND status = ?`
+		args = append(args, status)
+	}
+	rows, err := db.Query(query+` ORDER BY created_at DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sets := make([]ChangeSet, 0)
+	for rows.Next() {
+		cs, err := scanChangeSet(rows)
+		if err != nil {
+			log.Printf("db: skipping change set: %v", err)
+			continue
+		}
+		sets = append(sets, *cs)
+	}
+	return sets, rows.Err()
+}
+
+// ApplyChangeSet approves the files in paths, or every file when paths is
+// nil, and rejects the rest. Approved files are written to the workspace and
+// committed; a file that changed since the set was proposed is left alone and
+// marked as a conflict. Approving no files rejects the set.
+func ApplyChangeSet(db *sql.DB, publisher Publisher, id, userID string, paths []string) (*ChangeSet, error) {
+	cs, err := LoadChangeSet(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if cs.Status != ChangeSetPending {
+		return nil, ErrChangeSetReviewed
+	}
+
+	selected := map[string]bool{}
+	known := map[string]bool{}
+	for _, f := range cs.Files {
+		known[f.Path] = true
+		if paths == nil {
+			selected[f.Path] = true
+		}
+	}
+	for _, path := range paths {
+		if !known[path] {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownChangeSetFile, path)
+		}
+		selected[path] = true
+	}
+	if len(selected) == 0 {
+		return RejectChangeSet(db, publisher, id, userID)
+	}
+
+	if claimed, err := claimChangeSet(db, id, changeSetApplying); err != nil || !claimed {
+		return nil, claimError(err)
+	}
+
+	p := newMessageProcessor(db, publisher)
+	workspacePath, err := p.issueWorkspace(cs.ProjectID, cs.IssueID)
+	if err != nil {
+		db.Exec(`UPDATE artifacts SET status = ? WHERE id = ?`, ChangeSetPending, id)
+		return nil, fmt.Errorf("workspace unavailable: %w", err)
+	}
+
+	var notes []string
+	written := 0
+	for i := range cs.Files {
+		f := &cs.Files[i]
+		if !selected[f.Path] {
+			f.Decision = "rejected"
+			continue
+		}
+		reason, err := writeChangedFile(workspacePath, *f)
+		if err != nil {
+			reason = err.Error()
+		}
+		if reason != "" {
+			f.Decision = "conflict"
+			notes = append(notes, fmt.Sprintf("Did not write %s: %s", f.Path, reason))
+			continue
+		}
+		f.Decision = "approved"
+		written++
+	}
+	if written == 0 {
+		db.Exec(`UPDATE artifacts SET status = ? WHERE id = ?`, ChangeSetPending, id)
+		return nil, fmt.Errorf("%w: %s", ErrChangeSetConflict, strings.Join(notes, "; "))
+	}
+
+	cs.Status = ChangeSetApproved
+	if len(selected) < len(cs.Files) {
+		cs.Status = ChangeSetPartiallyApproved
+	}
+	now := time.Now()
+	cs.ApprovedBy, cs.ApprovedAt = userID, &now
+
+	gitResult, commitNotes := p.commitWorkspace(cs.ProjectID, userID, workspacePath, cs.Title)
+	notes = append(notes, commitNotes...)
+
+	if err := saveChangeSetReview(db, cs, `approved_by = ?, approved_at = ?`, userID, now); err != nil {
+		// The files are written; at least leave the set out of applying.
+		db.Exec(`UPDATE artifacts SET status = ? WHERE id = ? AND status = ?`, cs.Status, id, changeSetApplying)
+		return nil, err
+	}
+
+	content := fmt.Sprintf("Applied %d of %d file(s) from %s's change set after review.", written, len(cs.Files), agentName(cs.AgentID))
+	p.announceReview(cs, content, notes, workspacePath, gitResult)
+	if cs.IssueID != "" {
+		// The issue waited in review for this approval.
+		if err := p.completeIssue(cs.ProjectID, cs.IssueID, "review", workspacePath, userID); err != nil {
+			log.Printf("changeset: failed to complete issue %s: %v", cs.IssueID, err)
+		}
+	}
+	return cs, nil
+}
+
+// RejectChangeSet discards a pending change set without touching the
+// workspace. Its issue, which waited in review for the set, goes back to To
+// Do in the same transaction, with the rejection as its last error. It is
+// not queued again; someone has to decide what the agent should do next.
+func RejectChangeSet(db *sql.DB, publisher Publisher, id, userID string) (*ChangeSet, error) {
+	cs, err := LoadChangeSet(db, id)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if claimed, err := claimChangeSet(tx, id, ChangeSetRejected); err != nil || !claimed {
+		return nil, claimError(err)
+	}
+	for i := range cs.Files {
+		cs.Files[i].Decision = "rejected"
+	}
+	now := time.Now()
+	cs.Status, cs.RejectedBy, cs.RejectedAt = ChangeSetRejected, userID, &now
+	if err := saveChangeSetReview(tx, cs, `rejected_by = ?, rejected_at = ?`, userID, now); err != nil {
+		return nil, err
+	}
+	var issueMoved sql.Result
+	if cs.IssueID != "" {
+		issueMoved, err = tx.Exec(`
+			UPDATE issues
+			SET status = 'todo', last_error = ?, queued_agent_id = NULL, retry_at = NULL
+			WHERE id = ? AND status = 'review'
+		`, "the change set was rejected", cs.IssueID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to move issue back to todo: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	p := newMessageProcessor(db, publisher)
+	content := fmt.Sprintf("%s's change set was rejected; nothing was written.", agentName(cs.AgentID))
+	p.announceReview(cs, content, nil, "", nil)
+	if issueMoved != nil {
+		if err := p.publishIssueIfChanged(issueMoved, cs.IssueID); err != nil {
+			log.Printf("changeset: failed to publish issue %s: %v", cs.IssueID, err)
+		}
+	}
+	return cs, nil
+}
+
+// execer is the part of *sql.DB and *sql.Tx the review updates need.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// claimChangeSet moves a pending set to status, reporting false when another
+// review got there first.
+func claimChangeSet(db execer, id, status string) (bool, error) {
+	res, err := db.Exec(`UPDATE artifacts SET status = ? WHERE id = ? AND status = ?`, status, id, ChangeSetPending)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func claimError(err error) error {
+	if err != nil {
+		return err
+	}
+	return ErrChangeSetReviewed
+}
+
+func saveChangeSetReview(db execer, cs *ChangeSet, reviewColumns string, userID string, at time.Time) error {
+	content, err := json.Marshal(changeSetContent{Summary: cs.Summary, Notes: cs.Notes, Files: cs.Files})
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE artifacts SET status = ?, content = ?, `+reviewColumns+` WHERE id = ?`,
+		cs.Status, string(content), userID, at, cs.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record review: %w", err)
+	}
+	return nil
+}
+
+// announceReview publishes the reviewed set and posts the outcome to chat.
+func (p *MessageProcessor) announceReview(cs *ChangeSet, content string, notes []string, workspacePath string, gitResult *projectfs.CommitResult) {
+	view := cs.ForClient(false)
+	p.publish(cs.ProjectID, marshalEvent("changeset.updated", map[string]interface{}{
+		"changeSet": view,
+	}))
+	p.saveAgentMessage(uuid.New().String(), "message.received", cs.ProjectID, cs.AgentID, content, "chat", notes, workspacePath, nil, gitResult, map[string]interface{}{
+		"changeSet": view,
+	})
+}
+
+// writeChangedFile writes or deletes one approved file. A non-empty reason
+// means the file was left alone because it changed after the set was
+// proposed.
+func writeChangedFile(workspacePath string, f ChangedFile) (string, error) {
+	_, absPath, err := resolvePlanPath(workspacePath, f.Path)
+	if err != nil {
+		return "", err
+	}
+	current, err := statFile(absPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	if current.hash != f.BeforeHash {
+		return "file changed since the change set was proposed", nil
+	}
+
+	if f.Status == "deleted" {
+		return "", os.Remove(absPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(absPath), 0o755); err != nil {
+		return "", err
+	}
+	mode := f.Mode
+	if mode == 0 {
+		mode = 0o644
+	}
+	if err := os.WriteFile(absPath, f.Content, mode); err != nil {
+		return "", err
+	}
+	return "", os.Chmod(absPath, mode)
+}
+
+func agentName(agentType string) string {
+	if name := agentDisplayNames[agentType]; name != "" {
+		return name
+	}
+	return agentType
+}
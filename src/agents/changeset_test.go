@@ -0,0 +1,158 @@
+package agents
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChangeStageCollectsChangesWithoutTouchingWorkspace(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir := t.TempDir()
+	for rel, content := range map[string]string{"main.go": "package main\n", "old.txt": "bye\n", "same.txt": "same\n"} {
+		if err := os.WriteFile(filepath.Join(dir, rel), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stage, err := newChangeStage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stage.Close()
+
+	p := newMessageProcessor(nil, nil)
+	if _, err := p.applyActionPlan(stage.Path, "backend_architect", AgentActionPlan{
+		Files:     []GeneratedFile{{Path: "docs/new.md", Content: "# New\n"}},
+		Mutations: []FileMutation{{Path: "main.go", Find: "package main", Replace: "package app"}},
+		Deletes:   []string{"old.txt"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := os.ReadFile(filepath.Join(dir, "main.go")); string(content) != "package main\n" {
+		t.Fatalf("workspace was modified: %q", content)
+	}
+
+	files, err := stage.changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]ChangedFile{}
+	for _, f := range files {
+		got[f.Path] = f
+	}
+	if len(files) != 3 || got["docs/new.md"].Status != "added" || got["main.go"].Status != "modified" || got["old.txt"].Status != "deleted" {
+		t.Fatalf("unexpected changes %+v", files)
+	}
+	if diff := got["main.go"].Diff; !strings.Contains(diff, "--- a/main.go") || !strings.Contains(diff, "-package main\n+package app") {
+		t.Fatalf("main.go diff %q", diff)
+	}
+	if diff := got["docs/new.md"].Diff; !strings.Contains(diff, "+++ b/docs/new.md") {
+		t.Fatalf("new file diff %q", diff)
+	}
+	if got["old.txt"].Content != nil || string(got["main.go"].Content) != "package app\n" {
+		t.Fatalf("unexpected contents %+v", files)
+	}
+}
+
+func TestWriteChangedFileRefusesStaleFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.js")
+	if err := os.WriteFile(path, []byte("v1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := statFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change := ChangedFile{Path: "app.js", Status: "modified", Content: []byte("v2\n"), Mode: 0o644, BeforeHash: before.hash}
+
+	if err := os.WriteFile(path, []byte("edited by someone else\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if reason, err := writeChangedFile(dir, change); err != nil || reason == "" {
+		t.Fatalf("expected a conflict, got reason=%q err=%v", reason, err)
+	}
+
+	if err := os.WriteFile(path, []byte("v1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if reason, err := writeChangedFile(dir, change); err != nil || reason != "" {
+		t.Fatalf("expected the write to apply, got reason=%q err=%v", reason, err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "v2\n" {
+		t.Fatalf("content %q", content)
+	}
+
+	added := ChangedFile{Path: "app.js", Status: "added", Content: []byte("x\n")}
+	if reason, _ := writeChangedFile(dir, added); reason == "" {
+		t.Fatal("an added file must not overwrite one created since")
+	}
+}
+
+func TestSplitTreeDiff(t *testing.T) {
+	out := "diff --git a/my file.txt b/my file.txt\nindex 1..2 100644\n--- a/my file.txt\n+++ b/my file.txt\n@@ -1 +1 @@\n-a\n+b\n" +
+		"diff --git b/new.txt b/new.txt\nnew file mode 100644\n--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1 @@\n+x\n"
+	diffs := splitTreeDiff(out)
+	if len(diffs) != 2 || !strings.HasSuffix(diffs["my file.txt"], "+b\n") || !strings.HasPrefix(diffs["new.txt"], "diff --git b/new.txt") {
+		t.Fatalf("unexpected split %#v", diffs)
+	}
+}
+
+func TestRejectChangeSetMovesIssueBackToTodo(t *testing.T) {
+	db := newTestIssueDB(t)
+	if _, err := db.Exec(`
+		CREATE TABLE artifacts (
+			id TEXT PRIMARY KEY,
+			project_id TEXT,
+			issue_id TEXT,
+			type TEXT NOT NULL,
+			title TEXT NOT NULL,
+			content TEXT NOT NULL,
+			created_by TEXT NOT NULL,
+			status TEXT,
+			message_id TEXT,
+			approved_by TEXT,
+			approved_at TIMESTAMP,
+			rejected_by TEXT,
+			rejected_at TIMESTAMP,
+			created_at TIMESTAMP NOT NULL
+		)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO issues (id, status, assigned_agent_id) VALUES ('i1', 'review', 'backend_architect')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO artifacts (id, project_id, issue_id, type, title, content, created_by, status, created_at)
+		VALUES ('cs1', 'p1', 'i1', ?, 'Change port', ?, 'backend_architect', ?, ?)
+	`, changeSetType, `{"summary":"","files":[{"path":"main.go","status":"modified"}]}`, ChangeSetPending, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := RejectChangeSet(db, nil, "cs1", "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.Status != ChangeSetRejected || cs.Files[0].Decision != "rejected" {
+		t.Fatalf("unexpected change set %+v", cs)
+	}
+	if got := loadTestIssue(t, db, "i1"); got != (testIssue{Status: "todo"}) {
+		t.Fatalf("issue = %+v, want todo and not queued", got)
+	}
+	var lastError string
+	if err := db.QueryRow(`SELECT last_error FROM issues WHERE id = 'i1'`).Scan(&lastError); err != nil || !strings.Contains(lastError, "rejected") {
+		t.Fatalf("last error %q (%v) should mention the rejection", lastError, err)
+	}
+	if _, err := RejectChangeSet(db, nil, "cs1", "u1"); !errors.Is(err, ErrChangeSetReviewed) {
+		t.Fatalf("second rejection: %v, want %v", err, ErrChangeSetReviewed)
+	}
+}
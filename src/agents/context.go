@@ -0,0 +1,320 @@
+package agents
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"replychat/src/llm"
+)
+
+// Context assembly gives an agent the recent thread, open issues and resolved
+// dialog answers for its project, trimmed to fit a token budget so every
+// provider receives the same picture.
+const (
+	defaultContextTokens   = 3000
+	defaultContextMessages = 40
+	// maxTurnTokens caps a single history entry so one long paste cannot
+	// crowd out the rest of the thread.
+	maxTurnTokens = 500
+	// summaryLineRunes bounds each line of the older-turns summary.
+	summaryLineRunes = 100
+	maxContextIssues = 15
+	maxContextAnswer = 10
+)
+
+// contextTurn is one message from the project thread.
+type contextTurn struct {
+	Role    llm.Role
+	Speaker string
+	Content string
+}
+
+// contextBudget returns the token budget from AGENT_CONTEXT_TOKENS.
+func contextBudget() int {
+	return contextSetting("AGENT_CONTEXT_TOKENS", defaultContextTokens)
+}
+
+func contextSetting(key string, def int) int {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return def
+	}
+	parsed, err := strconv.Atoi(val)
+	if err != nil || parsed < 0 {
+		log.Printf("agent: invalid %s=%q, using %d", key, val, def)
+		return def
+	}
+	return parsed
+}
+
+// estimateTokens approximates token count at four characters per token, which
+// is close enough for budgeting across providers.
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// truncateTokens shortens text to roughly limit tokens, marking the cut.
+func truncateTokens(text string, limit int) string {
+	if estimateTokens(text) <= limit {
+		return text
+	}
+	runes := []rune(text)
+	keep := limit * 4
+	if keep > len(runes) {
+		keep = len(runes)
+	}
+	return strings.TrimSpace(string(runes[:keep])) + " …[truncated]"
+}
+
+// assembleContext returns the messages to place between the system prompt
+// and the triggering message for agentType in projectID.
+func (p *MessageProcessor) assembleContext(projectID, agentType, originalMessage string) []llm.Message {
+	budget := contextBudget()
+	if p.db == nil || budget == 0 {
+		return nil
+	}
+
+	var out []llm.Message
+
+	// Project state gets at most a third of the budget; the thread gets the
+	// rest, plus whatever project state left unused.
+	projectNotes := p.projectContext(projectID, budget/3)
+	if projectNotes != "" {
+		out = append(out, llm.Message{Role: llm.RoleSystem, Content: projectNotes})
+		budget -= estimateTokens(projectNotes)
+	}
+
+	turns, err := p.recentTurns(projectID, agentType, originalMessage, contextSetting("AGENT_CONTEXT_MESSAGES", defaultContextMessages))
+	if err != nil {
+		log.Printf("agent: failed to load history for project %s: %v", projectID, err)
+		return out
+	}
+	history, summary := fitHistory(turns, budget)
+	if summary != "" {
+		out = append(out, llm.Message{Role: llm.RoleSystem, Content: summary})
+	}
+	return append(out, history...)
+}
+
+// recentTurns loads up to limit messages, newest first, leaving out the
+// message that triggered this run and failed-run notices.
+func (p *MessageProcessor) recentTurns(projectID, agentType, originalMessage string, limit int) ([]contextTurn, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	rows, err := p.db.Query(`
+		SELECT m.sender_id, m.sender_type, m.content, m.message_type, COALESCE(u.name, '')
+		FROM messages m
+		LEFT JOIN users u ON m.sender_type = 'user' AND u.id = m.sender_id
+		WHERE m.project_id = ?
+		ORDER BY m.timestamp DESC
+		LIMIT ?
+	`, projectID, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trigger := strings.TrimSpace(originalMessage)
+	skippedTrigger := false
+	var turns []contextTurn
+	for rows.Next() {
+		var senderID, senderType, content, messageType, userName string
+		if err := rows.Scan(&senderID, &senderType, &content, &messageType, &userName); err != nil {
+			return nil, err
+		}
+		content = strings.TrimSpace(content)
+		if !skippedTrigger && senderType == "user" && content == trigger {
+			skippedTrigger = true
+			continue
+		}
+		if content == "" || messageType == "error" {
+			continue
+		}
+		turns = append(turns, newContextTurn(agentType, senderID, senderType, userName, content))
+	}
+	if len(turns) > limit {
+		turns = turns[:limit]
+	}
+	return turns, rows.Err()
+}
+
+func newContextTurn(agentType, senderID, senderType, userName, content string) contextTurn {
+	switch {
+	case senderType == "agent" && senderID == agentType:
+		return contextTurn{Role: llm.RoleAssistant, Speaker: "You", Content: content}
+	case senderType == "agent":
+		name := agentDisplayNames[senderID]
+		if name == "" {
+			name = "Agent"
+		}
+		return contextTurn{Role: llm.RoleUser, Speaker: name, Content: content}
+	case senderType == "user":
+		if userName == "" {
+			userName = "User"
+		}
+		return contextTurn{Role: llm.RoleUser, Speaker: userName, Content: content}
+	default:
+		return contextTurn{Role: llm.RoleUser, Speaker: "System", Content: content}
+	}
+}
+
+// fitHistory keeps as many of the newest turns (given newest first) as fit in
+// budget tokens and returns them oldest first. Turns that do not fit are
+// condensed into a one-line-per-turn summary while space remains; anything
+// beyond that is only counted.
+func fitHistory(turns []contextTurn, budget int) ([]llm.Message, string) {
+	if budget <= 0 || len(turns) == 0 {
+		return nil, ""
+	}
+
+	// Leave room for the summary of older turns.
+	fullBudget := budget * 3 / 4
+	var kept []llm.Message
+	used := 0
+	i := 0
+	for ; i < len(turns); i++ {
+		content := formatTurn(turns[i], truncateTokens(turns[i].Content, maxTurnTokens))
+		cost := estimateTokens(content)
+		if used+cost > fullBudget {
+			break
+		}
+		used += cost
+		kept = append(kept, llm.Message{Role: turns[i].Role, Content: content})
+	}
+
+	// Reverse into chronological order.
+	for l, r := 0, len(kept)-1; l < r; l, r = l+1, r-1 {
+		kept[l], kept[r] = kept[r], kept[l]
+	}
+
+	older := turns[i:]
+	if len(older) == 0 {
+		return kept, ""
+	}
+
+	const header = "Earlier conversation (condensed, newest first):"
+	// Reserve room for the header and the omitted-count line.
+	remaining := budget - used - estimateTokens(header) - estimateTokens(fmt.Sprintf("\n- …%d older message(s) omitted", len(older)))
+	var lines []string
+	j := 0
+	for ; j < len(older); j++ {
+		line := "- " + formatTurn(older[j], firstLine(older[j].Content, summaryLineRunes))
+		cost := estimateTokens("\n" + line)
+		if cost > remaining {
+			break
+		}
+		remaining -= cost
+		lines = append(lines, line)
+	}
+	if omitted := len(older) - j; omitted > 0 {
+		lines = append(lines, fmt.Sprintf("- …%d older message(s) omitted", omitted))
+	}
+	return kept, header + "\n" + strings.Join(lines, "\n")
+}
+
+func formatTurn(turn contextTurn, content string) string {
+	if turn.Role == llm.RoleAssistant {
+		return content
+	}
+	return turn.Speaker + ": " + content
+}
+
+// firstLine returns the first non-empty line of text, cut to limit runes.
+func firstLine(text string, limit int) string {
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			text = line
+			break
+		}
+	}
+	runes := []rune(text)
+	if len(runes) > limit {
+		return string(runes[:limit]) + "…"
+	}
+	return text
+}
+
+// projectContext summarizes open issues and resolved dialog answers within
+// budget tokens.
+func (p *MessageProcessor) projectContext(projectID string, budget int) string {
+	if budget <= 0 {
+		return ""
+	}
+
+	var sections []string
+	if issues, err := p.openIssueLines(projectID); err != nil {
+		log.Printf("agent: failed to load issues for context in project %s: %v", projectID, err)
+	} else if len(issues) > 0 {
+		sections = append(sections, "Open issues:\n"+strings.Join(issues, "\n"))
+	}
+	if answers, err := p.dialogAnswerLines(projectID); err != nil {
+		log.Printf("agent: failed to load dialogs for context in project %s: %v", projectID, err)
+	} else if len(answers) > 0 {
+		sections = append(sections, "Decisions the team already made:\n"+strings.Join(answers, "\n"))
+	}
+	if len(sections) == 0 {
+		return ""
+	}
+	return truncateTokens("Project context:\n\n"+strings.Join(sections, "\n\n"), budget)
+}
+
+func (p *MessageProcessor) openIssueLines(projectID string) ([]string, error) {
+	rows, err := p.db.Query(`
+		SELECT title, status, priority, COALESCE(assigned_agent_id, queued_agent_id, '')
+		FROM issues
+		WHERE project_id = ? AND status != 'done'
+		ORDER BY created_at DESC
+		LIMIT ?
+	`, projectID, maxContextIssues)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var title, status, priority, agentID string
+		if err := rows.Scan(&title, &status, &priority, &agentID); err != nil {
+			return nil, err
+		}
+		line := fmt.Sprintf("- [%s, %s] %s", status, priority, firstLine(title, summaryLineRunes))
+		if name := agentDisplayNames[agentID]; name != "" {
+			line += " (" + name + ")"
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+func (p *MessageProcessor) dialogAnswerLines(projectID string) ([]string, error) {
+	rows, err := p.db.Query(`
+		SELECT COALESCE(title, ''), COALESCE(message, ''), COALESCE(selected_option, '')
+		FROM dialogs
+		WHERE project_id = ? AND status = 'resolved'
+		ORDER BY responded_at DESC
+		LIMIT ?
+	`, projectID, maxContextAnswer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var title, message, selected string
+		if err := rows.Scan(&title, &message, &selected); err != nil {
+			return nil, err
+		}
+		question := firstLine(title, summaryLineRunes)
+		if question == "" {
+			question = firstLine(message, summaryLineRunes)
+		}
+		lines = append(lines, fmt.Sprintf("- %s → %s", question, selected))
+	}
+	return lines, rows.Err()
+}
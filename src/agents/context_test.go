@@ -0,0 +1,66 @@
+package agents
+
+import (
+	"strings"
+	"testing"
+
+	"replychat/src/llm"
+)
+
+func TestFitHistoryKeepsNewestTurnsInOrder(t *testing.T) {
+	turns := []contextTurn{
+		{Role: llm.RoleUser, Speaker: "Ada", Content: "third"},
+		{Role: llm.RoleAssistant, Speaker: "You", Content: "second"},
+		{Role: llm.RoleUser, Speaker: "Ada", Content: "first"},
+	}
+	history, summary := fitHistory(turns, 1000)
+	if summary != "" {
+		t.Fatalf("unexpected summary %q", summary)
+	}
+	if len(history) != 3 {
+		t.Fatalf("expected 3 turns, got %d", len(history))
+	}
+	if history[0].Content != "Ada: first" || history[1].Content != "second" || history[1].Role != llm.RoleAssistant {
+		t.Fatalf("unexpected history %+v", history)
+	}
+}
+
+func TestFitHistorySummarizesOlderTurns(t *testing.T) {
+	long := strings.Repeat("word ", 60)
+	var turns []contextTurn
+	for i := 0; i < 20; i++ {
+		turns = append(turns, contextTurn{Role: llm.RoleUser, Speaker: "Ada", Content: long + "\nsecond line"})
+	}
+
+	history, summary := fitHistory(turns, 200)
+	if len(history) == 0 || len(history) >= len(turns) {
+		t.Fatalf("expected some but not all turns in full, got %d", len(history))
+	}
+	if !strings.HasPrefix(summary, "Earlier conversation") {
+		t.Fatalf("expected summary, got %q", summary)
+	}
+	if strings.Contains(summary, "second line") {
+		t.Fatal("summary should only keep the first line of each turn")
+	}
+	if !strings.Contains(summary, "older message(s) omitted") {
+		t.Fatalf("expected omitted count in %q", summary)
+	}
+
+	total := estimateTokens(summary)
+	for _, msg := range history {
+		total += estimateTokens(msg.Content)
+	}
+	if total > 200 {
+		t.Fatalf("history uses %d tokens, over budget", total)
+	}
+}
+
+func TestTruncateTokens(t *testing.T) {
+	if got := truncateTokens("short", 10); got != "short" {
+		t.Fatalf("got %q", got)
+	}
+	got := truncateTokens(strings.Repeat("a", 100), 5)
+	if !strings.HasSuffix(got, "[truncated]") || len(got) > 40 {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,156 @@
+package agents
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"replychat/src/llm"
+	"replychat/src/projectfs"
+)
+
+// Tool loop bounds: an agent may call tools for at most maxSteps model turns
+// or until it has used maxTokens, whichever comes first. It then has to
+// answer without tools.
+const (
+	defaultToolMaxSteps  = 8
+	defaultToolMaxTokens = 60000
+)
+
+const toolFormatInstructions = `You can inspect and change the project workspace with tools. Read or search files before editing them, make focused edits with apply_patch or write_file, and call tools again to check your work. Use create_issue, open_dialog and mention_agent to coordinate with the team.
+Paths are relative to the workspace root. When you are done, reply with a short plain-text summary of what you changed and anything left to do. Do not repeat file contents in the summary.`
+
+// streamer is the part of llm.Chain the tool loop needs.
+type streamer interface {
+	Stream(ctx context.Context, req llm.Request, onDelta llm.DeltaFunc) (*llm.Response, error)
+}
+
+type toolLoopLimits struct {
+	maxSteps  int
+	maxTokens int
+}
+
+func toolLoopLimitsFromEnv() toolLoopLimits {
+	return toolLoopLimits{
+		maxSteps:  max(contextSetting("AGENT_TOOL_MAX_STEPS", defaultToolMaxSteps), 1),
+		maxTokens: contextSetting("AGENT_TOOL_MAX_TOKENS", defaultToolMaxTokens),
+	}
+}
+
+// toolsEnabled reports whether agents use the tool loop. AGENT_TOOLS=off
+// restores the single-shot JSON plan.
+func toolsEnabled() bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("AGENT_TOOLS"))) {
+	case "off", "false", "0", "no":
+		return false
+	}
+	return true
+}
+
+// toolLoopResult is the model's final answer plus what the loop did to get
+// there.
+type toolLoopResult struct {
+	Response *llm.Response
+	Steps    int
+	Tokens   int
+	// InputTokens and OutputTokens add up the usage the provider reported
+	// over every step.
+	InputTokens  int
+	OutputTokens int
+	// Exhausted is set when the limits forced a final answer.
+	Exhausted bool
+}
+
+// runToolLoop lets the model call run's tools until it answers in plain text
+// or the limits are reached. Text from every step is streamed to onDelta,
+// separated by blank lines.
+func runToolLoop(ctx context.Context, gen streamer, messages []llm.Message, run *toolRun, limits toolLoopLimits, onDelta llm.DeltaFunc) (toolLoopResult, error) {
+	var result toolLoopResult
+	emitted := false
+	stepDelta := func() llm.DeltaFunc {
+		separate := emitted
+		return func(delta string) {
+			if onDelta == nil || delta == "" {
+				return
+			}
+			if separate {
+				onDelta("\n\n")
+				separate = false
+			}
+			emitted = true
+			onDelta(delta)
+		}
+	}
+
+	specs := run.specs()
+	messages = append([]llm.Message(nil), messages...)
+	for {
+		if result.Steps >= limits.maxSteps || (limits.maxTokens > 0 && result.Tokens >= limits.maxTokens) {
+			result.Exhausted = true
+			break
+		}
+		resp, err := gen.Stream(ctx, llm.Request{Messages: messages, Tools: specs}, stepDelta())
+		if err != nil {
+			return result, err
+		}
+		result.Steps++
+		result.addUsage(messages, resp)
+		if len(resp.ToolCalls) == 0 {
+			result.Response = resp
+			return result, nil
+		}
+
+		messages = append(messages, llm.Message{Role: llm.RoleAssistant, Content: resp.Text, ToolCalls: resp.ToolCalls})
+		for _, call := range resp.ToolCalls {
+			if err := ctx.Err(); err != nil {
+				return result, err
+			}
+			messages = append(messages, llm.Message{Role: llm.RoleTool, ToolCallID: call.ID, Content: run.call(call)})
+		}
+	}
+
+	messages = append(messages, llm.Message{
+		Role:    llm.RoleSystem,
+		Content: fmt.Sprintf("Tool budget used up after %d steps. Do not call any more tools; reply now with your final summary.", result.Steps),
+	})
+	resp, err := gen.Stream(ctx, llm.Request{Messages: messages}, stepDelta())
+	if err != nil {
+		return result, err
+	}
+	result.addUsage(messages, resp)
+	result.Response = resp
+	return result, nil
+}
+
+func (r *toolLoopResult) addUsage(messages []llm.Message, resp *llm.Response) {
+	r.Tokens += responseTokens(messages, resp)
+	r.InputTokens += resp.InputTokens
+	r.OutputTokens += resp.OutputTokens
+}
+
+// responseTokens uses the provider's usage figures, estimating them when the
+// backend does not report any.
+func responseTokens(messages []llm.Message, resp *llm.Response) int {
+	if resp.InputTokens+resp.OutputTokens > 0 {
+		return resp.InputTokens + resp.OutputTokens
+	}
+	total := estimateTokens(resp.Text)
+	for _, msg := range messages {
+		total += estimateTokens(msg.Content)
+	}
+	for _, call := range resp.ToolCalls {
+		total += estimateTokens(call.Arguments)
+	}
+	return total
+}
+
+// commitToolChanges commits the files run changed through tools.
+func (p *MessageProcessor) commitToolChanges(projectID, agentType, issueTitle string, run *toolRun) (*projectfs.CommitResult, []string) {
+	return p.commitWorkspace(projectID, agentType, run.workspacePath, toolCommitMessage(agentType, issueTitle, run))
+}
+
+func toolCommitMessage(agentType, issueTitle string, run *toolRun) string {
+	notes := append(append([]string(nil), run.notes...), run.applied.Notes...)
+	return buildCommitMessage(agentType, issueTitle, run.summary(), notes)
+}
@@ -0,0 +1,172 @@
+package agents
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"replychat/src/llm"
+)
+
+// scriptedStreamer replays canned responses and records each request.
+type scriptedStreamer struct {
+	responses []*llm.Response
+	requests  []llm.Request
+}
+
+func (s *scriptedStreamer) Stream(_ context.Context, req llm.Request, onDelta llm.DeltaFunc) (*llm.Response, error) {
+	s.requests = append(s.requests, req)
+	resp := s.responses[0]
+	if len(s.responses) > 1 {
+		s.responses = s.responses[1:]
+	}
+	if resp.Text != "" && onDelta != nil {
+		onDelta(resp.Text)
+	}
+	return resp, nil
+}
+
+func newTestRun(t *testing.T) *toolRun {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "src"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src", "app.js"), []byte("const port = 3000;\nlisten(port);\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return &toolRun{p: newMessageProcessor(nil, nil), agentType: "backend_architect", workspacePath: dir}
+}
+
+func TestToolLoopRunsToolsUntilFinalAnswer(t *testing.T) {
+	run := newTestRun(t)
+	gen := &scriptedStreamer{responses: []*llm.Response{
+		{Text: "Looking.", ToolCalls: []llm.ToolCall{{ID: "a", Name: "read_file", Arguments: `{"path":"src/app.js"}`}}},
+		{ToolCalls: []llm.ToolCall{{ID: "b", Name: "apply_patch", Arguments: `{"mutations":[{"path":"src/app.js","find":"3000","replace":"8080"}]}`}}},
+		{Text: "Changed the port."},
+	}}
+
+	var streamed strings.Builder
+	result, err := runToolLoop(context.Background(), gen, []llm.Message{{Role: llm.RoleUser, Content: "use port 8080"}}, run, toolLoopLimits{maxSteps: 5}, func(d string) { streamed.WriteString(d) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Steps != 3 || result.Exhausted || result.Response.Text != "Changed the port." {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if streamed.String() != "Looking.\n\nChanged the port." {
+		t.Fatalf("streamed %q", streamed.String())
+	}
+
+	content, _ := os.ReadFile(filepath.Join(run.workspacePath, "src", "app.js"))
+	if !strings.Contains(string(content), "8080") || !run.changed {
+		t.Fatalf("patch not applied: %q", content)
+	}
+
+	second := gen.requests[1].Messages
+	last := second[len(second)-1]
+	if last.Role != llm.RoleTool || last.ToolCallID != "a" || !strings.Contains(last.Content, "const port = 3000;") {
+		t.Fatalf("read_file result not passed back: %+v", last)
+	}
+	if len(run.calls) != 2 || !run.calls[0].OK || run.calls[1].Target != "src/app.js" {
+		t.Fatalf("unexpected call records %+v", run.calls)
+	}
+}
+
+func TestToolLoopStopsAtStepLimit(t *testing.T) {
+	run := newTestRun(t)
+	gen := &scriptedStreamer{responses: []*llm.Response{
+		{ToolCalls: []llm.ToolCall{{ID: "x", Name: "list_dir", Arguments: `{}`}}},
+		{ToolCalls: []llm.ToolCall{{ID: "y", Name: "list_dir", Arguments: `{}`}}},
+		{Text: "Done."},
+	}}
+
+	result, err := runToolLoop(context.Background(), gen, nil, run, toolLoopLimits{maxSteps: 2}, func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Exhausted || result.Steps != 2 {
+		t.Fatalf("expected exhaustion after 2 steps, got %+v", result)
+	}
+	final := gen.requests[len(gen.requests)-1]
+	if len(gen.requests) != 3 || len(final.Tools) != 0 {
+		t.Fatalf("final request should offer no tools: %d requests, %d tools", len(gen.requests), len(final.Tools))
+	}
+}
+
+func TestToolsRejectPathsOutsideWorkspace(t *testing.T) {
+	run := newTestRun(t)
+	for _, call := range []llm.ToolCall{
+		{Name: "read_file", Arguments: `{"path":"../secret"}`},
+		{Name: "write_file", Arguments: `{"path":"../../evil.txt","content":"x"}`},
+		{Name: "shell", Arguments: `{}`},
+	} {
+		if out := run.call(call); !strings.HasPrefix(out, "error:") {
+			t.Fatalf("%s(%s) should fail, got %q", call.Name, call.Arguments, out)
+		}
+	}
+	if run.changed {
+		t.Fatal("rejected calls must not mark the run as changed")
+	}
+}
+
+func TestToolsRefuseSymlinksOutOfTheWorkspace(t *testing.T) {
+	run := newTestRun(t)
+	secret := filepath.Join(t.TempDir(), "passwd")
+	if err := os.WriteFile(secret, []byte("root:x:0:0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(run.workspacePath, "notes.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Dir(secret), filepath.Join(run.workspacePath, "etc")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, call := range []llm.ToolCall{
+		{Name: "read_file", Arguments: `{"path":"notes.txt"}`},
+		{Name: "read_file", Arguments: `{"path":"etc/passwd"}`},
+		{Name: "search", Arguments: `{"query":"root","path":"etc"}`},
+	} {
+		out := run.call(call)
+		if !strings.HasPrefix(out, "error:") || strings.Contains(out, "root:x") {
+			t.Fatalf("%s(%s) should be refused, got %q", call.Name, call.Arguments, out)
+		}
+	}
+	if out := run.call(llm.ToolCall{Name: "search", Arguments: `{"query":"root"}`}); strings.Contains(out, "root:x") {
+		t.Fatalf("search followed a symlink out of the workspace: %q", out)
+	}
+
+	for _, call := range []llm.ToolCall{
+		{Name: "write_file", Arguments: `{"path":"notes.txt","content":"pwned"}`},
+		{Name: "write_file", Arguments: `{"path":"etc/passwd","content":"pwned"}`},
+		{Name: "write_file", Arguments: `{"path":".git/config","content":"[core]\n\tfsmonitor = touch pwned\n"}`},
+		{Name: "apply_patch", Arguments: `{"mutations":[{"path":"notes.txt","find":"root","replace":"pwned"}]}`},
+		{Name: "apply_patch", Arguments: `{"mutations":[{"path":".git/config","find":"[core]","replace":"[core]\n\tfsmonitor = touch pwned"}]}`},
+	} {
+		if out := run.call(call); !strings.HasPrefix(out, "error:") {
+			t.Fatalf("%s(%s) should be refused, got %q", call.Name, call.Arguments, out)
+		}
+	}
+	if data, _ := os.ReadFile(secret); string(data) != "root:x:0:0\n" {
+		t.Fatalf("write followed a symlink out of the workspace: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(run.workspacePath, ".git", "config")); !os.IsNotExist(err) {
+		t.Fatalf(".git/config was written: %v", err)
+	}
+}
+
+func TestSearchAndListTools(t *testing.T) {
+	run := newTestRun(t)
+	if out := run.call(llm.ToolCall{Name: "search", Arguments: `{"query":"LISTEN"}`}); !strings.Contains(out, "src/app.js:2: listen(port);") {
+		t.Fatalf("search output %q", out)
+	}
+	if out := run.call(llm.ToolCall{Name: "list_dir", Arguments: `{}`}); !strings.Contains(out, "src/") || strings.Contains(out, "app.js") {
+		t.Fatalf("non-recursive listing %q", out)
+	}
+	if out := run.call(llm.ToolCall{Name: "list_dir", Arguments: `{"path":"src","recursive":true}`}); !strings.Contains(out, "app.js") {
+		t.Fatalf("recursive listing %q", out)
+	}
+}
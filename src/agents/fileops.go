@@ -0,0 +1,266 @@
+package agents
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"replychat/src/projectfs"
+)
+
+// FileRename moves a file or directory within the workspace.
+type FileRename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// FileChmod sets permission bits: an octal mode such as "755", or "+x" /
+// "-x" to toggle the executable bits.
+type FileChmod struct {
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+}
+
+// resolvePlanPath normalizes a plan path and joins it to the workspace. The
+// workspace root and anything under .git are refused so plans cannot delete
+// or move the repository itself, and so is a path whose closest existing
+// parent directory resolves, through symlinks, outside the workspace.
+func resolvePlanPath(workspacePath, candidate string) (string, string, error) {
+	cleanPath := normalizePlanPath(workspacePath, candidate)
+	if cleanPath == "" || cleanPath == "." {
+		return "", "", errors.New("missing path")
+	}
+	if first := strings.Split(filepath.ToSlash(cleanPath), "/")[0]; first == ".git" {
+		return cleanPath, "", fmt.Errorf("path %s is inside .git", candidate)
+	}
+	absPath, err := projectfs.SecureJoin(workspacePath, cleanPath)
+	if err != nil {
+		return cleanPath, "", err
+	}
+
+	parent := filepath.Dir(cleanPath)
+	for parent != "." {
+		if _, err := os.Lstat(filepath.Join(workspacePath, parent)); err == nil {
+			break
+		}
+		parent = filepath.Dir(parent)
+	}
+	if _, err := projectfs.ResolveInside(workspacePath, parent); err != nil {
+		return cleanPath, "", fmt.Errorf("path %s: %w", candidate, err)
+	}
+	return cleanPath, absPath, nil
+}
+
+// resolveWritePath is resolvePlanPath for operations that read or write
+// through the path itself. A symlink there is refused, since the write would
+// land wherever it points.
+func resolveWritePath(workspacePath, candidate string) (string, string, error) {
+	cleanPath, absPath, err := resolvePlanPath(workspacePath, candidate)
+	if err != nil {
+		return cleanPath, "", err
+	}
+	if info, err := os.Lstat(absPath); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		return cleanPath, "", fmt.Errorf("path %s is a symlink", candidate)
+	}
+	return cleanPath, absPath, nil
+}
+
+// applyPatch applies one unified diff, which may cover several files. Each
+// hunk that does not match is reported as skipped; the others are applied.
+func applyPatch(workspacePath, diff string, result *applyResult) error {
+	patches, err := parseUnifiedDiff(diff)
+	if err != nil {
+		result.Skipped = append(result.Skipped, skippedChange{Kind: "patch", Reason: "unreadable diff: " + err.Error()})
+		return nil
+	}
+
+	for _, fp := range patches {
+		skip := func(path, reason string) {
+			result.Skipped = append(result.Skipped, skippedChange{Path: path, Kind: "patch", Reason: reason})
+		}
+
+		target := fp.Path()
+		cleanTarget, targetAbs, err := resolveWritePath(workspacePath, target)
+		if err != nil {
+			if cleanTarget == "" {
+				skip(target, err.Error())
+				continue
+			}
+			return err
+		}
+
+		sourceAbs := targetAbs
+		cleanSource := cleanTarget
+		if !fp.Creates() && !fp.Deletes() && fp.OldPath != fp.NewPath {
+			if cleanSource, sourceAbs, err = resolveWritePath(workspacePath, fp.OldPath); err != nil {
+				return err
+			}
+		}
+
+		var original string
+		if fp.Creates() {
+			if _, err := os.Stat(targetAbs); err == nil {
+				skip(cleanTarget, "patch creates a file that already exists")
+				continue
+			}
+		} else {
+			content, err := os.ReadFile(sourceAbs)
+			if errors.Is(err, fs.ErrNotExist) {
+				skip(cleanSource, "file does not exist")
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read %s for patch: %w", cleanSource, err)
+			}
+			original = string(content)
+		}
+
+		updated, conflicts := applyHunks(original, fp.Hunks)
+		for _, c := range conflicts {
+			skip(cleanTarget, fmt.Sprintf("hunk %d (%s) does not match the file", c.Index, c.Header))
+		}
+		if len(conflicts) == len(fp.Hunks) && len(fp.Hunks) > 0 {
+			continue
+		}
+
+		if fp.Deletes() {
+			if len(fp.Hunks) > 0 && strings.TrimSpace(updated) != "" {
+				skip(cleanTarget, "patch deletes the file but its content does not match")
+				continue
+			}
+			if err := os.Remove(targetAbs); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", cleanTarget, err)
+			}
+			result.PatchesApplied++
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(targetAbs), 0o755); err != nil {
+			return fmt.Errorf("failed to prepare directory for %s: %w", cleanTarget, err)
+		}
+		mode := fs.FileMode(0o644)
+		if info, err := os.Stat(sourceAbs); err == nil {
+			mode = info.Mode().Perm()
+		}
+		if err := os.WriteFile(targetAbs, []byte(updated), mode); err != nil {
+			return fmt.Errorf("failed to apply patch to %s: %w", cleanTarget, err)
+		}
+		if sourceAbs != targetAbs {
+			if err := os.Remove(sourceAbs); err != nil {
+				return fmt.Errorf("failed to remove %s after rename: %w", cleanSource, err)
+			}
+		}
+		result.PatchesApplied++
+	}
+	return nil
+}
+
+func applyRename(workspacePath string, rename FileRename, result *applyResult) error {
+	skip := func(path, reason string) {
+		result.Skipped = append(result.Skipped, skippedChange{Path: path, Kind: "rename", Reason: reason})
+	}
+	from, fromAbs, err := resolvePlanPath(workspacePath, rename.From)
+	if err != nil {
+		if from == "" {
+			skip(rename.From, err.Error())
+			return nil
+		}
+		return err
+	}
+	to, toAbs, err := resolvePlanPath(workspacePath, rename.To)
+	if err != nil {
+		if to == "" {
+			skip(from, "missing destination")
+			return nil
+		}
+		return err
+	}
+	if _, err := os.Lstat(fromAbs); errors.Is(err, fs.ErrNotExist) {
+		skip(from, "file does not exist")
+		return nil
+	}
+	if _, err := os.Lstat(toAbs); err == nil {
+		skip(from, fmt.Sprintf("destination %s already exists", to))
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(toAbs), 0o755); err != nil {
+		return fmt.Errorf("failed to prepare directory for %s: %w", to, err)
+	}
+	if err := os.Rename(fromAbs, toAbs); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", from, to, err)
+	}
+	result.Renamed++
+	return nil
+}
+
+func applyChmod(workspacePath string, change FileChmod, result *applyResult) error {
+	skip := func(path, reason string) {
+		result.Skipped = append(result.Skipped, skippedChange{Path: path, Kind: "chmod", Reason: reason})
+	}
+	cleanPath, absPath, err := resolvePlanPath(workspacePath, change.Path)
+	if err != nil {
+		if cleanPath == "" {
+			skip(change.Path, err.Error())
+			return nil
+		}
+		return err
+	}
+	info, err := os.Lstat(absPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		skip(cleanPath, "file does not exist")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		skip(cleanPath, "refusing to chmod a symlink")
+		return nil
+	}
+
+	current := info.Mode().Perm()
+	var mode fs.FileMode
+	switch strings.TrimSpace(change.Mode) {
+	case "+x":
+		// Grant execute wherever read is granted, like chmod +x.
+		mode = current | (current&0o444)>>2
+	case "-x":
+		mode = current &^ 0o111
+	default:
+		parsed, err := strconv.ParseUint(strings.TrimSpace(change.Mode), 8, 32)
+		if err != nil || parsed > 0o777 {
+			skip(cleanPath, fmt.Sprintf("invalid mode %q", change.Mode))
+			return nil
+		}
+		mode = fs.FileMode(parsed)
+	}
+	if err := os.Chmod(absPath, mode); err != nil {
+		return fmt.Errorf("failed to chmod %s: %w", cleanPath, err)
+	}
+	result.Chmodded++
+	return nil
+}
+
+func applyDelete(workspacePath, candidate string, result *applyResult) error {
+	cleanPath, absPath, err := resolvePlanPath(workspacePath, candidate)
+	if err != nil {
+		if cleanPath == "" {
+			result.Skipped = append(result.Skipped, skippedChange{Path: candidate, Kind: "delete", Reason: err.Error()})
+			return nil
+		}
+		return err
+	}
+	if _, err := os.Lstat(absPath); errors.Is(err, fs.ErrNotExist) {
+		result.Skipped = append(result.Skipped, skippedChange{Path: cleanPath, Kind: "delete", Reason: "file does not exist"})
+		return nil
+	}
+	if err := os.RemoveAll(absPath); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", cleanPath, err)
+	}
+	result.Deleted++
+	return nil
+}
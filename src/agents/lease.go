@@ -0,0 +1,144 @@
+package agents
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WorkerID names this server process in the leases it takes on issues.
+var WorkerID = newWorkerID()
+
+func newWorkerID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "worker"
+	}
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), uuid.New().String()[:8])
+}
+
+// TaskLease is how long a claim on an issue holds without a heartbeat.
+type TaskLease struct {
+	TTL time.Duration
+}
+
+// TaskLeaseFromEnv reads TASK_LEASE_SECONDS (default 90, at least 10).
+func TaskLeaseFromEnv() TaskLease {
+	return TaskLease{TTL: time.Duration(max(10, contextSetting("TASK_LEASE_SECONDS", 90))) * time.Second}
+}
+
+// Heartbeat returns how often leases are renewed: three times per TTL, so
+// one late renewal does not lose the issue.
+func (l TaskLease) Heartbeat() time.Duration {
+	return l.TTL / 3
+}
+
+// RenewLeases extends the leases this worker holds on the issues it is
+// running.
+func RenewLeases(db *sql.DB, lease TaskLease) error {
+	var ids []string
+	for _, run := range ActiveRuns("") {
+		if run.task && run.IssueID != "" {
+			ids = append(ids, run.IssueID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	args := []interface{}{time.Now().Add(lease.TTL), WorkerID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	_, err := db.Exec(`
+		UPDATE issues SET lease_expires_at = ?
+		WHERE claimed_by = ? AND status = 'inProgress' AND id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)
+	`, args...)
+	return err
+}
+
+// ReleaseLease drops this worker's lease on issueID once its run is over.
+func ReleaseLease(db *sql.DB, issueID string) error {
+	_, err := db.Exec(`
+		UPDATE issues SET claimed_by = NULL, lease_expires_at = NULL
+		WHERE id = ? AND claimed_by = ?
+	`, issueID, WorkerID)
+	return err
+}
+
+// ReclaimExpiredLeases takes back in-progress issues whose worker stopped
+// renewing its lease, typically because the server died mid-run. Each one
+// counts as a failed attempt: it is queued again for its agent after the
+// policy's backoff, or marked failed once the attempts are used up. It
+// returns how many issues it took back.
+func ReclaimExpiredLeases(db *sql.DB, publisher Publisher, policy TaskRetryPolicy) (int, error) {
+	now := time.Now()
+	rows, err := db.Query(`
+		SELECT id, COALESCE(assigned_agent_id, ''), claimed_by, COALESCE(attempts, 0)
+		FROM issues
+		WHERE status = 'inProgress' AND claimed_by IS NOT NULL AND lease_expires_at < ?
+	`, now)
+	if err != nil {
+		return 0, err
+	}
+	type expired struct {
+		issueID, agentID, worker string
+		attempts                 int
+	}
+	var issues []expired
+	for rows.Next() {
+		var e expired
+		if err := rows.Scan(&e.issueID, &e.agentID, &e.worker, &e.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		issues = append(issues, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	p := newMessageProcessor(db, publisher)
+	reclaimed := 0
+	for _, e := range issues {
+		attempts := e.attempts + 1
+		reason := fmt.Sprintf("the run was lost: the worker running it (%s) stopped renewing its lease", e.worker)
+
+		var res sql.Result
+		if attempts < policy.MaxAttempts && e.agentID != "" {
+			retryAt := now.Add(policy.delay(attempts))
+			log.Printf("tasks: reclaimed issue %s from %s (attempt %d of %d), retrying at %s", e.issueID, e.worker, attempts, policy.MaxAttempts, retryAt.Format(time.RFC3339))
+			res, err = db.Exec(`
+				UPDATE issues
+				SET status = 'todo', attempts = ?, last_error = ?, queued_agent_id = ?, queued_at = ?, retry_at = ?,
+				    claimed_by = NULL, lease_expires_at = NULL
+				WHERE id = ? AND status = 'inProgress' AND claimed_by = ? AND lease_expires_at < ?
+			`, attempts, reason, e.agentID, now, retryAt, e.issueID, e.worker, now)
+		} else {
+			log.Printf("tasks: reclaimed issue %s from %s and marked it failed after %d attempts", e.issueID, e.worker, attempts)
+			res, err = db.Exec(`
+				UPDATE issues
+				SET status = 'failed', attempts = ?, last_error = ?, queued_agent_id = NULL, retry_at = NULL,
+				    claimed_by = NULL, lease_expires_at = NULL
+				WHERE id = ? AND status = 'inProgress' AND claimed_by = ? AND lease_expires_at < ?
+			`, attempts, reason, e.issueID, e.worker, now)
+		}
+		if err != nil {
+			log.Printf("tasks: failed to reclaim issue %s: %v", e.issueID, err)
+			continue
+		}
+		if rows, _ := res.RowsAffected(); rows > 0 {
+			reclaimed++
+		}
+		if err := p.publishIssueIfChanged(res, e.issueID); err != nil {
+			log.Printf("tasks: failed to publish reclaimed issue %s: %v", e.issueID, err)
+		}
+	}
+	return reclaimed, nil
+}
@@ -0,0 +1,94 @@
+package agents
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestTaskLeaseFromEnv(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"":    90 * time.Second,
+		"60":  time.Minute,
+		"3":   10 * time.Second,
+		"bad": 90 * time.Second,
+	} {
+		t.Setenv("TASK_LEASE_SECONDS", value)
+		lease := TaskLeaseFromEnv()
+		if lease.TTL != want {
+			t.Errorf("TASK_LEASE_SECONDS=%q: TTL %s, want %s", value, lease.TTL, want)
+		}
+		if lease.Heartbeat() != want/3 {
+			t.Errorf("TASK_LEASE_SECONDS=%q: heartbeat %s, want %s", value, lease.Heartbeat(), want/3)
+		}
+	}
+}
+
+func TestLeasesRenewRunningIssuesAndReclaimExpiredOnes(t *testing.T) {
+	db := newTestIssueDB(t)
+	now := time.Now()
+	expired, live := now.Add(-time.Minute), now.Add(time.Minute)
+	for _, issue := range []struct {
+		id, status, worker string
+		attempts           int
+		lease              interface{}
+	}{
+		{"running", "inProgress", WorkerID, 0, expired},
+		{"orphan", "inProgress", "dead-worker", 0, expired},
+		{"orphan-last-attempt", "inProgress", "dead-worker", 2, expired},
+		{"other-worker", "inProgress", "other-worker", 0, live},
+		{"moved-by-hand", "inProgress", "", 0, nil},
+	} {
+		var worker interface{}
+		if issue.worker != "" {
+			worker = issue.worker
+		}
+		if _, err := db.Exec(`
+			INSERT INTO issues (id, status, assigned_agent_id, attempts, claimed_by, lease_expires_at)
+			VALUES (?, ?, 'qa_tester', ?, ?, ?)
+		`, issue.id, issue.status, issue.attempts, worker, issue.lease); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := &Run{ProjectID: "p1", AgentType: "qa_tester", IssueID: "running", task: true}
+	if err := activeRuns.add(run, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer activeRuns.remove(run.ID)
+
+	lease := TaskLease{TTL: time.Minute}
+	if err := RenewLeases(db, lease); err != nil {
+		t.Fatal(err)
+	}
+	n, err := ReclaimExpiredLeases(db, nil, TaskRetryPolicy{MaxAttempts: 3, Backoff: time.Second, MaxBackoff: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("reclaimed %d issue(s), want 2", n)
+	}
+
+	for id, want := range map[string]testIssue{
+		"running":             {Status: "inProgress"},
+		"orphan":              {Status: "todo", Attempts: 1, Queued: "qa_tester", RetryAt: true},
+		"orphan-last-attempt": {Status: "failed", Attempts: 3},
+		"other-worker":        {Status: "inProgress"},
+		"moved-by-hand":       {Status: "inProgress"},
+	} {
+		if got := loadTestIssue(t, db, id); got != want {
+			t.Errorf("%s = %+v, want %+v", id, got, want)
+		}
+	}
+
+	var claimedBy sql.NullString
+	if err := db.QueryRow(`SELECT claimed_by FROM issues WHERE id = 'orphan'`).Scan(&claimedBy); err != nil || claimedBy.Valid {
+		t.Errorf("reclaimed issue still claimed by %q (%v)", claimedBy.String, err)
+	}
+	if err := ReleaseLease(db, "running"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT claimed_by FROM issues WHERE id = 'running'`).Scan(&claimedBy); err != nil || claimedBy.Valid {
+		t.Errorf("released issue still claimed by %q (%v)", claimedBy.String, err)
+	}
+}
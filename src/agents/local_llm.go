@@ -191,6 +191,20 @@ func newLocalLLMFromEnv() (*LocalLLM, error) {
 }
 
 func (l *LocalLLM) Generate(ctx context.Context, systemPrompt, workspaceHint, userMessage string) (string, error) {
+	return l.generate(ctx, systemPrompt, workspaceHint, userMessage, localOverrides{}, nil)
+}
+
+// Stream is Generate with onToken called for every token as llama produces
+// it.
+func (l *LocalLLM) Stream(ctx context.Context, systemPrompt, workspaceHint, userMessage string, onToken func(string)) (string, error) {
+	return l.generate(ctx, systemPrompt, workspaceHint, userMessage, localOverrides{}, onToken)
+}
+
+func (l *LocalLLM) modelName() string {
+	return filepath.Base(l.cfg.modelPath)
+}
+
+func (l *LocalLLM) generate(ctx context.Context, systemPrompt, workspaceHint, userMessage string, overrides localOverrides, onToken func(string)) (string, error) {
 	if l == nil {
 		return "", fmt.Errorf("local-llm: not configured")
 	}
@@ -204,6 +218,22 @@ func (l *LocalLLM) Generate(ctx context.Context, systemPrompt, workspaceHint, us
 		defer cancel()
 	}
 
+	opts := append([]llama.PredictOption(nil), l.predictOpts...)
+	if overrides.temperature != nil {
+		opts = append(opts, llama.SetTemperature(float32(*overrides.temperature)))
+	}
+	if overrides.maxTokens > 0 {
+		opts = append(opts, llama.SetTokens(overrides.maxTokens))
+	}
+	opts = append(opts, llama.SetTokenCallback(func(token string) bool {
+		if onToken != nil {
+			onToken(token)
+		}
+		// Returning false stops prediction once the caller gives up or the
+		// run is cancelled, so the model lock is not held for nothing.
+		return ctx.Err() == nil
+	}))
+
 	prompt := buildLocalPrompt(systemPrompt, workspaceHint, userMessage)
 	type result struct {
 		text string
@@ -214,7 +244,7 @@ func (l *LocalLLM) Generate(ctx context.Context, systemPrompt, workspaceHint, us
 	go func() {
 		l.mu.Lock()
 		defer l.mu.Unlock()
-		text, err := l.model.Predict(prompt, l.predictOpts...)
+		text, err := l.model.Predict(prompt, opts...)
 		resultCh <- result{text: text, err: err}
 	}()
 
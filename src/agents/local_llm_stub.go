@@ -15,5 +15,19 @@ func getLocalLLM() (*LocalLLM, error) {
 }
 
 func (l *LocalLLM) Generate(_ context.Context, _, _, _ string) (string, error) {
-	return "", fmt.Errorf("local-llm: support not built (compile with -tags local_llm)")
+	return "", errLocalLLMNotBuilt
 }
+
+func (l *LocalLLM) Stream(_ context.Context, _, _, _ string, _ func(string)) (string, error) {
+	return "", errLocalLLMNotBuilt
+}
+
+func (l *LocalLLM) modelName() string {
+	return ""
+}
+
+func (l *LocalLLM) generate(_ context.Context, _, _, _ string, _ localOverrides, _ func(string)) (string, error) {
+	return "", errLocalLLMNotBuilt
+}
+
+var errLocalLLMNotBuilt = fmt.Errorf("local-llm: support not built (compile with -tags local_llm)")
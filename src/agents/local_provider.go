@@ -0,0 +1,49 @@
+package agents
+
+import (
+	"context"
+
+	"replychat/src/llm"
+)
+
+func init() {
+	llm.Register(llm.ProviderLocal, func() (llm.Provider, error) {
+		local, err := getLocalLLM()
+		if err != nil {
+			return nil, err
+		}
+		if local == nil {
+			return nil, llm.ErrNotConfigured
+		}
+		return &localProvider{local: local}, nil
+	})
+}
+
+// localOverrides carries per-request sampling settings into LocalLLM.
+type localOverrides struct {
+	temperature *float64
+	maxTokens   int
+}
+
+// localProvider adapts the go-llama.cpp model to llm.Provider. The model is
+// fixed at startup by LOCAL_LLM_MODEL, so Request.Model is ignored.
+type localProvider struct {
+	local *LocalLLM
+}
+
+func (p *localProvider) Name() string { return llm.ProviderLocal }
+
+func (p *localProvider) Generate(ctx context.Context, req llm.Request) (*llm.Response, error) {
+	return p.Stream(ctx, req, nil)
+}
+
+func (p *localProvider) Stream(ctx context.Context, req llm.Request, onDelta llm.DeltaFunc) (*llm.Response, error) {
+	system, workspace, user := llm.SplitMessages(req.Messages)
+	overrides := localOverrides{temperature: req.Temperature, maxTokens: req.MaxTokens}
+
+	text, err := p.local.generate(ctx, system, workspace, user, overrides, onDelta)
+	if err != nil {
+		return nil, err
+	}
+	return &llm.Response{Text: text, Provider: llm.ProviderLocal, Model: p.local.modelName()}, nil
+}
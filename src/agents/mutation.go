@@ -0,0 +1,288 @@
+package agents
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"replychat/src/llm"
+)
+
+// Ways a mutation's find text was located in a file.
+const (
+	matchExact      = "exact"
+	matchWhitespace = "whitespace"
+	matchAnchored   = "anchored"
+)
+
+// correctionFileTokens bounds each file shown to the agent when it is asked
+// to fix skipped changes.
+const correctionFileTokens = 1500
+
+// minAnchoredLines is the shortest find text matched by its first and last
+// lines; shorter snippets have too little context to anchor safely.
+const minAnchoredLines = 3
+
+// skippedChange is a planned file write or mutation that was not applied.
+type skippedChange struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Reason string `json:"reason"`
+	// Find is the start of the mutation's find text, to identify it.
+	Find string `json:"find,omitempty"`
+}
+
+func (s skippedChange) note() string {
+	switch s.Kind {
+	case "file":
+		return fmt.Sprintf("Skipped writing %s: %s", s.Path, s.Reason)
+	case "mutation":
+		return fmt.Sprintf("Skipped mutation in %s: %s", s.Path, s.Reason)
+	case "patch":
+		if s.Path == "" {
+			return "Skipped patch: " + s.Reason
+		}
+		return fmt.Sprintf("Skipped patch to %s: %s", s.Path, s.Reason)
+	}
+	return fmt.Sprintf("Skipped %s of %s: %s", s.Kind, s.Path, s.Reason)
+}
+
+func skippedNotes(skipped []skippedChange) []string {
+	notes := make([]string, 0, len(skipped))
+	for _, s := range skipped {
+		notes = append(notes, s.note())
+	}
+	return notes
+}
+
+// hasSkippedMutations reports whether any mutation or patch was skipped.
+// Files kept because overwrite was false are usually intended and do not
+// warrant a retry on their own.
+func hasSkippedMutations(skipped []skippedChange) bool {
+	for _, s := range skipped {
+		if s.Kind == "mutation" || s.Kind == "patch" {
+			return true
+		}
+	}
+	return false
+}
+
+// locateMutation finds the span of content that find refers to. An exact
+// match wins; otherwise the text is matched ignoring differences in
+// whitespace, and finally a multi-line find is anchored on its first and
+// last lines. Fuzzy matches must be unique. reason explains a failure.
+func locateMutation(content, find string) (start, end int, mode, reason string) {
+	if idx := strings.Index(content, find); idx >= 0 {
+		return idx, idx + len(find), matchExact, ""
+	}
+
+	if pattern := whitespacePattern(find); pattern != nil {
+		matches := pattern.FindAllStringIndex(content, 2)
+		switch len(matches) {
+		case 1:
+			return matches[0][0], matches[0][1], matchWhitespace, ""
+		case 2:
+			return 0, 0, "", "find text matches more than one place when whitespace is ignored"
+		}
+	}
+
+	start, end, ok, ambiguous := anchoredMatch(content, find)
+	switch {
+	case ok:
+		return start, end, matchAnchored, ""
+	case ambiguous:
+		return 0, 0, "", "find text's first and last lines match more than one place"
+	}
+	return 0, 0, "", "find text not found"
+}
+
+// whitespacePattern matches find's words in order, separated by any run of
+// whitespace.
+func whitespacePattern(find string) *regexp.Regexp {
+	words := strings.Fields(find)
+	if len(words) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	return regexp.MustCompile(strings.Join(quoted, `\s+`))
+}
+
+// anchoredMatch looks for a block of lines that starts and ends like find
+// and is about as long, with at least half of find's inner lines present.
+// The span covers whole lines, without the final newline.
+func anchoredMatch(content, find string) (start, end int, ok, ambiguous bool) {
+	findLines := nonBlankTrimmedLines(find)
+	if len(findLines) < minAnchoredLines {
+		return 0, 0, false, false
+	}
+	first, last := findLines[0], findLines[len(findLines)-1]
+	inner := findLines[1 : len(findLines)-1]
+	slack := max(len(findLines)/4, 1)
+
+	lines := strings.SplitAfter(content, "\n")
+	offsets := make([]int, len(lines)+1)
+	for i, line := range lines {
+		offsets[i+1] = offsets[i] + len(line)
+	}
+
+	found := 0
+	for i, line := range lines {
+		if strings.TrimSpace(line) != first {
+			continue
+		}
+		for j := i + 1; j < len(lines) && j-i+1 <= len(findLines)+slack; j++ {
+			if strings.TrimSpace(lines[j]) != last || j-i+1 < len(findLines)-slack {
+				continue
+			}
+			if !innerLinesPresent(inner, lines[i+1:j]) {
+				continue
+			}
+			found++
+			if found > 1 {
+				return 0, 0, false, true
+			}
+			start = offsets[i]
+			end = offsets[j] + len(strings.TrimRight(lines[j], "\r\n"))
+			break
+		}
+	}
+	return start, end, found == 1, false
+}
+
+func innerLinesPresent(inner, block []string) bool {
+	if len(inner) == 0 {
+		return true
+	}
+	present := map[string]bool{}
+	for _, line := range block {
+		present[strings.TrimSpace(line)] = true
+	}
+	hits := 0
+	for _, line := range inner {
+		if present[line] {
+			hits++
+		}
+	}
+	return hits*2 >= len(inner)
+}
+
+func nonBlankTrimmedLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if trimmed := strings.TrimSpace(line); trimmed != "" {
+			lines = append(lines, trimmed)
+		}
+	}
+	return lines
+}
+
+// planCorrector asks the agent for a plan that fixes the skipped changes.
+type planCorrector func(skipped []skippedChange) (AgentActionPlan, bool)
+
+// correctionRequester returns a planCorrector that continues the
+// conversation in messages, where the agent answered with output, showing it
+// what was skipped and the current contents of those files. It returns nil
+// when AGENT_MUTATION_RETRY is 0.
+func correctionRequester(ctx context.Context, gen streamer, messages []llm.Message, output, workspacePath string) planCorrector {
+	if contextSetting("AGENT_MUTATION_RETRY", 1) == 0 {
+		return nil
+	}
+	return func(skipped []skippedChange) (AgentActionPlan, bool) {
+		retry := append(append([]llm.Message(nil), messages...),
+			llm.Message{Role: llm.RoleAssistant, Content: output},
+			llm.Message{Role: llm.RoleUser, Content: correctionPrompt(workspacePath, skipped)},
+		)
+		resp, err := gen.Stream(ctx, llm.Request{Messages: retry}, nil)
+		if err != nil {
+			log.Printf("agent: corrective retry failed: %v", err)
+			return AgentActionPlan{}, false
+		}
+		plan, err := parseActionPlan(resp.Text)
+		if err != nil {
+			log.Printf("agent: corrective retry returned no plan: %v", err)
+			return AgentActionPlan{}, false
+		}
+		return plan, true
+	}
+}
+
+// correctionPrompt lists the skipped changes and the files they target.
+func correctionPrompt(workspacePath string, skipped []skippedChange) string {
+	var b strings.Builder
+	b.WriteString("Some of your changes were not applied:\n")
+	seen := map[string]bool{}
+	var paths []string
+	for _, s := range skipped {
+		b.WriteString("- " + s.note())
+		if s.Find != "" {
+			fmt.Fprintf(&b, " (find: %q)", s.Find)
+		}
+		b.WriteString("\n")
+		if (s.Kind == "mutation" || s.Kind == "patch") && s.Path != "" && !seen[s.Path] {
+			seen[s.Path] = true
+			paths = append(paths, s.Path)
+		}
+	}
+	for _, rel := range paths {
+		if content, ok := readWorkspaceText(workspacePath, rel); ok {
+			fmt.Fprintf(&b, "\nCurrent contents of %s:\n%s\n", rel, truncateTokens(string(content), correctionFileTokens))
+		}
+	}
+	b.WriteString("\nReply with a JSON plan containing only the corrected files, mutations and patches. Copy each find string and diff context line exactly from the current contents, or rewrite the whole file via \"files\". Set \"overwrite\": true only if replacing an existing file is intended.")
+	return b.String()
+}
+
+// applyCorrection asks correct for a fixed plan, applies it and merges the
+// outcome into result. Skipped changes the retry did not address stay
+// skipped. The note describes the retry for the chat.
+func (p *MessageProcessor) applyCorrection(workspacePath, agentType string, notes []string, result applyResult, correct planCorrector) (applyResult, string) {
+	plan, ok := correct(result.Skipped)
+	if !ok || !plan.HasChanges() {
+		return result, "Corrective retry produced no changes"
+	}
+	retry, err := p.applyActionPlan(workspacePath, agentType, plan)
+	if err != nil {
+		log.Printf("agent: failed to apply corrective plan: %v", err)
+		return result, fmt.Sprintf("Corrective retry failed: %v", err)
+	}
+
+	// applyActionPlan normalized the retry's paths in place.
+	retried := map[string]bool{}
+	for _, f := range plan.Files {
+		retried[f.Path] = true
+	}
+	for _, m := range plan.Mutations {
+		retried[m.Path] = true
+	}
+	for _, diff := range plan.Patches {
+		if parsed, err := parseUnifiedDiff(diff); err == nil {
+			for _, fp := range parsed {
+				retried[normalizePlanPath(workspacePath, fp.Path())] = true
+			}
+		}
+	}
+	remaining := retry.Skipped
+	for _, s := range result.Skipped {
+		if !retried[s.Path] {
+			remaining = append(remaining, s)
+		}
+	}
+
+	fixed := len(result.Skipped) - len(remaining)
+	merged := result
+	merged.FilesWritten += retry.FilesWritten
+	merged.MutationsApplied += retry.MutationsApplied
+	merged.PatchesApplied += retry.PatchesApplied
+	merged.Renamed += retry.Renamed
+	merged.Chmodded += retry.Chmodded
+	merged.Deleted += retry.Deleted
+	merged.Fuzzy = append(merged.Fuzzy, retry.Fuzzy...)
+	merged.Skipped = remaining
+	merged.summarize(agentType, append(append([]string(nil), notes...), plan.Notes...))
+	return merged, fmt.Sprintf("Corrective retry fixed %d of %d skipped change(s)", max(fixed, 0), len(result.Skipped))
+}
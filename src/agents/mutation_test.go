@@ -0,0 +1,110 @@
+package agents
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"replychat/src/llm"
+)
+
+func TestLocateMutation(t *testing.T) {
+	content := "func main() {\n\tport := 3000\n\tlisten(port)\n\tlog(\"ready\")\n}\n"
+	tests := []struct {
+		name, find, mode, reason string
+		want                     string
+	}{
+		{name: "exact", find: "port := 3000", mode: matchExact, want: "port := 3000"},
+		{name: "whitespace", find: "port  :=\n 3000", mode: matchWhitespace, want: "port := 3000"},
+		{name: "anchored", find: "func main() {\n    port := 4000\n    listen(port)\n    log(\"ready\")\n}", mode: matchAnchored, want: strings.TrimSuffix(content, "\n")},
+		{name: "missing", find: "port := 9999", reason: "find text not found"},
+		{name: "partial words", find: "port )", reason: "find text not found"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			start, end, mode, reason := locateMutation(content, tc.find)
+			if reason != tc.reason || mode != tc.mode {
+				t.Fatalf("mode=%q reason=%q, want mode=%q reason=%q", mode, reason, tc.mode, tc.reason)
+			}
+			if tc.reason == "" && content[start:end] != tc.want {
+				t.Fatalf("matched %q, want %q", content[start:end], tc.want)
+			}
+		})
+	}
+}
+
+func TestLocateMutationRejectsAmbiguousFuzzyMatch(t *testing.T) {
+	content := "a  =  1\nb = 2\na = 1\n"
+	if _, _, _, reason := locateMutation(content, "a =\t1"); !strings.Contains(reason, "more than one place") {
+		t.Fatalf("expected ambiguity, got %q", reason)
+	}
+}
+
+func TestApplyActionPlanReportsSkippedChanges(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "keep.txt"), []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	no := false
+	p := newMessageProcessor(nil, nil)
+	result, err := p.applyActionPlan(dir, "backend_architect", AgentActionPlan{
+		Files: []GeneratedFile{{Path: "keep.txt", Content: "new\n", Overwrite: &no}, {Path: "new.txt", Content: "hi\n"}},
+		Mutations: []FileMutation{
+			{Path: "keep.txt", Find: "missing", Replace: "x"},
+			{Path: "absent.txt", Find: "a", Replace: "b"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FilesWritten != 1 || result.MutationsApplied != 0 || len(result.Skipped) != 3 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if result.Summary != "Backend Architect updated workspace (files=1, mutations=0, skipped=3)" {
+		t.Fatalf("summary %q", result.Summary)
+	}
+	notes := strings.Join(result.Notes(), "\n")
+	for _, want := range []string{
+		"Skipped writing keep.txt: file exists and overwrite is false",
+		"Skipped mutation in keep.txt: find text not found",
+		"Skipped mutation in absent.txt: file does not exist",
+	} {
+		if !strings.Contains(notes, want) {
+			t.Fatalf("notes missing %q:\n%s", want, notes)
+		}
+	}
+}
+
+func TestCorrectiveRetryFixesSkippedMutation(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "app.js"), []byte("const port = 3000;\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	gen := &scriptedStreamer{responses: []*llm.Response{
+		{Text: `{"mutations":[{"path":"app.js","find":"const port = 3000;","replace":"const port = 8080;"}]}`},
+	}}
+	output := `{"mutations":[{"path":"app.js","find":"let port = 3000","replace":"let port = 8080"}]}`
+	correct := correctionRequester(context.Background(), gen, []llm.Message{{Role: llm.RoleUser, Content: "change the port"}}, output, dir)
+
+	p := newMessageProcessor(nil, nil)
+	plan, _ := parseActionPlan(output)
+	result, err := p.applyActionPlan(dir, "backend_architect", plan)
+	if err != nil || len(result.Skipped) != 1 {
+		t.Fatalf("expected one skipped mutation, got %+v (%v)", result, err)
+	}
+	result, note := p.applyCorrection(dir, "backend_architect", nil, result, correct)
+	if note != "Corrective retry fixed 1 of 1 skipped change(s)" || len(result.Skipped) != 0 || result.MutationsApplied != 1 {
+		t.Fatalf("unexpected retry outcome %q %+v", note, result)
+	}
+
+	prompt := gen.requests[0].Messages[len(gen.requests[0].Messages)-1].Content
+	if !strings.Contains(prompt, "Skipped mutation in app.js: find text not found") || !strings.Contains(prompt, "const port = 3000;") {
+		t.Fatalf("retry prompt lacks failure details or file contents:\n%s", prompt)
+	}
+	content, _ := os.ReadFile(filepath.Join(dir, "app.js"))
+	if string(content) != "const port = 8080;\n" {
+		t.Fatalf("file content %q", content)
+	}
+}
@@ -0,0 +1,240 @@
+package agents
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"replychat/src/projectfs"
+)
+
+// Run outcomes.
+const (
+	OutcomeSucceeded  = "succeeded"
+	OutcomeFailed     = "failed"
+	OutcomeNeedsInput = "needs_input"
+	OutcomePartial    = "partial"
+	OutcomeCancelled  = "cancelled"
+	// OutcomeInReview means the run's edits were staged as a change set and
+	// nothing is applied until a reviewer approves it.
+	OutcomeInReview = "in_review"
+)
+
+// RunOutcome is how an agent run ended. Error explains every outcome but
+// success.
+type RunOutcome struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func failedOutcome(err error) RunOutcome {
+	return RunOutcome{Status: OutcomeFailed, Error: err.Error()}
+}
+
+// TaskRetryPolicy decides how often a failed issue run is queued again.
+// The n-th retry waits Backoff * 2^(n-1), at most MaxBackoff.
+type TaskRetryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+// TaskRetryPolicyFromEnv reads TASK_MAX_ATTEMPTS (default 3),
+// TASK_RETRY_BACKOFF_SECONDS (default 30) and
+// TASK_RETRY_BACKOFF_MAX_SECONDS (default 600).
+func TaskRetryPolicyFromEnv() TaskRetryPolicy {
+	return TaskRetryPolicy{
+		MaxAttempts: max(1, contextSetting("TASK_MAX_ATTEMPTS", 3)),
+		Backoff:     time.Duration(contextSetting("TASK_RETRY_BACKOFF_SECONDS", 30)) * time.Second,
+		MaxBackoff:  time.Duration(contextSetting("TASK_RETRY_BACKOFF_MAX_SECONDS", 600)) * time.Second,
+	}
+}
+
+// delay returns how long to wait before the attempt after attempt.
+func (r TaskRetryPolicy) delay(attempt int) time.Duration {
+	d := r.Backoff
+	for i := 1; i < attempt && d < r.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, r.MaxBackoff)
+}
+
+// openDialogsSince returns the dialogs agentType opened in projectID since
+// start that are still waiting for an answer.
+func (p *MessageProcessor) openDialogsSince(projectID, agentType string, start time.Time) []string {
+	rows, err := p.db.Query(`
+		SELECT id FROM dialogs
+		WHERE project_id = ? AND agent_id = ? AND status = 'open' AND created_at >= ?
+	`, projectID, agentType, start)
+	if err != nil {
+		log.Printf("dialog: failed to look up open dialogs for %s: %v", agentType, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// dialogQuestions returns the title of each dialog in ids, or its message
+// when it has no title.
+func (p *MessageProcessor) dialogQuestions(ids []string) []string {
+	var questions []string
+	for _, id := range ids {
+		var question string
+		err := p.db.QueryRow(`SELECT COALESCE(NULLIF(title, ''), message, '') FROM dialogs WHERE id = ?`, id).Scan(&question)
+		if err != nil {
+			log.Printf("dialog: failed to load dialog %s: %v", id, err)
+			continue
+		}
+		if question != "" {
+			questions = append(questions, question)
+		}
+	}
+	return questions
+}
+
+// issueRunOutcome decides how a run on an issue ended. A staged change set
+// takes precedence over open dialogs: the issue goes to review, where
+// approving the change set completes it, and the dialogs stay open beside
+// it. Without a change set, open dialogs block the issue.
+func issueRunOutcome(applyErr error, dialogs int, staged bool, skipped int) RunOutcome {
+	switch {
+	case applyErr != nil:
+		return failedOutcome(applyErr)
+	case staged:
+		return RunOutcome{Status: OutcomeInReview, Error: "the changes are waiting for review"}
+	case dialogs > 0:
+		return RunOutcome{Status: OutcomeNeedsInput, Error: "waiting for the team to answer a dialog"}
+	case skipped > 0:
+		return RunOutcome{Status: OutcomePartial, Error: fmt.Sprintf("%d change(s) could not be applied", skipped)}
+	}
+	return RunOutcome{Status: OutcomeSucceeded}
+}
+
+// finishIssueRun moves issueID according to how the agent's run on it
+// ended. Only a successful run completes the issue. A partial run and one
+// whose edits wait in a change set go to review; approving the change set
+// completes the issue. One that asked the team a question is blocked until
+// the dialog is answered, and a failed run is queued again with backoff
+// until it runs out of attempts and is marked failed. A cancelled run goes
+// back to To Do without being queued. Issues moved by someone while the
+// agent worked are left alone.
+//
+// The dialogs the run opened are linked to the issue. When the issue goes
+// to review instead of being blocked, their questions are recorded in its
+// last error so the reviewer sees them.
+func (p *MessageProcessor) finishIssueRun(projectID, agentType, issueID, workspacePath string, outcome RunOutcome, dialogs []string) {
+	for _, id := range dialogs {
+		if _, linkErr := p.db.Exec(`UPDATE dialogs SET issue_id = ? WHERE id = ? AND COALESCE(issue_id, '') = ''`, issueID, id); linkErr != nil {
+			log.Printf("dialog: failed to link dialog %s to issue %s: %v", id, issueID, linkErr)
+		}
+	}
+
+	var err error
+	switch outcome.Status {
+	case OutcomeSucceeded:
+		err = p.completeIssue(projectID, issueID, "inProgress", workspacePath, agentType)
+	case OutcomePartial, OutcomeInReview:
+		note := outcome.Error
+		if questions := p.dialogQuestions(dialogs); len(questions) > 0 {
+			note += "; open questions: " + strings.Join(questions, "; ")
+		}
+		err = p.setIssueOutcome(issueID, "review", note)
+	case OutcomeCancelled:
+		err = p.setIssueOutcome(issueID, "todo", outcome.Error)
+	case OutcomeNeedsInput:
+		err = p.setIssueOutcome(issueID, "blocked", outcome.Error)
+	default:
+		err = p.retryOrFailIssue(issueID, agentType, outcome.Error, TaskRetryPolicyFromEnv())
+	}
+	if err != nil {
+		log.Printf("agent: failed to record %s outcome for issue %s: %v", outcome.Status, issueID, err)
+	}
+}
+
+// completeIssue marks issueID done if it is still in from and then pushes
+// the workspace, if the push policy asks for it after an issue.
+func (p *MessageProcessor) completeIssue(projectID, issueID, from, workspacePath, actorID string) error {
+	completed, err := p.markIssueCompleted(issueID, from)
+	if err == nil && completed && workspacePath != "" {
+		// Failures are logged and recorded in the project's activity.
+		PushWorkspace(p.db, p.publisher, projectID, workspacePath, projectfs.PushAfterIssue, actorID)
+	}
+	return err
+}
+
+// setIssueOutcome moves an in-progress issue to status with note as its
+// last error.
+func (p *MessageProcessor) setIssueOutcome(issueID, status, note string) error {
+	res, err := p.db.Exec(`
+		UPDATE issues
+		SET status = ?, last_error = ?, queued_agent_id = NULL, retry_at = NULL
+		WHERE id = ? AND status = 'inProgress'
+	`, status, note, issueID)
+	if err != nil {
+		return err
+	}
+	return p.publishIssueIfChanged(res, issueID)
+}
+
+// retryOrFailIssue counts a failed attempt on issueID and queues it for
+// agentType again after the policy's backoff, or marks it failed once the
+// attempts are used up.
+func (p *MessageProcessor) retryOrFailIssue(issueID, agentType, reason string, policy TaskRetryPolicy) error {
+	var attempts int
+	err := p.db.QueryRow(`SELECT COALESCE(attempts, 0) + 1 FROM issues WHERE id = ? AND status = 'inProgress'`, issueID).Scan(&attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var res sql.Result
+	if attempts < policy.MaxAttempts {
+		retryAt := now.Add(policy.delay(attempts))
+		log.Printf("agent: issue %s failed (attempt %d of %d), retrying at %s: %s", issueID, attempts, policy.MaxAttempts, retryAt.Format(time.RFC3339), reason)
+		res, err = p.db.Exec(`
+			UPDATE issues
+			SET status = 'todo', attempts = ?, last_error = ?, queued_agent_id = ?, queued_at = ?, retry_at = ?
+			WHERE id = ? AND status = 'inProgress'
+		`, attempts, reason, agentType, now, retryAt, issueID)
+	} else {
+		log.Printf("agent: issue %s failed after %d attempts: %s", issueID, attempts, reason)
+		res, err = p.db.Exec(`
+			UPDATE issues
+			SET status = 'failed', attempts = ?, last_error = ?, queued_agent_id = NULL, retry_at = NULL
+			WHERE id = ? AND status = 'inProgress'
+		`, attempts, reason, issueID)
+	}
+	if err != nil {
+		return err
+	}
+	return p.publishIssueIfChanged(res, issueID)
+}
+
+func (p *MessageProcessor) publishIssueIfChanged(res sql.Result, issueID string) error {
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return nil
+	}
+	issue, err := fetchIssueForBroadcast(p.db, issueID)
+	if err != nil {
+		return err
+	}
+	projectID, _ := issue["projectId"].(string)
+	p.publish(projectID, marshalEvent("issue.updated", map[string]interface{}{
+		"issue": issue,
+	}))
+	return nil
+}
@@ -0,0 +1,179 @@
+package agents
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/glebarez/go-sqlite"
+)
+
+func TestTaskRetryPolicyDelay(t *testing.T) {
+	policy := TaskRetryPolicy{MaxAttempts: 5, Backoff: 30 * time.Second, MaxBackoff: 2 * time.Minute}
+	for attempt, want := range map[int]time.Duration{
+		1: 30 * time.Second,
+		2: time.Minute,
+		3: 2 * time.Minute,
+		4: 2 * time.Minute,
+	} {
+		if got := policy.delay(attempt); got != want {
+			t.Errorf("delay(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+}
+
+// newTestIssueDB opens an in-memory database with the issues table.
+func newTestIssueDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`
+		CREATE TABLE issues (
+			id TEXT PRIMARY KEY,
+			project_id TEXT NOT NULL DEFAULT 'p1',
+			title TEXT NOT NULL DEFAULT '',
+			description TEXT NOT NULL DEFAULT '',
+			priority TEXT NOT NULL DEFAULT 'medium',
+			status TEXT NOT NULL,
+			created_by TEXT NOT NULL DEFAULT 'u1',
+			created_by_type TEXT NOT NULL DEFAULT 'user',
+			assigned_agent_id TEXT,
+			queued_agent_id TEXT,
+			queued_at TIMESTAMP,
+			started_at TIMESTAMP,
+			completed_at TIMESTAMP,
+			created_at TIMESTAMP,
+			branch TEXT,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			retry_at TIMESTAMP,
+			claimed_by TEXT,
+			lease_expires_at TIMESTAMP
+		)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testIssue is the part of an issue the status tests look at.
+type testIssue struct {
+	Status   string
+	Attempts int
+	Queued   string
+	RetryAt  bool
+}
+
+func loadTestIssue(t *testing.T, db *sql.DB, id string) testIssue {
+	t.Helper()
+	var issue testIssue
+	var queued sql.NullString
+	var retryAt sql.NullTime
+	if err := db.QueryRow(`SELECT status, attempts, queued_agent_id, retry_at FROM issues WHERE id = ?`, id).Scan(&issue.Status, &issue.Attempts, &queued, &retryAt); err != nil {
+		t.Fatal(err)
+	}
+	issue.Queued, issue.RetryAt = queued.String, retryAt.Valid
+	return issue
+}
+
+func TestFinishIssueRunMovesIssueByOutcome(t *testing.T) {
+	t.Setenv("TASK_MAX_ATTEMPTS", "3")
+	cases := []struct {
+		name     string
+		status   string
+		attempts int
+		outcome  RunOutcome
+		want     testIssue
+	}{
+		{"succeeded", "inProgress", 0, RunOutcome{Status: OutcomeSucceeded}, testIssue{Status: "done"}},
+		{"failed with attempts left", "inProgress", 1, RunOutcome{Status: OutcomeFailed, Error: "boom"}, testIssue{Status: "todo", Attempts: 2, Queued: "qa_tester", RetryAt: true}},
+		{"failed for the last time", "inProgress", 2, RunOutcome{Status: OutcomeFailed, Error: "boom"}, testIssue{Status: "failed", Attempts: 3}},
+		{"partial", "inProgress", 0, RunOutcome{Status: OutcomePartial, Error: "1 change(s) could not be applied"}, testIssue{Status: "review"}},
+		{"in review", "inProgress", 0, RunOutcome{Status: OutcomeInReview, Error: "the changes are waiting for review"}, testIssue{Status: "review"}},
+		{"needs input", "inProgress", 0, RunOutcome{Status: OutcomeNeedsInput, Error: "waiting"}, testIssue{Status: "blocked"}},
+		{"cancelled", "inProgress", 1, RunOutcome{Status: OutcomeCancelled, Error: "the run was cancelled"}, testIssue{Status: "todo", Attempts: 1}},
+		{"moved while running", "review", 0, RunOutcome{Status: OutcomeFailed, Error: "boom"}, testIssue{Status: "review"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestIssueDB(t)
+			if _, err := db.Exec(`INSERT INTO issues (id, status, assigned_agent_id, attempts) VALUES ('i1', ?, 'qa_tester', ?)`, tc.status, tc.attempts); err != nil {
+				t.Fatal(err)
+			}
+			p := newMessageProcessor(db, nil)
+			p.finishIssueRun("p1", "qa_tester", "i1", "", tc.outcome, nil)
+			if got := loadTestIssue(t, db, "i1"); got != tc.want {
+				t.Fatalf("issue = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStagedChangesTakePrecedenceOverDialogs(t *testing.T) {
+	outcome := issueRunOutcome(nil, 1, true, 0)
+	if outcome.Status != OutcomeInReview {
+		t.Fatalf("outcome = %+v, want %s", outcome, OutcomeInReview)
+	}
+
+	db := newTestIssueDB(t)
+	if _, err := db.Exec(`
+		CREATE TABLE dialogs (
+			id TEXT PRIMARY KEY,
+			project_id TEXT NOT NULL,
+			agent_id TEXT NOT NULL,
+			issue_id TEXT,
+			title TEXT,
+			message TEXT,
+			status TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO issues (id, status, assigned_agent_id) VALUES ('i1', 'inProgress', 'qa_tester')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO dialogs (id, project_id, agent_id, title, message, status, created_at) VALUES ('d1', 'p1', 'qa_tester', 'Which port?', 'Pick one', 'open', ?)`, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newMessageProcessor(db, nil)
+	p.finishIssueRun("p1", "qa_tester", "i1", "", outcome, []string{"d1"})
+	if got := loadTestIssue(t, db, "i1"); got.Status != "review" {
+		t.Fatalf("issue = %+v, want review", got)
+	}
+	var lastError, linked string
+	if err := db.QueryRow(`SELECT last_error FROM issues WHERE id = 'i1'`).Scan(&lastError); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(lastError, "Which port?") {
+		t.Fatalf("last error %q does not record the open question", lastError)
+	}
+	if err := db.QueryRow(`SELECT issue_id FROM dialogs WHERE id = 'd1'`).Scan(&linked); err != nil || linked != "i1" {
+		t.Fatalf("dialog linked to %q (%v), want i1", linked, err)
+	}
+}
+
+func TestCompleteIssueOnlyFromExpectedStatus(t *testing.T) {
+	db := newTestIssueDB(t)
+	if _, err := db.Exec(`INSERT INTO issues (id, status) VALUES ('reviewed', 'review'), ('reopened', 'todo')`); err != nil {
+		t.Fatal(err)
+	}
+	p := newMessageProcessor(db, nil)
+	for _, id := range []string{"reviewed", "reopened"} {
+		if err := p.completeIssue("p1", id, "review", "", "u1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := loadTestIssue(t, db, "reviewed").Status; got != "done" {
+		t.Errorf("approved issue in review is %s", got)
+	}
+	if got := loadTestIssue(t, db, "reopened").Status; got != "todo" {
+		t.Errorf("issue moved out of review is %s", got)
+	}
+}
@@ -0,0 +1,280 @@
+package agents
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// devNull marks the missing side of a file creation or deletion in a diff.
+const devNull = "/dev/null"
+
+// filePatch is one file's section of a unified diff.
+type filePatch struct {
+	OldPath string
+	NewPath string
+	Hunks   []patchHunk
+}
+
+// Creates reports whether the patch adds a new file.
+func (fp filePatch) Creates() bool { return fp.OldPath == devNull }
+
+// Deletes reports whether the patch removes the file.
+func (fp filePatch) Deletes() bool { return fp.NewPath == devNull }
+
+// Path is the file the patch produces, or the deleted file.
+func (fp filePatch) Path() string {
+	if fp.Deletes() {
+		return fp.OldPath
+	}
+	return fp.NewPath
+}
+
+type patchHunk struct {
+	Header   string
+	OldStart int
+	Lines    []patchLine
+	// OldNoNewline and NewNoNewline record "\ No newline at end of file"
+	// markers for each side.
+	OldNoNewline bool
+	NewNoNewline bool
+}
+
+type patchLine struct {
+	Op   byte // ' ', '-' or '+'
+	Text string
+}
+
+func (h patchHunk) oldLines() []string {
+	var lines []string
+	for _, l := range h.Lines {
+		if l.Op != '+' {
+			lines = append(lines, l.Text)
+		}
+	}
+	return lines
+}
+
+func (h patchHunk) newLines() []string {
+	var lines []string
+	for _, l := range h.Lines {
+		if l.Op != '-' {
+			lines = append(lines, l.Text)
+		}
+	}
+	return lines
+}
+
+// parseUnifiedDiff splits a unified diff into per-file patches. Hunk line
+// counts are not trusted, since models often get them wrong; a hunk runs
+// until the next hunk or file header.
+func parseUnifiedDiff(diff string) ([]filePatch, error) {
+	lines := strings.Split(strings.ReplaceAll(diff, "\r\n", "\n"), "\n")
+	var patches []filePatch
+	var current *filePatch
+	var hunk *patchHunk
+
+	flushHunk := func() {
+		if hunk != nil && current != nil {
+			current.Hunks = append(current.Hunks, *hunk)
+		}
+		hunk = nil
+	}
+	flushFile := func() {
+		flushHunk()
+		if current != nil {
+			patches = append(patches, *current)
+		}
+		current = nil
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			flushFile()
+			current = &filePatch{
+				OldPath: diffPath(line[4:]),
+				NewPath: diffPath(lines[i+1][4:]),
+			}
+			i++
+		case strings.HasPrefix(line, "@@"):
+			if current == nil {
+				return nil, errors.New("hunk before any file header")
+			}
+			flushHunk()
+			oldStart, err := parseHunkHeader(line)
+			if err != nil {
+				return nil, err
+			}
+			hunk = &patchHunk{Header: line, OldStart: oldStart}
+		case hunk != nil && strings.HasPrefix(line, `\`):
+			if n := len(hunk.Lines); n > 0 {
+				switch hunk.Lines[n-1].Op {
+				case '-':
+					hunk.OldNoNewline = true
+				case '+':
+					hunk.NewNoNewline = true
+				default:
+					hunk.OldNoNewline, hunk.NewNoNewline = true, true
+				}
+			}
+		case hunk != nil && line != "" && (line[0] == ' ' || line[0] == '-' || line[0] == '+'):
+			hunk.Lines = append(hunk.Lines, patchLine{Op: line[0], Text: line[1:]})
+		case hunk != nil && line == "" && i+1 < len(lines) && isHunkBody(lines[i+1]):
+			// Some generators drop the space on empty context lines.
+			hunk.Lines = append(hunk.Lines, patchLine{Op: ' '})
+		default:
+			// "diff --git", "index" and other extended headers end the
+			// current hunk but carry nothing we need.
+			flushHunk()
+		}
+	}
+	flushFile()
+
+	if len(patches) == 0 {
+		return nil, errors.New("no file headers found")
+	}
+	for _, fp := range patches {
+		if fp.OldPath == devNull && fp.NewPath == devNull {
+			return nil, errors.New("patch has no file path")
+		}
+		if len(fp.Hunks) == 0 && !fp.Deletes() {
+			return nil, fmt.Errorf("patch for %s has no hunks", fp.Path())
+		}
+	}
+	return patches, nil
+}
+
+func isHunkBody(line string) bool {
+	if strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "+++ ") {
+		return false
+	}
+	return line == "" || line[0] == ' ' || line[0] == '-' || line[0] == '+'
+}
+
+// diffPath strips the a/ or b/ prefix and any trailing timestamp from a
+// ---/+++ header path.
+func diffPath(raw string) string {
+	if idx := strings.Index(raw, "\t"); idx >= 0 {
+		raw = raw[:idx]
+	}
+	raw = strings.TrimSpace(raw)
+	if raw == devNull {
+		return raw
+	}
+	if strings.HasPrefix(raw, "a/") || strings.HasPrefix(raw, "b/") {
+		raw = raw[2:]
+	}
+	return raw
+}
+
+// parseHunkHeader returns the old-side start line of "@@ -l,s +l,s @@".
+func parseHunkHeader(header string) (int, error) {
+	fields := strings.Fields(header)
+	if len(fields) < 3 || !strings.HasPrefix(fields[1], "-") {
+		return 0, fmt.Errorf("malformed hunk header %q", header)
+	}
+	start := strings.TrimPrefix(fields[1], "-")
+	if idx := strings.Index(start, ","); idx >= 0 {
+		start = start[:idx]
+	}
+	n, err := strconv.Atoi(start)
+	if err != nil {
+		return 0, fmt.Errorf("malformed hunk header %q", header)
+	}
+	return n, nil
+}
+
+// hunkConflict is a hunk whose context could not be found.
+type hunkConflict struct {
+	Index  int
+	Header string
+}
+
+// applyHunks applies hunks to content, searching outward from each hunk's
+// stated position so earlier edits or a stale line number do not matter.
+// Context is compared exactly first, then ignoring trailing whitespace.
+// Hunks that do not match are returned as conflicts and the rest are still
+// applied, like git apply --reject.
+func applyHunks(content string, hunks []patchHunk) (string, []hunkConflict) {
+	endsWithNewline := content == "" || strings.HasSuffix(content, "\n")
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if content == "" {
+		lines = nil
+	}
+
+	var conflicts []hunkConflict
+	offset := 0
+	floor := 0
+	for i, h := range hunks {
+		old := h.oldLines()
+		expected := h.OldStart - 1 + offset
+		if len(old) == 0 {
+			// Pure insertions name the line they follow.
+			expected = h.OldStart + offset
+		}
+		pos := findHunk(lines, old, expected, floor)
+		if pos < 0 {
+			conflicts = append(conflicts, hunkConflict{Index: i + 1, Header: h.Header})
+			continue
+		}
+
+		replacement := h.newLines()
+		touchesEnd := pos+len(old) == len(lines)
+		updated := make([]string, 0, len(lines)-len(old)+len(replacement))
+		updated = append(updated, lines[:pos]...)
+		updated = append(updated, replacement...)
+		updated = append(updated, lines[pos+len(old):]...)
+		lines = updated
+
+		offset += len(replacement) - len(old)
+		floor = pos + len(replacement)
+		if touchesEnd {
+			endsWithNewline = !h.NewNoNewline
+		}
+	}
+
+	out := strings.Join(lines, "\n")
+	if endsWithNewline && len(lines) > 0 {
+		out += "\n"
+	}
+	return out, conflicts
+}
+
+// findHunk returns where old occurs in lines at or after floor, preferring
+// the position nearest to expected, or -1.
+func findHunk(lines, old []string, expected, floor int) int {
+	last := len(lines) - len(old)
+	if last < floor {
+		return -1
+	}
+	expected = min(max(expected, floor), last)
+	for _, equal := range []func(a, b string) bool{
+		func(a, b string) bool { return a == b },
+		func(a, b string) bool { return strings.TrimRight(a, " \t\r") == strings.TrimRight(b, " \t\r") },
+	} {
+		for delta := 0; expected-delta >= floor || expected+delta <= last; delta++ {
+			candidates := []int{expected - delta}
+			if delta > 0 {
+				candidates = append(candidates, expected+delta)
+			}
+			for _, pos := range candidates {
+				if pos >= floor && pos <= last && linesMatch(lines[pos:pos+len(old)], old, equal) {
+					return pos
+				}
+			}
+		}
+	}
+	return -1
+}
+
+func linesMatch(have, want []string, equal func(a, b string) bool) bool {
+	for i := range want {
+		if !equal(have[i], want[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package agents
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyHunksToleratesOffsets(t *testing.T) {
+	content := "header\nextra\nextra\none\ntwo\nthree\nfour\nfive\n"
+	diff := `--- a/f.txt
++++ b/f.txt
+@@ -1,3 +1,3 @@
+ one
+-two
++TWO
+ three
+@@ -4,2 +4,3 @@
+ four
++four and a half
+ five
+`
+	patches, err := parseUnifiedDiff(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 1 || patches[0].Path() != "f.txt" || len(patches[0].Hunks) != 2 {
+		t.Fatalf("unexpected parse %+v", patches)
+	}
+	got, conflicts := applyHunks(content, patches[0].Hunks)
+	if len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts %+v", conflicts)
+	}
+	want := "header\nextra\nextra\none\nTWO\nthree\nfour\nfour and a half\nfive\n"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestApplyHunksReportsConflictsPerHunk(t *testing.T) {
+	content := "a\nb\nc\nd\n"
+	diff := "--- a/f\n+++ b/f\n@@ -1,2 +1,2 @@\n-a\n+A\n b\n@@ -3,1 +3,1 @@\n-x\n+X\n"
+	patches, err := parseUnifiedDiff(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, conflicts := applyHunks(content, patches[0].Hunks)
+	if got != "A\nb\nc\nd\n" {
+		t.Fatalf("matching hunk should still apply, got %q", got)
+	}
+	if len(conflicts) != 1 || conflicts[0].Index != 2 || conflicts[0].Header != "@@ -3,1 +3,1 @@" {
+		t.Fatalf("unexpected conflicts %+v", conflicts)
+	}
+}
+
+func TestApplyHunksNoNewlineAtEnd(t *testing.T) {
+	diff := "--- a/f\n+++ b/f\n@@ -1 +1 @@\n-last\n\\ No newline at end of file\n+last line\n\\ No newline at end of file\n"
+	patches, err := parseUnifiedDiff(diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := applyHunks("last", patches[0].Hunks); got != "last line" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestApplyActionPlanPatchesAndFileOperations(t *testing.T) {
+	dir := t.TempDir()
+	write := func(rel, content string) {
+		t.Helper()
+		abs := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(abs, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("main.go", "package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n")
+	write("old.txt", "moved\n")
+	write("run.sh", "#!/bin/sh\n")
+	write("tmp/junk.txt", "junk\n")
+
+	p := newMessageProcessor(nil, nil)
+	result, err := p.applyActionPlan(dir, "backend_architect", AgentActionPlan{
+		Patches: []string{
+			"--- a/main.go\n+++ b/main.go\n@@ -3,3 +3,3 @@\n func main() {\n-\tprintln(\"hi\")\n+\tprintln(\"hello\")\n }\n" +
+				"--- /dev/null\n+++ b/docs/new.md\n@@ -0,0 +1,2 @@\n+# New\n+text\n",
+			"--- a/main.go\n+++ b/main.go\n@@ -1 +1 @@\n-package nope\n+package yes\n",
+		},
+		Renames: []FileRename{{From: "old.txt", To: "new/place.txt"}},
+		Chmods:  []FileChmod{{Path: "run.sh", Mode: "+x"}},
+		Deletes: []string{"tmp"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.PatchesApplied != 2 || result.Renamed != 1 || result.Chmodded != 1 || result.Deleted != 1 {
+		t.Fatalf("unexpected counts %+v", result)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0].Kind != "patch" || !strings.Contains(result.Skipped[0].Reason, "hunk 1") {
+		t.Fatalf("expected one conflicting hunk, got %+v", result.Skipped)
+	}
+	if !strings.Contains(result.Summary, "patches=2, renamed=1, chmod=1, deleted=1, skipped=1") {
+		t.Fatalf("summary %q", result.Summary)
+	}
+
+	main, _ := os.ReadFile(filepath.Join(dir, "main.go"))
+	if !strings.Contains(string(main), `println("hello")`) {
+		t.Fatalf("main.go not patched: %q", main)
+	}
+	if doc, _ := os.ReadFile(filepath.Join(dir, "docs", "new.md")); string(doc) != "# New\ntext\n" {
+		t.Fatalf("new file content %q", doc)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new", "place.txt")); err != nil {
+		t.Fatalf("rename missing: %v", err)
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "run.sh")); info.Mode().Perm() != 0o755 {
+		t.Fatalf("run.sh mode %v", info.Mode().Perm())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tmp")); !os.IsNotExist(err) {
+		t.Fatalf("tmp should be deleted: %v", err)
+	}
+}
+
+func TestFileOperationsStayInsideWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	sibling := dir + "-sibling"
+	if err := os.MkdirAll(sibling, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sibling)
+	outside := filepath.Join(sibling, "secret.txt")
+	if err := os.WriteFile(outside, []byte("secret\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(sibling, filepath.Join(dir, "out")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newMessageProcessor(nil, nil)
+	for _, plan := range []AgentActionPlan{
+		{Deletes: []string{"../" + filepath.Base(sibling)}},
+		{Deletes: []string{".git/config"}},
+		{Renames: []FileRename{{From: "a", To: "../outside"}}},
+		{Patches: []string{"--- a/../../etc/passwd\n+++ b/../../etc/passwd\n@@ -1 +1 @@\n-x\n+y\n"}},
+		{Files: []GeneratedFile{{Path: ".git/config", Content: "[core]\n"}}},
+		{Files: []GeneratedFile{{Path: "link.txt", Content: "pwned\n"}}},
+		{Files: []GeneratedFile{{Path: "out/secret.txt", Content: "pwned\n"}}},
+		{Files: []GeneratedFile{{Path: "out/new/file.txt", Content: "pwned\n"}}},
+		{Mutations: []FileMutation{{Path: "link.txt", Find: "secret", Replace: "pwned"}}},
+		{Mutations: []FileMutation{{Path: ".git/config", Find: "[core]", Replace: "[core]\n\tfsmonitor = true"}}},
+		{Patches: []string{"--- a/link.txt\n+++ b/link.txt\n@@ -1 +1 @@\n-secret\n+pwned\n"}},
+	} {
+		if _, err := p.applyActionPlan(dir, "backend_architect", plan); err == nil {
+			t.Fatalf("plan %+v should be rejected", plan)
+		}
+	}
+	if _, err := os.Stat(sibling); err != nil {
+		t.Fatalf("sibling directory was touched: %v", err)
+	}
+	if data, _ := os.ReadFile(outside); string(data) != "secret\n" {
+		t.Fatalf("file outside the workspace was written: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(sibling, "new")); !os.IsNotExist(err) {
+		t.Fatalf("directory created outside the workspace: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); !os.IsNotExist(err) {
+		t.Fatalf(".git was written: %v", err)
+	}
+}
@@ -0,0 +1,356 @@
+package agents
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"replychat/src/llm"
+)
+
+// Reasons a task pool turns a task away. The task stays queued and is
+// offered again on the next tick.
+var (
+	ErrPoolFull          = errors.New("every task worker is busy")
+	ErrProjectBusy       = errors.New("the project is running as many tasks as it may")
+	ErrAgentBusy         = errors.New("the agent is running as many tasks as it may")
+	ErrAgentOnIssue      = errors.New("the agent is already working on an issue in this project")
+	ErrProviderSaturated = errors.New("the model provider is saturated")
+)
+
+// ErrRunCancelled is the cause of a run stopped on request. Wrap it to say
+// who stopped the run.
+var ErrRunCancelled = errors.New("the run was cancelled")
+
+// PoolLimits caps how many queued tasks run at once. Zero or negative
+// PerProject, PerAgent and PerProvider values mean no cap beyond Workers.
+// Whatever the limits, an agent works on one issue at a time per project.
+type PoolLimits struct {
+	// Workers bounds task runs across all projects.
+	Workers int
+	// PerProject bounds task runs within one project.
+	PerProject int
+	// PerAgent bounds runs of one agent type across projects.
+	PerAgent int
+	// PerProvider bounds agent runs, chat replies included, waiting on one
+	// LLM provider.
+	PerProvider int
+}
+
+// DefaultPoolLimits returns the limits used when nothing is configured.
+func DefaultPoolLimits() PoolLimits {
+	return PoolLimits{Workers: 4, PerProject: 2, PerAgent: 2, PerProvider: 4}
+}
+
+// PoolLimitsFromEnv reads TASK_WORKERS, TASK_CONCURRENCY_PER_PROJECT,
+// TASK_CONCURRENCY_PER_AGENT and TASK_CONCURRENCY_PER_PROVIDER over the
+// defaults.
+func PoolLimitsFromEnv() PoolLimits {
+	def := DefaultPoolLimits()
+	return PoolLimits{
+		Workers:     max(1, contextSetting("TASK_WORKERS", def.Workers)),
+		PerProject:  contextSetting("TASK_CONCURRENCY_PER_PROJECT", def.PerProject),
+		PerAgent:    contextSetting("TASK_CONCURRENCY_PER_AGENT", def.PerAgent),
+		PerProvider: contextSetting("TASK_CONCURRENCY_PER_PROVIDER", def.PerProvider),
+	}
+}
+
+// Run is one agent invocation in flight: a queued task or a chat reply.
+type Run struct {
+	ID        string    `json:"id"`
+	ProjectID string    `json:"projectId"`
+	AgentType string    `json:"agentType"`
+	IssueID   string    `json:"issueId,omitempty"`
+	Provider  string    `json:"provider,omitempty"`
+	StartedAt time.Time `json:"startedAt"`
+
+	// task marks runs started by a TaskPool, which count against its
+	// limits; chat replies only count against the provider limit.
+	task bool
+	// cancel stops the run's context.
+	cancel context.CancelCauseFunc
+}
+
+type runKey struct{}
+
+// newRunContext returns the context run works under, which carries its ID
+// and is cancelled through run.cancel.
+func newRunContext(run *Run) context.Context {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	run.cancel = cancel
+	return context.WithValue(ctx, runKey{}, run)
+}
+
+// runIDFromContext returns the ID of the run ctx belongs to, if any.
+func runIDFromContext(ctx context.Context) string {
+	if run, ok := ctx.Value(runKey{}).(*Run); ok {
+		return run.ID
+	}
+	return ""
+}
+
+// runRegistry tracks every run in flight in this process.
+type runRegistry struct {
+	mu   sync.Mutex
+	runs map[string]*Run
+}
+
+var activeRuns = &runRegistry{runs: map[string]*Run{}}
+
+// add registers run under a fresh ID unless admit, called with the registry
+// locked, refuses it.
+func (r *runRegistry) add(run *Run, admit func(runs map[string]*Run) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if admit != nil {
+		if err := admit(r.runs); err != nil {
+			return err
+		}
+	}
+	run.ID = uuid.New().String()
+	run.StartedAt = time.Now()
+	r.runs[run.ID] = run
+	return nil
+}
+
+func (r *runRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.runs, id)
+}
+
+// RunSelector picks runs within a project. Empty fields match every run.
+type RunSelector struct {
+	RunID     string
+	AgentType string
+	IssueID   string
+}
+
+func (s RunSelector) matches(run *Run) bool {
+	return (s.RunID == "" || run.ID == s.RunID) &&
+		(s.AgentType == "" || run.AgentType == s.AgentType) &&
+		(s.IssueID == "" || run.IssueID == s.IssueID)
+}
+
+// cancel stops the runs in projectID that sel matches with cause and
+// returns them.
+func (r *runRegistry) cancel(projectID string, sel RunSelector, cause error) []Run {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var cancelled []Run
+	for _, run := range r.runs {
+		if run.ProjectID != projectID || !sel.matches(run) || run.cancel == nil {
+			continue
+		}
+		run.cancel(cause)
+		cancelled = append(cancelled, *run)
+	}
+	return cancelled
+}
+
+// CancelRuns stops the runs in flight in projectID that sel matches. cause,
+// which should wrap ErrRunCancelled, is what the runs report. The stopped
+// runs are returned.
+func CancelRuns(projectID string, sel RunSelector, cause error) []Run {
+	return activeRuns.cancel(projectID, sel, cause)
+}
+
+// ActiveRuns lists the runs in flight for projectID, or for every project
+// when projectID is empty, oldest first.
+func ActiveRuns(projectID string) []Run {
+	activeRuns.mu.Lock()
+	runs := make([]Run, 0, len(activeRuns.runs))
+	for _, run := range activeRuns.runs {
+		if projectID == "" || run.ProjectID == projectID {
+			runs = append(runs, *run)
+		}
+	}
+	activeRuns.mu.Unlock()
+
+	sort.Slice(runs, func(i, j int) bool { return runs[i].StartedAt.Before(runs[j].StartedAt) })
+	return runs
+}
+
+// trackRun registers a chat reply for the duration of fn, which gets the
+// run's context.
+func (p *MessageProcessor) trackRun(projectID, agentType string, fn func(ctx context.Context)) {
+	run := &Run{ProjectID: projectID, AgentType: agentType, Provider: p.primaryProvider(projectID, agentType)}
+	ctx := newRunContext(run)
+	activeRuns.add(run, nil)
+	defer func() {
+		activeRuns.remove(run.ID)
+		run.cancel(nil)
+	}()
+	fn(ctx)
+}
+
+// primaryProvider returns the first provider agentType's chain will try in
+// projectID.
+func (p *MessageProcessor) primaryProvider(projectID, agentType string) string {
+	if providers := llm.NewChain(p.modelConfig(projectID, agentType), nil).Providers(); len(providers) > 0 {
+		return providers[0]
+	}
+	return ""
+}
+
+// Task is a queued issue for an agent to work on.
+type Task struct {
+	ProjectID  string
+	AgentType  string
+	IssueID    string
+	IssueTitle string
+	Prompt     string
+}
+
+// TaskPool runs queued tasks on a bounded number of workers. Callers
+// Reserve a slot before claiming a task, so a task is only taken off the
+// queue when it can start right away.
+type TaskPool struct {
+	limits   PoolLimits
+	registry *runRegistry
+
+	// providers returns the providers a task's chain would try, primary
+	// first.
+	providers func(projectID, agentType string) []string
+	allows    func(provider string) bool
+	run       func(ctx context.Context, task Task)
+
+	wg sync.WaitGroup
+}
+
+// NewTaskPool returns a pool that runs tasks with limits.
+func NewTaskPool(db *sql.DB, publisher Publisher, limits PoolLimits) *TaskPool {
+	processor := newMessageProcessor(db, publisher)
+	return &TaskPool{
+		limits:   limits,
+		registry: activeRuns,
+		providers: func(projectID, agentType string) []string {
+			return llm.NewChain(processor.modelConfig(projectID, agentType), nil).Providers()
+		},
+		allows: llm.BreakerAllows,
+		run: func(ctx context.Context, task Task) {
+			processor.generateAgentResponse(ctx, task.ProjectID, task.AgentType, task.IssueID, task.IssueTitle, task.Prompt)
+		},
+	}
+}
+
+// Limits returns the pool's limits.
+func (p *TaskPool) Limits() PoolLimits {
+	return p.limits
+}
+
+// Reservation holds a worker slot for a task until it is started or
+// released.
+type Reservation struct {
+	pool *TaskPool
+	run  *Run
+	ctx  context.Context
+}
+
+// Reserve takes a worker slot for agentType in projectID, or explains with
+// one of the pool's errors why the task has to wait.
+func (p *TaskPool) Reserve(projectID, agentType, issueID string) (*Reservation, error) {
+	providers := p.providers(projectID, agentType)
+	run := &Run{ProjectID: projectID, AgentType: agentType, IssueID: issueID, task: true}
+	if len(providers) > 0 {
+		run.Provider = providers[0]
+	}
+	if err := p.providerAvailable(providers); err != nil {
+		return nil, err
+	}
+	ctx := newRunContext(run)
+
+	err := p.registry.add(run, func(runs map[string]*Run) error {
+		var workers, project, agent, provider int
+		for _, other := range runs {
+			if other.Provider != "" && other.Provider == run.Provider {
+				provider++
+			}
+			if !other.task {
+				continue
+			}
+			workers++
+			if other.ProjectID == projectID {
+				project++
+				if other.AgentType == agentType && other.IssueID != "" && issueID != "" {
+					return ErrAgentOnIssue
+				}
+			}
+			if other.AgentType == agentType {
+				agent++
+			}
+		}
+		switch {
+		case workers >= p.limits.Workers:
+			return ErrPoolFull
+		case p.limits.PerProject > 0 && project >= p.limits.PerProject:
+			return ErrProjectBusy
+		case p.limits.PerAgent > 0 && agent >= p.limits.PerAgent:
+			return ErrAgentBusy
+		case p.limits.PerProvider > 0 && run.Provider != "" && provider >= p.limits.PerProvider:
+			return fmt.Errorf("%w: %s has %d runs in flight", ErrProviderSaturated, run.Provider, provider)
+		}
+		return nil
+	})
+	if err != nil {
+		run.cancel(nil)
+		return nil, err
+	}
+	return &Reservation{pool: p, run: run, ctx: ctx}, nil
+}
+
+// providerAvailable refuses tasks when the circuit of every provider in the
+// chain is open, since the run could only fail.
+func (p *TaskPool) providerAvailable(providers []string) error {
+	for _, name := range providers {
+		if p.allows(name) {
+			return nil
+		}
+	}
+	if len(providers) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: every provider's circuit is open", ErrProviderSaturated)
+}
+
+// Release gives the slot back without running anything.
+func (r *Reservation) Release() {
+	r.pool.registry.remove(r.run.ID)
+	r.run.cancel(nil)
+}
+
+// Start runs task on the reserved slot and calls done, if set, when it
+// finishes. The slot is released before done runs.
+func (r *Reservation) Start(task Task, done func()) {
+	p := r.pool
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.run(r.ctx, task)
+		r.Release()
+		if done != nil {
+			done()
+		}
+	}()
+}
+
+// Wait blocks until every started task has finished or ctx is done.
+func (p *TaskPool) Wait(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,144 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testPool(limits PoolLimits, run func(context.Context, Task)) *TaskPool {
+	return &TaskPool{
+		limits:    limits,
+		registry:  &runRegistry{runs: map[string]*Run{}},
+		providers: func(projectID, agentType string) []string { return []string{"openai", "local"} },
+		allows:    func(string) bool { return true },
+		run:       run,
+	}
+}
+
+func TestTaskPoolLimits(t *testing.T) {
+	pool := testPool(PoolLimits{Workers: 4, PerProject: 2, PerAgent: 2}, nil)
+
+	reserve := func(projectID, agentType, issueID string) error {
+		_, err := pool.Reserve(projectID, agentType, issueID)
+		return err
+	}
+	if err := reserve("p1", "backend_architect", "i1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reserve("p1", "backend_architect", "i2"); !errors.Is(err, ErrAgentOnIssue) {
+		t.Fatalf("second issue for the same agent and project: %v", err)
+	}
+	if err := reserve("p1", "frontend_developer", "i3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reserve("p1", "product_manager", "i4"); !errors.Is(err, ErrProjectBusy) {
+		t.Fatalf("third run in p1: %v", err)
+	}
+	if err := reserve("p2", "backend_architect", "i5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reserve("p3", "backend_architect", "i6"); !errors.Is(err, ErrAgentBusy) {
+		t.Fatalf("third backend run: %v", err)
+	}
+	if err := reserve("p3", "product_manager", "i7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reserve("p4", "frontend_developer", "i8"); !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("fourth run overall: %v", err)
+	}
+}
+
+func TestTaskPoolProviderBackpressure(t *testing.T) {
+	pool := testPool(PoolLimits{Workers: 10, PerProvider: 2}, nil)
+
+	// Chat replies count against the provider but not the workers.
+	chat := &Run{ProjectID: "p1", AgentType: "product_manager", Provider: "openai"}
+	pool.registry.add(chat, nil)
+	if _, err := pool.Reserve("p1", "backend_architect", "i1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Reserve("p2", "backend_architect", "i2"); !errors.Is(err, ErrProviderSaturated) {
+		t.Fatalf("provider at its limit: %v", err)
+	}
+	pool.registry.remove(chat.ID)
+	if _, err := pool.Reserve("p2", "backend_architect", "i2"); err != nil {
+		t.Fatal(err)
+	}
+
+	pool.allows = func(string) bool { return false }
+	if _, err := pool.Reserve("p3", "backend_architect", "i3"); !errors.Is(err, ErrProviderSaturated) {
+		t.Fatalf("every circuit open: %v", err)
+	}
+}
+
+func TestTaskPoolReleasesSlotWhenRunFinishes(t *testing.T) {
+	release := make(chan struct{})
+	pool := testPool(PoolLimits{Workers: 1}, func(context.Context, Task) { <-release })
+
+	reservation, err := pool.Reserve("p1", "backend_architect", "i1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	reservation.Start(Task{ProjectID: "p1", AgentType: "backend_architect", IssueID: "i1"}, func() { close(done) })
+
+	if _, err := pool.Reserve("p1", "frontend_developer", "i2"); !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("slot should be taken while the run is in flight: %v", err)
+	}
+	close(release)
+	<-done
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pool.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Reserve("p1", "frontend_developer", "i2"); err != nil {
+		t.Fatalf("slot should be free after the run: %v", err)
+	}
+}
+
+func TestCancelRunsStopsTheRunsContext(t *testing.T) {
+	stopped := make(chan error, 2)
+	pool := testPool(PoolLimits{Workers: 2}, func(ctx context.Context, task Task) {
+		<-ctx.Done()
+		stopped <- context.Cause(ctx)
+	})
+	for _, task := range []Task{
+		{ProjectID: "p1", AgentType: "backend_architect", IssueID: "i1"},
+		{ProjectID: "p1", AgentType: "qa_tester", IssueID: "i2"},
+	} {
+		reservation, err := pool.Reserve(task.ProjectID, task.AgentType, task.IssueID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reservation.Start(task, nil)
+	}
+
+	cause := fmt.Errorf("%w by Ada", ErrRunCancelled)
+	if runs := pool.registry.cancel("p2", RunSelector{AgentType: "qa_tester"}, cause); len(runs) != 0 {
+		t.Fatalf("cancelled runs of another project: %+v", runs)
+	}
+	runs := pool.registry.cancel("p1", RunSelector{AgentType: "qa_tester"}, cause)
+	if len(runs) != 1 || runs[0].IssueID != "i2" {
+		t.Fatalf("expected the qa_tester run, got %+v", runs)
+	}
+	if err := <-stopped; !errors.Is(err, ErrRunCancelled) || err.Error() != "the run was cancelled by Ada" {
+		t.Fatalf("run stopped with %v", err)
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("the other run stopped too: %v", err)
+	default:
+	}
+
+	pool.registry.cancel("p1", RunSelector{}, cause)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pool.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
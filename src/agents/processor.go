@@ -6,26 +6,28 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"replychat/src/llm"
 	"replychat/src/monitoring"
 	"replychat/src/projectfs"
 
 	"github.com/google/uuid"
-	openai "github.com/openai/openai-go/v3"
-	"github.com/openai/openai-go/v3/option"
-	"github.com/openai/openai-go/v3/responses"
 )
 
+// Publisher delivers marshalled events to the clients subscribed to a project.
+type Publisher interface {
+	Publish(projectID string, data []byte)
+}
+
 type MessageProcessor struct {
 	db        *sql.DB
-	broadcast chan<- []byte
-	aiClient  *openai.Client
-	localLLM  *LocalLLM
+	publisher Publisher
 }
 
 type AgentResponse struct {
@@ -33,10 +35,18 @@ type AgentResponse struct {
 	Payload map[string]interface{} `json:"payload"`
 }
 
+// AgentActionPlan is the set of workspace changes an agent asks for. They
+// are applied in field order: files, mutations, patches, renames, chmods and
+// finally deletes.
 type AgentActionPlan struct {
 	Files     []GeneratedFile `json:"files"`
 	Mutations []FileMutation  `json:"mutations"`
-	Notes     []string        `json:"notes"`
+	// Patches are unified diffs, each covering one or more files.
+	Patches []string     `json:"patches,omitempty"`
+	Renames []FileRename `json:"renames,omitempty"`
+	Chmods  []FileChmod  `json:"chmods,omitempty"`
+	Deletes []string     `json:"deletes,omitempty"`
+	Notes   []string     `json:"notes"`
 }
 
 type GeneratedFile struct {
@@ -70,8 +80,13 @@ Schema: {
   "mutations": [
     {"path": "relative/path.ext", "find": "exact substring to replace", "replace": "new text"}
   ],
+  "patches": ["--- a/relative/path.ext\n+++ b/relative/path.ext\n@@ -10,3 +10,4 @@\n context\n-old line\n+new line\n+added line\n context"],
+  "renames": [{"from": "old/path.ext", "to": "new/path.ext"}],
+  "chmods": [{"path": "scripts/run.sh", "mode": "755"}],
+  "deletes": ["obsolete/file.ext"],
   "notes": ["short status strings"]
 }
+Prefer a unified diff in "patches" for several edits to one file. Omit fields you do not need.
 Paths must stay inside the assigned project workspace. Do not wrap JSON in code fences or add commentary.
 
 When you need to collaborate or create workflow artifacts, emit the following structured blocks verbatim (outside of the JSON plan):
@@ -99,38 +114,37 @@ tags: backend, auth, security
 assignee: Backend Architect
 ---`
 
-func ProcessMessage(db *sql.DB, broadcast chan<- []byte, projectID, content, userID string) {
-	processor := newMessageProcessor(db, broadcast)
+func ProcessMessage(db *sql.DB, publisher Publisher, projectID, content, userID string) {
+	processor := newMessageProcessor(db, publisher)
 	processor.analyzeAndRespond(projectID, content, userID)
 }
 
-func ProcessAgentTask(db *sql.DB, broadcast chan<- []byte, projectID, agentType, issueID, issueTitle, content string) {
-	if agentType == "" || content == "" {
-		return
+func newMessageProcessor(db *sql.DB, publisher Publisher) *MessageProcessor {
+	return &MessageProcessor{
+		db:        db,
+		publisher: publisher,
 	}
-	processor := newMessageProcessor(db, broadcast)
-	go processor.generateAgentResponse(projectID, agentType, issueID, issueTitle, content)
 }
 
-func newMessageProcessor(db *sql.DB, broadcast chan<- []byte) *MessageProcessor {
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	var client *openai.Client
-	if apiKey != "" {
-		newClient := openai.NewClient(option.WithAPIKey(apiKey))
-		client = &newClient
-	}
-
-	localLLM, err := getLocalLLM()
+// modelConfig returns the LLM selection for agentType in projectID, falling
+// back to the server defaults when the project has none.
+func (p *MessageProcessor) modelConfig(projectID, agentType string) llm.ModelConfig {
+	settings, err := projectfs.LoadSettings(p.db, projectID)
 	if err != nil {
-		log.Printf("agent: local LLM initialization failed: %v", err)
+		log.Printf("agent: failed to load settings for project %s: %v", projectID, err)
+		return llm.ModelConfig{}
 	}
+	return settings.ModelFor(agentType)
+}
 
-	return &MessageProcessor{
-		db:        db,
-		broadcast: broadcast,
-		aiClient:  client,
-		localLLM:  localLLM,
+// reviewChanges reports whether projectID holds agent changes for review.
+func (p *MessageProcessor) reviewChanges(projectID string) bool {
+	settings, err := projectfs.LoadSettings(p.db, projectID)
+	if err != nil {
+		log.Printf("agent: failed to load settings for project %s: %v", projectID, err)
+		return false
 	}
+	return settings.ReviewChanges
 }
 
 func (p *MessageProcessor) analyzeAndRespond(projectID, content, userID string) {
@@ -139,15 +153,34 @@ func (p *MessageProcessor) analyzeAndRespond(projectID, content, userID string)
 		return
 	}
 
-	go p.generateAgentResponse(projectID, agent, "", "", content)
+	p.runAgent(projectID, agent, content)
+}
+
+// RunAgent has agentType answer prompt in projectID in the background, as if
+// the prompt had been posted in the chat for it.
+func RunAgent(db *sql.DB, publisher Publisher, projectID, agentType, prompt string) {
+	newMessageProcessor(db, publisher).runAgent(projectID, agentType, prompt)
+}
+
+func (p *MessageProcessor) runAgent(projectID, agentType, prompt string) {
+	go p.trackRun(projectID, agentType, func(ctx context.Context) {
+		p.generateAgentResponse(ctx, projectID, agentType, "", "", prompt)
+	})
 }
 
-func (p *MessageProcessor) generateAgentResponse(projectID, agentType, issueID, issueTitle, originalMessage string) {
+// generateAgentResponse runs agentType on originalMessage and posts its
+// reply. For an issue it also moves the issue according to the run's
+// outcome, which it returns. Cancelling ctx stops the model mid-answer.
+func (p *MessageProcessor) generateAgentResponse(ctx context.Context, projectID, agentType, issueID, issueTitle, originalMessage string) RunOutcome {
 	var responseText string
 	var planNotes []string
 	var planForMessage *AgentActionPlan
 	var gitResult *projectfs.CommitResult
 	start := time.Now()
+	record := &RunRecord{ID: runIDFromContext(ctx), ProjectID: projectID, IssueID: issueID, AgentID: agentType, Prompt: originalMessage, StartedAt: start}
+	if record.ID == "" {
+		record.ID = uuid.New().String()
+	}
 
 	monitoring.AgentWorkStarted(projectID, agentType)
 	defer func() {
@@ -155,9 +188,38 @@ func (p *MessageProcessor) generateAgentResponse(projectID, agentType, issueID,
 		monitoring.RecordAgentDuration(projectID, agentType, time.Since(start))
 	}()
 
-	workspacePath, workspaceErr := p.ensureWorkspace(projectID)
+	workspacePath, workspaceErr := p.issueWorkspace(projectID, issueID)
 	if workspaceErr != nil {
 		log.Printf("workspace: failed to prepare workspace for project %s: %v", projectID, workspaceErr)
+		if issueID != "" {
+			// Work on an issue means changing files; there is no point
+			// asking the model without a workspace.
+			outcome := failedOutcome(fmt.Errorf("workspace unavailable: %w", workspaceErr))
+			p.sendAgentMessage(projectID, agentType, fmt.Sprintf("%s couldn't start on %q: %s.", agentName(agentType), issueTitle, outcome.Error), "error", nil, "", nil, nil)
+			p.finishIssueRun(projectID, agentType, issueID, "", outcome, nil)
+			p.saveRunRecord(record, outcome)
+			return outcome
+		}
+	}
+
+	// In review mode the agent works on a staged copy and its changes are
+	// held as a change set. If staging fails the workspace is treated as
+	// unavailable rather than written directly.
+	var stage *changeStage
+	if workspaceErr == nil && p.reviewChanges(projectID) {
+		var stageErr error
+		if stage, stageErr = newChangeStage(workspacePath); stageErr != nil {
+			log.Printf("workspace: failed to stage project %s for review: %v", projectID, stageErr)
+			workspaceErr = fmt.Errorf("could not stage changes for review: %w", stageErr)
+		}
+		defer stage.Close()
+	}
+
+	// The tool loop replaces the JSON plan format; AGENT_TOOLS=off keeps it.
+	useTools := toolsEnabled()
+	formatInstructions := planFormatInstructions
+	if useTools {
+		formatInstructions = toolFormatInstructions
 	}
 
 	systemPrompts := map[string]string{
@@ -166,116 +228,230 @@ func (p *MessageProcessor) generateAgentResponse(projectID, agentType, issueID,
 		Be concise and helpful. Ask clarifying questions when needed.
 		Keep responses under 200 words.
 
-		%s`, planFormatInstructions),
+		%s`, formatInstructions),
 
 		"backend_architect": fmt.Sprintf(`You are a Backend Architect AI agent in a collaborative team workspace.
 	Your role is to design APIs, database schemas, and server architecture.
 	Be technical but clear. Provide concrete suggestions.
 	Keep responses under 200 words.
 
-	%s`, planFormatInstructions),
+	%s`, formatInstructions),
 
 		"frontend_developer": fmt.Sprintf(`You are a Frontend Developer AI agent in a collaborative team workspace.
 	Your role is to build UI components, handle state management, and ensure responsive design.
 	Be practical and focus on implementation. Share best practices.
 	Keep responses under 200 words.
 
-	%s`, planFormatInstructions),
+	%s`, formatInstructions),
 
 		"qa_tester": fmt.Sprintf(`You are a QA Tester AI agent in a collaborative team workspace.
 	Your role is to validate new functionality, design automated/manual tests, and report regressions.
 	Describe the scenarios you verify, add or update test files, and share any defects you find.
 	Keep responses under 200 words.
 
-	%s`, planFormatInstructions),
+	%s`, formatInstructions),
 
 		"devops_engineer": fmt.Sprintf(`You are a DevOps Engineer AI agent in a collaborative team workspace.
 	Your role is to manage infrastructure, CI/CD pipelines, deployment scripts, and operational tooling.
 		Provide practical improvements, update configs/scripts, and verify commands.
 		Keep responses under 200 words.
 
-		%s`, planFormatInstructions),
+		%s`, formatInstructions),
 	}
 	systemPrompt, ok := systemPrompts[agentType]
 	if !ok || strings.TrimSpace(systemPrompt) == "" {
 		systemPrompt = fmt.Sprintf(`You are a collaborative software agent. Keep responses under 200 words.
 
-%s`, planFormatInstructions)
+%s`, formatInstructions)
 	}
 
 	var workspacePrompt string
+	var workspaceCtx workspaceContext
 	if workspaceErr == nil && workspacePath != "" {
 		workspacePrompt = "Workspace root alias: ./ (project root). Always reference files relative to this root (e.g. src/routes/index.ts). Never mention host-specific paths under data/projects/…"
+		workspaceCtx = buildWorkspaceContext(workspacePath, issueTitle+"\n"+originalMessage)
 	}
 
-	var rawLLMOutput string
-
-	switch {
-	case p.aiClient != nil:
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
+	messages := []llm.Message{{Role: llm.RoleSystem, Content: systemPrompt}}
+	if workspacePrompt != "" {
+		messages = append(messages, llm.Message{Role: llm.RoleSystem, Content: workspacePrompt})
+	}
+	if workspaceCtx.Prompt != "" {
+		messages = append(messages, llm.Message{Role: llm.RoleSystem, Content: workspaceCtx.Prompt})
+	}
+	messages = append(messages, p.assembleContext(projectID, agentType, originalMessage)...)
+	messages = append(messages, llm.Message{Role: llm.RoleUser, Content: originalMessage})
 
-		inputMessages := responses.ResponseInputParam{
-			responses.ResponseInputItemParamOfMessage(systemPrompt, responses.EasyInputMessageRoleSystem),
+	modelCfg := p.modelConfig(projectID, agentType)
+	chain := llm.NewChain(modelCfg, func(a llm.Attempt) {
+		monitoring.RecordLLMAttempt(projectID, agentType, a.Provider, a.Outcome, a.Duration)
+		if a.Err != nil {
+			log.Printf("agent: %s attempt %d via %s: %s: %v", agentType, a.Number, a.Provider, a.Outcome, a.Err)
 		}
-		if workspacePrompt != "" {
-			inputMessages = append(inputMessages, responses.ResponseInputItemParamOfMessage(workspacePrompt, responses.EasyInputMessageRoleSystem))
+	})
+	messageID := uuid.New().String()
+	deltas := p.deltaPublisher(projectID, agentType, messageID)
+	record.MessageID, record.PromptHash = messageID, promptHash(messages)
+
+	var resp *llm.Response
+	var err error
+	var run *toolRun
+	var loop toolLoopResult
+	if useTools {
+		run = &toolRun{p: p, projectID: projectID, agentType: agentType}
+		if stage != nil {
+			run.workspacePath = stage.Path
+		} else if workspaceErr == nil {
+			run.workspacePath = workspacePath
 		}
-		inputMessages = append(inputMessages, responses.ResponseInputItemParamOfMessage(originalMessage, responses.EasyInputMessageRoleUser))
-
-		resp, err := p.aiClient.Responses.New(ctx, responses.ResponseNewParams{
-			Model:           openai.ResponsesModel(openai.ChatModelGPT4oMini),
-			Input:           responses.ResponseNewParamsInputUnion{OfInputItemList: inputMessages},
-			MaxOutputTokens: openai.Int(1200),
-			Temperature:     openai.Float(0.7),
-		})
-
-		if err != nil {
-			log.Printf("agent: OpenAI API error: %v", err)
-			responseText = p.getFallbackResponse(agentType)
-		} else if output := resp.OutputText(); output != "" {
-			rawLLMOutput = output
-		} else {
-			responseText = p.getFallbackResponse(agentType)
+		loop, err = runToolLoop(ctx, chain, messages, run, toolLoopLimitsFromEnv(), deltas)
+		resp = loop.Response
+		record.InputTokens, record.OutputTokens = loop.InputTokens, loop.OutputTokens
+	} else {
+		resp, err = chain.Stream(ctx, llm.Request{Messages: messages}, deltas)
+		if resp != nil {
+			record.InputTokens, record.OutputTokens = resp.InputTokens, resp.OutputTokens
 		}
-
-	case p.localLLM != nil:
-		output, err := p.localLLM.Generate(context.Background(), systemPrompt, workspacePrompt, originalMessage)
-		if err != nil {
-			log.Printf("agent: local LLM error: %v", err)
-			responseText = p.getFallbackResponse(agentType)
+	}
+	if err != nil {
+		// Fail visibly rather than posting canned text that looks like a
+		// real answer; the issue stays open so it can be retried.
+		content := providerFailureMessage(agentType, err)
+		outcome := RunOutcome{Status: OutcomeFailed, Error: content}
+		if cause := context.Cause(ctx); errors.Is(cause, ErrRunCancelled) {
+			log.Printf("agent: %s run for project %s stopped: %v", agentType, projectID, cause)
+			content = fmt.Sprintf("%s stopped: %v. Nothing was changed.", agentName(agentType), cause)
+			outcome = RunOutcome{Status: OutcomeCancelled, Error: cause.Error()}
 		} else {
-			rawLLMOutput = output
+			log.Printf("agent: %s could not reach any provider for project %s: %v", agentType, projectID, err)
 		}
-
-	default:
-		log.Printf("agent: No AI provider configured, using fallback")
-		responseText = p.getFallbackResponse(agentType)
+		var notes []string
+		extra := record.messageMetadata(outcome)
+		if run != nil && run.changed {
+			planForMessage = &run.applied
+			if stage != nil {
+				// Keep the partial edits for review like any other change.
+				changeSet, note := p.proposeChangeSet(stage, projectID, agentType, issueID, messageID, toolCommitMessage(agentType, issueTitle, run), run.summary(), run.notes)
+				if note != "" {
+					notes = append(notes, note)
+				}
+				if changeSet != nil {
+					content = strings.TrimSuffix(content, " Nothing was changed.") + " Edits made before the failure are waiting for review."
+					extra["changeSet"] = changeSet.ForClient(false)
+				}
+			} else {
+				// Edits made before the failure are already on disk; commit
+				// them so they are visible and can be reverted.
+				content = strings.TrimSuffix(content, " Nothing was changed.") + " Edits made before the failure were kept."
+				gitResult, notes = p.commitToolChanges(projectID, agentType, issueTitle, run)
+			}
+		}
+		p.saveAgentMessage(messageID, "message.completed", projectID, agentType, content, "error", notes, workspacePath, planForMessage, gitResult, extra)
+		if issueID != "" {
+			p.finishIssueRun(projectID, agentType, issueID, workspacePath, outcome, nil)
+		}
+		record.setResult(planForMessage, gitResult, notes, extra)
+		p.saveRunRecord(record, outcome)
+		return outcome
 	}
 
-	if rawLLMOutput != "" {
-		responseText, planNotes, planForMessage, gitResult = p.processLLMOutput(projectID, agentType, issueTitle, rawLLMOutput, planNotes, workspacePath, workspaceErr)
+	// With tools the agent already saw each failed change in the tool result.
+	var correct planCorrector
+	if !useTools {
+		correctPath := workspacePath
+		if stage != nil {
+			correctPath = stage.Path
+		}
+		correct = correctionRequester(ctx, chain, messages, resp.Text, correctPath)
 	}
+	var skipped []skippedChange
+	var applyErr error
+	responseText, planNotes, planForMessage, gitResult, skipped, applyErr = p.processLLMOutput(projectID, agentType, issueTitle, resp.Text, planNotes, workspacePath, workspaceErr, correct, stage)
 
-	p.sendAgentMessage(projectID, agentType, responseText, "chat", planNotes, workspacePath, planForMessage, gitResult)
+	extra := map[string]interface{}{
+		"model": map[string]interface{}{
+			"provider": resp.Provider,
+			"model":    resp.Model,
+		},
+	}
+	if run != nil {
+		planNotes = append(run.notes, planNotes...)
+		if run.changed {
+			planNotes = append(planNotes, run.applied.Notes...)
+			if gitResult == nil && stage == nil {
+				var commitNotes []string
+				gitResult, commitNotes = p.commitToolChanges(projectID, agentType, issueTitle, run)
+				planNotes = append(planNotes, commitNotes...)
+			}
+			if planForMessage == nil || !planForMessage.HasChanges() {
+				planForMessage = &run.applied
+			}
+			if strings.TrimSpace(resp.Text) == "" {
+				responseText = run.summary()
+			}
+		}
+		if len(run.calls) > 0 {
+			extra["toolCalls"] = run.calls
+			extra["toolSteps"] = loop.Steps
+		}
+		skipped = append(run.skipped, skipped...)
+		planNotes = append(planNotes, skippedNotes(run.skipped)...)
+		if loop.Exhausted {
+			planNotes = append(planNotes, fmt.Sprintf("Stopped calling tools after %d steps", loop.Steps))
+		}
+	}
+	if len(skipped) > 0 {
+		extra["skippedChanges"] = skipped
+	}
+	if stage != nil {
+		changeSet, note := p.proposeChangeSet(stage, projectID, agentType, issueID, messageID, buildCommitMessage(agentType, issueTitle, responseText, planNotes), responseText, planNotes)
+		if note != "" {
+			planNotes = append(planNotes, note)
+		}
+		if changeSet != nil {
+			responseText = stagedSummary(responseText)
+			extra["changeSet"] = changeSet.ForClient(false)
+		}
+	}
+	if len(workspaceCtx.Files) > 0 {
+		extra["contextFiles"] = workspaceCtx.Files
+		if len(workspaceCtx.Truncated) > 0 {
+			extra["contextFilesTruncated"] = workspaceCtx.Truncated
+		}
+	}
+	dialogs := p.openDialogsSince(projectID, agentType, start)
+	outcome := issueRunOutcome(applyErr, len(dialogs), extra["changeSet"] != nil, len(skipped))
+	for key, value := range record.messageMetadata(outcome) {
+		extra[key] = value
+	}
+	p.saveAgentMessage(messageID, "message.completed", projectID, agentType, responseText, "chat", planNotes, workspacePath, planForMessage, gitResult, extra)
+	record.Provider, record.Model, record.RawOutput = resp.Provider, resp.Model, resp.Text
+	record.setResult(planForMessage, gitResult, planNotes, extra)
+	p.saveRunRecord(record, outcome)
 
 	if issueID != "" {
-		if err := p.markIssueCompleted(issueID); err != nil {
-			log.Printf("agent: failed to complete issue %s: %v", issueID, err)
-		}
+		p.finishIssueRun(projectID, agentType, issueID, workspacePath, outcome, dialogs)
 	}
 
 	if strings.Contains(strings.ToLower(originalMessage), "create task") ||
 		strings.Contains(strings.ToLower(originalMessage), "add task") {
 		p.proposeTask(projectID, agentType)
 	}
+	return outcome
 }
 
 func (plan AgentActionPlan) HasChanges() bool {
-	return len(plan.Files) > 0 || len(plan.Mutations) > 0
+	return len(plan.Files) > 0 || len(plan.Mutations) > 0 || len(plan.Patches) > 0 ||
+		len(plan.Renames) > 0 || len(plan.Chmods) > 0 || len(plan.Deletes) > 0
 }
 
-func (p *MessageProcessor) processLLMOutput(projectID, agentType, issueTitle, rawOutput string, planNotes []string, workspacePath string, workspaceErr error) (string, []string, *AgentActionPlan, *projectfs.CommitResult) {
+// processLLMOutput handles structured blocks in rawOutput and applies and
+// commits its JSON plan. When changes are skipped and correct is set, the
+// agent gets one chance to fix them first. The changes still skipped are
+// returned, and so is the error that stopped the plan from being applied.
+// With a stage the plan is applied to the staged copy and nothing is
+// committed.
+func (p *MessageProcessor) processLLMOutput(projectID, agentType, issueTitle, rawOutput string, planNotes []string, workspacePath string, workspaceErr error, correct planCorrector, stage *changeStage) (string, []string, *AgentActionPlan, *projectfs.CommitResult, []skippedChange, error) {
 	cleanOutput, blocks := extractStructuredBlocks(rawOutput)
 	if len(blocks) > 0 {
 		structuredNotes := p.handleStructuredBlocks(projectID, agentType, blocks)
@@ -289,46 +465,121 @@ func (p *MessageProcessor) processLLMOutput(projectID, agentType, issueTitle, ra
 
 	var planForMessage *AgentActionPlan
 	var gitResult *projectfs.CommitResult
+	var skipped []skippedChange
+	var failure error
 	responseText := processedOutput
 
 	if workspaceErr == nil {
+		if stage != nil {
+			workspacePath = stage.Path
+		}
 		plan, planErr := parseActionPlan(processedOutput)
 		if planErr == nil {
 			planCopy := plan
 			planForMessage = &planCopy
 		}
 		if planErr == nil && plan.HasChanges() {
-			summary, applyErr := p.applyActionPlan(workspacePath, agentType, plan)
+			result, applyErr := p.applyActionPlan(workspacePath, agentType, plan)
 			if applyErr != nil {
 				log.Printf("agent: failed to apply plan for project %s: %v", projectID, applyErr)
 				responseText = fmt.Sprintf("%s produced changes but hit an error: %v", agentDisplayNames[agentType], applyErr)
+				failure = applyErr
 			} else {
-				responseText = summary
-				planNotes = append(planNotes, plan.Notes...)
-				commitMsg := buildCommitMessage(agentType, issueTitle, summary, planNotes)
-				if commitMsg != "" {
-					result, gitErr := projectfs.CommitWorkspaceChanges(workspacePath, commitMsg)
-					if gitErr != nil {
-						log.Printf("git: commit workflow failed for project %s: %v", projectID, gitErr)
-					}
-					if result != nil {
-						gitResult = result
-						if note := gitNote(result, gitErr); note != "" {
-							planNotes = append(planNotes, note)
-						}
-					} else if gitErr != nil {
-						planNotes = append(planNotes, fmt.Sprintf("Git commit skipped: %v", gitErr))
+				if correct != nil && hasSkippedMutations(result.Skipped) {
+					var retryNote string
+					result, retryNote = p.applyCorrection(workspacePath, agentType, plan.Notes, result, correct)
+					if retryNote != "" {
+						planNotes = append(planNotes, retryNote)
 					}
 				}
+				responseText = result.Summary
+				skipped = result.Skipped
+				planNotes = append(planNotes, plan.Notes...)
+				planNotes = append(planNotes, result.Notes()...)
+				if stage != nil {
+					return responseText, planNotes, planForMessage, nil, skipped, nil
+				}
+				var commitNotes []string
+				gitResult, commitNotes = p.commitWorkspace(projectID, agentType, workspacePath, buildCommitMessage(agentType, issueTitle, result.Summary, planNotes))
+				planNotes = append(planNotes, commitNotes...)
 			}
 		}
 	}
 
-	return responseText, planNotes, planForMessage, gitResult
+	return responseText, planNotes, planForMessage, gitResult, skipped, failure
+}
+
+// commitWorkspace commits the workspace with commitMsg, pushes it if the
+// project's push policy says so, and returns notes describing the outcome.
+func (p *MessageProcessor) commitWorkspace(projectID, actorID, workspacePath, commitMsg string) (*projectfs.CommitResult, []string) {
+	if commitMsg == "" {
+		return nil, nil
+	}
+	result, gitErr := projectfs.CommitWorkspaceChanges(workspacePath, commitMsg)
+	if gitErr != nil {
+		log.Printf("git: commit workflow failed for project %s: %v", projectID, gitErr)
+	}
+	if result == nil {
+		if gitErr != nil {
+			return nil, []string{fmt.Sprintf("Git commit skipped: %v", gitErr)}
+		}
+		return nil, nil
+	}
+
+	pushed, pushErr := PushWorkspace(p.db, p.publisher, projectID, workspacePath, projectfs.PushAfterCommit, actorID)
+	if pushed != nil && pushed.Pushed {
+		result.Pushed, result.PushedTo = true, pushed.RemoteBranch
+	}
+	if note := gitNote(result, pushErr); note != "" {
+		return result, []string{note}
+	}
+	return result, nil
+}
+
+// providerFailureMessage explains to the team that an agent produced nothing.
+func providerFailureMessage(agentType string, err error) string {
+	name := agentDisplayNames[agentType]
+	if name == "" {
+		name = agentType
+	}
+	detail := err.Error()
+	var chainErr *llm.ChainError
+	if errors.As(err, &chainErr) {
+		if len(chainErr.Attempts) == 0 {
+			detail = "no AI provider is configured"
+		} else {
+			detail = "every provider failed: " + chainErr.Summary()
+		}
+	}
+	return fmt.Sprintf("%s couldn't respond: %s. Nothing was changed.", name, detail)
+}
+
+// deltaPublisher forwards generated text to clients as message.delta events
+// for the placeholder messageID. The persisted message follows as
+// message.completed with the same ID.
+func (p *MessageProcessor) deltaPublisher(projectID, agentType, messageID string) llm.DeltaFunc {
+	index := 0
+	return func(delta string) {
+		p.publish(projectID, marshalEvent("message.delta", map[string]interface{}{
+			"messageId":  messageID,
+			"projectId":  projectID,
+			"senderId":   agentType,
+			"senderType": "agent",
+			"senderName": agentDisplayNames[agentType],
+			"delta":      delta,
+			"index":      index,
+		}))
+		index++
+	}
 }
 
 func (p *MessageProcessor) sendAgentMessage(projectID, agentType, content, messageType string, notes []string, workspacePath string, plan *AgentActionPlan, gitInfo *projectfs.CommitResult) {
-	messageID := uuid.New().String()
+	p.saveAgentMessage(uuid.New().String(), "message.received", projectID, agentType, content, messageType, notes, workspacePath, plan, gitInfo, nil)
+}
+
+// saveAgentMessage persists an agent message and publishes it as eventType.
+// Entries in extra are added to the message metadata.
+func (p *MessageProcessor) saveAgentMessage(messageID, eventType, projectID, agentType, content, messageType string, notes []string, workspacePath string, plan *AgentActionPlan, gitInfo *projectfs.CommitResult, extra map[string]interface{}) {
 	timestamp := time.Now()
 
 	metadata := map[string]interface{}{}
@@ -345,6 +596,9 @@ func (p *MessageProcessor) sendAgentMessage(projectID, agentType, content, messa
 	if gitInfo != nil {
 		metadata["git"] = gitInfo
 	}
+	for key, value := range extra {
+		metadata[key] = value
+	}
 	var metadataPayload map[string]interface{}
 	if len(metadata) > 0 {
 		metadataPayload = metadata
@@ -387,11 +641,16 @@ func (p *MessageProcessor) sendAgentMessage(projectID, agentType, content, messa
 		messagePayload["metadata"] = metadataPayload
 	}
 
-	if data := marshalEvent("message.received", map[string]interface{}{
+	p.publish(projectID, marshalEvent(eventType, map[string]interface{}{
 		"message": messagePayload,
-	}); data != nil {
-		p.broadcast <- data
+	}))
+}
+
+func (p *MessageProcessor) publish(projectID string, data []byte) {
+	if p.publisher == nil || projectID == "" || data == nil {
+		return
 	}
+	p.publisher.Publish(projectID, data)
 }
 
 func buildCommitMessage(agentType, issueTitle, summary string, notes []string) string {
@@ -437,10 +696,12 @@ func gitNote(result *projectfs.CommitResult, gitErr error) string {
 
 	var status string
 	switch {
+	case result.Pushed && result.PushedTo != "":
+		status = fmt.Sprintf("recorded on %s, pushed to origin/%s", branch, result.PushedTo)
 	case result.Pushed:
 		status = fmt.Sprintf("pushed to origin/%s", branch)
 	case strings.TrimSpace(result.Remote) != "":
-		status = fmt.Sprintf("recorded on %s (push pending)", branch)
+		status = fmt.Sprintf("recorded on %s (not pushed)", branch)
 	default:
 		status = fmt.Sprintf("recorded on %s (no remote)", branch)
 	}
@@ -483,14 +744,39 @@ func summarizePlan(plan *AgentActionPlan) map[string]interface{} {
 		}
 	}
 
-	if len(files) == 0 && len(mutations) == 0 {
+	var patches []string
+	for _, diff := range plan.Patches {
+		parsed, err := parseUnifiedDiff(diff)
+		if err != nil {
+			continue
+		}
+		for _, fp := range parsed {
+			patches = append(patches, fp.Path())
+		}
+	}
+	var renames []string
+	for _, rename := range plan.Renames {
+		renames = append(renames, rename.From+" → "+rename.To)
+	}
+	var chmods []string
+	for _, change := range plan.Chmods {
+		chmods = append(chmods, change.Path+" "+change.Mode)
+	}
+
+	if len(files) == 0 && len(mutations) == 0 && len(patches) == 0 && len(renames) == 0 && len(chmods) == 0 && len(plan.Deletes) == 0 {
 		return nil
 	}
 
-	return map[string]interface{}{
+	summary := map[string]interface{}{
 		"files":     files,
 		"mutations": mutations,
 	}
+	for key, list := range map[string][]string{"patches": patches, "renames": renames, "chmods": chmods, "deletes": plan.Deletes} {
+		if len(list) > 0 {
+			summary[key] = list
+		}
+	}
+	return summary
 }
 
 func marshalEnvelope(data map[string]interface{}) string {
@@ -539,25 +825,88 @@ func (p *MessageProcessor) ensureWorkspace(projectID string) (string, error) {
 	return workspacePath, nil
 }
 
-func (p *MessageProcessor) applyActionPlan(workspacePath, agentType string, plan AgentActionPlan) (string, error) {
-	filesWritten := 0
-	mutationsApplied := 0
+// issueWorkspace returns where work on issueID happens: a worktree with the
+// issue's own branch, created on first use and recorded on the issue. Work
+// not tied to an issue, and workspaces that are not git repositories, use
+// the project workspace.
+func (p *MessageProcessor) issueWorkspace(projectID, issueID string) (string, error) {
+	workspacePath, err := p.ensureWorkspace(projectID)
+	if err != nil {
+		return "", err
+	}
+	// A sync that stopped on conflicts leaves the workspace mid-rebase;
+	// neither it nor new branches cut from it are safe to work on.
+	if projectfs.InConflict(workspacePath) {
+		return "", projectfs.ErrUnfinishedSync
+	}
+	if issueID == "" || !projectfs.IsRepository(workspacePath) {
+		return workspacePath, nil
+	}
 
-	for i := range plan.Files {
-		file := plan.Files[i]
-		cleanPath := normalizePlanPath(workspacePath, file.Path)
-		if cleanPath == "" {
-			continue
+	var title string
+	var branch, worktreePath sql.NullString
+	if err := p.db.QueryRow(`SELECT title, branch, worktree_path FROM issues WHERE id = ?`, issueID).Scan(&title, &branch, &worktreePath); err != nil {
+		return "", fmt.Errorf("failed to load issue %s: %w", issueID, err)
+	}
+	name, path := branch.String, worktreePath.String
+	if name == "" {
+		name = projectfs.IssueBranch(issueID, title)
+	}
+	if path == "" {
+		path = projectfs.WorktreePath(projectID, issueID)
+	}
+	if err := projectfs.EnsureWorktree(workspacePath, path, name); err != nil {
+		return "", fmt.Errorf("failed to prepare branch %s: %w", name, err)
+	}
+
+	if name != branch.String || path != worktreePath.String {
+		if _, err := p.db.Exec(`UPDATE issues SET branch = ?, worktree_path = ? WHERE id = ?`, name, path, issueID); err != nil {
+			log.Printf("workspace: failed to record branch for issue %s: %v", issueID, err)
+		} else if issue, err := fetchIssueForBroadcast(p.db, issueID); err == nil {
+			p.publish(projectID, marshalEvent("issue.updated", map[string]interface{}{"issue": issue}))
 		}
-		plan.Files[i].Path = cleanPath
+		log.Printf("workspace: issue %s works on branch %s in %s", issueID, name, path)
+	}
+	return path, nil
+}
+
+// applyResult reports what applyActionPlan did with a plan.
+type applyResult struct {
+	Summary          string
+	FilesWritten     int
+	MutationsApplied int
+	PatchesApplied   int
+	Renamed          int
+	Chmodded         int
+	Deleted          int
+	// Fuzzy notes each mutation applied by a whitespace-insensitive or
+	// anchored match instead of an exact one.
+	Fuzzy   []string
+	Skipped []skippedChange
+}
+
+// Notes returns the fuzzy-match and skip notes for the chat message.
+func (r applyResult) Notes() []string {
+	return append(append([]string(nil), r.Fuzzy...), skippedNotes(r.Skipped)...)
+}
 
-		absPath, err := secureJoin(workspacePath, cleanPath)
+func (p *MessageProcessor) applyActionPlan(workspacePath, agentType string, plan AgentActionPlan) (applyResult, error) {
+	var result applyResult
+
+	for i := range plan.Files {
+		file := plan.Files[i]
+		cleanPath, absPath, err := resolveWritePath(workspacePath, file.Path)
 		if err != nil {
-			return "", err
+			if cleanPath == "" {
+				result.Skipped = append(result.Skipped, skippedChange{Path: file.Path, Kind: "file", Reason: err.Error()})
+				continue
+			}
+			return result, err
 		}
+		plan.Files[i].Path = cleanPath
 
 		if err := os.MkdirAll(filepath.Dir(absPath), 0o755); err != nil {
-			return "", fmt.Errorf("failed to prepare directory for %s: %w", file.Path, err)
+			return result, fmt.Errorf("failed to prepare directory for %s: %w", file.Path, err)
 		}
 
 		overwrite := true
@@ -566,71 +915,119 @@ func (p *MessageProcessor) applyActionPlan(workspacePath, agentType string, plan
 		}
 		if !overwrite {
 			if _, err := os.Stat(absPath); err == nil {
+				result.Skipped = append(result.Skipped, skippedChange{Path: cleanPath, Kind: "file", Reason: "file exists and overwrite is false"})
 				continue
 			}
 		}
 
 		if err := os.WriteFile(absPath, []byte(file.Content), 0o644); err != nil {
-			return "", fmt.Errorf("failed to write file %s: %w", file.Path, err)
+			return result, fmt.Errorf("failed to write file %s: %w", file.Path, err)
 		}
-		filesWritten++
+		result.FilesWritten++
 	}
 
 	for i := range plan.Mutations {
 		mutation := plan.Mutations[i]
-		if mutation.Path == "" || mutation.Find == "" {
+		if mutation.Find == "" {
+			result.Skipped = append(result.Skipped, skippedChange{Path: mutation.Path, Kind: "mutation", Reason: "missing find text"})
 			continue
 		}
-
-		cleanPath := normalizePlanPath(workspacePath, mutation.Path)
-		if cleanPath == "" {
-			continue
+		cleanPath, absPath, err := resolveWritePath(workspacePath, mutation.Path)
+		if err != nil {
+			if cleanPath == "" {
+				result.Skipped = append(result.Skipped, skippedChange{Path: mutation.Path, Kind: "mutation", Reason: err.Error()})
+				continue
+			}
+			return result, err
 		}
 		plan.Mutations[i].Path = cleanPath
-
-		absPath, err := secureJoin(workspacePath, cleanPath)
-		if err != nil {
-			return "", err
+		skip := func(reason string) {
+			result.Skipped = append(result.Skipped, skippedChange{Path: cleanPath, Kind: "mutation", Reason: reason, Find: firstLine(mutation.Find, 80)})
 		}
 
 		content, err := os.ReadFile(absPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			skip("file does not exist")
+			continue
+		}
 		if err != nil {
-			return "", fmt.Errorf("failed to read %s for mutation: %w", mutation.Path, err)
+			return result, fmt.Errorf("failed to read %s for mutation: %w", mutation.Path, err)
 		}
 
 		original := string(content)
-		if !strings.Contains(original, mutation.Find) {
+		start, end, mode, reason := locateMutation(original, mutation.Find)
+		if reason != "" {
+			skip(reason)
 			continue
 		}
 
-		updated := strings.Replace(original, mutation.Find, mutation.Replace, 1)
+		updated := original[:start] + mutation.Replace + original[end:]
 		if err := os.WriteFile(absPath, []byte(updated), 0o644); err != nil {
-			return "", fmt.Errorf("failed to apply mutation to %s: %w", mutation.Path, err)
+			return result, fmt.Errorf("failed to apply mutation to %s: %w", mutation.Path, err)
+		}
+		result.MutationsApplied++
+		switch mode {
+		case matchWhitespace:
+			result.Fuzzy = append(result.Fuzzy, fmt.Sprintf("Mutation in %s matched ignoring whitespace", cleanPath))
+		case matchAnchored:
+			result.Fuzzy = append(result.Fuzzy, fmt.Sprintf("Mutation in %s matched by its first and last lines", cleanPath))
 		}
-		mutationsApplied++
 	}
 
-	agentName := agentDisplayNames[agentType]
-	if agentName == "" {
-		agentName = agentType
+	for _, diff := range plan.Patches {
+		if err := applyPatch(workspacePath, diff, &result); err != nil {
+			return result, err
+		}
+	}
+	for _, rename := range plan.Renames {
+		if err := applyRename(workspacePath, rename, &result); err != nil {
+			return result, err
+		}
+	}
+	for _, change := range plan.Chmods {
+		if err := applyChmod(workspacePath, change, &result); err != nil {
+			return result, err
+		}
 	}
-	summary := fmt.Sprintf("%s updated workspace (files=%d, mutations=%d)", agentName, filesWritten, mutationsApplied)
-	if len(plan.Notes) > 0 {
-		summary = summary + "; notes: " + strings.Join(plan.Notes, "; ")
+	for _, candidate := range plan.Deletes {
+		if err := applyDelete(workspacePath, candidate, &result); err != nil {
+			return result, err
+		}
 	}
 
-	return summary, nil
+	result.summarize(agentType, plan.Notes)
+	return result, nil
 }
 
-func secureJoin(basePath, relative string) (string, error) {
-	cleanBase := filepath.Clean(basePath)
-	cleanRel := filepath.Clean(relative)
-	joined := filepath.Join(cleanBase, cleanRel)
+// Applied counts every change that was made.
+func (r applyResult) Applied() int {
+	return r.FilesWritten + r.MutationsApplied + r.PatchesApplied + r.Renamed + r.Chmodded + r.Deleted
+}
 
-	if !strings.HasPrefix(joined, cleanBase) {
-		return "", fmt.Errorf("path %s escapes workspace", relative)
+// summarize sets Summary from the counts. The "updated workspace (...)" form
+// is parsed by the web client.
+func (r *applyResult) summarize(agentType string, notes []string) {
+	agentName := agentDisplayNames[agentType]
+	if agentName == "" {
+		agentName = agentType
+	}
+	counts := fmt.Sprintf("files=%d, mutations=%d", r.FilesWritten, r.MutationsApplied)
+	for _, extra := range []struct {
+		label string
+		n     int
+	}{{"patches", r.PatchesApplied}, {"renamed", r.Renamed}, {"chmod", r.Chmodded}, {"deleted", r.Deleted}, {"skipped", len(r.Skipped)}} {
+		if extra.n > 0 {
+			counts += fmt.Sprintf(", %s=%d", extra.label, extra.n)
+		}
+	}
+	if r.Applied() == 0 && len(r.Skipped) > 0 {
+		r.Summary = fmt.Sprintf("%s could not apply its changes (%s)", agentName, counts)
+	} else {
+		r.Summary = fmt.Sprintf("%s updated workspace (%s)", agentName, counts)
+	}
+	if len(notes) > 0 {
+		r.Summary = r.Summary + "; notes: " + strings.Join(notes, "; ")
 	}
-	return joined, nil
 }
 
 func normalizePlanPath(workspacePath, candidate string) string {
@@ -751,10 +1148,10 @@ func (p *MessageProcessor) handleIssueBlock(projectID, agentType string, fields
 		"assignee":    assigneeID,
 	}
 
-	p.broadcast <- marshalEvent("issue.created", map[string]interface{}{
+	p.publish(projectID, marshalEvent("issue.created", map[string]interface{}{
 		"issue":            issuePayload,
 		"requiresApproval": false,
-	})
+	}))
 
 	return fmt.Sprintf("Created issue: %s", title), nil
 }
@@ -773,55 +1170,49 @@ func (p *MessageProcessor) handleMentionBlock(projectID, agentType string, field
 	return fmt.Sprintf("Mentioned %s", target)
 }
 
-func (p *MessageProcessor) markIssueCompleted(issueID string) error {
+// markIssueCompleted moves issueID from status from to done, reporting
+// whether it did.
+func (p *MessageProcessor) markIssueCompleted(issueID, from string) (bool, error) {
 	now := time.Now()
 	res, err := p.db.Exec(`
 		UPDATE issues
 		SET status = 'done',
 		    completed_at = COALESCE(completed_at, ?),
-		    queued_agent_id = NULL
-		WHERE id = ? AND status != 'done'
-	`, now, issueID)
+		    queued_agent_id = NULL,
+		    last_error = NULL,
+		    retry_at = NULL
+		WHERE id = ? AND status = ?
+	`, now, issueID, from)
 	if err != nil {
-		return err
+		return false, err
 	}
-
 	if rows, _ := res.RowsAffected(); rows == 0 {
-		return nil
+		return false, nil
 	}
-
-	issue, err := fetchIssueForBroadcast(p.db, issueID)
-	if err != nil {
-		return err
-	}
-
-	if data := marshalEvent("issue.updated", map[string]interface{}{
-		"issue": issue,
-	}); data != nil {
-		p.broadcast <- data
-	}
-
-	return nil
+	return true, p.publishIssueIfChanged(res, issueID)
 }
 
 func fetchIssueForBroadcast(db *sql.DB, issueID string) (map[string]interface{}, error) {
 	row := db.QueryRow(`
 		SELECT id, project_id, title, description, priority, status,
 		       created_by, created_by_type, assigned_agent_id, queued_agent_id,
-		       queued_at, started_at, completed_at, created_at
+		       queued_at, started_at, completed_at, created_at, branch,
+		       attempts, last_error, retry_at
 		FROM issues
 		WHERE id = ?
 	`, issueID)
 
 	var (
 		id, projectID, title, description, priority, status, createdBy, createdByType string
-		assignedAgentID, queuedAgentID                                                sql.NullString
-		queuedAt, startedAt, completedAt, createdAt                                   sql.NullTime
+		assignedAgentID, queuedAgentID, branch, lastError                             sql.NullString
+		queuedAt, startedAt, completedAt, createdAt, retryAt                          sql.NullTime
+		attempts                                                                      sql.NullInt64
 	)
 
 	if err := row.Scan(&id, &projectID, &title, &description, &priority, &status,
 		&createdBy, &createdByType, &assignedAgentID, &queuedAgentID,
-		&queuedAt, &startedAt, &completedAt, &createdAt); err != nil {
+		&queuedAt, &startedAt, &completedAt, &createdAt, &branch,
+		&attempts, &lastError, &retryAt); err != nil {
 		return nil, err
 	}
 
@@ -840,6 +1231,10 @@ func fetchIssueForBroadcast(db *sql.DB, issueID string) (map[string]interface{},
 		"startedAt":       startedAt.Time,
 		"completedAt":     completedAt.Time,
 		"createdAt":       createdAt.Time,
+		"branch":          branch.String,
+		"attempts":        attempts.Int64,
+		"lastError":       lastError.String,
+		"retryAt":         retryAt.Time,
 	}, nil
 }
 
@@ -869,12 +1264,10 @@ func (p *MessageProcessor) handleDialogBlock(projectID, agentType string, fields
 		"issueId":       issueID,
 	}
 
-	if data := marshalEvent("dialog.requested", map[string]interface{}{
+	p.publish(projectID, marshalEvent("dialog.requested", map[string]interface{}{
 		"dialog":  dialog,
 		"agentId": agentType,
-	}); data != nil {
-		p.broadcast <- data
-	}
+	}))
 
 	if dialog["title"] != "" {
 		return fmt.Sprintf("Requested decision: %s", dialog["title"])
@@ -985,51 +1378,6 @@ func normalizeAgentIdentifier(value string) string {
 	}
 }
 
-func (p *MessageProcessor) getFallbackResponse(agentType string) string {
-	responses := map[string]string{
-		"product_manager": `I understand you need help with requirements. Let me analyze what you're asking for.
-
-Based on your message, I can help break this down into actionable tasks. Would you like me to create some initial user stories and features?`,
-
-		"backend_architect": `I can help with the backend architecture for this feature.
-
-Here's what I'm thinking:
-- Design the database schema
-- Create REST API endpoints
-- Set up proper error handling and validation
-
-Should I create tasks for these items?`,
-
-		"frontend_developer": `I can help build the frontend components for this.
-
-I'll focus on:
-- Creating reusable UI components
-- Implementing responsive design
-- Ensuring good UX patterns
-
-Let me know if you'd like me to start on any specific part.`,
-
-		"qa_tester": `I can validate the functionality we just discussed.
-
-I'll prepare or update test cases, run the relevant suites, and report any regressions I find.
-Let me know if there are specific scenarios or environments I should focus on.`,
-
-		"devops_engineer": `I can help with the infrastructure and delivery pipeline for this work.
-
-I’m thinking:
-- Update CI/CD or deployment scripts
-- Adjust infrastructure-as-code templates
-- Verify monitoring or rollout steps
-
-Would you like me to start on any particular environment or pipeline stage?`,
-	}
-
-	if response, ok := responses[agentType]; ok {
-		return response
-	}
-	return "I'm ready to help with this task."
-}
-
 func (p *MessageProcessor) proposeTask(projectID, agentType string) {
 	time.Sleep(1 * time.Second)
 
@@ -1063,7 +1411,7 @@ func (p *MessageProcessor) proposeTask(projectID, agentType string) {
 		return
 	}
 
-	if data := marshalEvent("issue.created", map[string]interface{}{
+	p.publish(projectID, marshalEvent("issue.created", map[string]interface{}{
 		"issue": map[string]interface{}{
 			"id":          taskID,
 			"projectId":   projectID,
@@ -1074,7 +1422,5 @@ func (p *MessageProcessor) proposeTask(projectID, agentType string) {
 			"createdBy":   agentType,
 		},
 		"requiresApproval": true,
-	}); data != nil {
-		p.broadcast <- data
-	}
+	}))
 }
@@ -0,0 +1,44 @@
+package agents
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type recordingPublisher struct {
+	events []AgentResponse
+}
+
+func (r *recordingPublisher) Publish(projectID string, data []byte) {
+	var event AgentResponse
+	if err := json.Unmarshal(data, &event); err == nil {
+		r.events = append(r.events, event)
+	}
+}
+
+func TestDeltaPublisherEmitsOrderedDeltas(t *testing.T) {
+	pub := &recordingPublisher{}
+	p := newMessageProcessor(nil, pub)
+
+	onDelta := p.deltaPublisher("proj", "backend_architect", "msg-1")
+	onDelta("Hello")
+	onDelta(", world")
+
+	if len(pub.events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(pub.events))
+	}
+	for i, event := range pub.events {
+		if event.Type != "message.delta" {
+			t.Fatalf("event %d type = %s", i, event.Type)
+		}
+		if event.Payload["messageId"] != "msg-1" || event.Payload["senderId"] != "backend_architect" {
+			t.Fatalf("event %d payload = %v", i, event.Payload)
+		}
+		if int(event.Payload["index"].(float64)) != i {
+			t.Fatalf("event %d index = %v", i, event.Payload["index"])
+		}
+	}
+	if pub.events[1].Payload["delta"] != ", world" {
+		t.Fatalf("unexpected delta %v", pub.events[1].Payload["delta"])
+	}
+}
@@ -0,0 +1,222 @@
+package agents
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"replychat/src/llm"
+	"replychat/src/projectfs"
+)
+
+var ErrRunRecordNotFound = errors.New("agent run not found")
+
+// RunRecord is the stored history of one agent run: what the agent was
+// asked, what it answered, what was applied and how the run ended.
+type RunRecord struct {
+	ID        string `json:"id"`
+	ProjectID string `json:"projectId"`
+	IssueID   string `json:"issueId,omitempty"`
+	AgentID   string `json:"agentId"`
+	AgentName string `json:"agentName,omitempty"`
+	MessageID string `json:"messageId,omitempty"`
+	Provider  string `json:"provider,omitempty"`
+	Model     string `json:"model,omitempty"`
+	// Prompt is the message or task the agent was given; PromptHash
+	// identifies the exact messages sent to the model, context included, so
+	// runs given the same prompt can be compared.
+	Prompt     string           `json:"prompt,omitempty"`
+	PromptHash string           `json:"promptHash,omitempty"`
+	RawOutput  string           `json:"rawOutput,omitempty"`
+	Plan       *AgentActionPlan `json:"plan,omitempty"`
+	// Result is what was applied: notes, skipped changes, tool calls and
+	// the change set held for review.
+	Result       map[string]interface{} `json:"result,omitempty"`
+	CommitID     string                 `json:"commitId,omitempty"`
+	InputTokens  int                    `json:"inputTokens"`
+	OutputTokens int                    `json:"outputTokens"`
+	DurationMs   int64                  `json:"durationMs"`
+	Status       string                 `json:"status"`
+	Error        string                 `json:"error,omitempty"`
+	StartedAt    time.Time              `json:"startedAt"`
+	FinishedAt   time.Time              `json:"finishedAt"`
+}
+
+// ForList returns a copy without the prompt, raw output, plan and result.
+func (r RunRecord) ForList() RunRecord {
+	r.Prompt = ""
+	r.RawOutput = ""
+	r.Plan = nil
+	r.Result = nil
+	return r
+}
+
+// RunFilter narrows ListRunRecords. Empty fields match every run.
+type RunFilter struct {
+	IssueID string
+	AgentID string
+	Status  string
+}
+
+// promptHash returns the SHA-256 of messages.
+func promptHash(messages []llm.Message) string {
+	raw, err := json.Marshal(messages)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// setResult records what the run applied, taking the tool calls, skipped
+// changes, context files and change set from the agent message's metadata.
+func (r *RunRecord) setResult(plan *AgentActionPlan, commit *projectfs.CommitResult, notes []string, extra map[string]interface{}) {
+	r.Plan = plan
+	if commit != nil {
+		r.CommitID = commit.CommitID
+	}
+	result := map[string]interface{}{}
+	if len(notes) > 0 {
+		result["notes"] = notes
+	}
+	for _, key := range []string{"toolCalls", "toolSteps", "skippedChanges", "contextFiles"} {
+		if value, ok := extra[key]; ok {
+			result[key] = value
+		}
+	}
+	if changeSet, ok := extra["changeSet"].(ChangeSet); ok {
+		result["changeSetId"] = changeSet.ID
+	}
+	r.Result = result
+}
+
+// messageMetadata links the agent's message to the run and its outcome.
+func (r *RunRecord) messageMetadata(outcome RunOutcome) map[string]interface{} {
+	metadata := map[string]interface{}{
+		"runId":   r.ID,
+		"outcome": outcome,
+	}
+	if r.IssueID != "" {
+		metadata["issueId"] = r.IssueID
+	}
+	return metadata
+}
+
+// saveRunRecord stores record as finished with outcome. Failures are only
+// logged; the run itself already happened.
+func (p *MessageProcessor) saveRunRecord(record *RunRecord, outcome RunOutcome) {
+	if p.db == nil {
+		return
+	}
+	if record.ID == "" {
+		record.ID = uuid.New().String()
+	}
+	record.Status, record.Error = outcome.Status, outcome.Error
+	record.FinishedAt = time.Now()
+	record.DurationMs = record.FinishedAt.Sub(record.StartedAt).Milliseconds()
+
+	var plan string
+	if record.Plan != nil {
+		if raw, err := json.Marshal(record.Plan); err == nil {
+			plan = string(raw)
+		}
+	}
+	_, err := p.db.Exec(`
+		INSERT INTO agent_runs (id, project_id, issue_id, agent_id, message_id, provider, model, prompt, prompt_hash,
+		                        raw_output, plan, result, commit_id, input_tokens, output_tokens, duration_ms,
+		                        status, error, started_at, finished_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, record.ID, record.ProjectID, record.IssueID, record.AgentID, record.MessageID, record.Provider, record.Model, record.Prompt, record.PromptHash,
+		record.RawOutput, plan, marshalEnvelope(record.Result), record.CommitID, record.InputTokens, record.OutputTokens, record.DurationMs,
+		record.Status, record.Error, record.StartedAt, record.FinishedAt)
+	if err != nil {
+		log.Printf("db: failed to record %s run for project %s: %v", record.AgentID, record.ProjectID, err)
+	}
+}
+
+const runRecordColumns = `id, project_id, issue_id, agent_id, message_id, provider, model, prompt, prompt_hash,
+	raw_output, plan, result, commit_id, input_tokens, output_tokens, duration_ms,
+	status, error, started_at, finished_at`
+
+func scanRunRecord(row rowScanner) (RunRecord, error) {
+	var (
+		r                                                 RunRecord
+		issueID, messageID, provider, model, prompt, hash sql.NullString
+		rawOut                                            sql.NullString
+		plan, result, commitID, errText                   sql.NullString
+		inputTokens, outputTokens, durationMs             sql.NullInt64
+	)
+	if err := row.Scan(&r.ID, &r.ProjectID, &issueID, &r.AgentID, &messageID, &provider, &model, &prompt, &hash,
+		&rawOut, &plan, &result, &commitID, &inputTokens, &outputTokens, &durationMs,
+		&r.Status, &errText, &r.StartedAt, &r.FinishedAt); err != nil {
+		return r, err
+	}
+	r.IssueID, r.MessageID, r.Provider, r.Model, r.PromptHash = issueID.String, messageID.String, provider.String, model.String, hash.String
+	r.Prompt, r.RawOutput, r.CommitID, r.Error = prompt.String, rawOut.String, commitID.String, errText.String
+	r.InputTokens, r.OutputTokens, r.DurationMs = int(inputTokens.Int64), int(outputTokens.Int64), durationMs.Int64
+	r.AgentName = agentDisplayNames[r.AgentID]
+	if plan.String != "" {
+		if err := json.Unmarshal([]byte(plan.String), &r.Plan); err != nil {
+			log.Printf("db: agent run %s has an invalid plan: %v", r.ID, err)
+		}
+	}
+	if result.String != "" {
+		if err := json.Unmarshal([]byte(result.String), &r.Result); err != nil {
+			log.Printf("db: agent run %s has an invalid result: %v", r.ID, err)
+		}
+	}
+	return r, nil
+}
+
+// ListRunRecords returns up to limit of a project's most recent agent runs
+// matching filter, newest first.
+func ListRunRecords(db *sql.DB, projectID string, filter RunFilter, limit int) ([]RunRecord, error) {
+	query := `SELECT ` + runRecordColumns + ` FROM agent_runs WHERE project_id = ?`
+	args := []interface{}{projectID}
+	if filter.IssueID != "" {
+		query += ` AND issue_id = ?`
+		args = append(args, filter.IssueID)
+	}
+	if filter.AgentID != "" {
+		query += ` AND agent_id = ?`
+		args = append(args, filter.AgentID)
+	}
+	if filter.Status != "" {
+		query += ` AND status = ?`
+		args = append(args, filter.Status)
+	}
+	query += ` ORDER BY started_at DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]RunRecord, 0)
+	for rows.Next() {
+		r, err := scanRunRecord(rows)
+		if err != nil {
+			log.Printf("db: skipping agent run: %v", err)
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// LoadRunRecord returns the agent run with id.
+func LoadRunRecord(db *sql.DB, id string) (*RunRecord, error) {
+	r, err := scanRunRecord(db.QueryRow(`SELECT `+runRecordColumns+` FROM agent_runs WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRunRecordNotFound
+	}
+	return &r, err
+}
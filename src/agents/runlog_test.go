@@ -0,0 +1,38 @@
+package agents
+
+import (
+	"testing"
+
+	"replychat/src/llm"
+	"replychat/src/projectfs"
+)
+
+func TestPromptHash(t *testing.T) {
+	messages := []llm.Message{{Role: llm.RoleSystem, Content: "You are a QA Tester."}, {Role: llm.RoleUser, Content: "Add tests"}}
+	hash := promptHash(messages)
+	if len(hash) != 64 || hash != promptHash(messages) {
+		t.Fatalf("hash should be a stable SHA-256: %q", hash)
+	}
+	messages[1].Content = "Add more tests"
+	if promptHash(messages) == hash {
+		t.Fatal("different prompts hashed alike")
+	}
+}
+
+func TestRunRecordSetResult(t *testing.T) {
+	var record RunRecord
+	record.setResult(&AgentActionPlan{Deletes: []string{"old.txt"}}, &projectfs.CommitResult{CommitID: "abc123"}, []string{"Deleted old.txt"}, map[string]interface{}{
+		"model":     map[string]interface{}{"provider": "openai"},
+		"toolSteps": 2,
+		"changeSet": ChangeSet{ID: "cs1"},
+	})
+	if record.CommitID != "abc123" || record.Plan == nil || record.Result["changeSetId"] != "cs1" || record.Result["toolSteps"] != 2 {
+		t.Fatalf("unexpected record: %+v", record)
+	}
+	if _, ok := record.Result["model"]; ok {
+		t.Fatal("the model belongs in its own columns, not the result")
+	}
+	if listed := record.ForList(); listed.Plan != nil || listed.Result != nil {
+		t.Fatalf("list view should drop the plan and result: %+v", listed)
+	}
+}
@@ -0,0 +1,617 @@
+package agents
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"replychat/src/llm"
+	"replychat/src/projectfs"
+)
+
+// Tool limits keep a single result from flooding the conversation.
+const (
+	maxToolResultTokens = 2000
+	maxReadLines        = 400
+	maxListEntries      = 300
+	maxSearchResults    = 50
+)
+
+// toolRun holds the state of one agent response while it calls tools: the
+// workspace it may touch and everything it changed along the way.
+type toolRun struct {
+	p             *MessageProcessor
+	projectID     string
+	agentType     string
+	workspacePath string
+
+	// applied collects every file write and mutation made through tools so
+	// the final message can summarize them like a one-shot plan.
+	applied AgentActionPlan
+	changed bool
+	notes   []string
+	calls   []toolCallRecord
+	// skipped holds changes that did not apply and were not fixed by a
+	// later call.
+	skipped []skippedChange
+}
+
+// toolCallRecord is the metadata kept for each tool call.
+type toolCallRecord struct {
+	Name   string `json:"name"`
+	Target string `json:"target,omitempty"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+}
+
+type agentTool struct {
+	spec llm.ToolSpec
+	// target names what the call touched, for the metadata record.
+	run func(r *toolRun, args json.RawMessage) (result, target string, err error)
+}
+
+func schema(required []string, props map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+		"required":   required,
+	}
+}
+
+func prop(kind, description string) map[string]interface{} {
+	return map[string]interface{}{"type": kind, "description": description}
+}
+
+var workspaceTools = []agentTool{
+	{
+		spec: llm.ToolSpec{
+			Name:        "read_file",
+			Description: "Read a text file from the workspace. Optionally limit to a 1-based line range.",
+			Parameters: schema([]string{"path"}, map[string]interface{}{
+				"path":       prop("string", "File path relative to the workspace root"),
+				"start_line": prop("integer", "First line to return (1-based)"),
+				"end_line":   prop("integer", "Last line to return (inclusive)"),
+			}),
+		},
+		run: (*toolRun).readFile,
+	},
+	{
+		spec: llm.ToolSpec{
+			Name:        "list_dir",
+			Description: "List files and directories under a workspace path, honouring .gitignore.",
+			Parameters: schema(nil, map[string]interface{}{
+				"path":      prop("string", "Directory relative to the workspace root; defaults to the root"),
+				"recursive": prop("boolean", "List every file below the directory instead of its direct children"),
+			}),
+		},
+		run: (*toolRun).listDir,
+	},
+	{
+		spec: llm.ToolSpec{
+			Name:        "search",
+			Description: "Search workspace text files for a string (case-insensitive) or a regular expression. Returns path:line: text matches.",
+			Parameters: schema([]string{"query"}, map[string]interface{}{
+				"query": prop("string", "Text or regular expression to find"),
+				"path":  prop("string", "Only search below this directory"),
+				"regex": prop("boolean", "Treat query as a Go regular expression"),
+			}),
+		},
+		run: (*toolRun).search,
+	},
+	{
+		spec: llm.ToolSpec{
+			Name:        "write_file",
+			Description: "Create or replace a file with the given full contents.",
+			Parameters: schema([]string{"path", "content"}, map[string]interface{}{
+				"path":      prop("string", "File path relative to the workspace root"),
+				"content":   prop("string", "Complete new file contents"),
+				"overwrite": prop("boolean", "Replace the file if it exists (default true)"),
+			}),
+		},
+		run: (*toolRun).writeFile,
+	},
+	{
+		spec: llm.ToolSpec{
+			Name:        "apply_patch",
+			Description: "Apply an action plan: whole-file writes, find/replace mutations, unified diff patches, renames, chmods and deletes. Read a file before editing it; find text and diff context must match its current text. Prefer patches for several edits to one file.",
+			Parameters: schema(nil, map[string]interface{}{
+				"files": map[string]interface{}{
+					"type": "array",
+					"items": schema([]string{"path", "content"}, map[string]interface{}{
+						"path":      prop("string", "File path"),
+						"content":   prop("string", "Full file contents"),
+						"overwrite": prop("boolean", "Replace the file if it exists (default true)"),
+					}),
+				},
+				"mutations": map[string]interface{}{
+					"type": "array",
+					"items": schema([]string{"path", "find", "replace"}, map[string]interface{}{
+						"path":    prop("string", "File path"),
+						"find":    prop("string", "Exact text to replace"),
+						"replace": prop("string", "Replacement text"),
+					}),
+				},
+				"patches": map[string]interface{}{"type": "array", "items": prop("string", "Unified diff (--- a/path, +++ b/path, @@ hunks); use /dev/null to create or delete a file")},
+				"renames": map[string]interface{}{
+					"type": "array",
+					"items": schema([]string{"from", "to"}, map[string]interface{}{
+						"from": prop("string", "Current path"),
+						"to":   prop("string", "New path"),
+					}),
+				},
+				"chmods": map[string]interface{}{
+					"type": "array",
+					"items": schema([]string{"path", "mode"}, map[string]interface{}{
+						"path": prop("string", "File path"),
+						"mode": prop("string", "Octal mode such as 755, or +x / -x"),
+					}),
+				},
+				"deletes": map[string]interface{}{"type": "array", "items": prop("string", "Path to delete")},
+				"notes":   map[string]interface{}{"type": "array", "items": prop("string", "Short status note")},
+			}),
+		},
+		run: (*toolRun).applyPatch,
+	},
+}
+
+var collaborationTools = []agentTool{
+	{
+		spec: llm.ToolSpec{
+			Name:        "create_issue",
+			Description: "Create a kanban issue, optionally assigned to an agent.",
+			Parameters: schema([]string{"title"}, map[string]interface{}{
+				"title":       prop("string", "Short issue title"),
+				"description": prop("string", "What needs to be done"),
+				"priority":    prop("string", "low, medium, high or urgent"),
+				"tags":        map[string]interface{}{"type": "array", "items": prop("string", "Tag")},
+				"assignee":    prop("string", "Agent to assign, e.g. Backend Architect"),
+			}),
+		},
+		run: (*toolRun).createIssue,
+	},
+	{
+		spec: llm.ToolSpec{
+			Name:        "open_dialog",
+			Description: "Ask the team to choose between options. The answer arrives later; do not wait for it.",
+			Parameters: schema([]string{"title", "options"}, map[string]interface{}{
+				"title":   prop("string", "Decision to make"),
+				"message": prop("string", "Context for the decision"),
+				"options": map[string]interface{}{"type": "array", "items": prop("string", "Option")},
+				"default": prop("string", "Suggested option"),
+			}),
+		},
+		run: (*toolRun).openDialog,
+	},
+	{
+		spec: llm.ToolSpec{
+			Name:        "mention_agent",
+			Description: "Post a message asking another agent to collaborate.",
+			Parameters: schema([]string{"agent", "message"}, map[string]interface{}{
+				"agent":   prop("string", "Agent name, e.g. Frontend Developer"),
+				"message": prop("string", "What you need from them"),
+			}),
+		},
+		run: (*toolRun).mentionAgent,
+	},
+}
+
+// tools returns the tools available to this run. Workspace tools are left
+// out when the workspace could not be prepared.
+func (r *toolRun) tools() []agentTool {
+	var tools []agentTool
+	if r.workspacePath != "" {
+		tools = append(tools, workspaceTools...)
+	}
+	return append(tools, collaborationTools...)
+}
+
+func (r *toolRun) specs() []llm.ToolSpec {
+	var specs []llm.ToolSpec
+	for _, tool := range r.tools() {
+		specs = append(specs, tool.spec)
+	}
+	return specs
+}
+
+// call runs one tool call and returns the text sent back to the model.
+// Errors are reported to the model rather than aborting the loop.
+func (r *toolRun) call(call llm.ToolCall) string {
+	record := toolCallRecord{Name: call.Name}
+	defer func() { r.calls = append(r.calls, record) }()
+
+	var tool *agentTool
+	for _, candidate := range r.tools() {
+		if candidate.spec.Name == call.Name {
+			c := candidate
+			tool = &c
+			break
+		}
+	}
+	if tool == nil {
+		record.Error = "unknown tool"
+		return fmt.Sprintf("error: unknown tool %q", call.Name)
+	}
+
+	args := json.RawMessage(call.Arguments)
+	if len(strings.TrimSpace(call.Arguments)) == 0 {
+		args = json.RawMessage("{}")
+	}
+	result, target, err := tool.run(r, args)
+	record.Target = target
+	if err != nil {
+		record.Error = err.Error()
+		return "error: " + err.Error()
+	}
+	record.OK = true
+	return truncateTokens(result, maxToolResultTokens)
+}
+
+// resolve maps a model-supplied path to a workspace-relative and absolute
+// path, rejecting anything outside the workspace, including through a
+// symlink, and anything in .git. A path that does not exist yet is checked
+// lexically only.
+func (r *toolRun) resolve(candidate string) (string, string, error) {
+	rel := normalizePlanPath(r.workspacePath, candidate)
+	if rel == "" || rel == "." {
+		return "", r.workspacePath, nil
+	}
+	abs, err := projectfs.ResolveInside(r.workspacePath, rel)
+	if errors.Is(err, fs.ErrNotExist) {
+		abs, err = projectfs.SecureJoin(r.workspacePath, rel)
+	}
+	if err != nil {
+		return "", "", projectfs.ErrPathEscapes
+	}
+	return rel, abs, nil
+}
+
+func (r *toolRun) readFile(raw json.RawMessage) (string, string, error) {
+	var args struct {
+		Path      string `json:"path"`
+		StartLine int    `json:"start_line"`
+		EndLine   int    `json:"end_line"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	rel, _, err := r.resolve(args.Path)
+	if err != nil {
+		return "", args.Path, err
+	}
+	if rel == "" {
+		return "", args.Path, errors.New("path is a directory; use list_dir")
+	}
+	content, ok := readWorkspaceText(r.workspacePath, rel)
+	if !ok {
+		return "", rel, errors.New("not found, not a regular file, binary or too large")
+	}
+
+	lines := strings.SplitAfter(string(content), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	start := max(args.StartLine, 1)
+	end := args.EndLine
+	if end <= 0 || end > len(lines) {
+		end = len(lines)
+	}
+	if end-start+1 > maxReadLines {
+		end = start + maxReadLines - 1
+	}
+	if start > end {
+		return fmt.Sprintf("%s has %d lines", rel, len(lines)), rel, nil
+	}
+	header := fmt.Sprintf("%s (lines %d-%d of %d)\n", rel, start, end, len(lines))
+	return header + strings.Join(lines[start-1:end], ""), rel, nil
+}
+
+func (r *toolRun) listDir(raw json.RawMessage) (string, string, error) {
+	var args struct {
+		Path      string `json:"path"`
+		Recursive bool   `json:"recursive"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	rel, _, err := r.resolve(args.Path)
+	if err != nil {
+		return "", args.Path, err
+	}
+	files, err := projectfs.ListFiles(r.workspacePath)
+	if err != nil {
+		return "", rel, err
+	}
+
+	prefix := ""
+	if rel != "" {
+		prefix = strings.TrimSuffix(filepathToSlash(rel), "/") + "/"
+	}
+	seen := map[string]bool{}
+	var entries []string
+	for _, f := range files {
+		if !strings.HasPrefix(f, prefix) {
+			continue
+		}
+		entry := strings.TrimPrefix(f, prefix)
+		if !args.Recursive {
+			if idx := strings.Index(entry, "/"); idx >= 0 {
+				entry = entry[:idx+1]
+			}
+		}
+		if !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	sort.Strings(entries)
+
+	target := rel
+	if target == "" {
+		target = "."
+	}
+	if len(entries) == 0 {
+		return fmt.Sprintf("%s: no files", target), target, nil
+	}
+	more := ""
+	if len(entries) > maxListEntries {
+		more = fmt.Sprintf("\n…and %d more", len(entries)-maxListEntries)
+		entries = entries[:maxListEntries]
+	}
+	return target + ":\n" + strings.Join(entries, "\n") + more, target, nil
+}
+
+func (r *toolRun) search(raw json.RawMessage) (string, string, error) {
+	var args struct {
+		Query string `json:"query"`
+		Path  string `json:"path"`
+		Regex bool   `json:"regex"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	if strings.TrimSpace(args.Query) == "" {
+		return "", "", errors.New("query required")
+	}
+	rel, _, err := r.resolve(args.Path)
+	if err != nil {
+		return "", args.Query, err
+	}
+
+	match := func(line string) bool {
+		return strings.Contains(strings.ToLower(line), strings.ToLower(args.Query))
+	}
+	if args.Regex {
+		re, err := regexp.Compile(args.Query)
+		if err != nil {
+			return "", args.Query, fmt.Errorf("invalid regex: %w", err)
+		}
+		match = re.MatchString
+	}
+
+	files, err := projectfs.ListFiles(r.workspacePath)
+	if err != nil {
+		return "", args.Query, err
+	}
+	prefix := ""
+	if rel != "" {
+		prefix = strings.TrimSuffix(filepathToSlash(rel), "/") + "/"
+	}
+
+	var results []string
+	truncated := false
+	for _, f := range files {
+		if !strings.HasPrefix(f, prefix) {
+			continue
+		}
+		content, ok := readWorkspaceText(r.workspacePath, f)
+		if !ok {
+			continue
+		}
+		for i, line := range strings.Split(string(content), "\n") {
+			if !match(line) {
+				continue
+			}
+			if len(results) >= maxSearchResults {
+				truncated = true
+				break
+			}
+			results = append(results, fmt.Sprintf("%s:%d: %s", f, i+1, strings.TrimSpace(firstLine(line, 200))))
+		}
+		if truncated {
+			break
+		}
+	}
+	if len(results) == 0 {
+		return "no matches", args.Query, nil
+	}
+	out := strings.Join(results, "\n")
+	if truncated {
+		out += fmt.Sprintf("\n…stopped after %d matches; narrow the query or path", maxSearchResults)
+	}
+	return out, args.Query, nil
+}
+
+func (r *toolRun) writeFile(raw json.RawMessage) (string, string, error) {
+	var file GeneratedFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return "", "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	if strings.TrimSpace(file.Path) == "" {
+		return "", "", errors.New("path required")
+	}
+	summary, err := r.apply(AgentActionPlan{Files: []GeneratedFile{file}})
+	return summary, file.Path, err
+}
+
+func (r *toolRun) applyPatch(raw json.RawMessage) (string, string, error) {
+	var plan AgentActionPlan
+	if err := json.Unmarshal(raw, &plan); err != nil {
+		return "", "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	if !plan.HasChanges() {
+		return "", "", errors.New("nothing to apply")
+	}
+	seen := map[string]bool{}
+	var targets []string
+	for _, f := range plan.Files {
+		if !seen[f.Path] {
+			seen[f.Path] = true
+			targets = append(targets, f.Path)
+		}
+	}
+	for _, m := range plan.Mutations {
+		if !seen[m.Path] {
+			seen[m.Path] = true
+			targets = append(targets, m.Path)
+		}
+	}
+	summary, err := r.apply(plan)
+	return summary, strings.Join(targets, ", "), err
+}
+
+// apply runs plan through applyActionPlan and remembers what changed. The
+// result tells the model which changes were skipped so it can retry them.
+func (r *toolRun) apply(plan AgentActionPlan) (string, error) {
+	result, err := r.p.applyActionPlan(r.workspacePath, r.agentType, plan)
+	if err != nil {
+		return "", err
+	}
+
+	failed := map[string]bool{}
+	for _, s := range result.Skipped {
+		failed[s.Kind+":"+s.Path] = true
+	}
+	// A later successful change to a path supersedes earlier skips there.
+	succeeded := map[string]bool{}
+	for _, f := range plan.Files {
+		if !failed["file:"+f.Path] {
+			succeeded[f.Path] = true
+			r.applied.Files = append(r.applied.Files, f)
+		}
+	}
+	for _, m := range plan.Mutations {
+		if !failed["mutation:"+m.Path] {
+			succeeded[m.Path] = true
+			r.applied.Mutations = append(r.applied.Mutations, m)
+		}
+	}
+	kept := r.skipped[:0]
+	for _, s := range r.skipped {
+		if !succeeded[s.Path] {
+			kept = append(kept, s)
+		}
+	}
+	r.skipped = append(kept, result.Skipped...)
+	r.applied.Patches = append(r.applied.Patches, plan.Patches...)
+	r.applied.Renames = append(r.applied.Renames, plan.Renames...)
+	r.applied.Chmods = append(r.applied.Chmods, plan.Chmods...)
+	r.applied.Deletes = append(r.applied.Deletes, plan.Deletes...)
+	r.applied.Notes = append(r.applied.Notes, plan.Notes...)
+	r.notes = append(r.notes, result.Fuzzy...)
+	if result.Applied() > 0 {
+		r.changed = true
+	}
+
+	out := result.Summary
+	if notes := result.Notes(); len(notes) > 0 {
+		out += "\n" + strings.Join(notes, "\n")
+	}
+	if len(result.Skipped) > 0 {
+		out += "\nRead the affected files and retry with find text copied exactly."
+	}
+	return out, nil
+}
+
+// summary describes the run's workspace changes in the same form as
+// applyActionPlan.
+func (r *toolRun) summary() string {
+	name := agentDisplayNames[r.agentType]
+	if name == "" {
+		name = r.agentType
+	}
+	return fmt.Sprintf("%s updated workspace (files=%d, mutations=%d)", name, len(r.applied.Files), len(r.applied.Mutations))
+}
+
+func (r *toolRun) createIssue(raw json.RawMessage) (string, string, error) {
+	var args struct {
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		Priority    string   `json:"priority"`
+		Tags        []string `json:"tags"`
+		Assignee    string   `json:"assignee"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	if strings.TrimSpace(args.Title) == "" {
+		return "", "", errors.New("title required")
+	}
+	note, err := r.p.handleIssueBlock(r.projectID, r.agentType, map[string]string{
+		"title":       args.Title,
+		"description": args.Description,
+		"priority":    args.Priority,
+		"tags":        strings.Join(args.Tags, ","),
+		"assignee":    args.Assignee,
+	})
+	if err != nil {
+		return "", args.Title, err
+	}
+	r.notes = append(r.notes, note)
+	return note, args.Title, nil
+}
+
+func (r *toolRun) openDialog(raw json.RawMessage) (string, string, error) {
+	var args struct {
+		Title   string   `json:"title"`
+		Message string   `json:"message"`
+		Options []string `json:"options"`
+		Default string   `json:"default"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	if len(args.Options) == 0 {
+		return "", args.Title, errors.New("options required")
+	}
+	// Dialog blocks carry options comma-separated.
+	options := make([]string, 0, len(args.Options))
+	for _, option := range args.Options {
+		options = append(options, strings.ReplaceAll(option, ",", ";"))
+	}
+	note := r.p.handleDialogBlock(r.projectID, r.agentType, map[string]string{
+		"title":   args.Title,
+		"message": args.Message,
+		"options": strings.Join(options, ", "),
+		"default": args.Default,
+	})
+	r.notes = append(r.notes, note)
+	return note + ". The team will answer in the chat.", args.Title, nil
+}
+
+func (r *toolRun) mentionAgent(raw json.RawMessage) (string, string, error) {
+	var args struct {
+		Agent   string `json:"agent"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return "", "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	if strings.TrimSpace(args.Message) == "" {
+		return "", args.Agent, errors.New("message required")
+	}
+	note := r.p.handleMentionBlock(r.projectID, r.agentType, map[string]string{
+		"agent":   args.Agent,
+		"message": args.Message,
+	})
+	r.notes = append(r.notes, note)
+	return note, args.Agent, nil
+}
+
+func filepathToSlash(p string) string {
+	return path.Clean(strings.ReplaceAll(p, "\\", "/"))
+}
@@ -0,0 +1,293 @@
+package agents
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"replychat/src/projectfs"
+)
+
+// Workspace context shows an agent the project's file tree and the contents
+// of the files most relevant to the request, so find/replace mutations target
+// text that actually exists.
+const (
+	defaultWorkspaceTokens = 6000
+	// maxTreeEntries bounds the file listing; the rest are only counted.
+	maxTreeEntries = 300
+	// maxScannedFileBytes skips large files for keyword search and inclusion.
+	maxScannedFileBytes = 128 * 1024
+	// maxScannedFiles bounds how many files are opened for keyword search.
+	maxScannedFiles = 400
+	// minPartialTokens is the smallest useful excerpt of a file that does not
+	// fit in full.
+	minPartialTokens = 200
+)
+
+var wellKnownFiles = map[string]bool{
+	"readme.md":        true,
+	"package.json":     true,
+	"go.mod":           true,
+	"pyproject.toml":   true,
+	"requirements.txt": true,
+	"cargo.toml":       true,
+	"dockerfile":       true,
+}
+
+var keywordStopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "with": true, "that": true, "this": true,
+	"you": true, "are": true, "can": true, "please": true, "add": true, "make": true,
+	"from": true, "into": true, "should": true, "would": true, "could": true, "have": true,
+	"has": true, "need": true, "use": true, "using": true, "new": true, "when": true,
+	"task": true, "title": true, "priority": true, "description": true, "work": true,
+	"begin": true, "immediately": true, "update": true, "project": true, "workspace": true,
+	"changes": true, "summarize": true, "respond": true, "assigned": true, "queued": true,
+	"provided": true, "additional": true, "your": true, "our": true, "all": true,
+}
+
+// workspaceContext is the file tree and selected file contents for a prompt.
+type workspaceContext struct {
+	Prompt string
+	// Files lists the paths whose contents were included, in prompt order.
+	Files []string
+	// Truncated lists included files that were cut short.
+	Truncated []string
+}
+
+type scoredFile struct {
+	path  string
+	score int
+}
+
+// buildWorkspaceContext lists the workspace and includes the files most
+// relevant to query within AGENT_WORKSPACE_TOKENS.
+func buildWorkspaceContext(workspacePath, query string) workspaceContext {
+	budget := contextSetting("AGENT_WORKSPACE_TOKENS", defaultWorkspaceTokens)
+	if workspacePath == "" || budget == 0 {
+		return workspaceContext{}
+	}
+	files, err := projectfs.ListFiles(workspacePath)
+	if err != nil {
+		log.Printf("workspace: failed to list %s: %v", workspacePath, err)
+		return workspaceContext{}
+	}
+	return assembleWorkspaceContext(files, query, budget, func(rel string) ([]byte, bool) {
+		return readWorkspaceText(workspacePath, rel)
+	})
+}
+
+// assembleWorkspaceContext does the selection for buildWorkspaceContext;
+// read returns a file's contents and whether it is text worth showing.
+func assembleWorkspaceContext(files []string, query string, budget int, read func(string) ([]byte, bool)) workspaceContext {
+	if len(files) == 0 {
+		return workspaceContext{Prompt: "Workspace files: (empty workspace)"}
+	}
+
+	cache := map[string][]byte{}
+	uncached := read
+	read = func(rel string) ([]byte, bool) {
+		if content, ok := cache[rel]; ok {
+			return content, content != nil
+		}
+		content, ok := uncached(rel)
+		if !ok {
+			content = nil
+		}
+		cache[rel] = content
+		return content, ok
+	}
+
+	tree := renderTree(files, budget/4)
+	remaining := budget - estimateTokens(tree)
+
+	var sections []string
+	var out workspaceContext
+	for _, candidate := range rankFiles(files, query, read) {
+		if remaining < minPartialTokens {
+			break
+		}
+		content, ok := read(candidate.path)
+		if !ok {
+			continue
+		}
+		text := string(content)
+		truncated := false
+		header := fmt.Sprintf("--- %s ---\n", candidate.path)
+		cost := estimateTokens(header + text)
+		if cost > remaining {
+			text = truncateTokens(text, remaining-estimateTokens(header)-10)
+			truncated = true
+		}
+		section := header + text
+		remaining -= estimateTokens(section)
+		sections = append(sections, section)
+		out.Files = append(out.Files, candidate.path)
+		if truncated {
+			out.Truncated = append(out.Truncated, candidate.path)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(tree)
+	if len(sections) > 0 {
+		b.WriteString("\n\nRelevant file contents. Mutation \"find\" strings must match this text exactly; to change a file not shown here, rewrite it via \"files\" instead.\n\n")
+		b.WriteString(strings.Join(sections, "\n\n"))
+	}
+	out.Prompt = b.String()
+	return out
+}
+
+// renderTree lists files within budget tokens.
+func renderTree(files []string, budget int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Workspace files (%d):", len(files))
+	shown := 0
+	for _, f := range files {
+		line := "\n" + f
+		if shown >= maxTreeEntries || estimateTokens(b.String()+line) > budget {
+			break
+		}
+		b.WriteString(line)
+		shown++
+	}
+	if shown < len(files) {
+		fmt.Fprintf(&b, "\n…and %d more", len(files)-shown)
+	}
+	return b.String()
+}
+
+// rankFiles scores files by explicit path mentions, keyword matches in the
+// path and keyword matches in the content, highest first. Files with no
+// signal at all are left out, except well-known project files.
+func rankFiles(files []string, query string, read func(string) ([]byte, bool)) []scoredFile {
+	lowerQuery := strings.ToLower(query)
+
+	scores := make(map[string]int, len(files))
+	// Mentioned paths are removed before keyword extraction so their
+	// directory names do not pull in every sibling file.
+	keywordQuery := lowerQuery
+	for _, f := range files {
+		lower := strings.ToLower(f)
+		base := path.Base(lower)
+		switch {
+		case strings.Contains(lowerQuery, lower):
+			scores[f] += 100
+			keywordQuery = strings.ReplaceAll(keywordQuery, lower, " ")
+		case strings.Contains(base, ".") && containsWord(lowerQuery, base):
+			scores[f] += 40
+		}
+	}
+	keywords := queryKeywords(keywordQuery)
+
+	for _, f := range files {
+		lower := strings.ToLower(f)
+		base := path.Base(lower)
+		score := 0
+		for _, kw := range keywords {
+			if strings.Contains(lower, kw) {
+				score += 10
+			}
+		}
+		if wellKnownFiles[base] && !strings.Contains(lower, "/") {
+			score++
+		}
+		scores[f] += score
+	}
+
+	if len(keywords) > 0 {
+		scanned := 0
+		for _, f := range files {
+			if scanned >= maxScannedFiles {
+				break
+			}
+			content, ok := read(f)
+			if !ok {
+				continue
+			}
+			scanned++
+			lower := bytes.ToLower(content)
+			hits := 0
+			for _, kw := range keywords {
+				hits += bytes.Count(lower, []byte(kw))
+			}
+			scores[f] += 3 * min(hits, 5)
+		}
+	}
+
+	var ranked []scoredFile
+	for _, f := range files {
+		if scores[f] > 0 {
+			ranked = append(ranked, scoredFile{path: f, score: scores[f]})
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return len(ranked[i].path) < len(ranked[j].path)
+	})
+	return ranked
+}
+
+// queryKeywords extracts distinct lowercase words worth searching for.
+func queryKeywords(query string) []string {
+	seen := map[string]bool{}
+	var keywords []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}) {
+		if utf8.RuneCountInString(word) < 3 || keywordStopWords[word] || seen[word] {
+			continue
+		}
+		seen[word] = true
+		keywords = append(keywords, word)
+	}
+	return keywords
+}
+
+// containsWord reports whether word appears in text delimited by non-path
+// characters, so "app.js" does not match "myapp.json".
+func containsWord(text, word string) bool {
+	isPathChar := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' || r == '-'
+	}
+	for start := 0; ; {
+		idx := strings.Index(text[start:], word)
+		if idx < 0 {
+			return false
+		}
+		idx += start
+		end := idx + len(word)
+		before, _ := utf8.DecodeLastRuneInString(text[:idx])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if (idx == 0 || !isPathChar(before) || before == '/') && (end == len(text) || !isPathChar(after) || after == '.') {
+			return true
+		}
+		start = idx + 1
+	}
+}
+
+// readWorkspaceText returns the file's contents when it is small, valid
+// UTF-8 text. Files reached through a symlink out of the workspace, or in
+// .git, are not read.
+func readWorkspaceText(workspacePath, rel string) ([]byte, bool) {
+	absPath, err := projectfs.ResolveInside(workspacePath, rel)
+	if err != nil {
+		return nil, false
+	}
+	info, err := os.Stat(absPath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > maxScannedFileBytes {
+		return nil, false
+	}
+	content, err := os.ReadFile(absPath)
+	if err != nil || bytes.IndexByte(content, 0) >= 0 || !utf8.Valid(content) {
+		return nil, false
+	}
+	return content, true
+}
@@ -0,0 +1,102 @@
+package agents
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func fakeWorkspace(files map[string]string) func(string) ([]byte, bool) {
+	return func(rel string) ([]byte, bool) {
+		content, ok := files[rel]
+		return []byte(content), ok
+	}
+}
+
+func TestWorkspaceContextPrefersMentionedAndMatchingFiles(t *testing.T) {
+	files := map[string]string{
+		"README.md":             "# Demo",
+		"src/routes/users.ts":   "export function listUsers() {}",
+		"src/routes/billing.ts": "export function charge() {}",
+		"src/db/schema.sql":     "CREATE TABLE invoices (id TEXT);",
+		"assets/logo.png":       "",
+	}
+	paths := []string{"README.md", "assets/logo.png", "src/db/schema.sql", "src/routes/billing.ts", "src/routes/users.ts"}
+	read := fakeWorkspace(files)
+	delete(files, "assets/logo.png") // binary: not readable as text
+
+	ctx := assembleWorkspaceContext(paths, "Fix the bug in src/routes/users.ts and store invoices", 2000, read)
+
+	if len(ctx.Files) < 2 || ctx.Files[0] != "src/routes/users.ts" {
+		t.Fatalf("files = %v", ctx.Files)
+	}
+	if ctx.Files[1] != "src/db/schema.sql" {
+		t.Fatalf("expected keyword match second, got %v", ctx.Files)
+	}
+	for _, f := range ctx.Files {
+		if f == "src/routes/billing.ts" || f == "assets/logo.png" {
+			t.Fatalf("unrelated file %s included", f)
+		}
+	}
+	if !strings.Contains(ctx.Prompt, "Workspace files (5):") || !strings.Contains(ctx.Prompt, "--- src/routes/users.ts ---\nexport function listUsers() {}") {
+		t.Fatalf("unexpected prompt:\n%s", ctx.Prompt)
+	}
+}
+
+func TestWorkspaceContextRespectsBudget(t *testing.T) {
+	big := strings.Repeat("invoice line\n", 400)
+	files := map[string]string{"a/invoice.txt": big, "b/invoice.txt": big}
+	ctx := assembleWorkspaceContext([]string{"a/invoice.txt", "b/invoice.txt"}, "invoice totals", 600, fakeWorkspace(files))
+
+	if estimateTokens(ctx.Prompt) > 700 {
+		t.Fatalf("prompt uses %d tokens", estimateTokens(ctx.Prompt))
+	}
+	if len(ctx.Truncated) != 1 || len(ctx.Files) != 1 {
+		t.Fatalf("files = %v truncated = %v", ctx.Files, ctx.Truncated)
+	}
+}
+
+func TestContainsWord(t *testing.T) {
+	if !containsWord("please edit app.js.", "app.js") {
+		t.Fatal("expected match at sentence end")
+	}
+	if containsWord("see myapp.json", "app.js") {
+		t.Fatal("unexpected partial match")
+	}
+}
+
+func TestReadWorkspaceTextRefusesSymlinksOutOfTheWorkspace(t *testing.T) {
+	root := t.TempDir()
+	workspace := filepath.Join(root, "workspace")
+	for name, content := range map[string]string{
+		filepath.Join(root, "secret.txt"):          "outside\n",
+		filepath.Join(workspace, "src", "app.js"):  "listen(3000);\n",
+		filepath.Join(workspace, ".git", "config"): "[core]\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"notes.txt": filepath.Join(root, "secret.txt"),
+		"up.txt":    "../secret.txt",
+		"alias.js":  "src/app.js",
+	} {
+		if err := os.Symlink(target, filepath.Join(workspace, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, rel := range []string{"notes.txt", "up.txt", ".git/config"} {
+		if content, ok := readWorkspaceText(workspace, rel); ok {
+			t.Errorf("%s: read %q", rel, content)
+		}
+	}
+	if content, ok := readWorkspaceText(workspace, "alias.js"); !ok || string(content) != "listen(3000);\n" {
+		t.Errorf("a symlink within the workspace should be readable, got %q", content)
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	authMethodPassword = "password"
+	authMethodOIDC     = "oidc"
+
+	minPasswordLength = 8
+	// bcrypt silently ignores everything past 72 bytes, so reject longer input
+	// instead of pretending it matters.
+	maxPasswordLength = 72
+
+	passwordResetTTL = time.Hour
+)
+
+var (
+	errInvalidCredentials = errors.New("invalid email or password")
+	errTooManyAttempts    = errors.New("too many failed attempts, try again later")
+)
+
+var loginLimiter = newAttemptLimiter(5, 50, 15*time.Minute)
+
+// resetLimiter caps password reset requests. It is separate from
+// loginLimiter so requesting resets for someone's address cannot lock them
+// out of logging in.
+var resetLimiter = newAttemptLimiter(3, 20, time.Hour)
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func validatePassword(password string) error {
+	switch {
+	case len(password) < minPasswordLength:
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	case len(password) > maxPasswordLength:
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordLength)
+	default:
+		return nil
+	}
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// authenticatePassword returns the user ID for a matching email/password pair.
+// Accounts created by the old email-only login have no password hash and must
+// go through the reset flow before they can sign in.
+func authenticatePassword(email, password string) (string, error) {
+	var userID string
+	var passwordHash sql.NullString
+	err := db.QueryRow(`SELECT id, password_hash FROM users WHERE email = ?`, email).Scan(&userID, &passwordHash)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !passwordHash.Valid) {
+		// Burn comparable time so response latency doesn't reveal which
+		// emails have accounts.
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return "", errInvalidCredentials
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash.String), []byte(password)); err != nil {
+		return "", errInvalidCredentials
+	}
+	return userID, nil
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+func dummyPasswordHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("replychat-timing-guard"), bcrypt.DefaultCost)
+	})
+	return dummyHash
+}
+
+func redirectWithError(w http.ResponseWriter, r *http.Request, target, message string) {
+	http.Redirect(w, r, target+"?error="+url.QueryEscape(message)+"#login", http.StatusSeeOther)
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	email := normalizeEmail(r.FormValue("email"))
+	password := r.FormValue("password")
+	if email == "" || password == "" {
+		redirectWithError(w, r, "/", "Email and password required")
+		return
+	}
+
+	ip := clientIP(r)
+	if !loginLimiter.allow(email, ip) {
+		log.Printf("auth: login throttled for %s from %s", email, ip)
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(loginLimiter.window.Seconds())))
+		http.Error(w, errTooManyAttempts.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	userID, err := authenticatePassword(email, password)
+	if err != nil {
+		if errors.Is(err, errInvalidCredentials) {
+			loginLimiter.fail(email, ip)
+			redirectWithError(w, r, "/", err.Error())
+			return
+		}
+		log.Printf("db: login query error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	loginLimiter.reset(email)
+
+	if err := startSession(w, r, userID, authMethodPassword); err != nil {
+		log.Printf("db: failed to create session: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/projects", http.StatusSeeOther)
+}
+
+func signupHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderAuthPage(w, r, "signup")
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	email := normalizeEmail(r.FormValue("email"))
+	password := r.FormValue("password")
+
+	if name == "" || email == "" || password == "" {
+		redirectWithError(w, r, "/signup", "Name, email and password required")
+		return
+	}
+	if err := validatePassword(password); err != nil {
+		redirectWithError(w, r, "/signup", err.Error())
+		return
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("auth: failed to hash password: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	var existing string
+	err = db.QueryRow(`SELECT id FROM users WHERE email = ?`, email).Scan(&existing)
+	if err == nil {
+		redirectWithError(w, r, "/signup", "An account with that email already exists. Sign in or reset your password.")
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("db: query error: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	userID := uuid.New().String()
+	if _, err := db.Exec(`
+		INSERT INTO users (id, email, name, password_hash, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, userID, email, name, hash, time.Now()); err != nil {
+		log.Printf("db: failed to create user: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := startSession(w, r, userID, authMethodPassword); err != nil {
+		log.Printf("db: failed to create session: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/projects", http.StatusSeeOther)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err == nil {
+		db.Exec(`DELETE FROM sessions WHERE id = ?`, cookie.Value)
+		disconnectSession(cookie.Value)
+	}
+
+	clearSessionCookie(w)
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// forgotPasswordHandler issues a single-use reset token. The response is the
+// same whether or not the email exists.
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderAuthPage(w, r, "forgot")
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	email := normalizeEmail(r.FormValue("email"))
+	ip := clientIP(r)
+	if email != "" && allowPasswordResetRequest(email, ip) {
+		if err := issuePasswordReset(r, email); err != nil {
+			log.Printf("auth: failed to issue password reset: %v", err)
+		}
+	}
+
+	http.Redirect(w, r, "/password/forgot?notice="+url.QueryEscape("If that account exists, a reset link is on its way.")+"#login", http.StatusSeeOther)
+}
+
+// allowPasswordResetRequest reports whether a reset link may be sent for
+// email and counts the request, so the endpoint can't be used to spam reset
+// links.
+func allowPasswordResetRequest(email, ip string) bool {
+	if !resetLimiter.allow(email, ip) {
+		return false
+	}
+	resetLimiter.fail(email, ip)
+	return true
+}
+
+func issuePasswordReset(r *http.Request, email string) error {
+	var userID string
+	err := db.QueryRow(`SELECT id FROM users WHERE email = ?`, email).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if _, err := db.Exec(`
+		INSERT INTO password_resets (id, user_id, token_hash, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, uuid.New().String(), userID, hashToken(token), now.Add(passwordResetTTL), now); err != nil {
+		return err
+	}
+
+	deliverPasswordReset(email, publicURL("/password/reset?token="+url.QueryEscape(token)))
+	return nil
+}
+
+// deliverPasswordReset hands the reset link to the operator. There is no mail
+// transport yet, so the link is written to the server log.
+func deliverPasswordReset(email, link string) {
+	log.Printf("auth: password reset requested for %s: %s", email, link)
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		renderAuthPage(w, r, "reset")
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimSpace(r.FormValue("token"))
+	password := r.FormValue("password")
+	failTarget := "/password/reset?token=" + url.QueryEscape(token) + "&error="
+
+	if token == "" {
+		redirectWithError(w, r, "/password/forgot", "Reset link is invalid or has expired")
+		return
+	}
+	if err := validatePassword(password); err != nil {
+		http.Redirect(w, r, failTarget+url.QueryEscape(err.Error())+"#login", http.StatusSeeOther)
+		return
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("auth: failed to hash password: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	var resetID, userID string
+	var expiresAt time.Time
+	err = db.QueryRow(`
+		SELECT id, user_id, expires_at FROM password_resets
+		WHERE token_hash = ? AND used_at IS NULL
+	`, hashToken(token)).Scan(&resetID, &userID, &expiresAt)
+	if err != nil || expiresAt.Before(now) {
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("db: reset lookup failed: %v", err)
+		}
+		redirectWithError(w, r, "/password/forgot", "Reset link is invalid or has expired")
+		return
+	}
+
+	res, err := db.Exec(`UPDATE password_resets SET used_at = ? WHERE id = ? AND used_at IS NULL`, now, resetID)
+	if err != nil {
+		log.Printf("db: failed to consume reset token: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		redirectWithError(w, r, "/password/forgot", "Reset link is invalid or has expired")
+		return
+	}
+
+	if _, err := db.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, hash, userID); err != nil {
+		log.Printf("db: failed to update password: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// A password change invalidates every existing session for the account.
+	if _, err := db.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID); err != nil {
+		log.Printf("db: failed to clear sessions for %s: %v", userID, err)
+	}
+	disconnectUserSessions(userID)
+
+	var email string
+	db.QueryRow(`SELECT email FROM users WHERE id = ?`, userID).Scan(&email)
+	loginLimiter.reset(email)
+	resetLimiter.reset(email)
+
+	if err := startSession(w, r, userID, authMethodPassword); err != nil {
+		log.Printf("db: failed to create session: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/projects", http.StatusSeeOther)
+}
+
+// renderAuthPage renders the landing page with the auth card switched to mode
+// (login, signup, forgot or reset).
+func renderAuthPage(w http.ResponseWriter, r *http.Request, mode string) {
+	query := r.URL.Query()
+	data := map[string]interface{}{
+		"Mode":        mode,
+		"Error":       query.Get("error"),
+		"Notice":      query.Get("notice"),
+		"Token":       query.Get("token"),
+		"OIDCEnabled": oidcProvider != nil,
+		"OIDCName":    "",
+	}
+	if oidcProvider != nil {
+		data["OIDCName"] = oidcProvider.displayName
+	}
+	if err := renderTemplate(w, "index.html", data); err != nil {
+		log.Printf("template: failed to render auth page: %v", err)
+	}
+}
+
+func randomToken(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// publicURL returns the link to path on the server's public address,
+// PUBLIC_URL. Links are never built from the request: its Host header is
+// whatever the client sent. Without PUBLIC_URL they point at localhost.
+func publicURL(path string) string {
+	base := strings.TrimRight(strings.TrimSpace(os.Getenv("PUBLIC_URL")), "/")
+	if base == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "8080"
+		}
+		base = "http://localhost:" + port
+	}
+	return base + path
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// attemptLimiter throttles failed authentication attempts per account and per
+// client address within a sliding window.
+type attemptLimiter struct {
+	mu         sync.Mutex
+	perAccount int
+	perAddress int
+	window     time.Duration
+	failures   map[string][]time.Time
+	now        func() time.Time
+}
+
+func newAttemptLimiter(perAccount, perAddress int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		perAccount: perAccount,
+		perAddress: perAddress,
+		window:     window,
+		failures:   make(map[string][]time.Time),
+		now:        time.Now,
+	}
+}
+
+func (l *attemptLimiter) allow(account, address string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	return len(l.recent("account:"+account, now)) < l.perAccount &&
+		len(l.recent("address:"+address, now)) < l.perAddress
+}
+
+func (l *attemptLimiter) fail(account, address string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for _, key := range []string{"account:" + account, "address:" + address} {
+		l.failures[key] = append(l.recent(key, now), now)
+	}
+}
+
+func (l *attemptLimiter) reset(account string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, "account:"+account)
+}
+
+// recent prunes and returns the failures for key inside the window. Callers
+// must hold l.mu.
+func (l *attemptLimiter) recent(key string, now time.Time) []time.Time {
+	entries := l.failures[key]
+	cutoff := now.Add(-l.window)
+	kept := entries[:0]
+	for _, ts := range entries {
+		if ts.After(cutoff) {
+			kept = append(kept, ts)
+		}
+	}
+	if len(kept) == 0 {
+		delete(l.failures, key)
+		return nil
+	}
+	l.failures[key] = kept
+	return kept
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttemptLimiter(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	limiter := newAttemptLimiter(3, 5, time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("ada@example.com", "10.0.0.1") {
+			t.Fatalf("attempt %d should be allowed", i)
+		}
+		limiter.fail("ada@example.com", "10.0.0.1")
+	}
+	if limiter.allow("ada@example.com", "10.0.0.2") {
+		t.Fatal("account should be locked after 3 failures")
+	}
+
+	// Other accounts from the same address still have budget left.
+	if !limiter.allow("grace@example.com", "10.0.0.1") {
+		t.Fatal("other account should be allowed")
+	}
+	limiter.fail("grace@example.com", "10.0.0.1")
+	limiter.fail("grace@example.com", "10.0.0.1")
+	if limiter.allow("linus@example.com", "10.0.0.1") {
+		t.Fatal("address should be locked after 5 failures")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if !limiter.allow("ada@example.com", "10.0.0.1") {
+		t.Fatal("failures should expire after the window")
+	}
+
+	limiter.fail("ada@example.com", "10.0.0.3")
+	limiter.reset("ada@example.com")
+	if len(limiter.failures["account:ada@example.com"]) != 0 {
+		t.Fatal("reset should clear account failures")
+	}
+}
+
+func TestPasswordResetRequestsDoNotLockLogin(t *testing.T) {
+	previousLogin, previousReset := loginLimiter, resetLimiter
+	loginLimiter, resetLimiter = newAttemptLimiter(5, 50, time.Minute), newAttemptLimiter(3, 20, time.Minute)
+	defer func() { loginLimiter, resetLimiter = previousLogin, previousReset }()
+
+	for i := 0; i < 3; i++ {
+		if !allowPasswordResetRequest("ada@example.com", "10.0.0.1") {
+			t.Fatalf("reset request %d should be allowed", i)
+		}
+	}
+	if allowPasswordResetRequest("ada@example.com", "10.0.0.1") {
+		t.Fatal("reset requests should be capped")
+	}
+	if !loginLimiter.allow("ada@example.com", "10.0.0.2") {
+		t.Fatal("reset requests must not count against the login budget")
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	if err := validatePassword("short"); err == nil {
+		t.Fatal("expected short password to be rejected")
+	}
+	if err := validatePassword("correct horse battery"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestPublicURLIgnoresRequestHost(t *testing.T) {
+	t.Setenv("PORT", "9090")
+	t.Setenv("PUBLIC_URL", "")
+	if got := publicURL("/password/reset?token=x"); got != "http://localhost:9090/password/reset?token=x" {
+		t.Errorf("without PUBLIC_URL: %s", got)
+	}
+	t.Setenv("PUBLIC_URL", "https://chat.example.com/")
+	if got := publicURL("/password/reset?token=x"); got != "https://chat.example.com/password/reset?token=x" {
+		t.Errorf("with PUBLIC_URL: %s", got)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"replychat/src/agents"
+)
+
+// changeSetsAPIHandler lists a project's change sets, optionally filtered by
+// ?status=.
+func changeSetsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	access := accessFromRequest(r)
+
+	sets, err := agents.ListChangeSets(db, access.ProjectID, strings.TrimSpace(r.URL.Query().Get("status")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	views := make([]agents.ChangeSet, 0, len(sets))
+	for _, cs := range sets {
+		views = append(views, cs.ForClient(false))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"changeSets": views,
+		"canReview":  access.Role.can(permReviewChanges),
+	})
+}
+
+// changeSetAPIHandler serves /api/change-sets/{id} (GET, with diffs) and the
+// /approve and /reject actions. Approve takes {"paths": [...]} to approve
+// only some files; omitting paths approves them all.
+func changeSetAPIHandler(w http.ResponseWriter, r *http.Request) {
+	access := accessFromRequest(r)
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/change-sets/"), "/"), "/")
+
+	var (
+		cs  *agents.ChangeSet
+		err error
+	)
+	switch action {
+	case "":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cs, err = agents.LoadChangeSet(db, id)
+	case "approve", "reject":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requirePermission(w, access, permReviewChanges) {
+			return
+		}
+		if action == "reject" {
+			cs, err = agents.RejectChangeSet(db, hubPublisher(), id, access.UserID)
+			break
+		}
+		var req struct {
+			Paths []string `json:"paths"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		cs, err = agents.ApplyChangeSet(db, hubPublisher(), id, access.UserID, req.Paths)
+	default:
+		http.Error(w, "Invalid change set endpoint", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case errors.Is(err, agents.ErrChangeSetNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, agents.ErrChangeSetReviewed), errors.Is(err, agents.ErrChangeSetConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, agents.ErrUnknownChangeSetFile):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if action != "" {
+		log.Printf("changeset: %s reviewed change set %s: %s", access.UserID, id, cs.Status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"changeSet": cs.ForClient(true),
+		"canReview": access.Role.can(permReviewChanges),
+	})
+}
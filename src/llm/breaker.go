@@ -0,0 +1,183 @@
+package llm
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// breaker stops calls to a provider after threshold consecutive failures.
+// After cooldown a single trial call is let through; success closes the
+// circuit and failure re-opens it.
+type breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		b.trial = true
+		return true
+	case BreakerHalfOpen:
+		// Only one trial request at a time.
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.trial = false
+	b.setState(BreakerClosed)
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trial = false
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// release gives up a call allow let through without judging the provider,
+// as when the caller cancels it. A half-open circuit lets the next trial
+// through.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// setState must be called with b.mu held.
+func (b *breaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	log.Printf("llm: circuit for %s %s -> %s", b.name, b.state, state)
+	b.state = state
+	if hook := breakerStateHook; hook != nil {
+		hook(b.name, state)
+	}
+}
+
+// wouldAllow reports whether allow would let a call through, without
+// claiming the half-open trial.
+func (b *breaker) wouldAllow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		return b.now().Sub(b.openedAt) >= b.cooldown
+	case BreakerHalfOpen:
+		return !b.trial
+	default:
+		return true
+	}
+}
+
+func (b *breaker) currentState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+type breakerSet struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	byName    map[string]*breaker
+}
+
+func newBreakerSet(threshold int, cooldown time.Duration) *breakerSet {
+	return &breakerSet{
+		threshold: max(1, threshold),
+		cooldown:  cooldown,
+		now:       time.Now,
+		byName:    map[string]*breaker{},
+	}
+}
+
+func (s *breakerSet) get(name string) *breaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.byName[name]
+	if !ok {
+		b = &breaker{name: name, threshold: s.threshold, cooldown: s.cooldown, now: s.now, state: BreakerClosed}
+		s.byName[name] = b
+	}
+	return b
+}
+
+var (
+	defaultBreakersOnce sync.Once
+	defaultBreakers     *breakerSet
+)
+
+// sharedBreakers is used by every chain so a provider that keeps failing is
+// skipped for all agents, not just the one that tripped it. It is built on
+// first use so LLM_BREAKER_THRESHOLD and LLM_BREAKER_COOLDOWN_SECONDS can come
+// from .env.
+func sharedBreakers() *breakerSet {
+	defaultBreakersOnce.Do(func() {
+		defaultBreakers = newBreakerSet(
+			envInt("LLM_BREAKER_THRESHOLD", 5),
+			time.Duration(envInt("LLM_BREAKER_COOLDOWN_SECONDS", 30))*time.Second,
+		)
+	})
+	return defaultBreakers
+}
+
+// breakerStateHook, when set, is told about every circuit state change.
+var breakerStateHook func(provider, state string)
+
+// OnBreakerStateChange registers fn to be called whenever a provider's
+// circuit changes state. It is meant to be set once at startup.
+func OnBreakerStateChange(fn func(provider, state string)) {
+	breakerStateHook = fn
+}
+
+// BreakerState reports the circuit state for a provider.
+func BreakerState(provider string) string {
+	return sharedBreakers().get(provider).currentState()
+}
+
+// BreakerAllows reports whether the circuit for a provider would currently
+// let a call through.
+func BreakerAllows(provider string) bool {
+	return sharedBreakers().get(provider).wouldAllow()
+}
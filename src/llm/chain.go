@@ -0,0 +1,346 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// RetryPolicy controls how often a single provider is retried on transient
+// errors before the chain moves on to the next one.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy reads LLM_RETRY_ATTEMPTS, LLM_RETRY_BASE_MS and
+// LLM_RETRY_MAX_MS.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: max(1, envInt("LLM_RETRY_ATTEMPTS", 3)),
+		BaseDelay:   time.Duration(envInt("LLM_RETRY_BASE_MS", 500)) * time.Millisecond,
+		MaxDelay:    time.Duration(envInt("LLM_RETRY_MAX_MS", 8000)) * time.Millisecond,
+	}
+}
+
+// backoff returns the delay before retry number attempt (1-based) using
+// exponential backoff with full jitter.
+func (p RetryPolicy) backoff(attempt int, rnd func(int64) int64) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+	ceiling := p.BaseDelay << uint(min(attempt-1, 16))
+	if p.MaxDelay > 0 && (ceiling > p.MaxDelay || ceiling <= 0) {
+		ceiling = p.MaxDelay
+	}
+	return time.Duration(rnd(int64(ceiling) + 1))
+}
+
+// Outcomes reported for each attempt.
+const (
+	OutcomeSuccess       = "success"
+	OutcomeRetryable     = "retryable_error"
+	OutcomeError         = "error"
+	OutcomeCircuitOpen   = "circuit_open"
+	OutcomeNotConfigured = "not_configured"
+	OutcomeCanceled      = "canceled"
+)
+
+// Attempt describes one call (or skipped call) to a provider in a chain.
+type Attempt struct {
+	Provider string
+	Model    string
+	Number   int
+	Outcome  string
+	Duration time.Duration
+	Err      error
+}
+
+// ChainError is returned when every provider in a chain failed.
+type ChainError struct {
+	Attempts []Attempt
+}
+
+func (e *ChainError) Error() string {
+	if len(e.Attempts) == 0 {
+		return "llm: no providers configured"
+	}
+	parts := make([]string, 0, len(e.Attempts))
+	for _, a := range e.Attempts {
+		reason := a.Outcome
+		if a.Err != nil {
+			reason = a.Err.Error()
+		}
+		parts = append(parts, fmt.Sprintf("%s#%d: %s", a.Provider, a.Number, reason))
+	}
+	return "llm: all providers failed (" + strings.Join(parts, "; ") + ")"
+}
+
+// Summary lists each provider once with its final outcome, for user-facing
+// messages.
+func (e *ChainError) Summary() string {
+	seen := map[string]int{}
+	var order []string
+	for i, a := range e.Attempts {
+		if _, ok := seen[a.Provider]; !ok {
+			order = append(order, a.Provider)
+		}
+		seen[a.Provider] = i
+	}
+	parts := make([]string, 0, len(order))
+	for _, name := range order {
+		a := e.Attempts[seen[name]]
+		detail := strings.ReplaceAll(a.Outcome, "_", " ")
+		if a.Number > 1 {
+			detail = fmt.Sprintf("%s after %d attempts", detail, a.Number)
+		}
+		parts = append(parts, fmt.Sprintf("%s (%s)", name, detail))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Chain tries each configured model in order, retrying transient failures and
+// skipping providers whose circuit breaker is open. It never substitutes
+// canned output: if every link fails the caller gets a *ChainError.
+type Chain struct {
+	links    []ModelConfig
+	policy   RetryPolicy
+	observer func(Attempt)
+	sleep    func(context.Context, time.Duration) error
+	rand     func(int64) int64
+	lookup   func(name string) (Provider, error)
+	breakers *breakerSet
+}
+
+// NewChain builds a chain from cfg followed by its fallbacks. An empty
+// provider in the primary link means the server default; fallbacks without a
+// provider are ignored. When cfg declares no fallbacks, LLM_FALLBACKS
+// (comma-separated provider names) is used.
+func NewChain(cfg ModelConfig, observer func(Attempt)) *Chain {
+	primary := cfg
+	primary.Fallbacks = nil
+	if primary.Provider == "" {
+		primary.Provider = DefaultProviderName()
+	}
+
+	fallbacks := cfg.Fallbacks
+	if fallbacks == nil {
+		fallbacks = defaultFallbacks()
+	}
+
+	links := []ModelConfig{}
+	seen := map[string]bool{}
+	for _, link := range append([]ModelConfig{primary}, fallbacks...) {
+		if link.Provider == "" {
+			continue
+		}
+		key := link.Provider + "|" + link.Model
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		links = append(links, link)
+	}
+
+	return &Chain{
+		links:    links,
+		policy:   DefaultRetryPolicy(),
+		observer: observer,
+		sleep:    sleepContext,
+		rand:     rand.Int63n,
+		lookup:   Get,
+		breakers: sharedBreakers(),
+	}
+}
+
+func defaultFallbacks() []ModelConfig {
+	var links []ModelConfig
+	for _, name := range strings.Split(envString("LLM_FALLBACKS", ""), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			links = append(links, ModelConfig{Provider: name})
+		}
+	}
+	return links
+}
+
+// Providers returns the provider names in the order they will be tried.
+func (c *Chain) Providers() []string {
+	names := make([]string, 0, len(c.links))
+	for _, link := range c.links {
+		names = append(names, link.Provider)
+	}
+	return names
+}
+
+func (c *Chain) Generate(ctx context.Context, req Request) (*Response, error) {
+	return c.run(ctx, req, nil)
+}
+
+// Stream streams from the first provider that succeeds. Once any text has
+// reached onDelta the chain stops falling back, because the caller has
+// already shown that output.
+func (c *Chain) Stream(ctx context.Context, req Request, onDelta DeltaFunc) (*Response, error) {
+	return c.run(ctx, req, onDelta)
+}
+
+func (c *Chain) run(ctx context.Context, req Request, onDelta DeltaFunc) (*Response, error) {
+	chainErr := &ChainError{}
+	emitted := false
+
+	var forward DeltaFunc
+	if onDelta != nil {
+		forward = func(delta string) {
+			emitted = true
+			onDelta(delta)
+		}
+	}
+
+	for _, link := range c.links {
+		provider, err := c.lookup(link.Provider)
+		if err != nil {
+			outcome := OutcomeError
+			if errors.Is(err, ErrNotConfigured) {
+				outcome = OutcomeNotConfigured
+			}
+			c.record(chainErr, Attempt{Provider: link.Provider, Model: link.Model, Number: 1, Outcome: outcome, Err: err})
+			continue
+		}
+
+		breaker := c.breakers.get(link.Provider)
+		linkReq := link.Apply(req)
+
+		for attempt := 1; attempt <= c.policy.MaxAttempts; attempt++ {
+			if !breaker.allow() {
+				c.record(chainErr, Attempt{Provider: link.Provider, Model: linkReq.Model, Number: attempt, Outcome: OutcomeCircuitOpen})
+				break
+			}
+
+			start := time.Now()
+			var resp *Response
+			switch {
+			case len(linkReq.Tools) > 0 && !supportsNativeTools(provider):
+				resp, err = generateWithTextTools(ctx, provider, linkReq)
+			case forward != nil:
+				resp, err = provider.Stream(ctx, linkReq, forward)
+			default:
+				resp, err = provider.Generate(ctx, linkReq)
+			}
+			if err == nil && strings.TrimSpace(resp.Text) == "" && len(resp.ToolCalls) == 0 {
+				err = errEmptyResponse
+			}
+			duration := time.Since(start)
+
+			if err == nil {
+				breaker.success()
+				c.record(nil, Attempt{Provider: link.Provider, Model: resp.Model, Number: attempt, Outcome: OutcomeSuccess, Duration: duration})
+				return resp, nil
+			}
+
+			if ctx.Err() != nil {
+				// The caller gave up; that says nothing about the provider.
+				breaker.release()
+				c.record(chainErr, Attempt{Provider: link.Provider, Model: linkReq.Model, Number: attempt, Outcome: OutcomeCanceled, Duration: duration, Err: ctx.Err()})
+				return nil, ctx.Err()
+			}
+
+			if countsAgainstProvider(err) {
+				breaker.failure()
+			} else {
+				// The provider answered; the request itself was rejected.
+				breaker.success()
+			}
+			retryable := IsTransient(err) && !emitted && attempt < c.policy.MaxAttempts
+			outcome := OutcomeError
+			if IsTransient(err) {
+				outcome = OutcomeRetryable
+			}
+			c.record(chainErr, Attempt{Provider: link.Provider, Model: linkReq.Model, Number: attempt, Outcome: outcome, Duration: duration, Err: err})
+
+			if emitted {
+				return nil, chainErr
+			}
+			if !retryable {
+				break
+			}
+			if err := c.sleep(ctx, c.policy.backoff(attempt, c.rand)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return nil, chainErr
+}
+
+func (c *Chain) record(chainErr *ChainError, attempt Attempt) {
+	if chainErr != nil {
+		chainErr.Attempts = append(chainErr.Attempts, attempt)
+	}
+	if c.observer != nil {
+		c.observer(attempt)
+	}
+}
+
+var errEmptyResponse = errors.New("llm: provider returned an empty response")
+
+// StatusError is returned by providers for non-2xx HTTP responses.
+type StatusError struct {
+	StatusCode int
+	Message    string
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *StatusError) Unwrap() error { return e.Err }
+
+// IsTransient reports whether err is worth retrying: timeouts, network
+// failures, rate limiting and server-side errors.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errEmptyResponse) {
+		return true
+	}
+	var status *StatusError
+	if errors.As(err, &status) {
+		code := status.StatusCode
+		return code == 408 || code == 409 || code == 429 || code >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// countsAgainstProvider is false for client errors such as a bad model name,
+// which say nothing about the provider's health.
+func countsAgainstProvider(err error) bool {
+	var status *StatusError
+	if errors.As(err, &status) && status.StatusCode >= 400 && status.StatusCode < 500 {
+		return IsTransient(err)
+	}
+	return true
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,262 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeProvider struct {
+	name    string
+	errs    []error
+	deltas  []string
+	calls   int
+	lastReq Request
+}
+
+func (f *fakeProvider) Name() string { return f.name }
+
+func (f *fakeProvider) Generate(ctx context.Context, req Request) (*Response, error) {
+	return f.Stream(ctx, req, nil)
+}
+
+func (f *fakeProvider) Stream(_ context.Context, req Request, onDelta DeltaFunc) (*Response, error) {
+	f.calls++
+	f.lastReq = req
+	if onDelta != nil {
+		for _, d := range f.deltas {
+			onDelta(d)
+		}
+	}
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Response{Text: "ok from " + f.name, Provider: f.name, Model: req.Model}, nil
+}
+
+func testChain(links []ModelConfig, providers ...*fakeProvider) (*Chain, *[]Attempt, *[]time.Duration) {
+	byName := map[string]Provider{}
+	for _, p := range providers {
+		byName[p.name] = p
+	}
+	var attempts []Attempt
+	var sleeps []time.Duration
+	return &Chain{
+		links:    links,
+		policy:   RetryPolicy{MaxAttempts: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second},
+		observer: func(a Attempt) { attempts = append(attempts, a) },
+		sleep: func(_ context.Context, d time.Duration) error {
+			sleeps = append(sleeps, d)
+			return nil
+		},
+		rand: func(n int64) int64 { return n - 1 },
+		lookup: func(name string) (Provider, error) {
+			if p, ok := byName[name]; ok {
+				return p, nil
+			}
+			return nil, ErrNotConfigured
+		},
+		breakers: newBreakerSet(2, time.Minute),
+	}, &attempts, &sleeps
+}
+
+func outcomes(attempts []Attempt) []string {
+	out := make([]string, len(attempts))
+	for i, a := range attempts {
+		out[i] = a.Provider + ":" + a.Outcome
+	}
+	return out
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestChainRetriesTransientErrorsWithBackoff(t *testing.T) {
+	primary := &fakeProvider{name: "a", errs: []error{&StatusError{StatusCode: 503}, &StatusError{StatusCode: 429}}}
+	chain, attempts, sleeps := testChain([]ModelConfig{{Provider: "a", Model: "m1"}}, primary)
+	chain.breakers = newBreakerSet(5, time.Minute)
+
+	resp, err := chain.Generate(context.Background(), Request{})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if resp.Text != "ok from a" || primary.lastReq.Model != "m1" {
+		t.Fatalf("unexpected response %+v (model %q)", resp, primary.lastReq.Model)
+	}
+	want := []string{"a:retryable_error", "a:retryable_error", "a:success"}
+	if got := outcomes(*attempts); !equalStrings(got, want) {
+		t.Fatalf("attempts = %v, want %v", got, want)
+	}
+	if len(*sleeps) != 2 || (*sleeps)[0] != 100*time.Millisecond || (*sleeps)[1] != 200*time.Millisecond {
+		t.Fatalf("sleeps = %v", *sleeps)
+	}
+}
+
+func TestChainFallsBackOnPermanentError(t *testing.T) {
+	primary := &fakeProvider{name: "a", errs: []error{&StatusError{StatusCode: 400, Message: "bad model"}}}
+	backup := &fakeProvider{name: "b"}
+	chain, attempts, sleeps := testChain([]ModelConfig{{Provider: "a"}, {Provider: "missing"}, {Provider: "b"}}, primary, backup)
+
+	resp, err := chain.Generate(context.Background(), Request{})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if resp.Provider != "b" || primary.calls != 1 {
+		t.Fatalf("provider = %s, primary calls = %d", resp.Provider, primary.calls)
+	}
+	want := []string{"a:error", "missing:not_configured", "b:success"}
+	if got := outcomes(*attempts); !equalStrings(got, want) {
+		t.Fatalf("attempts = %v, want %v", got, want)
+	}
+	if len(*sleeps) != 0 {
+		t.Fatalf("permanent errors should not back off, slept %v", *sleeps)
+	}
+	if state := chain.breakers.get("a").currentState(); state != BreakerClosed {
+		t.Fatalf("client errors should not trip the breaker, state = %s", state)
+	}
+}
+
+func TestChainReturnsChainErrorWhenAllFail(t *testing.T) {
+	primary := &fakeProvider{name: "a", errs: []error{errEmptyResponse, errEmptyResponse}}
+	chain, _, _ := testChain([]ModelConfig{{Provider: "a"}}, primary)
+	chain.policy.MaxAttempts = 2
+
+	_, err := chain.Generate(context.Background(), Request{})
+	var chainErr *ChainError
+	if !errors.As(err, &chainErr) {
+		t.Fatalf("expected ChainError, got %v", err)
+	}
+	if got := chainErr.Summary(); got != "a (retryable error after 2 attempts)" {
+		t.Fatalf("summary = %q", got)
+	}
+}
+
+func TestChainOpensCircuitAndSkipsProvider(t *testing.T) {
+	failing := &fakeProvider{name: "a", errs: []error{errEmptyResponse, errEmptyResponse, errEmptyResponse}}
+	backup := &fakeProvider{name: "b"}
+	chain, attempts, _ := testChain([]ModelConfig{{Provider: "a"}, {Provider: "b"}}, failing, backup)
+	now := time.Now()
+	chain.breakers.now = func() time.Time { return now }
+
+	if _, err := chain.Generate(context.Background(), Request{}); err != nil {
+		t.Fatalf("first Generate: %v", err)
+	}
+	want := []string{"a:retryable_error", "a:retryable_error", "a:circuit_open", "b:success"}
+	if got := outcomes(*attempts); !equalStrings(got, want) {
+		t.Fatalf("attempts = %v, want %v", got, want)
+	}
+
+	*attempts = nil
+	if _, err := chain.Generate(context.Background(), Request{}); err != nil {
+		t.Fatalf("second Generate: %v", err)
+	}
+	if failing.calls != 2 {
+		t.Fatalf("open circuit should skip the provider, calls = %d", failing.calls)
+	}
+	if chain.breakers.get("a").wouldAllow() {
+		t.Fatal("open circuit should not report that it allows calls")
+	}
+
+	// After the cooldown a trial call goes through and closes the circuit.
+	now = now.Add(2 * time.Minute)
+	if !chain.breakers.get("a").wouldAllow() {
+		t.Fatal("circuit should allow a trial call after the cooldown")
+	}
+	failing.errs = nil
+	*attempts = nil
+	resp, err := chain.Generate(context.Background(), Request{})
+	if err != nil || resp.Provider != "a" {
+		t.Fatalf("trial call: %v %+v", err, resp)
+	}
+	if state := chain.breakers.get("a").currentState(); state != BreakerClosed {
+		t.Fatalf("state after trial = %s", state)
+	}
+}
+
+func TestChainCancelledTrialReleasesCircuit(t *testing.T) {
+	failing := &fakeProvider{name: "a", errs: []error{errEmptyResponse, errEmptyResponse}}
+	chain, _, _ := testChain([]ModelConfig{{Provider: "a"}}, failing)
+	now := time.Now()
+	chain.breakers.now = func() time.Time { return now }
+
+	chain.Generate(context.Background(), Request{})
+	if state := chain.breakers.get("a").currentState(); state != BreakerOpen {
+		t.Fatalf("state after failures = %s", state)
+	}
+
+	// The trial call after the cooldown is cancelled by the caller.
+	now = now.Add(2 * time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	failing.errs = []error{context.Canceled}
+	if _, err := chain.Generate(ctx, Request{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled trial: %v", err)
+	}
+	if !chain.breakers.get("a").wouldAllow() {
+		t.Fatal("a cancelled trial should not hold the circuit")
+	}
+	resp, err := chain.Generate(context.Background(), Request{})
+	if err != nil || resp.Provider != "a" {
+		t.Fatalf("next call: %v %+v", err, resp)
+	}
+	if state := chain.breakers.get("a").currentState(); state != BreakerClosed {
+		t.Fatalf("state after the next trial = %s", state)
+	}
+}
+
+func TestChainStreamDoesNotFallBackAfterOutput(t *testing.T) {
+	primary := &fakeProvider{name: "a", deltas: []string{"partial"}, errs: []error{&StatusError{StatusCode: 502}}}
+	backup := &fakeProvider{name: "b"}
+	chain, _, _ := testChain([]ModelConfig{{Provider: "a"}, {Provider: "b"}}, primary, backup)
+
+	var got []string
+	_, err := chain.Stream(context.Background(), Request{}, func(d string) { got = append(got, d) })
+	if err == nil {
+		t.Fatal("expected error after partial output")
+	}
+	if primary.calls != 1 || backup.calls != 0 {
+		t.Fatalf("calls: primary %d, backup %d", primary.calls, backup.calls)
+	}
+	if len(got) != 1 || got[0] != "partial" {
+		t.Fatalf("deltas = %v", got)
+	}
+}
+
+func TestChainStopsWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	primary := &fakeProvider{name: "a", errs: []error{context.Canceled}}
+	backup := &fakeProvider{name: "b"}
+	chain, _, _ := testChain([]ModelConfig{{Provider: "a"}, {Provider: "b"}}, primary, backup)
+
+	if _, err := chain.Generate(ctx, Request{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v", err)
+	}
+	if backup.calls != 0 {
+		t.Fatal("canceled request should not fall back")
+	}
+}
+
+func TestNewChainDeduplicatesLinks(t *testing.T) {
+	chain := NewChain(ModelConfig{
+		Provider:  "a",
+		Fallbacks: []ModelConfig{{Provider: "b"}, {Provider: "a"}, {}},
+	}, nil)
+	if got := chain.Providers(); !equalStrings(got, []string{"a", "b"}) {
+		t.Fatalf("providers = %v", got)
+	}
+}
@@ -0,0 +1,293 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register(ProviderOpenAICompatible, newCompatFromEnv)
+}
+
+// compatProvider speaks the Chat Completions protocol implemented by vLLM,
+// Ollama, llama.cpp's server, LM Studio and similar OpenAI-compatible servers.
+type compatProvider struct {
+	baseURL     string
+	apiKey      string
+	model       string
+	temperature float64
+	maxTokens   int
+	httpClient  *http.Client
+	// nativeTools sends tools as Chat Completions function definitions.
+	// Servers and models without tool support get the text protocol instead.
+	nativeTools bool
+}
+
+func newCompatFromEnv() (Provider, error) {
+	baseURL := strings.TrimRight(envString("LLM_COMPAT_BASE_URL", ""), "/")
+	if baseURL == "" {
+		return nil, ErrNotConfigured
+	}
+	model := envString("LLM_COMPAT_MODEL", "")
+	if model == "" {
+		return nil, errors.New("LLM_COMPAT_MODEL is required when LLM_COMPAT_BASE_URL is set")
+	}
+	p := newCompatProvider(baseURL, envString("LLM_COMPAT_API_KEY", ""), model,
+		envFloat("LLM_COMPAT_TEMPERATURE", 0.7),
+		envInt("LLM_COMPAT_MAX_TOKENS", 1200),
+		time.Duration(envInt("LLM_COMPAT_TIMEOUT_SECONDS", 120))*time.Second)
+	p.nativeTools = strings.EqualFold(envString("LLM_COMPAT_NATIVE_TOOLS", ""), "true")
+	return p, nil
+}
+
+func newCompatProvider(baseURL, apiKey, model string, temperature float64, maxTokens int, timeout time.Duration) *compatProvider {
+	return &compatProvider{
+		baseURL:     baseURL,
+		apiKey:      apiKey,
+		model:       model,
+		temperature: temperature,
+		maxTokens:   maxTokens,
+		httpClient:  &http.Client{Timeout: timeout},
+	}
+}
+
+func (p *compatProvider) Name() string { return ProviderOpenAICompatible }
+
+func (p *compatProvider) NativeTools() bool { return p.nativeTools }
+
+type compatMessage struct {
+	Role       string           `json:"role"`
+	Content    string           `json:"content"`
+	ToolCalls  []compatToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type compatToolCall struct {
+	// Index identifies the call across streamed fragments.
+	Index    int    `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments,omitempty"`
+	} `json:"function"`
+}
+
+type compatTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description,omitempty"`
+		Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+type compatRequest struct {
+	Model       string          `json:"model"`
+	Messages    []compatMessage `json:"messages"`
+	Temperature float64         `json:"temperature"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Stream      bool            `json:"stream,omitempty"`
+	Tools       []compatTool    `json:"tools,omitempty"`
+}
+
+type compatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+func (p *compatProvider) body(req Request, stream bool) compatRequest {
+	body := compatRequest{
+		Model:       req.Model,
+		Temperature: p.temperature,
+		MaxTokens:   p.maxTokens,
+		Stream:      stream,
+	}
+	if body.Model == "" {
+		body.Model = p.model
+	}
+	if req.Temperature != nil {
+		body.Temperature = *req.Temperature
+	}
+	if req.MaxTokens > 0 {
+		body.MaxTokens = req.MaxTokens
+	}
+	for _, msg := range req.Messages {
+		out := compatMessage{Role: string(msg.Role), Content: msg.Content, ToolCallID: msg.ToolCallID}
+		for _, call := range msg.ToolCalls {
+			tc := compatToolCall{ID: call.ID, Type: "function"}
+			tc.Function.Name = call.Name
+			tc.Function.Arguments = call.Arguments
+			out.ToolCalls = append(out.ToolCalls, tc)
+		}
+		body.Messages = append(body.Messages, out)
+	}
+	for _, spec := range req.Tools {
+		tool := compatTool{Type: "function"}
+		tool.Function.Name = spec.Name
+		tool.Function.Description = spec.Description
+		tool.Function.Parameters = spec.Parameters
+		body.Tools = append(body.Tools, tool)
+	}
+	return body
+}
+
+func toToolCalls(calls []compatToolCall) []ToolCall {
+	var out []ToolCall
+	for _, call := range calls {
+		out = append(out, ToolCall{ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments})
+	}
+	return out
+}
+
+func (p *compatProvider) post(ctx context.Context, body compatRequest) (*http.Response, error) {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/chat/completions", bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return resp, nil
+}
+
+func (p *compatProvider) Generate(ctx context.Context, req Request) (*Response, error) {
+	body := p.body(req, false)
+	resp, err := p.post(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var decoded struct {
+		Model   string `json:"model"`
+		Choices []struct {
+			Message compatMessage `json:"message"`
+		} `json:"choices"`
+		Usage compatUsage `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("decode completion: %w", err)
+	}
+	if len(decoded.Choices) == 0 {
+		return nil, errors.New("completion returned no choices")
+	}
+
+	return &Response{
+		Text:         decoded.Choices[0].Message.Content,
+		Provider:     ProviderOpenAICompatible,
+		Model:        firstNonEmpty(decoded.Model, body.Model),
+		InputTokens:  decoded.Usage.PromptTokens,
+		OutputTokens: decoded.Usage.CompletionTokens,
+		ToolCalls:    toToolCalls(decoded.Choices[0].Message.ToolCalls),
+	}, nil
+}
+
+// Stream reads the server-sent events emitted when stream=true.
+func (p *compatProvider) Stream(ctx context.Context, req Request, onDelta DeltaFunc) (*Response, error) {
+	body := p.body(req, true)
+	resp, err := p.post(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	out := &Response{Provider: ProviderOpenAICompatible, Model: body.Model}
+	var text strings.Builder
+	// Tool calls arrive in fragments keyed by index.
+	var calls []compatToolCall
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		data, ok := strings.CutPrefix(line, "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk struct {
+			Model   string `json:"model"`
+			Choices []struct {
+				Delta struct {
+					Content   string           `json:"content"`
+					ToolCalls []compatToolCall `json:"tool_calls"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Usage *compatUsage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("decode stream chunk: %w", err)
+		}
+		if chunk.Model != "" {
+			out.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			out.InputTokens = chunk.Usage.PromptTokens
+			out.OutputTokens = chunk.Usage.CompletionTokens
+		}
+		for _, choice := range chunk.Choices {
+			for _, fragment := range choice.Delta.ToolCalls {
+				if fragment.Index < 0 {
+					continue
+				}
+				for len(calls) <= fragment.Index {
+					calls = append(calls, compatToolCall{Index: len(calls)})
+				}
+				call := &calls[fragment.Index]
+				call.ID = firstNonEmpty(fragment.ID, call.ID)
+				call.Function.Name += fragment.Function.Name
+				call.Function.Arguments += fragment.Function.Arguments
+			}
+			if delta := choice.Delta.Content; delta != "" {
+				text.WriteString(delta)
+				if onDelta != nil {
+					onDelta(delta)
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	out.Text = text.String()
+	out.ToolCalls = toToolCalls(calls)
+	return out, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,122 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCompatServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "Bearer key" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		var body compatRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reply := fmt.Sprintf("%s@%.1f:%s", body.Model, body.Temperature, body.Messages[len(body.Messages)-1].Content)
+
+		if !body.Stream {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"model":   body.Model,
+				"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": reply}}},
+				"usage":   map[string]int{"prompt_tokens": 7, "completion_tokens": 3},
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, part := range strings.SplitAfter(reply, ":") {
+			chunk, _ := json.Marshal(map[string]interface{}{
+				"model":   body.Model,
+				"choices": []map[string]interface{}{{"delta": map[string]string{"content": part}}},
+			})
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCompatGenerate(t *testing.T) {
+	srv := newTestCompatServer(t)
+	provider := newCompatProvider(srv.URL+"/v1", "key", "llama3", 0.7, 256, 5*time.Second)
+
+	temp := 0.2
+	resp, err := provider.Generate(context.Background(), Request{
+		Messages:    []Message{{Role: RoleSystem, Content: "be brief"}, {Role: RoleUser, Content: "hi"}},
+		Temperature: &temp,
+	})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if resp.Text != "llama3@0.2:hi" {
+		t.Fatalf("unexpected text %q", resp.Text)
+	}
+	if resp.InputTokens != 7 || resp.OutputTokens != 3 || resp.Provider != ProviderOpenAICompatible {
+		t.Fatalf("unexpected metadata %+v", resp)
+	}
+}
+
+func TestCompatStream(t *testing.T) {
+	srv := newTestCompatServer(t)
+	provider := newCompatProvider(srv.URL+"/v1", "key", "llama3", 0.7, 256, 5*time.Second)
+
+	var deltas []string
+	resp, err := provider.Stream(context.Background(), Request{
+		Model:    "qwen",
+		Messages: []Message{{Role: RoleUser, Content: "hi"}},
+	}, func(delta string) { deltas = append(deltas, delta) })
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	if resp.Text != "qwen@0.7:hi" || resp.Model != "qwen" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if len(deltas) != 2 {
+		t.Fatalf("expected 2 deltas, got %q", deltas)
+	}
+}
+
+func TestModelConfigMerge(t *testing.T) {
+	low, high := 0.1, 0.9
+	project := ModelConfig{Provider: ProviderOpenAI, Model: "gpt-4o-mini", Temperature: &low, MaxTokens: 800}
+	agent := ModelConfig{Model: "gpt-4o", Temperature: &high}
+
+	got := project.Merge(agent)
+	if got.Provider != ProviderOpenAI || got.Model != "gpt-4o" || *got.Temperature != 0.9 || got.MaxTokens != 800 {
+		t.Fatalf("unexpected merge result %+v", got)
+	}
+}
+
+func TestSplitMessages(t *testing.T) {
+	system, extra, user := SplitMessages([]Message{
+		{Role: RoleSystem, Content: "sys"},
+		{Role: RoleSystem, Content: "workspace"},
+		{Role: RoleUser, Content: "question"},
+	})
+	if system != "sys" || extra != "workspace" || user != "question" {
+		t.Fatalf("got %q %q %q", system, extra, user)
+	}
+
+	_, extra, user = SplitMessages([]Message{
+		{Role: RoleSystem, Content: "sys"},
+		{Role: RoleUser, Content: "Ada: earlier"},
+		{Role: RoleAssistant, Content: "reply"},
+		{Role: RoleUser, Content: "question"},
+	})
+	if extra != "Conversation so far:\nAda: earlier\n\nYou: reply" || user != "question" {
+		t.Fatalf("history: got %q %q", extra, user)
+	}
+}
@@ -0,0 +1,320 @@
+// Package llm defines the Provider interface shared by agents and the prompt
+// coach, plus a registry of named backends configured from the environment.
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Role identifies who authored a message in a request.
+type Role string
+
+const (
+	RoleSystem    Role = "system"
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+	// RoleTool carries the result of a tool call back to the model.
+	RoleTool Role = "tool"
+)
+
+type Message struct {
+	Role    Role
+	Content string
+	// ToolCalls are the calls an assistant message asked for.
+	ToolCalls []ToolCall
+	// ToolCallID links a RoleTool message to the call it answers.
+	ToolCallID string
+}
+
+// Request is a single completion call. Zero values fall back to the
+// provider's configured defaults.
+type Request struct {
+	Model       string
+	Messages    []Message
+	Temperature *float64
+	MaxTokens   int
+	// Tools the model may call instead of answering directly.
+	Tools []ToolSpec
+}
+
+type Response struct {
+	Text         string
+	Provider     string
+	Model        string
+	InputTokens  int
+	OutputTokens int
+	// ToolCalls is non-empty when the model wants tools run before it
+	// answers.
+	ToolCalls []ToolCall
+}
+
+// DeltaFunc receives generated text as it arrives.
+type DeltaFunc func(delta string)
+
+type Provider interface {
+	Name() string
+	Generate(ctx context.Context, req Request) (*Response, error)
+	// Stream behaves like Generate but reports text to onDelta as it is
+	// produced. The returned Response carries the full text.
+	Stream(ctx context.Context, req Request, onDelta DeltaFunc) (*Response, error)
+}
+
+// Factory builds a provider from the environment. It returns
+// ErrNotConfigured when the backend has not been set up.
+type Factory func() (Provider, error)
+
+var (
+	ErrNotConfigured   = errors.New("llm: provider not configured")
+	ErrUnknownProvider = errors.New("llm: unknown provider")
+)
+
+const (
+	ProviderOpenAI           = "openai"
+	ProviderLocal            = "local"
+	ProviderOpenAICompatible = "openai_compatible"
+)
+
+// defaultOrder is the preference used when LLM_PROVIDER is not set.
+var defaultOrder = []string{ProviderOpenAI, ProviderLocal, ProviderOpenAICompatible}
+
+type entry struct {
+	factory  Factory
+	once     sync.Once
+	provider Provider
+	err      error
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]*entry{}
+)
+
+// Register makes a provider factory available under name. Registering the
+// same name twice replaces the earlier factory.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = &entry{factory: factory}
+}
+
+// Get returns the named provider, constructing it on first use.
+func Get(name string) (Provider, error) {
+	registryMu.RLock()
+	e, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProvider, name)
+	}
+
+	e.once.Do(func() {
+		e.provider, e.err = e.factory()
+		if e.err == nil && e.provider == nil {
+			e.err = ErrNotConfigured
+		}
+		if e.err != nil && !errors.Is(e.err, ErrNotConfigured) {
+			log.Printf("llm: failed to initialize %s provider: %v", name, e.err)
+		}
+	})
+	return e.provider, e.err
+}
+
+// Names lists every registered provider, configured or not.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Available lists the registered providers that are configured.
+func Available() []string {
+	var names []string
+	for _, name := range Names() {
+		if _, err := Get(name); err == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// DefaultProviderName returns LLM_PROVIDER when set, otherwise the first
+// configured provider in preference order.
+func DefaultProviderName() string {
+	if name := strings.TrimSpace(os.Getenv("LLM_PROVIDER")); name != "" {
+		return name
+	}
+	for _, name := range defaultOrder {
+		if _, err := Get(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// ModelConfig selects a provider and its sampling parameters. It is stored in
+// project settings, once for the project and optionally per agent.
+type ModelConfig struct {
+	Provider    string   `json:"provider,omitempty"`
+	Model       string   `json:"model,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   int      `json:"maxTokens,omitempty"`
+	// Fallbacks are tried in order when this model fails. Only meaningful on
+	// the outermost config; nested fallbacks are ignored.
+	Fallbacks []ModelConfig `json:"fallbacks,omitempty"`
+}
+
+// Merge returns c with every field set in override taking precedence.
+func (c ModelConfig) Merge(override ModelConfig) ModelConfig {
+	if override.Provider != "" {
+		c.Provider = override.Provider
+	}
+	if override.Model != "" {
+		c.Model = override.Model
+	}
+	if override.Temperature != nil {
+		c.Temperature = override.Temperature
+	}
+	if override.MaxTokens > 0 {
+		c.MaxTokens = override.MaxTokens
+	}
+	if override.Fallbacks != nil {
+		c.Fallbacks = override.Fallbacks
+	}
+	return c
+}
+
+// Validate rejects configurations that no provider would accept.
+func (c ModelConfig) Validate() error {
+	if c.Provider != "" {
+		registryMu.RLock()
+		_, ok := registry[c.Provider]
+		registryMu.RUnlock()
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrUnknownProvider, c.Provider)
+		}
+	}
+	if c.Temperature != nil && (*c.Temperature < 0 || *c.Temperature > 2) {
+		return errors.New("temperature must be between 0 and 2")
+	}
+	if c.MaxTokens < 0 {
+		return errors.New("maxTokens must not be negative")
+	}
+	for i, fallback := range c.Fallbacks {
+		if fallback.Provider == "" {
+			return fmt.Errorf("fallbacks[%d]: provider required", i)
+		}
+		if len(fallback.Fallbacks) > 0 {
+			return fmt.Errorf("fallbacks[%d]: nested fallbacks are not supported", i)
+		}
+		if err := fallback.Validate(); err != nil {
+			return fmt.Errorf("fallbacks[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Apply copies the model parameters from c onto req.
+func (c ModelConfig) Apply(req Request) Request {
+	if c.Model != "" {
+		req.Model = c.Model
+	}
+	if c.Temperature != nil {
+		req.Temperature = c.Temperature
+	}
+	if c.MaxTokens > 0 {
+		req.MaxTokens = c.MaxTokens
+	}
+	return req
+}
+
+// Resolve returns the provider named by cfg, or the default provider when
+// cfg leaves it empty.
+func Resolve(cfg ModelConfig) (Provider, error) {
+	name := cfg.Provider
+	if name == "" {
+		name = DefaultProviderName()
+	}
+	if name == "" {
+		return nil, ErrNotConfigured
+	}
+	return Get(name)
+}
+
+// SplitMessages flattens a request into the system prompt, any additional
+// context and the final user message, for backends that take a single prompt
+// string. Earlier conversation turns are folded into the context as a
+// transcript.
+func SplitMessages(messages []Message) (system, context, user string) {
+	last := -1
+	for i, msg := range messages {
+		if msg.Role != RoleSystem {
+			last = i
+		}
+	}
+
+	var extra []string
+	var transcript []string
+	for i, msg := range messages {
+		switch {
+		case msg.Role == RoleSystem && system == "":
+			system = msg.Content
+		case msg.Role == RoleSystem:
+			extra = append(extra, msg.Content)
+		case i == last:
+			user = msg.Content
+		case msg.Role == RoleAssistant:
+			transcript = append(transcript, "You: "+msg.Content)
+		default:
+			transcript = append(transcript, msg.Content)
+		}
+	}
+	if len(transcript) > 0 {
+		extra = append(extra, "Conversation so far:\n"+strings.Join(transcript, "\n\n"))
+	}
+	return system, strings.Join(extra, "\n\n"), user
+}
+
+func envString(key, def string) string {
+	if val := strings.TrimSpace(os.Getenv(key)); val != "" {
+		return val
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return def
+	}
+	parsed, err := strconv.Atoi(val)
+	if err != nil {
+		log.Printf("llm: invalid integer %s=%q: %v", key, val, err)
+		return def
+	}
+	return parsed
+}
+
+func envFloat(key string, def float64) float64 {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return def
+	}
+	parsed, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		log.Printf("llm: invalid float %s=%q: %v", key, val, err)
+		return def
+	}
+	return parsed
+}
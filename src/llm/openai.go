@@ -0,0 +1,193 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	openai "github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/option"
+	"github.com/openai/openai-go/v3/responses"
+)
+
+func init() {
+	Register(ProviderOpenAI, newOpenAIFromEnv)
+}
+
+// openAIProvider talks to the OpenAI Responses API.
+type openAIProvider struct {
+	client      openai.Client
+	model       string
+	temperature float64
+	maxTokens   int
+	timeout     time.Duration
+}
+
+func newOpenAIFromEnv() (Provider, error) {
+	apiKey := strings.TrimSpace(os.Getenv("OPENAI_API_KEY"))
+	if apiKey == "" {
+		return nil, ErrNotConfigured
+	}
+
+	// Retries are handled by Chain so every attempt is visible in metrics.
+	opts := []option.RequestOption{option.WithAPIKey(apiKey), option.WithMaxRetries(0)}
+	if baseURL := strings.TrimSpace(os.Getenv("OPENAI_BASE_URL")); baseURL != "" {
+		opts = append(opts, option.WithBaseURL(baseURL))
+	}
+
+	return &openAIProvider{
+		client:      openai.NewClient(opts...),
+		model:       envString("OPENAI_MODEL", openai.ChatModelGPT4oMini),
+		temperature: envFloat("OPENAI_TEMPERATURE", 0.7),
+		maxTokens:   envInt("OPENAI_MAX_TOKENS", 1200),
+		timeout:     time.Duration(envInt("OPENAI_TIMEOUT_SECONDS", 30)) * time.Second,
+	}, nil
+}
+
+func (p *openAIProvider) Name() string { return ProviderOpenAI }
+
+func (p *openAIProvider) NativeTools() bool { return true }
+
+func (p *openAIProvider) params(req Request) responses.ResponseNewParams {
+	input := make(responses.ResponseInputParam, 0, len(req.Messages))
+	for _, msg := range req.Messages {
+		if msg.Role == RoleTool {
+			input = append(input, responses.ResponseInputItemParamOfFunctionCallOutput(msg.ToolCallID, msg.Content))
+			continue
+		}
+		role := responses.EasyInputMessageRoleUser
+		switch msg.Role {
+		case RoleSystem:
+			role = responses.EasyInputMessageRoleSystem
+		case RoleAssistant:
+			role = responses.EasyInputMessageRoleAssistant
+		}
+		if msg.Content != "" || len(msg.ToolCalls) == 0 {
+			input = append(input, responses.ResponseInputItemParamOfMessage(msg.Content, role))
+		}
+		for _, call := range msg.ToolCalls {
+			input = append(input, responses.ResponseInputItemParamOfFunctionCall(call.Arguments, call.ID, call.Name))
+		}
+	}
+
+	var tools []responses.ToolUnionParam
+	for _, spec := range req.Tools {
+		tool := responses.ToolParamOfFunction(spec.Name, spec.Parameters, false)
+		if spec.Description != "" {
+			tool.OfFunction.Description = openai.String(spec.Description)
+		}
+		tools = append(tools, tool)
+	}
+
+	model := req.Model
+	if model == "" {
+		model = p.model
+	}
+	temperature := p.temperature
+	if req.Temperature != nil {
+		temperature = *req.Temperature
+	}
+	maxTokens := p.maxTokens
+	if req.MaxTokens > 0 {
+		maxTokens = req.MaxTokens
+	}
+
+	return responses.ResponseNewParams{
+		Model:           openai.ResponsesModel(model),
+		Input:           responses.ResponseNewParamsInputUnion{OfInputItemList: input},
+		MaxOutputTokens: openai.Int(int64(maxTokens)),
+		Temperature:     openai.Float(temperature),
+		Tools:           tools,
+	}
+}
+
+func (p *openAIProvider) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || p.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.timeout)
+}
+
+func (p *openAIProvider) Generate(ctx context.Context, req Request) (*Response, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	params := p.params(req)
+	resp, err := p.client.Responses.New(ctx, params)
+	if err != nil {
+		return nil, wrapOpenAIError(err)
+	}
+	return p.toResponse(resp, params.Model), nil
+}
+
+func (p *openAIProvider) Stream(ctx context.Context, req Request, onDelta DeltaFunc) (*Response, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	params := p.params(req)
+	stream := p.client.Responses.NewStreaming(ctx, params)
+	defer stream.Close()
+
+	var text strings.Builder
+	var completed *responses.Response
+	for stream.Next() {
+		event := stream.Current()
+		switch event.Type {
+		case "response.output_text.delta":
+			delta := event.AsResponseOutputTextDelta().Delta
+			text.WriteString(delta)
+			if onDelta != nil && delta != "" {
+				onDelta(delta)
+			}
+		case "response.completed":
+			resp := event.AsResponseCompleted().Response
+			completed = &resp
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, wrapOpenAIError(err)
+	}
+
+	if completed == nil {
+		if text.Len() == 0 {
+			return nil, errors.New("openai: stream ended without a response")
+		}
+		return &Response{Text: text.String(), Provider: ProviderOpenAI, Model: params.Model}, nil
+	}
+
+	out := p.toResponse(completed, params.Model)
+	if out.Text == "" {
+		out.Text = text.String()
+	}
+	return out, nil
+}
+
+func (p *openAIProvider) toResponse(resp *responses.Response, model string) *Response {
+	out := &Response{
+		Text:         resp.OutputText(),
+		Provider:     ProviderOpenAI,
+		Model:        model,
+		InputTokens:  int(resp.Usage.InputTokens),
+		OutputTokens: int(resp.Usage.OutputTokens),
+	}
+	if resp.Model != "" {
+		out.Model = string(resp.Model)
+	}
+	for _, item := range resp.Output {
+		if item.Type == "function_call" {
+			out.ToolCalls = append(out.ToolCalls, ToolCall{ID: item.CallID, Name: item.Name, Arguments: item.Arguments})
+		}
+	}
+	return out
+}
+
+// wrapOpenAIError exposes the HTTP status of API errors to IsTransient.
+func wrapOpenAIError(err error) error {
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) {
+		return &StatusError{StatusCode: apiErr.StatusCode, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ToolSpec describes a function the model may call. Parameters is a JSON
+// schema object.
+type ToolSpec struct {
+	Name        string
+	Description string
+	Parameters  map[string]interface{}
+}
+
+// ToolCall is one function call requested by the model. Arguments holds the
+// raw JSON object.
+type ToolCall struct {
+	ID        string
+	Name      string
+	Arguments string
+}
+
+// NativeTools is implemented by providers whose API supports function
+// calling. Other providers get tools through a text protocol.
+type NativeTools interface {
+	NativeTools() bool
+}
+
+func supportsNativeTools(p Provider) bool {
+	native, ok := p.(NativeTools)
+	return ok && native.NativeTools()
+}
+
+const (
+	toolCallOpen  = "<tool_call>"
+	toolCallClose = "</tool_call>"
+)
+
+// generateWithTextTools runs a tool-enabled request against a provider
+// without function calling. The tools are described in a system message, and
+// calls come back as <tool_call>{"name": ..., "arguments": {...}}</tool_call>
+// blocks in the reply. Text is not streamed because it may contain calls.
+func generateWithTextTools(ctx context.Context, provider Provider, req Request) (*Response, error) {
+	resp, err := provider.Generate(ctx, textToolRequest(req))
+	if err != nil {
+		return nil, err
+	}
+	calls, text := parseTextToolCalls(resp.Text)
+	resp.Text = text
+	resp.ToolCalls = calls
+	return resp, nil
+}
+
+// textToolRequest rewrites req so the tools, earlier calls and their results
+// are all plain messages.
+func textToolRequest(req Request) Request {
+	var b strings.Builder
+	b.WriteString("You can call tools. To call one or more, reply with only blocks of the form\n")
+	b.WriteString(toolCallOpen + `{"name": "tool_name", "arguments": {...}}` + toolCallClose + "\n")
+	b.WriteString("and wait for the results. When you are finished, reply with your final answer and no tool_call blocks.\n\nTools:")
+	for _, tool := range req.Tools {
+		schema, _ := json.Marshal(tool.Parameters)
+		fmt.Fprintf(&b, "\n- %s: %s\n  arguments schema: %s", tool.Name, tool.Description, schema)
+	}
+
+	messages := make([]Message, 0, len(req.Messages)+1)
+	inserted := false
+	for _, msg := range req.Messages {
+		if !inserted && msg.Role != RoleSystem {
+			messages = append(messages, Message{Role: RoleSystem, Content: b.String()})
+			inserted = true
+		}
+		switch {
+		case msg.Role == RoleTool:
+			messages = append(messages, Message{Role: RoleUser, Content: "Tool result (" + msg.ToolCallID + "):\n" + msg.Content})
+		case len(msg.ToolCalls) > 0:
+			content := msg.Content
+			for _, call := range msg.ToolCalls {
+				content += "\n" + formatTextToolCall(call)
+			}
+			messages = append(messages, Message{Role: msg.Role, Content: strings.TrimSpace(content)})
+		default:
+			messages = append(messages, Message{Role: msg.Role, Content: msg.Content})
+		}
+	}
+	if !inserted {
+		messages = append(messages, Message{Role: RoleSystem, Content: b.String()})
+	}
+
+	out := req
+	out.Messages = messages
+	out.Tools = nil
+	return out
+}
+
+func formatTextToolCall(call ToolCall) string {
+	args := strings.TrimSpace(call.Arguments)
+	if args == "" {
+		args = "{}"
+	}
+	return fmt.Sprintf(`%s{"name": %q, "arguments": %s}%s`, toolCallOpen, call.Name, args, toolCallClose)
+}
+
+// parseTextToolCalls extracts <tool_call> blocks from text, returning the
+// calls and the remaining text. Malformed blocks are left in the text.
+func parseTextToolCalls(text string) ([]ToolCall, string) {
+	var calls []ToolCall
+	var rest strings.Builder
+	for {
+		start := strings.Index(text, toolCallOpen)
+		if start < 0 {
+			break
+		}
+		end := strings.Index(text[start:], toolCallClose)
+		if end < 0 {
+			break
+		}
+		end += start
+		body := strings.TrimSpace(text[start+len(toolCallOpen) : end])
+
+		var parsed struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal([]byte(body), &parsed); err != nil || parsed.Name == "" {
+			rest.WriteString(text[:end+len(toolCallClose)])
+		} else {
+			rest.WriteString(text[:start])
+			args := strings.TrimSpace(string(parsed.Arguments))
+			if args == "" || args == "null" {
+				args = "{}"
+			}
+			calls = append(calls, ToolCall{
+				ID:        fmt.Sprintf("call_%d", len(calls)+1),
+				Name:      parsed.Name,
+				Arguments: args,
+			})
+		}
+		text = text[end+len(toolCallClose):]
+	}
+	rest.WriteString(text)
+	return calls, strings.TrimSpace(rest.String())
+}
@@ -0,0 +1,51 @@
+package llm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTextToolCalls(t *testing.T) {
+	text := "Let me look.\n<tool_call>{\"name\": \"read_file\", \"arguments\": {\"path\": \"a.go\"}}</tool_call>\n" +
+		"<tool_call>not json</tool_call>\n<tool_call>{\"name\": \"list_dir\"}</tool_call>"
+
+	calls, rest := parseTextToolCalls(text)
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 calls, got %+v", calls)
+	}
+	if calls[0].ID != "call_1" || calls[0].Name != "read_file" || calls[0].Arguments != `{"path": "a.go"}` {
+		t.Fatalf("unexpected first call %+v", calls[0])
+	}
+	if calls[1].Name != "list_dir" || calls[1].Arguments != "{}" {
+		t.Fatalf("missing arguments should default to {}: %+v", calls[1])
+	}
+	if !strings.HasPrefix(rest, "Let me look.") || !strings.Contains(rest, "not json") {
+		t.Fatalf("malformed block should stay in the text: %q", rest)
+	}
+}
+
+func TestTextToolRequestFlattensToolTurns(t *testing.T) {
+	req := Request{
+		Messages: []Message{
+			{Role: RoleSystem, Content: "sys"},
+			{Role: RoleUser, Content: "hi"},
+			{Role: RoleAssistant, ToolCalls: []ToolCall{{ID: "call_1", Name: "list_dir", Arguments: "{}"}}},
+			{Role: RoleTool, ToolCallID: "call_1", Content: "a.go"},
+		},
+		Tools: []ToolSpec{{Name: "list_dir", Description: "List files"}},
+	}
+
+	out := textToolRequest(req)
+	if len(out.Tools) != 0 || len(out.Messages) != 5 {
+		t.Fatalf("unexpected request %+v", out)
+	}
+	if out.Messages[1].Role != RoleSystem || !strings.Contains(out.Messages[1].Content, "- list_dir: List files") {
+		t.Fatalf("tool description should follow the system prompt: %+v", out.Messages[1])
+	}
+	if !strings.Contains(out.Messages[3].Content, `<tool_call>{"name": "list_dir", "arguments": {}}</tool_call>`) {
+		t.Fatalf("assistant call not rendered: %q", out.Messages[3].Content)
+	}
+	if out.Messages[4].Role != RoleUser || out.Messages[4].Content != "Tool result (call_1):\na.go" {
+		t.Fatalf("tool result not rendered: %+v", out.Messages[4])
+	}
+}
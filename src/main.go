@@ -14,6 +14,7 @@ import (
 	"os"
 	"os/signal"
 	"replychat/src/agents"
+	"replychat/src/llm"
 	"replychat/src/monitoring"
 	"replychat/src/projectfs"
 	"replychat/src/promptcoach"
@@ -56,48 +57,73 @@ var agentDisplayNames = map[string]string{
 	"devops_engineer":    "DevOps Engineer",
 }
 
-func currentUserID(r *http.Request) (string, error) {
-	cookie, err := r.Cookie("session_id")
-	if err != nil {
-		return "", err
-	}
-
-	var userID string
-	if err := db.QueryRow(`SELECT user_id FROM sessions WHERE id = ?`, cookie.Value).Scan(&userID); err != nil {
-		return "", err
-	}
-	return userID, nil
-}
-
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	CheckOrigin: checkWebSocketOrigin,
 }
 
 type Client struct {
 	conn      *websocket.Conn
 	projectID string
 	userID    string
+	sessionID string
 	send      chan []byte
 	hub       *Hub
 }
 
+// projectMessage is a marshalled event addressed to the subscribers of a single project.
+type projectMessage struct {
+	projectID string
+	data      []byte
+}
+
 type Hub struct {
 	clients    map[*Client]bool
-	broadcast  chan []byte
+	broadcast  chan projectMessage
 	register   chan *Client
 	unregister chan *Client
 	mu         sync.RWMutex
-	projectRef map[string]int
+	projects   map[string]map[*Client]bool
 }
 
 func newHub() *Hub {
 	return &Hub{
 		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []byte),
+		broadcast:  make(chan projectMessage),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		projects:   make(map[string]map[*Client]bool),
+	}
+}
+
+// Publish queues data for every client subscribed to projectID. It blocks until
+// the hub accepts the message.
+func (h *Hub) Publish(projectID string, data []byte) {
+	if projectID == "" || data == nil {
+		return
+	}
+	h.broadcast <- projectMessage{projectID: projectID, data: data}
+}
+
+// publishWithin behaves like Publish but gives up after timeout so callers on
+// hot paths never stall behind a busy hub. A zero timeout never waits.
+func (h *Hub) publishWithin(projectID string, data []byte, timeout time.Duration) bool {
+	if projectID == "" || data == nil {
+		return false
+	}
+	msg := projectMessage{projectID: projectID, data: data}
+	if timeout <= 0 {
+		select {
+		case h.broadcast <- msg:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case h.broadcast <- msg:
+		return true
+	case <-time.After(timeout):
+		return false
 	}
 }
 
@@ -114,68 +140,99 @@ func (h *Hub) hasClients() bool {
 func (h *Hub) hasClientsFor(projectID string) bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	return h.projectRef != nil && h.projectRef[projectID] > 0
+	return len(h.projects[projectID]) > 0
 }
 
 func (h *Hub) activeProjects() []string {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	if len(h.projectRef) == 0 {
+	if len(h.projects) == 0 {
 		return nil
 	}
-	result := make([]string, 0, len(h.projectRef))
-	for projectID := range h.projectRef {
+	result := make([]string, 0, len(h.projects))
+	for projectID := range h.projects {
 		result = append(result, projectID)
 	}
 	return result
 }
 
+// closeClients closes the connections of the clients match selects and
+// reports how many there were. Their read pumps then unregister them.
+func (h *Hub) closeClients(match func(*Client) bool) int {
+	h.mu.RLock()
+	var matched []*Client
+	for client := range h.clients {
+		if match(client) {
+			matched = append(matched, client)
+		}
+	}
+	h.mu.RUnlock()
+	for _, client := range matched {
+		client.conn.Close()
+	}
+	return len(matched)
+}
+
+// removeClient drops a client from the hub indexes. Callers must hold h.mu.
+func (h *Hub) removeClient(client *Client) bool {
+	if _, ok := h.clients[client]; !ok {
+		return false
+	}
+	delete(h.clients, client)
+	close(client.send)
+	if subscribers := h.projects[client.projectID]; subscribers != nil {
+		delete(subscribers, client)
+		if len(subscribers) == 0 {
+			delete(h.projects, client.projectID)
+		}
+	}
+	return true
+}
+
 func (h *Hub) run() {
 	for {
 		select {
 		case client := <-h.register:
 			h.mu.Lock()
 			h.clients[client] = true
-			if h.projectRef == nil {
-				h.projectRef = make(map[string]int)
+			subscribers := h.projects[client.projectID]
+			if subscribers == nil {
+				subscribers = make(map[*Client]bool)
+				h.projects[client.projectID] = subscribers
 			}
-			h.projectRef[client.projectID]++
+			subscribers[client] = true
+			total := len(h.clients)
 			h.mu.Unlock()
-			log.Printf("ws: client registered, total: %d", len(h.clients))
+			log.Printf("ws: client registered for project %s, total: %d", client.projectID, total)
 			monitoring.WSClientConnected(client.projectID)
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			removed := false
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-				if h.projectRef != nil {
-					if count := h.projectRef[client.projectID]; count > 1 {
-						h.projectRef[client.projectID] = count - 1
-					} else {
-						delete(h.projectRef, client.projectID)
-					}
-				}
-				removed = true
-			}
+			removed := h.removeClient(client)
+			total := len(h.clients)
 			h.mu.Unlock()
-			log.Printf("ws: client unregistered, total: %d", len(h.clients))
+			log.Printf("ws: client unregistered, total: %d", total)
 			if removed {
 				monitoring.WSClientDisconnected(client.projectID)
 			}
 
 		case message := <-h.broadcast:
-			h.mu.RLock()
-			for client := range h.clients {
+			var dropped []*Client
+			h.mu.Lock()
+			for client := range h.projects[message.projectID] {
 				select {
-				case client.send <- message:
+				case client.send <- message.data:
 				default:
-					close(client.send)
-					delete(h.clients, client)
+					if h.removeClient(client) {
+						dropped = append(dropped, client)
+					}
 				}
 			}
-			h.mu.RUnlock()
+			h.mu.Unlock()
+			for _, client := range dropped {
+				log.Printf("ws: dropping slow client for project %s", client.projectID)
+				monitoring.WSClientDisconnected(client.projectID)
+			}
 		}
 	}
 }
@@ -263,7 +320,9 @@ func handleMessage(c *Client, message []byte) {
 	case "chat.message":
 		handleChatMessage(c, msg)
 	case "agent.command":
-		handleAgentCommand(c, msg)
+		go handleAgentCommand(c, msg)
+	case "commit.revert":
+		go handleRevertCommand(c, msg)
 	default:
 		log.Printf("ws: unknown message type: %s", msgType)
 	}
@@ -276,7 +335,11 @@ func handleChatMessage(c *Client, msg map[string]interface{}) {
 	}
 
 	content, _ := payload["content"].(string)
-	projectID, _ := payload["projectId"].(string)
+	projectID := c.projectID
+	if requested, _ := payload["projectId"].(string); requested != "" && requested != projectID {
+		log.Printf("ws: ignoring chat message for project %s from client joined to %s", requested, projectID)
+		return
+	}
 
 	messageID := uuid.New().String()
 	timestamp := time.Now()
@@ -310,13 +373,14 @@ func handleChatMessage(c *Client, msg map[string]interface{}) {
 	}
 
 	responseJSON, _ := json.Marshal(response)
-	c.hub.broadcast <- responseJSON
+	c.hub.Publish(projectID, responseJSON)
 
-	go agents.ProcessMessage(db, c.hub.broadcast, projectID, content, c.userID)
-}
+	role, err := lookupProjectRole(projectID, c.userID)
+	if err != nil || !role.can(permRunAgents) {
+		return
+	}
 
-func handleAgentCommand(c *Client, msg map[string]interface{}) {
-	log.Printf("agent: command received: %v", msg)
+	go agents.ProcessMessage(db, c.hub, projectID, content, c.userID)
 }
 
 func sendSystemMessage(projectID, content string) {
@@ -359,7 +423,7 @@ func sendSystemMessage(projectID, content string) {
 	}
 
 	if data, err := json.Marshal(response); err == nil {
-		globalHub.broadcast <- data
+		globalHub.Publish(projectID, data)
 	}
 }
 
@@ -376,37 +440,12 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	renderTemplate(w, "index.html", nil)
+	renderAuthPage(w, r, "login")
 }
 
 func projectHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session_id")
-	if err != nil {
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
-	}
-
-	var userID string
-	err = db.QueryRow(`SELECT user_id FROM sessions WHERE id = ?`, cookie.Value).Scan(&userID)
-	if err != nil {
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
-	}
-
-	projectID := r.URL.Query().Get("id")
-	if projectID == "" {
-		http.Redirect(w, r, "/projects", http.StatusTemporaryRedirect)
-		return
-	}
-
-	var memberID string
-	err = db.QueryRow(`
-		SELECT id FROM project_members WHERE project_id = ? AND user_id = ?
-	`, projectID, userID).Scan(&memberID)
-	if err != nil {
-		http.Redirect(w, r, "/projects", http.StatusTemporaryRedirect)
-		return
-	}
+	access := accessFromRequest(r)
+	userID, projectID := access.UserID, access.ProjectID
 
 	var username, email string
 	var projectName string
@@ -419,24 +458,15 @@ func projectHandler(w http.ResponseWriter, r *http.Request) {
 		"UserID":      userID,
 		"ProjectID":   projectID,
 		"ProjectName": projectName,
+		"CSRFToken":   access.CSRFToken,
 	}
 
 	renderTemplate(w, "project.html", data)
 }
 
 func wsHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
-	cookie, err := r.Cookie("session_id")
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	var userID string
-	err = db.QueryRow(`SELECT user_id FROM sessions WHERE id = ?`, cookie.Value).Scan(&userID)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	access := accessFromRequest(r)
+	userID, projectID := access.UserID, access.ProjectID
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -444,15 +474,11 @@ func wsHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
 		return
 	}
 
-	projectID := r.URL.Query().Get("projectId")
-	if projectID == "" {
-		projectID = "default"
-	}
-
 	client := &Client{
 		conn:      conn,
 		projectID: projectID,
 		userID:    userID,
+		sessionID: access.SessionID,
 		send:      make(chan []byte, 256),
 		hub:       hub,
 	}
@@ -464,108 +490,9 @@ func wsHandler(w http.ResponseWriter, r *http.Request, hub *Hub) {
 	go client.readPump()
 }
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	email := r.FormValue("email")
-	name := r.FormValue("name")
-
-	if email == "" || name == "" {
-		http.Error(w, "Email and name required", http.StatusBadRequest)
-		return
-	}
-
-	var userID string
-	err := db.QueryRow(`SELECT id FROM users WHERE email = ?`, email).Scan(&userID)
-
-	if err == sql.ErrNoRows {
-		userID = uuid.New().String()
-		_, err = db.Exec(`
-			INSERT INTO users (id, email, name, created_at)
-			VALUES (?, ?, ?, ?)
-		`, userID, email, name, time.Now())
-
-		if err != nil {
-			log.Printf("db: failed to create user: %v", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
-		}
-	} else if err != nil {
-		log.Printf("db: query error: %v", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-
-	sessionID := uuid.New().String()
-	_, err = db.Exec(`
-		INSERT INTO sessions (id, user_id, created_at)
-		VALUES (?, ?, ?)
-	`, sessionID, userID, time.Now())
-
-	if err != nil {
-		log.Printf("db: failed to create session: %v", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_id",
-		Value:    sessionID,
-		Path:     "/",
-		HttpOnly: true,
-		MaxAge:   86400 * 7,
-	})
-
-	http.Redirect(w, r, "/projects", http.StatusSeeOther)
-}
-
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session_id")
-	if err == nil {
-		db.Exec(`DELETE FROM sessions WHERE id = ?`, cookie.Value)
-	}
-
-	http.SetCookie(w, &http.Cookie{
-		Name:   "session_id",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	})
-
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
-
 func kanbanHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session_id")
-	if err != nil {
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
-	}
-
-	var userID string
-	err = db.QueryRow(`SELECT user_id FROM sessions WHERE id = ?`, cookie.Value).Scan(&userID)
-	if err != nil {
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
-	}
-
-	projectID := r.URL.Query().Get("id")
-	if projectID == "" {
-		http.Redirect(w, r, "/projects", http.StatusTemporaryRedirect)
-		return
-	}
-
-	var memberID string
-	err = db.QueryRow(`
-		SELECT id FROM project_members WHERE project_id = ? AND user_id = ?
-	`, projectID, userID).Scan(&memberID)
-	if err != nil {
-		http.Redirect(w, r, "/projects", http.StatusTemporaryRedirect)
-		return
-	}
+	access := accessFromRequest(r)
+	userID, projectID := access.UserID, access.ProjectID
 
 	var username, email string
 	var projectName string
@@ -578,6 +505,7 @@ func kanbanHandler(w http.ResponseWriter, r *http.Request) {
 		"UserID":      userID,
 		"ProjectID":   projectID,
 		"ProjectName": projectName,
+		"CSRFToken":   access.CSRFToken,
 	}
 
 	renderTemplate(w, "kanban.html", data)
@@ -595,15 +523,13 @@ func issuesAPIHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func listIssuesHandler(w http.ResponseWriter, r *http.Request) {
-	projectID := r.URL.Query().Get("project_id")
-	if projectID == "" {
-		projectID = "default"
-	}
+	projectID := accessFromRequest(r).ProjectID
 
 	rows, err := db.Query(`
 		SELECT id, title, description, priority, status,
 		       created_by, created_by_type, assigned_agent_id,
-		       queued_agent_id, queued_at, started_at, completed_at, created_at
+		       queued_agent_id, queued_at, started_at, completed_at, created_at, branch,
+		       attempts, last_error, retry_at
 		FROM issues
 		WHERE project_id = ?
 		ORDER BY
@@ -625,11 +551,13 @@ func listIssuesHandler(w http.ResponseWriter, r *http.Request) {
 	issues := make([]map[string]interface{}, 0)
 	for rows.Next() {
 		var id, title, description, priority, status, createdBy, createdByType string
-		var assignedAgentID, queuedAgentID sql.NullString
-		var queuedAt, startedAt, completedAt, createdAt sql.NullTime
+		var assignedAgentID, queuedAgentID, branch, lastError sql.NullString
+		var queuedAt, startedAt, completedAt, createdAt, retryAt sql.NullTime
+		var attempts sql.NullInt64
 
 		rows.Scan(&id, &title, &description, &priority, &status, &createdBy, &createdByType,
-			&assignedAgentID, &queuedAgentID, &queuedAt, &startedAt, &completedAt, &createdAt)
+			&assignedAgentID, &queuedAgentID, &queuedAt, &startedAt, &completedAt, &createdAt, &branch,
+			&attempts, &lastError, &retryAt)
 
 		issue := map[string]interface{}{
 			"id":                id,
@@ -645,6 +573,10 @@ func listIssuesHandler(w http.ResponseWriter, r *http.Request) {
 			"started_at":        startedAt.Time,
 			"completed_at":      completedAt.Time,
 			"created_at":        createdAt.Time,
+			"branch":            branch.String,
+			"attempts":          attempts.Int64,
+			"last_error":        lastError.String,
+			"retry_at":          retryAt.Time,
 		}
 		issues = append(issues, issue)
 	}
@@ -672,12 +604,22 @@ func createIssueHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.ProjectID == "" {
-		req.ProjectID = "default"
+	access := accessFromRequest(r)
+	if !requirePermission(w, access, permManageIssues) {
+		return
 	}
+
+	req.ProjectID = access.ProjectID
 	if req.Status == "" {
 		req.Status = "proposed"
 	}
+	if req.Status == "todo" && !requirePermission(w, access, permRunAgents) {
+		return
+	}
+	if req.CreatedByType == "" || req.CreatedByType == "user" {
+		req.CreatedBy = access.UserID
+		req.CreatedByType = "user"
+	}
 
 	agentID := determineIssueAgent(req.AssignedAgentID, req.Title, req.Description)
 	var assignedAgent interface{}
@@ -725,12 +667,23 @@ func issueAPIHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	switch r.Method {
+	case "GET":
+		issueDetailHandler(w, r, issueID)
 	case "PUT":
 		if len(parts) > 1 && parts[1] == "status" {
 			updateIssueStatusHandler(w, r, issueID)
 		} else {
 			http.Error(w, "Invalid endpoint", http.StatusBadRequest)
 		}
+	case "POST":
+		switch {
+		case len(parts) > 1 && parts[1] == "merge":
+			mergeIssueHandler(w, r, issueID)
+		case len(parts) > 1 && parts[1] == "resolve-conflicts":
+			resolveConflictsHandler(w, r, issueID)
+		default:
+			http.Error(w, "Invalid endpoint", http.StatusBadRequest)
+		}
 	case "DELETE":
 		deleteIssueHandler(w, r, issueID)
 	default:
@@ -739,10 +692,7 @@ func issueAPIHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func messagesAPIHandler(w http.ResponseWriter, r *http.Request) {
-	projectID := r.URL.Query().Get("project_id")
-	if projectID == "" {
-		projectID = "default"
-	}
+	projectID := accessFromRequest(r).ProjectID
 
 	rows, err := db.Query(`
 		SELECT id, sender_id, sender_type, content, message_type, metadata, timestamp
@@ -863,13 +813,21 @@ func updateIssueStatusHandler(w http.ResponseWriter, r *http.Request, issueID st
 		return
 	}
 
+	access := accessFromRequest(r)
+	if !requirePermission(w, access, permManageIssues) {
+		return
+	}
+	if req.Status == "todo" && !requirePermission(w, access, permRunAgents) {
+		return
+	}
+
 	var (
 		projectID, title, description string
-		assignedAgentID               sql.NullString
+		assignedAgentID, worktreePath sql.NullString
 	)
 
-	row := db.QueryRow(`SELECT project_id, title, description, assigned_agent_id FROM issues WHERE id = ?`, issueID)
-	if err := row.Scan(&projectID, &title, &description, &assignedAgentID); err != nil {
+	row := db.QueryRow(`SELECT project_id, title, description, assigned_agent_id, worktree_path FROM issues WHERE id = ?`, issueID)
+	if err := row.Scan(&projectID, &title, &description, &assignedAgentID, &worktreePath); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			http.Error(w, "issue not found", http.StatusNotFound)
 			return
@@ -885,8 +843,13 @@ func updateIssueStatusHandler(w http.ResponseWriter, r *http.Request, issueID st
 	if req.Status != "todo" {
 		updateFields = append(updateFields, "queued_agent_id = NULL")
 	}
+	// Whoever moves the issue takes it over from the worker that claimed it.
+	updateFields = append(updateFields, "claimed_by = NULL", "lease_expires_at = NULL")
 
 	switch req.Status {
+	case "todo":
+		// Moving an issue back to the queue by hand starts its retries over.
+		updateFields = append(updateFields, "attempts = 0", "last_error = NULL", "retry_at = NULL")
 	case "inProgress":
 		updateFields = append(updateFields, "started_at = COALESCE(started_at, ?)")
 		args = append(args, now)
@@ -917,19 +880,81 @@ func updateIssueStatusHandler(w http.ResponseWriter, r *http.Request, issueID st
 			log.Printf("issue: failed to queue %s: %v", issueID, err)
 		}
 	}
+	if req.Status == "done" && worktreePath.String != "" {
+		go agents.PushWorkspace(db, hubPublisher(), projectID, worktreePath.String, projectfs.PushAfterIssue, access.UserID)
+	}
 
 	broadcastIssueChange(issueID)
 	pushAgentStatusUpdate(projectID)
 	w.WriteHeader(http.StatusOK)
 }
 
+// maxIssueCommits bounds the commit list returned with an issue.
+const maxIssueCommits = 50
+
+// issueDetailHandler returns one issue with the commits on its branch that
+// the project workspace does not have yet.
+func issueDetailHandler(w http.ResponseWriter, r *http.Request, issueID string) {
+	issue, err := fetchIssue(issueID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Issue not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	commits := make([]projectfs.Commit, 0)
+	if branch, _ := issue["branch"].(string); branch != "" {
+		settings, err := projectfs.LoadSettings(db, accessFromRequest(r).ProjectID)
+		if err == nil {
+			var list []projectfs.Commit
+			list, err = projectfs.BranchCommits(settings.WorkspacePath, branch, maxIssueCommits)
+			commits = append(commits, list...)
+		}
+		if err != nil {
+			log.Printf("git: failed to list commits for issue %s: %v", issueID, err)
+		}
+	}
+	issue["commits"] = commits
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issue":    issue,
+		"canMerge": accessFromRequest(r).Role.can(permMergeBranches),
+	})
+}
+
 func deleteIssueHandler(w http.ResponseWriter, r *http.Request, issueID string) {
+	access := accessFromRequest(r)
+	if !requirePermission(w, access, permDeleteIssues) {
+		return
+	}
+
+	var worktreePath sql.NullString
+	db.QueryRow(`SELECT worktree_path FROM issues WHERE id = ?`, issueID).Scan(&worktreePath)
+
 	_, err := db.Exec(`DELETE FROM issues WHERE id = ?`, issueID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// The branch keeps the issue's commits; only the checkout goes, unless
+	// a conflict resolution issue still works in it.
+	var sharing int
+	if worktreePath.String != "" {
+		db.QueryRow(`SELECT COUNT(*) FROM issues WHERE worktree_path = ?`, worktreePath.String).Scan(&sharing)
+	}
+	if worktreePath.String != "" && sharing == 0 {
+		if settings, err := projectfs.LoadSettings(db, access.ProjectID); err == nil {
+			if err := projectfs.RemoveWorktree(settings.WorkspacePath, worktreePath.String); err != nil {
+				log.Printf("git: failed to remove worktree for issue %s: %v", issueID, err)
+			}
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -955,6 +980,14 @@ func respondToDialog(dialogID, userID, selected string) (map[string]interface{},
 		return nil, fmt.Errorf("dialog already resolved")
 	}
 
+	role, err := lookupProjectRole(projectID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !role.can(permRespondDialog) {
+		return nil, errPermissionDenied
+	}
+
 	var options []string
 	if optionsJSON.Valid {
 		_ = json.Unmarshal([]byte(optionsJSON.String), &options)
@@ -992,7 +1025,7 @@ func respondToDialog(dialogID, userID, selected string) (map[string]interface{},
 	}
 
 	now := time.Now()
-	_, err := db.Exec(`
+	_, err = db.Exec(`
 		UPDATE dialogs
 		SET status = 'resolved', selected_option = ?, responded_by = ?, responded_at = ?
 		WHERE id = ? AND status = 'open'
@@ -1021,7 +1054,7 @@ func respondToDialog(dialogID, userID, selected string) (map[string]interface{},
 	}
 	if globalHub != nil {
 		if data, err := json.Marshal(event); err == nil {
-			globalHub.broadcast <- data
+			globalHub.Publish(projectID, data)
 		}
 	}
 
@@ -1033,14 +1066,46 @@ func respondToDialog(dialogID, userID, selected string) (map[string]interface{},
 	summary := fmt.Sprintf("%s selected '%s' for dialog '%s'.", userName, selectedOption, title)
 	sendSystemMessage(projectID, summary)
 
+	if issueID.String != "" {
+		if err := resumeBlockedIssue(issueID.String); err != nil {
+			log.Printf("issue: failed to resume %s after dialog %s: %v", issueID.String, dialogID, err)
+		}
+	}
+
 	return response, nil
 }
 
-func dialogsAPIHandler(w http.ResponseWriter, r *http.Request) {
-	projectID := r.URL.Query().Get("project_id")
-	if projectID == "" {
-		projectID = "default"
+// resumeBlockedIssue queues an issue that was blocked on the team's input
+// for its agent again once none of its dialogs is open.
+func resumeBlockedIssue(issueID string) error {
+	var status string
+	var agentID sql.NullString
+	if err := db.QueryRow(`SELECT status, assigned_agent_id FROM issues WHERE id = ?`, issueID).Scan(&status, &agentID); err != nil {
+		return err
+	}
+	if status != "blocked" || agentID.String == "" {
+		return nil
+	}
+	var open int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM dialogs WHERE issue_id = ? AND status = 'open'`, issueID).Scan(&open); err != nil {
+		return err
+	}
+	if open > 0 {
+		return nil
+	}
+
+	if _, err := db.Exec(`UPDATE issues SET status = 'todo', last_error = NULL WHERE id = ? AND status = 'blocked'`, issueID); err != nil {
+		return err
 	}
+	if err := queueIssue(issueID, agentID.String); err != nil {
+		return err
+	}
+	broadcastIssueChange(issueID)
+	return nil
+}
+
+func dialogsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	projectID := accessFromRequest(r).ProjectID
 
 	rows, err := db.Query(`
 		SELECT id, project_id, agent_id, issue_id, title, message, options, default_option,
@@ -1105,11 +1170,7 @@ func dialogActionHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		userID, err := currentUserID(r)
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+		userID := accessFromRequest(r).UserID
 
 		var req struct {
 			SelectedOption string `json:"selected_option"`
@@ -1121,6 +1182,10 @@ func dialogActionHandler(w http.ResponseWriter, r *http.Request) {
 
 		resp, err := respondToDialog(DialogID, userID, req.SelectedOption)
 		if err != nil {
+			if errors.Is(err, errPermissionDenied) || errors.Is(err, errNotProjectMember) {
+				http.Error(w, "Forbidden: your project role does not allow this action", http.StatusForbidden)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -1173,10 +1238,7 @@ func promptCoachAPIHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func agentQueuesAPIHandler(w http.ResponseWriter, r *http.Request) {
-	projectID := r.URL.Query().Get("project_id")
-	if projectID == "" {
-		projectID = "default"
-	}
+	projectID := accessFromRequest(r).ProjectID
 
 	stats, err := collectQueueStatsForProject(projectID)
 	if err != nil {
@@ -1191,10 +1253,7 @@ func agentQueuesAPIHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func agentStatusAPIHandler(w http.ResponseWriter, r *http.Request) {
-	projectID := r.URL.Query().Get("project_id")
-	if projectID == "" {
-		projectID = "default"
-	}
+	projectID := accessFromRequest(r).ProjectID
 
 	stats, err := collectQueueStatsForProject(projectID)
 	if err != nil {
@@ -1232,9 +1291,13 @@ type AgentQueueStat struct {
 	AgentID           string `json:"agent_id"`
 	QueueDepth        int    `json:"queue_depth"`
 	InProgress        int    `json:"in_progress"`
+	Paused            bool   `json:"paused"`
 	Status            string `json:"status"`
 	CurrentIssueID    string `json:"current_issue_id,omitempty"`
 	CurrentIssueTitle string `json:"current_issue_title,omitempty"`
+	// RunIDs are the agent's runs in flight, chat replies included; pass
+	// one to the cancel command.
+	RunIDs []string `json:"run_ids,omitempty"`
 }
 
 type queuedIssue struct {
@@ -1244,6 +1307,9 @@ type queuedIssue struct {
 	Title       string
 	Description string
 	Priority    string
+	// Prompt replaces the generated task prompt when someone re-ran the
+	// issue with an edited one.
+	Prompt string
 }
 
 func determineIssueAgent(requestedAgent, title, description string) string {
@@ -1269,11 +1335,19 @@ func queueIssue(issueID, agentID string) error {
 	return err
 }
 
-func claimNextQueuedIssue() (*queuedIssue, error) {
-	row := db.QueryRow(`
-		SELECT id, project_id, queued_agent_id, title, description, priority
+// queuedIssues lists the issues waiting for an agent, most urgent first.
+// Projects whose workspace is stuck mid-conflict are left out until the
+// conflict is resolved or the sync aborted, and so are paused queues.
+func queuedIssues() ([]queuedIssue, error) {
+	rows, err := db.Query(`
+		SELECT id, project_id, queued_agent_id, title, description, priority, COALESCE(agent_prompt, '')
 		FROM issues
 		WHERE status = 'todo' AND queued_agent_id IS NOT NULL
+		  AND (retry_at IS NULL OR retry_at <= ?)
+		  AND NOT EXISTS (
+			SELECT 1 FROM agent_pauses
+			WHERE agent_pauses.project_id = issues.project_id AND agent_pauses.agent_id = issues.queued_agent_id
+		  )
 		ORDER BY
 			CASE priority
 				WHEN 'urgent' THEN 0
@@ -1282,56 +1356,82 @@ func claimNextQueuedIssue() (*queuedIssue, error) {
 				ELSE 3
 			END,
 			queued_at ASC
-		LIMIT 1
-	`)
-
-	var issue queuedIssue
-	if err := row.Scan(&issue.ID, &issue.ProjectID, &issue.AgentID, &issue.Title, &issue.Description, &issue.Priority); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
+	`, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var candidates []queuedIssue
+	for rows.Next() {
+		var issue queuedIssue
+		if err := rows.Scan(&issue.ID, &issue.ProjectID, &issue.AgentID, &issue.Title, &issue.Description, &issue.Priority, &issue.Prompt); err != nil {
+			rows.Close()
+			return nil, err
 		}
+		candidates = append(candidates, issue)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
+	blocked := map[string]bool{}
+	issues := candidates[:0]
+	for _, issue := range candidates {
+		isBlocked, checked := blocked[issue.ProjectID]
+		if !checked {
+			isBlocked = projectWorkspaceBlocked(issue.ProjectID)
+			blocked[issue.ProjectID] = isBlocked
+		}
+		if !isBlocked {
+			issues = append(issues, issue)
+		}
+	}
+	return issues, nil
+}
+
+// claimQueuedIssue moves a queued issue to in progress under a lease held
+// by this worker. It reports false when the issue is no longer waiting.
+func claimQueuedIssue(issueID string, lease agents.TaskLease) (bool, error) {
 	now := time.Now()
 	res, err := db.Exec(`
 		UPDATE issues
 		SET status = 'inProgress',
 			started_at = COALESCE(started_at, ?),
 			assigned_agent_id = COALESCE(assigned_agent_id, queued_agent_id),
-			queued_agent_id = NULL
-		WHERE id = ? AND status = 'todo'
-	`, now, issue.ID)
+			queued_agent_id = NULL,
+			claimed_by = ?,
+			lease_expires_at = ?
+		WHERE id = ? AND status = 'todo' AND queued_agent_id IS NOT NULL
+	`, now, agents.WorkerID, now.Add(lease.TTL), issueID)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
 	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected == 0 {
-		return nil, nil
-	}
-
-	return &issue, nil
+	return rowsAffected > 0, nil
 }
 
 func fetchIssue(issueID string) (map[string]interface{}, error) {
 	var (
 		id, projectID, title, description, priority, status, createdBy, createdByType string
-		assignedAgentID, queuedAgentID                                                sql.NullString
-		queuedAt, startedAt, completedAt, createdAt                                   sql.NullTime
+		assignedAgentID, queuedAgentID, branch, lastError                             sql.NullString
+		queuedAt, startedAt, completedAt, createdAt, retryAt                          sql.NullTime
+		attempts                                                                      sql.NullInt64
 	)
 
 	row := db.QueryRow(`
 		SELECT id, project_id, title, description, priority, status,
 		       created_by, created_by_type, assigned_agent_id, queued_agent_id,
-		       queued_at, started_at, completed_at, created_at
+		       queued_at, started_at, completed_at, created_at, branch,
+		       attempts, last_error, retry_at
 		FROM issues
 		WHERE id = ?
 	`, issueID)
 
 	if err := row.Scan(&id, &projectID, &title, &description, &priority, &status,
 		&createdBy, &createdByType, &assignedAgentID, &queuedAgentID,
-		&queuedAt, &startedAt, &completedAt, &createdAt); err != nil {
+		&queuedAt, &startedAt, &completedAt, &createdAt, &branch,
+		&attempts, &lastError, &retryAt); err != nil {
 		return nil, err
 	}
 
@@ -1350,11 +1450,24 @@ func fetchIssue(issueID string) (map[string]interface{}, error) {
 		"started_at":        startedAt.Time,
 		"completed_at":      completedAt.Time,
 		"created_at":        createdAt.Time,
+		"branch":            branch.String,
+		"attempts":          attempts.Int64,
+		"last_error":        lastError.String,
+		"retry_at":          retryAt.Time,
 	}
 
 	return issue, nil
 }
 
+// hubPublisher returns globalHub as an agents.Publisher, or nil when there
+// is no hub, so agents never see a non-nil interface holding a nil *Hub.
+func hubPublisher() agents.Publisher {
+	if globalHub == nil {
+		return nil
+	}
+	return globalHub
+}
+
 func broadcastIssueChange(issueID string) {
 	if globalHub == nil {
 		return
@@ -1379,10 +1492,9 @@ func broadcastIssueChange(issueID string) {
 		return
 	}
 
-	select {
-	case globalHub.broadcast <- data:
-	default:
-		log.Print("issue: broadcast channel full, dropping update event")
+	projectID, _ := issue["project_id"].(string)
+	if !globalHub.publishWithin(projectID, data, 0) {
+		log.Printf("issue: hub busy, dropping update event for project %s", projectID)
 	}
 }
 
@@ -1470,6 +1582,24 @@ func collectQueueStatsForProject(projectID string) ([]AgentQueueStat, error) {
 		}
 	}
 
+	pauseRows, err := db.Query(`SELECT agent_id FROM agent_pauses WHERE project_id = ?`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer pauseRows.Close()
+	for pauseRows.Next() {
+		var agentID string
+		if err := pauseRows.Scan(&agentID); err != nil {
+			return nil, err
+		}
+		ensureEntry(agentID).Paused = true
+	}
+
+	for _, run := range agents.ActiveRuns(projectID) {
+		entry := ensureEntry(run.AgentType)
+		entry.RunIDs = append(entry.RunIDs, run.ID)
+	}
+
 	result := make([]AgentQueueStat, 0, len(stats))
 	for _, agentID := range defaultAgents {
 		if entry, ok := stats[agentID]; ok {
@@ -1493,8 +1623,10 @@ func collectQueueStatsForProject(projectID string) ([]AgentQueueStat, error) {
 
 func deriveAgentStatus(stat *AgentQueueStat) string {
 	switch {
-	case stat.InProgress > 0:
+	case stat.InProgress > 0 || len(stat.RunIDs) > 0:
 		return "working"
+	case stat.Paused:
+		return "paused"
 	case stat.QueueDepth > 0:
 		return "queued"
 	default:
@@ -1521,9 +1653,7 @@ func broadcastAgentQueueSnapshot(hub *Hub, projectID string, stats []AgentQueueS
 		return
 	}
 
-	select {
-	case hub.broadcast <- data:
-	case <-time.After(500 * time.Millisecond):
+	if !hub.publishWithin(projectID, data, 500*time.Millisecond) {
 		log.Printf("queue: dropping snapshot broadcast for project %s", projectID)
 	}
 }
@@ -1547,9 +1677,7 @@ func broadcastAgentStatusSnapshot(hub *Hub, projectID string, stats []AgentQueue
 		return
 	}
 
-	select {
-	case hub.broadcast <- data:
-	case <-time.After(500 * time.Millisecond):
+	if !hub.publishWithin(projectID, data, 500*time.Millisecond) {
 		log.Printf("agent status: dropping snapshot for project %s", projectID)
 	}
 }
@@ -1619,29 +1747,95 @@ func startQueueWorker(ctx context.Context, hub *Hub, interval time.Duration) {
 	}
 }
 
-func startTaskProcessor(ctx context.Context, broadcast chan<- []byte, interval time.Duration) {
+// startTaskProcessor hands queued issues to the pool every interval, as
+// many as it has room for. An issue is only claimed once the pool has
+// reserved a slot for it; the rest stay queued for the next tick.
+func startTaskProcessor(ctx context.Context, pool *agents.TaskPool, lease agents.TaskLease, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	held := map[string]string{}
 	for {
 		select {
 		case <-ctx.Done():
 			log.Println("tasks: processor shutting down")
 			return
 		case <-ticker.C:
-			issue, err := claimNextQueuedIssue()
+			issues, err := queuedIssues()
 			if err != nil {
-				log.Printf("tasks: failed to claim issue: %v", err)
+				log.Printf("tasks: failed to list queued issues: %v", err)
 				continue
 			}
-			if issue == nil {
-				continue
+
+			waiting := map[string]string{}
+			for i := range issues {
+				issue := &issues[i]
+				reservation, err := pool.Reserve(issue.ProjectID, issue.AgentID, issue.ID)
+				if err != nil {
+					waiting[issue.ID] = err.Error()
+					if held[issue.ID] != err.Error() {
+						log.Printf("tasks: holding issue %s for %s: %v", issue.ID, issue.AgentID, err)
+					}
+					continue
+				}
+
+				claimed, err := claimQueuedIssue(issue.ID, lease)
+				if err != nil || !claimed {
+					reservation.Release()
+					if err != nil {
+						log.Printf("tasks: failed to claim issue %s: %v", issue.ID, err)
+					}
+					continue
+				}
+
+				task := agents.Task{
+					ProjectID:  issue.ProjectID,
+					AgentType:  issue.AgentID,
+					IssueID:    issue.ID,
+					IssueTitle: issue.Title,
+					Prompt:     buildAgentTaskPrompt(issue),
+				}
+				reservation.Start(task, func() {
+					if err := agents.ReleaseLease(db, task.IssueID); err != nil {
+						log.Printf("tasks: failed to release lease on issue %s: %v", task.IssueID, err)
+					}
+					broadcastIssueChange(task.IssueID)
+					pushAgentStatusUpdate(task.ProjectID)
+				})
+				broadcastIssueChange(issue.ID)
+				pushAgentStatusUpdate(issue.ProjectID)
 			}
+			held = waiting
+		}
+	}
+}
 
-			prompt := buildAgentTaskPrompt(issue)
-			agents.ProcessAgentTask(db, broadcast, issue.ProjectID, issue.AgentID, issue.ID, issue.Title, prompt)
-			broadcastIssueChange(issue.ID)
-			pushAgentStatusUpdate(issue.ProjectID)
+// startLeaseKeeper renews the leases on the issues this worker is running
+// every heartbeat and takes back issues whose lease expired, which is how
+// runs lost to a crash or restart are recovered. It reclaims once at start.
+func startLeaseKeeper(ctx context.Context, lease agents.TaskLease) {
+	reclaim := func() {
+		policy := agents.TaskRetryPolicyFromEnv()
+		if n, err := agents.ReclaimExpiredLeases(db, hubPublisher(), policy); err != nil {
+			log.Printf("tasks: failed to reclaim expired leases: %v", err)
+		} else if n > 0 {
+			log.Printf("tasks: reclaimed %d issue(s) with expired leases", n)
+		}
+	}
+	reclaim()
+
+	ticker := time.NewTicker(lease.Heartbeat())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("tasks: lease keeper shutting down")
+			return
+		case <-ticker.C:
+			if err := agents.RenewLeases(db, lease); err != nil {
+				log.Printf("tasks: failed to renew leases: %v", err)
+			}
+			reclaim()
 		}
 	}
 }
@@ -1658,6 +1852,9 @@ func lookupUserName(userID string) string {
 }
 
 func buildAgentTaskPrompt(issue *queuedIssue) string {
+	if issue.Prompt != "" {
+		return issue.Prompt
+	}
 	desc := strings.TrimSpace(issue.Description)
 	if desc == "" {
 		desc = "No additional description provided."
@@ -1675,44 +1872,24 @@ Begin work immediately, update the project workspace as needed, and summarize yo
 }
 
 func projectsPageHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session_id")
-	if err != nil {
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
-	}
-
-	var userID string
-	err = db.QueryRow(`SELECT user_id FROM sessions WHERE id = ?`, cookie.Value).Scan(&userID)
-	if err != nil {
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
-	}
+	access := accessFromRequest(r)
+	userID := access.UserID
 
 	var username, email string
 	db.QueryRow(`SELECT name, email FROM users WHERE id = ?`, userID).Scan(&username, &email)
 
 	data := map[string]interface{}{
-		"Username": username,
-		"Email":    email,
-		"UserID":   userID,
+		"Username":  username,
+		"Email":     email,
+		"UserID":    userID,
+		"CSRFToken": access.CSRFToken,
 	}
 
 	renderTemplate(w, "projects.html", data)
 }
 
 func projectsAPIHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session_id")
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	var userID string
-	err = db.QueryRow(`SELECT user_id FROM sessions WHERE id = ?`, cookie.Value).Scan(&userID)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	userID := accessFromRequest(r).UserID
 
 	switch r.Method {
 	case http.MethodGet:
@@ -1726,11 +1903,12 @@ func projectsAPIHandler(w http.ResponseWriter, r *http.Request) {
 
 func listProjectsHandler(w http.ResponseWriter, r *http.Request, userID string) {
 	rows, err := db.Query(`
-		SELECT DISTINCT p.id, p.name, p.description, p.owner_id, p.created_at, p.settings,
-		       (SELECT COUNT(*) FROM project_members WHERE project_id = p.id) as member_count
+		SELECT p.id, p.name, p.description, p.owner_id, p.created_at, p.settings,
+		       (SELECT COUNT(*) FROM project_members WHERE project_id = p.id) as member_count,
+		       pm.role
 		FROM projects p
-		LEFT JOIN project_members pm ON p.id = pm.project_id
-		WHERE p.owner_id = ? OR pm.user_id = ?
+		LEFT JOIN project_members pm ON p.id = pm.project_id AND pm.user_id = ?
+		WHERE p.owner_id = ? OR pm.user_id IS NOT NULL
 		ORDER BY p.created_at DESC
 	`, userID, userID)
 
@@ -1747,8 +1925,16 @@ func listProjectsHandler(w http.ResponseWriter, r *http.Request, userID string)
 		var createdAt time.Time
 		var settings sql.NullString
 		var memberCount int
+		var memberRole sql.NullString
+
+		rows.Scan(&id, &name, &description, &ownerID, &createdAt, &settings, &memberCount, &memberRole)
 
-		rows.Scan(&id, &name, &description, &ownerID, &createdAt, &settings, &memberCount)
+		role, ok := parseProjectRole(memberRole.String)
+		if ownerID == userID {
+			role = roleOwner
+		} else if !ok || role == roleOwner {
+			role = roleViewer
+		}
 
 		project := map[string]interface{}{
 			"id":           id,
@@ -1757,6 +1943,7 @@ func listProjectsHandler(w http.ResponseWriter, r *http.Request, userID string)
 			"owner_id":     ownerID,
 			"created_at":   createdAt,
 			"member_count": memberCount,
+			"role":         role,
 		}
 
 		if settings.Valid {
@@ -1814,7 +2001,7 @@ func createProjectHandler(w http.ResponseWriter, r *http.Request, userID string)
 	_, err = db.Exec(`
 		INSERT INTO project_members (id, project_id, user_id, role, joined_at)
 		VALUES (?, ?, ?, ?, ?)
-	`, memberID, projectID, userID, "owner", timestamp)
+	`, memberID, projectID, userID, string(roleOwner), timestamp)
 
 	if err != nil {
 		log.Printf("Failed to insert project member: %v", err)
@@ -1843,38 +2030,41 @@ func createProjectHandler(w http.ResponseWriter, r *http.Request, userID string)
 }
 
 func projectInviteHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session_id")
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	access := accessFromRequest(r)
+	userID, projectID := access.UserID, access.ProjectID
 
-	var userID string
-	err = db.QueryRow(`SELECT user_id FROM sessions WHERE id = ?`, cookie.Value).Scan(&userID)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/projects/"), "/")
+	if len(parts) < 2 || parts[1] != "invite" {
+		http.Error(w, "Invalid endpoint", http.StatusBadRequest)
 		return
 	}
 
-	path := strings.TrimPrefix(r.URL.Path, "/api/projects/")
-	parts := strings.Split(path, "/")
-	projectID := parts[0]
-
-	if projectID == "" || len(parts) < 2 || parts[1] != "invite" {
-		http.Error(w, "Invalid endpoint", http.StatusBadRequest)
+	if !requirePermission(w, access, permCreateInvites) {
 		return
 	}
 
-	var ownerID string
-	err = db.QueryRow(`SELECT owner_id FROM projects WHERE id = ?`, projectID).Scan(&ownerID)
-	if err != nil {
-		http.Error(w, "Project not found", http.StatusNotFound)
-		return
+	var req struct {
+		Role string `json:"role"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
-	if ownerID != userID {
-		http.Error(w, "Only project owner can create invites", http.StatusForbidden)
-		return
+	inviteRole := roleMember
+	if req.Role != "" {
+		role, ok := parseProjectRole(req.Role)
+		if !ok || role == roleOwner {
+			http.Error(w, "role must be one of maintainer, member or viewer", http.StatusBadRequest)
+			return
+		}
+		if role == roleMaintainer && access.Role != roleOwner {
+			http.Error(w, "only the project owner can invite maintainers", http.StatusForbidden)
+			return
+		}
+		inviteRole = role
 	}
 
 	inviteID := uuid.New().String()
@@ -1883,10 +2073,10 @@ func projectInviteHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Generating invite for project %s: code=%s", projectID, code)
 
-	_, err = db.Exec(`
-		INSERT INTO invite_links (id, project_id, code, created_by, created_at)
-		VALUES (?, ?, ?, ?, ?)
-	`, inviteID, projectID, code, userID, timestamp)
+	_, err := db.Exec(`
+		INSERT INTO invite_links (id, project_id, code, created_by, role, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, inviteID, projectID, code, userID, string(inviteRole), timestamp)
 
 	if err != nil {
 		log.Printf("Failed to create invite link: %v", err)
@@ -1899,22 +2089,12 @@ func projectInviteHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"code": code,
+		"role": inviteRole,
 	})
 }
 
 func inviteAcceptHandler(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session_id")
-	if err != nil {
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
-	}
-
-	var userID string
-	err = db.QueryRow(`SELECT user_id FROM sessions WHERE id = ?`, cookie.Value).Scan(&userID)
-	if err != nil {
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
-	}
+	userID := accessFromRequest(r).UserID
 
 	code := strings.TrimPrefix(r.URL.Path, "/invite/")
 	if code == "" {
@@ -1928,12 +2108,13 @@ func inviteAcceptHandler(w http.ResponseWriter, r *http.Request) {
 	var uses int
 	var maxUses sql.NullInt64
 	var expiresAt sql.NullTime
+	var inviteRole sql.NullString
 
-	err = db.QueryRow(`
-		SELECT id, project_id, uses, max_uses, expires_at
+	err := db.QueryRow(`
+		SELECT id, project_id, uses, max_uses, expires_at, role
 		FROM invite_links
 		WHERE code = ?
-	`, code).Scan(&inviteID, &projectID, &uses, &maxUses, &expiresAt)
+	`, code).Scan(&inviteID, &projectID, &uses, &maxUses, &expiresAt, &inviteRole)
 
 	if err != nil {
 		log.Printf("Failed to find invite: %v", err)
@@ -1963,11 +2144,16 @@ func inviteAcceptHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	role, ok := parseProjectRole(inviteRole.String)
+	if !ok || role == roleOwner {
+		role = roleMember
+	}
+
 	memberID := uuid.New().String()
 	_, err = db.Exec(`
 		INSERT INTO project_members (id, project_id, user_id, role, joined_at)
 		VALUES (?, ?, ?, ?, ?)
-	`, memberID, projectID, userID, "member", time.Now())
+	`, memberID, projectID, userID, string(role), time.Now())
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -2017,6 +2203,8 @@ func createTables() error {
 				email TEXT UNIQUE NOT NULL,
 				name TEXT NOT NULL,
 				avatar TEXT,
+				password_hash TEXT,
+				oidc_subject TEXT,
 				created_at TIMESTAMP NOT NULL
 			)`,
 		},
@@ -2025,6 +2213,24 @@ func createTables() error {
 			query: `CREATE TABLE IF NOT EXISTS sessions (
 				id TEXT PRIMARY KEY,
 				user_id TEXT NOT NULL,
+				auth_method TEXT,
+				csrf_token TEXT,
+				user_agent TEXT,
+				ip_address TEXT,
+				created_at TIMESTAMP NOT NULL,
+				last_seen_at TIMESTAMP,
+				expires_at TIMESTAMP,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`,
+		},
+		{
+			name: "password_resets",
+			query: `CREATE TABLE IF NOT EXISTS password_resets (
+				id TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				token_hash TEXT UNIQUE NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				used_at TIMESTAMP,
 				created_at TIMESTAMP NOT NULL,
 				FOREIGN KEY (user_id) REFERENCES users(id)
 			)`,
@@ -2131,11 +2337,63 @@ func createTables() error {
 				expires_at TIMESTAMP,
 				max_uses INTEGER,
 				uses INTEGER DEFAULT 0,
+				role TEXT,
 				created_at TIMESTAMP NOT NULL,
 				FOREIGN KEY (project_id) REFERENCES projects(id),
 				FOREIGN KEY (created_by) REFERENCES users(id)
 			)`,
 		},
+		{
+			name: "activity",
+			query: `CREATE TABLE IF NOT EXISTS activity (
+				id TEXT PRIMARY KEY,
+				project_id TEXT NOT NULL,
+				kind TEXT NOT NULL,
+				actor_id TEXT,
+				summary TEXT NOT NULL,
+				status TEXT NOT NULL,
+				error TEXT,
+				details TEXT,
+				created_at TIMESTAMP NOT NULL,
+				FOREIGN KEY (project_id) REFERENCES projects(id)
+			)`,
+		},
+		{
+			name: "agent_runs",
+			query: `CREATE TABLE IF NOT EXISTS agent_runs (
+				id TEXT PRIMARY KEY,
+				project_id TEXT NOT NULL,
+				issue_id TEXT,
+				agent_id TEXT NOT NULL,
+				message_id TEXT,
+				provider TEXT,
+				model TEXT,
+				prompt_hash TEXT,
+				raw_output TEXT,
+				plan TEXT,
+				result TEXT,
+				commit_id TEXT,
+				input_tokens INTEGER NOT NULL DEFAULT 0,
+				output_tokens INTEGER NOT NULL DEFAULT 0,
+				duration_ms INTEGER NOT NULL DEFAULT 0,
+				status TEXT NOT NULL,
+				error TEXT,
+				started_at TIMESTAMP NOT NULL,
+				finished_at TIMESTAMP NOT NULL,
+				FOREIGN KEY (project_id) REFERENCES projects(id)
+			)`,
+		},
+		{
+			name: "agent_pauses",
+			query: `CREATE TABLE IF NOT EXISTS agent_pauses (
+				project_id TEXT NOT NULL,
+				agent_id TEXT NOT NULL,
+				paused_by TEXT,
+				paused_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (project_id, agent_id),
+				FOREIGN KEY (project_id) REFERENCES projects(id)
+			)`,
+		},
 		{
 			name: "dialogs",
 			query: `CREATE TABLE IF NOT EXISTS dialogs (
@@ -2166,13 +2424,64 @@ func createTables() error {
 	if err := ensureIssueColumns(); err != nil {
 		return err
 	}
+	if err := ensureColumns("issues", []columnSpec{
+		{name: "branch", definition: "TEXT"},
+		{name: "worktree_path", definition: "TEXT"},
+		{name: "attempts", definition: "INTEGER NOT NULL DEFAULT 0"},
+		{name: "last_error", definition: "TEXT"},
+		{name: "retry_at", definition: "TIMESTAMP"},
+		{name: "agent_prompt", definition: "TEXT"},
+	}); err != nil {
+		return err
+	}
+	// Change sets are stored as artifacts of type change_set.
+	if err := ensureColumns("artifacts", []columnSpec{
+		{name: "project_id", definition: "TEXT"},
+		{name: "status", definition: "TEXT"},
+		{name: "message_id", definition: "TEXT"},
+		{name: "rejected_by", definition: "TEXT"},
+		{name: "rejected_at", definition: "TIMESTAMP"},
+	}); err != nil {
+		return err
+	}
+	if err := ensureColumns("invite_links", []columnSpec{
+		{name: "role", definition: "TEXT"},
+	}); err != nil {
+		return err
+	}
+	if err := ensureColumns("users", []columnSpec{
+		{name: "password_hash", definition: "TEXT"},
+		{name: "oidc_subject", definition: "TEXT"},
+	}); err != nil {
+		return err
+	}
+	if err := ensureColumns("sessions", []columnSpec{
+		{name: "auth_method", definition: "TEXT"},
+		{name: "csrf_token", definition: "TEXT"},
+		{name: "user_agent", definition: "TEXT"},
+		{name: "ip_address", definition: "TEXT"},
+		{name: "last_seen_at", definition: "TIMESTAMP"},
+		{name: "expires_at", definition: "TIMESTAMP"},
+	}); err != nil {
+		return err
+	}
+	if err := ensureColumns("agent_runs", []columnSpec{
+		{name: "prompt", definition: "TEXT"},
+	}); err != nil {
+		return err
+	}
 	return ensureIndexes()
 }
 
-func ensureIssueColumns() error {
-	rows, err := db.Query(`PRAGMA table_info(issues)`)
+type columnSpec struct {
+	name       string
+	definition string
+}
+
+func tableColumns(table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
 	if err != nil {
-		return fmt.Errorf("failed to inspect issues table: %w", err)
+		return nil, fmt.Errorf("failed to inspect %s table: %w", table, err)
 	}
 	defer rows.Close()
 
@@ -2187,10 +2496,38 @@ func ensureIssueColumns() error {
 			pk         int
 		)
 		if err := rows.Scan(&cid, &name, &typeName, &notNull, &defaultVal, &pk); err != nil {
-			return fmt.Errorf("failed to scan issues columns: %w", err)
+			return nil, fmt.Errorf("failed to scan %s columns: %w", table, err)
 		}
 		columns[name] = true
 	}
+	return columns, rows.Err()
+}
+
+// ensureColumns adds any missing columns to an existing table so databases
+// created by older builds pick up new fields without a manual migration.
+func ensureColumns(table string, specs []columnSpec) error {
+	columns, err := tableColumns(table)
+	if err != nil {
+		return err
+	}
+
+	for _, spec := range specs {
+		if columns[spec.name] {
+			continue
+		}
+		query := fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, spec.name, spec.definition)
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("failed to add %s.%s column: %w", table, spec.name, err)
+		}
+	}
+	return nil
+}
+
+func ensureIssueColumns() error {
+	columns, err := tableColumns("issues")
+	if err != nil {
+		return err
+	}
 
 	if !columns["queued_agent_id"] {
 		if _, err := db.Exec(`ALTER TABLE issues ADD COLUMN queued_agent_id TEXT`); err != nil {
@@ -2207,6 +2544,22 @@ func ensureIssueColumns() error {
 		}
 	}
 
+	if !columns["claimed_by"] {
+		for _, column := range []string{"claimed_by TEXT", "lease_expires_at TIMESTAMP"} {
+			if _, err := db.Exec(`ALTER TABLE issues ADD COLUMN ` + column); err != nil {
+				return fmt.Errorf("failed to add lease columns: %w", err)
+			}
+		}
+		// Agent work left in progress before leases existed gets an expired
+		// lease, so the lease keeper recovers it at startup.
+		if _, err := db.Exec(`
+			UPDATE issues SET claimed_by = 'unknown', lease_expires_at = ?
+			WHERE status = 'inProgress' AND assigned_agent_id IS NOT NULL
+		`, time.Now()); err != nil {
+			return fmt.Errorf("failed to backfill lease columns: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -2220,6 +2573,11 @@ func ensureIndexes() error {
 		{name: "idx_issues_project_status", query: `CREATE INDEX IF NOT EXISTS idx_issues_project_status ON issues (project_id, status)`},
 		{name: "idx_issues_queued_agent", query: `CREATE INDEX IF NOT EXISTS idx_issues_queued_agent ON issues (queued_agent_id)`},
 		{name: "idx_dialogs_project_status", query: `CREATE INDEX IF NOT EXISTS idx_dialogs_project_status ON dialogs (project_id, status)`},
+		{name: "idx_artifacts_project_status", query: `CREATE INDEX IF NOT EXISTS idx_artifacts_project_status ON artifacts (project_id, status)`},
+		{name: "idx_activity_project_created", query: `CREATE INDEX IF NOT EXISTS idx_activity_project_created ON activity (project_id, created_at)`},
+		{name: "idx_agent_runs_project_started", query: `CREATE INDEX IF NOT EXISTS idx_agent_runs_project_started ON agent_runs (project_id, started_at)`},
+		{name: "idx_users_oidc_subject", query: `CREATE INDEX IF NOT EXISTS idx_users_oidc_subject ON users (oidc_subject)`},
+		{name: "idx_sessions_user", query: `CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions (user_id)`},
 	}
 
 	for _, idx := range indexes {
@@ -2242,7 +2600,10 @@ func main() {
 	}
 	defer db.Close()
 
+	llm.OnBreakerStateChange(monitoring.SetLLMCircuitState)
 	promptCoach = promptcoach.New()
+	oidcProvider = newOIDCProviderFromEnv()
+	configureSessions()
 
 	hub := newHub()
 	globalHub = hub
@@ -2256,27 +2617,44 @@ func main() {
 	}
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticContent))))
 
+	// Public routes.
 	mux.HandleFunc("/", indexHandler)
 	mux.HandleFunc("/login", loginHandler)
+	mux.HandleFunc("/signup", signupHandler)
 	mux.HandleFunc("/logout", logoutHandler)
-	mux.HandleFunc("/projects", projectsPageHandler)
-	mux.HandleFunc("/project", projectHandler)
-	mux.HandleFunc("/kanban", kanbanHandler)
-	mux.HandleFunc("/api/projects", projectsAPIHandler)
-	mux.HandleFunc("/api/projects/", projectInviteHandler)
-	mux.HandleFunc("/api/issues", issuesAPIHandler)
-	mux.HandleFunc("/api/issues/", issueAPIHandler)
-	mux.HandleFunc("/api/messages", messagesAPIHandler)
-	mux.HandleFunc("/api/dialogs", dialogsAPIHandler)
-	mux.HandleFunc("/api/dialogs/", dialogActionHandler)
-	mux.HandleFunc("/api/agent-queues", agentQueuesAPIHandler)
-	mux.HandleFunc("/api/agent-status", agentStatusAPIHandler)
-	mux.HandleFunc("/api/prompt-coach", promptCoachAPIHandler)
-	mux.HandleFunc("/invite/", inviteAcceptHandler)
+	mux.HandleFunc("/password/forgot", forgotPasswordHandler)
+	mux.HandleFunc("/password/reset", resetPasswordHandler)
+	mux.HandleFunc("/auth/oidc/login", oidcLoginHandler)
+	mux.HandleFunc("/auth/oidc/callback", oidcCallbackHandler)
 	mux.Handle("/metrics", monitoring.Handler())
-	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+
+	// Session-only routes.
+	mux.HandleFunc("/projects", requirePageSession(projectsPageHandler))
+	mux.HandleFunc("/invite/", requirePageSession(inviteAcceptHandler))
+	mux.HandleFunc("/api/projects", requireSession(projectsAPIHandler))
+	mux.HandleFunc("/api/prompt-coach", requireSession(promptCoachAPIHandler))
+	mux.HandleFunc("/api/sessions", requireSession(sessionsAPIHandler))
+	mux.HandleFunc("/api/sessions/", requireSession(sessionAPIHandler))
+
+	// Project-scoped routes: the caller must own or belong to the project.
+	mux.HandleFunc("/project", requireProjectPage(projectHandler))
+	mux.HandleFunc("/kanban", requireProjectPage(kanbanHandler))
+	mux.HandleFunc("/api/projects/", requireProjectAccess(projectFromPath("/api/projects/"), projectAPIHandler))
+	mux.HandleFunc("/api/issues", requireProjectAccess(projectFromQueryOrBody, issuesAPIHandler))
+	mux.HandleFunc("/api/issues/", requireProjectAccess(projectFromRecordPath("/api/issues/", "issues"), issueAPIHandler))
+	mux.HandleFunc("/api/messages", requireProjectAccess(projectFromQuery("project_id"), messagesAPIHandler))
+	mux.HandleFunc("/api/messages/", requireProjectAccess(projectFromRecordPath("/api/messages/", "messages"), messageAPIHandler))
+	mux.HandleFunc("/api/dialogs", requireProjectAccess(projectFromQuery("project_id"), dialogsAPIHandler))
+	mux.HandleFunc("/api/dialogs/", requireProjectAccess(projectFromRecordPath("/api/dialogs/", "dialogs"), dialogActionHandler))
+	mux.HandleFunc("/api/change-sets", requireProjectAccess(projectFromQuery("project_id"), changeSetsAPIHandler))
+	mux.HandleFunc("/api/change-sets/", requireProjectAccess(projectFromRecordPath("/api/change-sets/", "artifacts"), changeSetAPIHandler))
+	mux.HandleFunc("/api/agent-runs", requireProjectAccess(projectFromQuery("project_id"), agentRunsAPIHandler))
+	mux.HandleFunc("/api/agent-runs/", requireProjectAccess(projectFromRecordPath("/api/agent-runs/", "agent_runs"), agentRunAPIHandler))
+	mux.HandleFunc("/api/agent-queues", requireProjectAccess(projectFromQuery("project_id"), agentQueuesAPIHandler))
+	mux.HandleFunc("/api/agent-status", requireProjectAccess(projectFromQuery("project_id"), agentStatusAPIHandler))
+	mux.HandleFunc("/ws", requireProjectAccess(projectFromQuery("projectId"), func(w http.ResponseWriter, r *http.Request) {
 		wsHandler(w, r, hub)
-	})
+	}))
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -2295,7 +2673,16 @@ func main() {
 	defer stop()
 
 	go startQueueWorker(shutdownCtx, hub, 5*time.Second)
-	go startTaskProcessor(shutdownCtx, hub.broadcast, 4*time.Second)
+	limits := agents.PoolLimitsFromEnv()
+	log.Printf("tasks: %d workers (per project %d, per agent %d, per provider %d)",
+		limits.Workers, limits.PerProject, limits.PerAgent, limits.PerProvider)
+	pool := agents.NewTaskPool(db, hub, limits)
+	lease := agents.TaskLeaseFromEnv()
+	log.Printf("tasks: worker %s, leases of %s", agents.WorkerID, lease.TTL)
+	go startLeaseKeeper(shutdownCtx, lease)
+	go startTaskProcessor(shutdownCtx, pool, lease, 4*time.Second)
+	go startSessionJanitor(shutdownCtx, time.Hour)
+	go startWorkspaceSync(shutdownCtx, workspaceSyncInterval())
 
 	errCh := make(chan error, 1)
 	go func() {
@@ -2316,6 +2703,9 @@ func main() {
 		if err := server.Shutdown(ctx); err != nil {
 			log.Printf("server: shutdown error: %v", err)
 		}
+		if err := pool.Wait(ctx); err != nil {
+			log.Printf("tasks: %d agent runs still in flight at shutdown", len(agents.ActiveRuns("")))
+		}
 	}
 
 	log.Println("server: stopped")
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"replychat/src/agents"
+	"replychat/src/projectfs"
+)
+
+// issueBranch is the git state of an issue as recorded by the agents.
+type issueBranch struct {
+	ProjectID, Title, Description, Priority string
+	AgentID, Branch, WorktreePath           string
+}
+
+func loadIssueBranch(issueID string) (issueBranch, error) {
+	var (
+		ib                            issueBranch
+		agentID, branch, worktreePath sql.NullString
+	)
+	err := db.QueryRow(`
+		SELECT project_id, title, description, priority, assigned_agent_id, branch, worktree_path
+		FROM issues WHERE id = ?
+	`, issueID).Scan(&ib.ProjectID, &ib.Title, &ib.Description, &ib.Priority, &agentID, &branch, &worktreePath)
+	ib.AgentID, ib.Branch, ib.WorktreePath = agentID.String, branch.String, worktreePath.String
+	return ib, err
+}
+
+// writeBranchError maps git state errors to HTTP statuses.
+func writeBranchError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "issue not found", http.StatusNotFound)
+	case errors.Is(err, projectfs.ErrDirtyWorkspace),
+		errors.Is(err, projectfs.ErrDetachedHead),
+		errors.Is(err, projectfs.ErrMissingWorktree):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// mergeIssueHandler lands an issue's branch on the project's default branch
+// by merging or rebasing it, and reports the outcome in the chat.
+func mergeIssueHandler(w http.ResponseWriter, r *http.Request, issueID string) {
+	access := accessFromRequest(r)
+	if !requirePermission(w, access, permMergeBranches) {
+		return
+	}
+
+	var req struct {
+		Strategy string `json:"strategy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Strategy == "" {
+		req.Strategy = projectfs.MergeStrategyMerge
+	}
+	if req.Strategy != projectfs.MergeStrategyMerge && req.Strategy != projectfs.MergeStrategyRebase {
+		http.Error(w, "strategy must be merge or rebase", http.StatusBadRequest)
+		return
+	}
+
+	issue, err := loadIssueBranch(issueID)
+	if err != nil {
+		writeBranchError(w, err)
+		return
+	}
+	if issue.Branch == "" {
+		http.Error(w, "issue has no branch yet", http.StatusConflict)
+		return
+	}
+	settings, err := projectfs.LoadSettings(db, issue.ProjectID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := projectfs.MergeBranch(settings.WorkspacePath, issue.WorktreePath, issue.Branch, req.Strategy)
+	if err != nil {
+		log.Printf("git: %s of %s failed: %v", req.Strategy, issue.Branch, err)
+		writeBranchError(w, err)
+		return
+	}
+	log.Printf("git: %s %s of %s into %s (conflicts=%d)", access.UserID, req.Strategy, result.Branch, result.Target, len(result.Conflicts))
+
+	var (
+		push    *projectfs.PushResult
+		pushErr error
+	)
+	if result.CommitID != "" {
+		push, pushErr = agents.PushWorkspace(db, hubPublisher(), issue.ProjectID, settings.WorkspacePath, projectfs.PushAfterMerge, access.UserID)
+	}
+
+	sendSystemMessage(issue.ProjectID, mergeMessage(issue.Title, result, push, pushErr))
+	broadcastIssueChange(issueID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"result": result,
+		"push":   push,
+	})
+}
+
+func mergeMessage(title string, result *projectfs.MergeResult, push *projectfs.PushResult, pushErr error) string {
+	action := "Merging"
+	if result.Strategy == projectfs.MergeStrategyRebase {
+		action = "Rebasing"
+	}
+
+	switch {
+	case result.UpToDate:
+		return fmt.Sprintf("Branch %s for %q has nothing new for %s.", result.Branch, title, result.Target)
+	case len(result.Conflicts) > 0:
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s %s into %s for %q stopped on conflicts in:\n", action, result.Branch, result.Target, title)
+		for _, path := range result.Conflicts {
+			fmt.Fprintf(&b, "- %s\n", path)
+		}
+		b.WriteString("Nothing was changed. Assign the conflicts to the agent from the task to have them resolved.")
+		return b.String()
+	}
+
+	message := fmt.Sprintf("Merged %s into %s for %q (%s).", result.Branch, result.Target, title, shortCommit(result.CommitID))
+	if result.Strategy == projectfs.MergeStrategyRebase {
+		message = fmt.Sprintf("Rebased %s onto %s and fast-forwarded for %q (%s).", result.Branch, result.Target, title, shortCommit(result.CommitID))
+	}
+	switch {
+	case pushErr != nil:
+		message += " Pushing to origin failed; see the project activity."
+	case push != nil && push.Pushed:
+		message += fmt.Sprintf(" Pushed to origin/%s.", push.RemoteBranch)
+	}
+	return message
+}
+
+func shortCommit(id string) string {
+	if len(id) > 7 {
+		return id[:7]
+	}
+	return id
+}
+
+// resolveConflictsHandler hands a conflicting branch back to its agent: it
+// merges the default branch into the issue's worktree, leaving conflict
+// markers in place, and queues a new issue on the same branch asking the
+// agent to resolve them.
+func resolveConflictsHandler(w http.ResponseWriter, r *http.Request, issueID string) {
+	access := accessFromRequest(r)
+	if !requirePermission(w, access, permMergeBranches) || !requirePermission(w, access, permRunAgents) {
+		return
+	}
+
+	issue, err := loadIssueBranch(issueID)
+	if err != nil {
+		writeBranchError(w, err)
+		return
+	}
+	if issue.Branch == "" || issue.WorktreePath == "" {
+		http.Error(w, "issue has no branch yet", http.StatusConflict)
+		return
+	}
+	settings, err := projectfs.LoadSettings(db, issue.ProjectID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	target, err := projectfs.DefaultBranch(settings.WorkspacePath)
+	if err != nil {
+		writeBranchError(w, err)
+		return
+	}
+
+	conflicts, err := projectfs.StartConflictMerge(settings.WorkspacePath, issue.WorktreePath)
+	if err != nil {
+		log.Printf("git: failed to merge %s into %s: %v", target, issue.Branch, err)
+		writeBranchError(w, err)
+		return
+	}
+	if len(conflicts) == 0 {
+		sendSystemMessage(issue.ProjectID, fmt.Sprintf("Branch %s for %q now merges cleanly with %s.", issue.Branch, issue.Title, target))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"conflicts": []string{},
+		})
+		return
+	}
+
+	title := "Resolve merge conflicts: " + issue.Title
+	var description strings.Builder
+	fmt.Fprintf(&description, "Branch %s conflicts with %s. %s has been merged into the branch and these files contain conflict markers (<<<<<<<, =======, >>>>>>>):\n", issue.Branch, target, target)
+	for _, path := range conflicts {
+		fmt.Fprintf(&description, "- %s\n", path)
+	}
+	description.WriteString("\nEdit each file to combine both sides so the original task still works, and remove every conflict marker.")
+
+	agentID := issue.AgentID
+	if agentID == "" {
+		agentID = determineIssueAgent("", issue.Title, issue.Description)
+	}
+	var assignedAgent interface{}
+	if agentID != "" {
+		assignedAgent = agentID
+	}
+
+	// The new issue shares the original's branch and worktree, so the
+	// agent's commit concludes the pending merge.
+	newID := uuid.New().String()
+	_, err = db.Exec(`
+		INSERT INTO issues (id, project_id, title, description, priority, status,
+		                   created_by, created_by_type, assigned_agent_id, branch, worktree_path, created_at)
+		VALUES (?, ?, ?, ?, ?, 'todo', ?, 'user', ?, ?, ?, ?)
+	`, newID, issue.ProjectID, title, description.String(), issue.Priority,
+		access.UserID, assignedAgent, issue.Branch, issue.WorktreePath, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := queueIssue(newID, agentID); err != nil {
+		log.Printf("issue: failed to queue %s: %v", newID, err)
+	}
+	log.Printf("issue: %s assigned conflicts on %s to %s as %s", access.UserID, issue.Branch, agentID, newID)
+
+	broadcastIssueChange(newID)
+	pushAgentStatusUpdate(issue.ProjectID)
+	sendSystemMessage(issue.ProjectID, fmt.Sprintf("Queued %q so the agent can resolve %d conflicting file(s) on %s.", title, len(conflicts), issue.Branch))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issueId":   newID,
+		"conflicts": conflicts,
+	})
+}
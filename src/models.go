@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"replychat/src/llm"
+	"replychat/src/projectfs"
+)
+
+// projectModelsHandler reads (GET) or replaces (PUT) the LLM selection for a
+// project and its agents.
+func projectModelsHandler(w http.ResponseWriter, r *http.Request) {
+	access := accessFromRequest(r)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !requirePermission(w, access, permManageModels) {
+			return
+		}
+		if !updateProjectModels(w, r, access) {
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	settings, err := projectfs.LoadSettings(db, access.ProjectID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	agentModels := settings.AgentModels
+	if agentModels == nil {
+		agentModels = map[string]llm.ModelConfig{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"model":           settings.Model,
+		"agentModels":     agentModels,
+		"providers":       llm.Names(),
+		"available":       llm.Available(),
+		"defaultProvider": llm.DefaultProviderName(),
+	})
+}
+
+func updateProjectModels(w http.ResponseWriter, r *http.Request, access requestAccess) bool {
+	var req struct {
+		Model       llm.ModelConfig            `json:"model"`
+		AgentModels map[string]llm.ModelConfig `json:"agentModels"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	if err := req.Model.Validate(); err != nil {
+		http.Error(w, "model: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	agentModels := make(map[string]llm.ModelConfig, len(req.AgentModels))
+	for agentType, cfg := range req.AgentModels {
+		agentType = strings.TrimSpace(agentType)
+		if _, ok := agentDisplayNames[agentType]; !ok {
+			http.Error(w, fmt.Sprintf("unknown agent %q", agentType), http.StatusBadRequest)
+			return false
+		}
+		if err := cfg.Validate(); err != nil {
+			http.Error(w, fmt.Sprintf("agentModels.%s: %v", agentType, err), http.StatusBadRequest)
+			return false
+		}
+		agentModels[agentType] = cfg
+	}
+
+	settings, err := projectfs.LoadSettings(db, access.ProjectID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	settings.Model = req.Model
+	settings.AgentModels = agentModels
+	if err := projectfs.SaveSettings(db, access.ProjectID, settings); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	log.Printf("models: %s updated model settings for project %s", access.UserID, access.ProjectID)
+	return true
+}
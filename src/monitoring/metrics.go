@@ -21,8 +21,18 @@ var (
 	wsClients        *prometheus.GaugeVec
 	agentQueueDepth  *prometheus.GaugeVec
 	agentRunDuration *prometheus.HistogramVec
+	llmAttemptsTotal *prometheus.CounterVec
+	llmAttemptTime   *prometheus.HistogramVec
+	llmCircuitState  *prometheus.GaugeVec
 )
 
+// circuitStates maps llm breaker states to gauge values.
+var circuitStates = map[string]float64{
+	"closed":    0,
+	"half_open": 1,
+	"open":      2,
+}
+
 func initRegistry() {
 	messagesTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -88,6 +98,34 @@ func initRegistry() {
 		[]string{"project_id", "agent_id"},
 	)
 
+	llmAttemptsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "replychat",
+			Name:      "llm_attempts_total",
+			Help:      "LLM provider calls per project/agent/provider, labeled by outcome.",
+		},
+		[]string{"project_id", "agent_id", "provider", "outcome"},
+	)
+
+	llmAttemptTime = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "replychat",
+			Name:      "llm_attempt_duration_seconds",
+			Help:      "Latency of individual LLM provider calls.",
+			Buckets:   []float64{0.5, 1, 2, 5, 10, 20, 40, 80, 160},
+		},
+		[]string{"provider", "outcome"},
+	)
+
+	llmCircuitState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "replychat",
+			Name:      "llm_circuit_state",
+			Help:      "Circuit breaker state per LLM provider (0 closed, 1 half-open, 2 open).",
+		},
+		[]string{"provider"},
+	)
+
 	prometheus.MustRegister(
 		messagesTotal,
 		charactersTotal,
@@ -96,6 +134,9 @@ func initRegistry() {
 		wsClients,
 		agentQueueDepth,
 		agentRunDuration,
+		llmAttemptsTotal,
+		llmAttemptTime,
+		llmCircuitState,
 	)
 }
 
@@ -162,6 +203,24 @@ func SetAgentQueueDepth(projectID, agentID string, depth int) {
 		Set(float64(depth))
 }
 
+// RecordLLMAttempt counts one provider call made on behalf of an agent. Skipped
+// calls (open circuit, unconfigured provider) are counted but not timed.
+func RecordLLMAttempt(projectID, agentID, provider, outcome string, duration time.Duration) {
+	ensureInit()
+	provider = sanitize(provider, "unknown")
+	outcome = sanitize(outcome, "unknown")
+	llmAttemptsTotal.WithLabelValues(normalizeProject(projectID), sanitize(agentID, "unknown"), provider, outcome).Inc()
+	if duration > 0 {
+		llmAttemptTime.WithLabelValues(provider, outcome).Observe(duration.Seconds())
+	}
+}
+
+// SetLLMCircuitState records a provider's circuit breaker state.
+func SetLLMCircuitState(provider, state string) {
+	ensureInit()
+	llmCircuitState.WithLabelValues(sanitize(provider, "unknown")).Set(circuitStates[state])
+}
+
 func normalizeProject(projectID string) string {
 	return sanitize(projectID, "default")
 }
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const oidcStateCookie = "oidc_state"
+
+// oidcProvider is nil unless OIDC_ISSUER_URL and OIDC_CLIENT_ID are set.
+var oidcProvider *oidcClient
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+type oidcIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// oidcClient implements the authorization code flow against a single issuer.
+// Discovery is fetched lazily so the server still starts when the IdP is down.
+type oidcClient struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	displayName  string
+	httpClient   *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+}
+
+func newOIDCProviderFromEnv() *oidcClient {
+	issuer := strings.TrimRight(strings.TrimSpace(os.Getenv("OIDC_ISSUER_URL")), "/")
+	clientID := strings.TrimSpace(os.Getenv("OIDC_CLIENT_ID"))
+	if issuer == "" || clientID == "" {
+		return nil
+	}
+
+	name := strings.TrimSpace(os.Getenv("OIDC_PROVIDER_NAME"))
+	if name == "" {
+		name = "SSO"
+	}
+	log.Printf("auth: OIDC sign-in enabled via %s", issuer)
+	return &oidcClient{
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		redirectURL:  strings.TrimSpace(os.Getenv("OIDC_REDIRECT_URL")),
+		displayName:  name,
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *oidcClient) discover(ctx context.Context) (*oidcDiscovery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.discovery != nil {
+		return c.discovery, nil
+	}
+
+	var doc oidcDiscovery
+	if err := c.getJSON(ctx, c.issuer+"/.well-known/openid-configuration", "", &doc); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if strings.TrimRight(doc.Issuer, "/") != c.issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer mismatch %q", doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" {
+		return nil, errors.New("oidc discovery: missing authorization or token endpoint")
+	}
+	c.discovery = &doc
+	return c.discovery, nil
+}
+
+func (c *oidcClient) authCodeURL(ctx context.Context, redirectURL, state, nonce string) (string, error) {
+	doc, err := c.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", c.clientID)
+	params.Set("redirect_uri", redirectURL)
+	params.Set("scope", "openid email profile")
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+
+	sep := "?"
+	if strings.Contains(doc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return doc.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// exchange redeems an authorization code and returns the signed-in identity.
+// The ID token comes straight from the token endpoint over the back channel,
+// so its claims are checked (issuer, audience, expiry, nonce) but its
+// signature is not, as permitted by OpenID Connect Core §3.1.3.7.
+func (c *oidcClient) exchange(ctx context.Context, redirectURL, code, nonce string) (oidcIdentity, error) {
+	doc, err := c.discover(ctx)
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("client_id", c.clientID)
+	if c.clientSecret != "" {
+		form.Set("client_secret", c.clientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return oidcIdentity{}, fmt.Errorf("oidc token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return oidcIdentity{}, fmt.Errorf("oidc token exchange: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return oidcIdentity{}, fmt.Errorf("oidc token exchange: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return oidcIdentity{}, errors.New("oidc token exchange: no id_token returned")
+	}
+
+	identity, err := c.verifyIDToken(tokens.IDToken, nonce)
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+
+	if doc.UserinfoEndpoint != "" && tokens.AccessToken != "" {
+		var info struct {
+			Subject       string `json:"sub"`
+			Email         string `json:"email"`
+			EmailVerified *bool  `json:"email_verified"`
+			Name          string `json:"name"`
+		}
+		if err := c.getJSON(ctx, doc.UserinfoEndpoint, tokens.AccessToken, &info); err != nil {
+			return oidcIdentity{}, fmt.Errorf("oidc userinfo: %w", err)
+		}
+		if info.Subject != identity.Subject {
+			return oidcIdentity{}, errors.New("oidc userinfo: subject mismatch")
+		}
+		if info.Email != "" {
+			identity.Email = info.Email
+			identity.EmailVerified = info.EmailVerified != nil && *info.EmailVerified
+		}
+		if info.Name != "" {
+			identity.Name = info.Name
+		}
+	}
+
+	identity.Email = normalizeEmail(identity.Email)
+	return identity, nil
+}
+
+func (c *oidcClient) verifyIDToken(raw, nonce string) (oidcIdentity, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return oidcIdentity{}, errors.New("oidc: malformed id_token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return oidcIdentity{}, fmt.Errorf("oidc: malformed id_token: %w", err)
+	}
+
+	var claims struct {
+		Issuer        string          `json:"iss"`
+		Subject       string          `json:"sub"`
+		Audience      json.RawMessage `json:"aud"`
+		Expiry        int64           `json:"exp"`
+		Nonce         string          `json:"nonce"`
+		Email         string          `json:"email"`
+		EmailVerified bool            `json:"email_verified"`
+		Name          string          `json:"name"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return oidcIdentity{}, fmt.Errorf("oidc: malformed id_token: %w", err)
+	}
+
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != c.issuer:
+		return oidcIdentity{}, errors.New("oidc: id_token issuer mismatch")
+	case !audienceContains(claims.Audience, c.clientID):
+		return oidcIdentity{}, errors.New("oidc: id_token audience mismatch")
+	case time.Now().Unix() >= claims.Expiry:
+		return oidcIdentity{}, errors.New("oidc: id_token expired")
+	case claims.Nonce != nonce:
+		return oidcIdentity{}, errors.New("oidc: id_token nonce mismatch")
+	case claims.Subject == "":
+		return oidcIdentity{}, errors.New("oidc: id_token missing subject")
+	}
+
+	return oidcIdentity{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	}, nil
+}
+
+// audienceContains handles both the single-string and array forms of aud.
+func audienceContains(raw json.RawMessage, clientID string) bool {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return single == clientID
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err != nil {
+		return false
+	}
+	for _, aud := range many {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *oidcClient) getJSON(ctx context.Context, endpoint, bearer string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+func (c *oidcClient) callbackURL() string {
+	if c.redirectURL != "" {
+		return c.redirectURL
+	}
+	return publicURL("/auth/oidc/callback")
+}
+
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	state, err := randomToken(16)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomToken(16)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	target, err := oidcProvider.authCodeURL(r.Context(), oidcProvider.callbackURL(), state, nonce)
+	if err != nil {
+		log.Printf("auth: %v", err)
+		redirectWithError(w, r, "/", "Single sign-on is unavailable right now")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state + "." + nonce,
+		Path:     "/auth/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   600,
+	})
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/auth/oidc", MaxAge: -1})
+	if err != nil {
+		redirectWithError(w, r, "/", "Sign-in session expired, please try again")
+		return
+	}
+	state, nonce, ok := strings.Cut(cookie.Value, ".")
+	if !ok || state == "" || r.URL.Query().Get("state") != state {
+		redirectWithError(w, r, "/", "Sign-in session expired, please try again")
+		return
+	}
+	if idpErr := r.URL.Query().Get("error"); idpErr != "" {
+		log.Printf("auth: OIDC provider returned error %q", idpErr)
+		redirectWithError(w, r, "/", "Single sign-on was cancelled or denied")
+		return
+	}
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		redirectWithError(w, r, "/", "Single sign-on failed")
+		return
+	}
+
+	identity, err := oidcProvider.exchange(r.Context(), oidcProvider.callbackURL(), code, nonce)
+	if err != nil {
+		log.Printf("auth: %v", err)
+		redirectWithError(w, r, "/", "Single sign-on failed")
+		return
+	}
+
+	userID, err := resolveOIDCUser(identity)
+	if err != nil {
+		log.Printf("auth: failed to resolve OIDC user %s: %v", identity.Subject, err)
+		redirectWithError(w, r, "/", "Single sign-on failed")
+		return
+	}
+
+	if err := startSession(w, r, userID, authMethodOIDC); err != nil {
+		log.Printf("db: failed to create session: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/projects", http.StatusSeeOther)
+}
+
+// resolveOIDCUser maps an IdP identity onto a local account. Existing accounts
+// are linked by email only when the IdP vouches for the address, otherwise a
+// matching email could be used to take over a password account.
+func resolveOIDCUser(identity oidcIdentity) (string, error) {
+	subject := oidcProvider.issuer + "|" + identity.Subject
+
+	var userID string
+	err := db.QueryRow(`SELECT id FROM users WHERE oidc_subject = ?`, subject).Scan(&userID)
+	if err == nil {
+		return userID, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	if identity.Email == "" {
+		return "", errors.New("identity has no email address")
+	}
+
+	err = db.QueryRow(`SELECT id FROM users WHERE email = ?`, identity.Email).Scan(&userID)
+	switch {
+	case err == nil:
+		if !identity.EmailVerified {
+			return "", fmt.Errorf("email %s is not verified by the identity provider", identity.Email)
+		}
+		_, err = db.Exec(`UPDATE users SET oidc_subject = ? WHERE id = ?`, subject, userID)
+		return userID, err
+	case errors.Is(err, sql.ErrNoRows):
+		name := identity.Name
+		if name == "" {
+			name, _, _ = strings.Cut(identity.Email, "@")
+		}
+		userID = uuid.New().String()
+		_, err = db.Exec(`
+			INSERT INTO users (id, email, name, oidc_subject, created_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, userID, identity.Email, name, subject, time.Now())
+		return userID, err
+	default:
+		return "", err
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newMockIdP serves discovery, token and userinfo endpoints. The issued
+// id_token carries whatever nonce is returned by nonce().
+func newMockIdP(t *testing.T, nonce func() string) (*httptest.Server, *oidcClient) {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"userinfo_endpoint":      srv.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" || r.FormValue("client_secret") != "shh" {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss":   srv.URL,
+			"sub":   "user-42",
+			"aud":   []string{"replychat"},
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": nonce(),
+		})
+		idToken := "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access-123",
+			"id_token":     idToken,
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-123" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sub":            "user-42",
+			"email":          "Ada@Example.com",
+			"email_verified": true,
+			"name":           "Ada Lovelace",
+		})
+	})
+
+	client := &oidcClient{
+		issuer:       srv.URL,
+		clientID:     "replychat",
+		clientSecret: "shh",
+		httpClient:   srv.Client(),
+	}
+	return srv, client
+}
+
+func TestOIDCAuthCodeURL(t *testing.T) {
+	srv, client := newMockIdP(t, func() string { return "n" })
+
+	raw, err := client.authCodeURL(context.Background(), "http://app/cb", "state-1", "nonce-1")
+	if err != nil {
+		t.Fatalf("authCodeURL: %v", err)
+	}
+	if !strings.HasPrefix(raw, srv.URL+"/authorize?") {
+		t.Fatalf("unexpected authorize URL %s", raw)
+	}
+	parsed, _ := url.Parse(raw)
+	q := parsed.Query()
+	if q.Get("state") != "state-1" || q.Get("nonce") != "nonce-1" || q.Get("client_id") != "replychat" {
+		t.Fatalf("missing auth params: %v", q)
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	_, client := newMockIdP(t, func() string { return "nonce-1" })
+
+	identity, err := client.exchange(context.Background(), "http://app/cb", "good-code", "nonce-1")
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if identity.Subject != "user-42" || identity.Email != "ada@example.com" || !identity.EmailVerified {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+	if identity.Name != "Ada Lovelace" {
+		t.Fatalf("expected name from userinfo, got %q", identity.Name)
+	}
+}
+
+func TestOIDCExchangeRejectsNonceMismatch(t *testing.T) {
+	_, client := newMockIdP(t, func() string { return "someone-elses-nonce" })
+
+	if _, err := client.exchange(context.Background(), "http://app/cb", "good-code", "nonce-1"); err == nil {
+		t.Fatal("expected nonce mismatch to be rejected")
+	}
+}
+
+func TestOIDCExchangeRejectsBadCode(t *testing.T) {
+	_, client := newMockIdP(t, func() string { return "nonce-1" })
+
+	if _, err := client.exchange(context.Background(), "http://app/cb", "bad-code", "nonce-1"); err == nil {
+		t.Fatal("expected token endpoint error")
+	}
+}
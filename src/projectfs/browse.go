@@ -0,0 +1,246 @@
+package projectfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// binarySniffLength is how much of a file is inspected to tell binary from
+// text, the same amount git uses.
+const binarySniffLength = 8000
+
+var (
+	ErrPathEscapes  = errors.New("path escapes workspace")
+	ErrNotAFile     = errors.New("not a regular file")
+	ErrUnknownRef   = errors.New("unknown commit")
+	ErrNoRepository = errors.New("workspace is not a git repository")
+)
+
+// SecureJoin joins relative onto basePath, refusing results outside it.
+func SecureJoin(basePath, relative string) (string, error) {
+	cleanBase := filepath.Clean(basePath)
+	cleanRel := filepath.Clean(relative)
+	joined := filepath.Join(cleanBase, cleanRel)
+
+	if joined != cleanBase && !strings.HasPrefix(joined, cleanBase+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s escapes workspace", relative)
+	}
+	return joined, nil
+}
+
+// TreeEntry is one file of a workspace listing.
+type TreeEntry struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// FileContent is a workspace file read for display. Content is empty for
+// binary files and cut at the size limit for large ones.
+type FileContent struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Binary    bool   `json:"binary"`
+	Truncated bool   `json:"truncated"`
+	Content   string `json:"content"`
+}
+
+// Diff is a unified diff, cut at the size limit when Truncated is set.
+// Untracked lists new files that the diff of uncommitted changes leaves out.
+type Diff struct {
+	Commit    *Commit  `json:"commit,omitempty"`
+	Diff      string   `json:"diff"`
+	Truncated bool     `json:"truncated"`
+	Untracked []string `json:"untracked,omitempty"`
+}
+
+// Tree lists the workspace's files, as ListFiles does, with their sizes.
+func Tree(workspacePath string) ([]TreeEntry, error) {
+	files, err := ListFiles(workspacePath)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]TreeEntry, 0, len(files))
+	for _, name := range files {
+		info, err := os.Stat(filepath.Join(workspacePath, filepath.FromSlash(name)))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, TreeEntry{Path: name, Size: info.Size()})
+	}
+	return entries, nil
+}
+
+// ReadFile reads up to maxBytes of the workspace file at rel. Paths leaving
+// the workspace, directly or through a symlink, and paths inside .git are
+// refused.
+func ReadFile(workspacePath, rel string, maxBytes int64) (*FileContent, error) {
+	abs, err := ResolveInside(workspacePath, rel)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, ErrNotAFile
+	}
+
+	f, err := os.Open(abs)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	content := &FileContent{
+		Path:      filepath.ToSlash(filepath.Clean(rel)),
+		Size:      info.Size(),
+		Truncated: info.Size() > int64(len(data)),
+	}
+	if isBinary(data, content.Truncated) {
+		content.Binary = true
+		return content, nil
+	}
+	content.Content = string(data)
+	return content, nil
+}
+
+// ResolveInside joins rel onto workspacePath and makes sure the file it
+// names, after following symlinks, is still inside the workspace and not
+// part of the repository metadata. Anything else is ErrPathEscapes.
+func ResolveInside(workspacePath, rel string) (string, error) {
+	abs, err := SecureJoin(workspacePath, rel)
+	if err != nil {
+		return "", ErrPathEscapes
+	}
+	base, err := filepath.EvalSymlinks(workspacePath)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", err
+	}
+	inside, err := filepath.Rel(base, resolved)
+	if err != nil || inside == ".." || strings.HasPrefix(inside, ".."+string(filepath.Separator)) {
+		return "", ErrPathEscapes
+	}
+	if first, _, _ := strings.Cut(filepath.ToSlash(inside), "/"); first == ".git" {
+		return "", ErrPathEscapes
+	}
+	return abs, nil
+}
+
+// isBinary applies git's heuristic, a NUL byte near the start, and also
+// treats invalid UTF-8 as binary. A multi-byte rune cut by truncation does
+// not count.
+func isBinary(data []byte, truncated bool) bool {
+	sniff := data
+	if len(sniff) > binarySniffLength {
+		sniff = sniff[:binarySniffLength]
+	}
+	if bytes.IndexByte(sniff, 0) >= 0 {
+		return true
+	}
+	if truncated {
+		for i := 0; i < utf8.UTFMax && len(data) > 0 && !utf8.Valid(data); i++ {
+			data = data[:len(data)-1]
+		}
+	}
+	return !utf8.Valid(data)
+}
+
+// Log lists up to limit commits reachable from HEAD, newest first, limited
+// to those touching path when it is set.
+func Log(workspacePath, path string, limit int) ([]Commit, error) {
+	if !IsRepository(workspacePath) {
+		return nil, nil
+	}
+	if _, err := gitOutput(workspacePath, "rev-parse", "--verify", "--quiet", "HEAD"); err != nil {
+		return []Commit{}, nil
+	}
+	args := []string{fmt.Sprintf("--max-count=%d", limit), "HEAD", "--"}
+	if path != "" {
+		if _, err := SecureJoin(workspacePath, path); err != nil {
+			return nil, ErrPathEscapes
+		}
+		args = append(args, filepath.ToSlash(filepath.Clean(path)))
+	}
+	commits, err := logCommits(workspacePath, args...)
+	if commits == nil && err == nil {
+		commits = []Commit{}
+	}
+	return commits, err
+}
+
+// CommitDiff returns the changes commitID introduced, cut at maxBytes.
+func CommitDiff(workspacePath, commitID string, maxBytes int) (*Diff, error) {
+	if !IsRepository(workspacePath) {
+		return nil, ErrNoRepository
+	}
+	if commitID == "" || strings.HasPrefix(commitID, "-") {
+		return nil, ErrUnknownRef
+	}
+	full, err := gitOutput(workspacePath, "rev-parse", "--verify", "--quiet", commitID+"^{commit}")
+	if err != nil {
+		return nil, ErrUnknownRef
+	}
+	commits, err := logCommits(workspacePath, "-1", strings.TrimSpace(full), "--")
+	if err != nil || len(commits) == 0 {
+		return nil, ErrUnknownRef
+	}
+
+	out, err := gitOutput(workspacePath, "show", "--format=", "--no-color", "--no-ext-diff", "--root", commits[0].ID, "--")
+	if err != nil {
+		return nil, err
+	}
+	diff := truncatedDiff(out, maxBytes)
+	diff.Commit = &commits[0]
+	return diff, nil
+}
+
+// WorkingDiff returns the workspace's uncommitted changes against HEAD, cut
+// at maxBytes, and lists untracked files separately.
+func WorkingDiff(workspacePath string, maxBytes int) (*Diff, error) {
+	if !IsRepository(workspacePath) {
+		return nil, ErrNoRepository
+	}
+	args := []string{"diff", "--no-color", "--no-ext-diff"}
+	if _, err := gitOutput(workspacePath, "rev-parse", "--verify", "--quiet", "HEAD"); err == nil {
+		args = append(args, "HEAD")
+	}
+	out, err := gitOutput(workspacePath, append(args, "--")...)
+	if err != nil {
+		return nil, err
+	}
+	diff := truncatedDiff(out, maxBytes)
+
+	untracked, err := gitOutput(workspacePath, "ls-files", "--others", "--exclude-standard", "-z")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(untracked, "\x00") {
+		if name != "" {
+			diff.Untracked = append(diff.Untracked, name)
+		}
+	}
+	return diff, nil
+}
+
+func truncatedDiff(out string, maxBytes int) *Diff {
+	if len(out) <= maxBytes {
+		return &Diff{Diff: out}
+	}
+	cut := strings.LastIndexByte(out[:maxBytes], '\n') + 1
+	return &Diff{Diff: out[:cut], Truncated: true}
+}
@@ -0,0 +1,72 @@
+package projectfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadFile(t *testing.T) {
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo")
+	writeTestFile(t, repo, "src/main.go", "package main\n")
+	writeTestFile(t, repo, "logo.png", "\x89PNG\r\n\x1a\n\x00\x00")
+	writeTestFile(t, repo, "big.txt", strings.Repeat("héllo ", 100))
+	writeTestFile(t, repo, ".git/config", "[core]\n")
+	writeTestFile(t, root, "secret.txt", "outside\n")
+	if err := os.Symlink(filepath.Join(root, "secret.txt"), filepath.Join(repo, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := ReadFile(repo, "src/../src/main.go", 1024)
+	if err != nil || file.Content != "package main\n" || file.Binary || file.Truncated || file.Path != "src/main.go" {
+		t.Fatalf("main.go: %+v (%v)", file, err)
+	}
+	if file, err := ReadFile(repo, "logo.png", 1024); err != nil || !file.Binary || file.Content != "" {
+		t.Fatalf("logo.png: %+v (%v)", file, err)
+	}
+	// The limit cuts "é" in half; that must not look binary.
+	if file, err := ReadFile(repo, "big.txt", 8); err != nil || file.Binary || !file.Truncated || file.Size != 700 {
+		t.Fatalf("big.txt: %+v (%v)", file, err)
+	}
+
+	for _, rel := range []string{"../secret.txt", "link.txt", ".git/config", "/etc/passwd/../../secret.txt"} {
+		if _, err := ReadFile(repo, rel, 1024); !errors.Is(err, ErrPathEscapes) && !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: expected a refusal, got %v", rel, err)
+		}
+	}
+	if _, err := ReadFile(repo, "src", 1024); !errors.Is(err, ErrNotAFile) {
+		t.Errorf("directory: expected ErrNotAFile, got %v", err)
+	}
+}
+
+func TestWorkspaceDiffs(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "repo")
+	initTestRepo(t, repo)
+	commitTestFile(t, repo, "README.md", "hello\nworld\n")
+
+	commits, err := Log(repo, "README.md", 10)
+	if err != nil || len(commits) != 2 || commits[0].Subject != "Update README.md" {
+		t.Fatalf("log: %+v (%v)", commits, err)
+	}
+
+	diff, err := CommitDiff(repo, commits[0].ID[:8], 1<<20)
+	if err != nil || diff.Commit.ID != commits[0].ID || !strings.Contains(diff.Diff, "+world") {
+		t.Fatalf("commit diff: %+v (%v)", diff, err)
+	}
+	if _, err := CommitDiff(repo, "--output=/tmp/x", 1<<20); !errors.Is(err, ErrUnknownRef) {
+		t.Fatalf("options must not pass as commits, got %v", err)
+	}
+
+	writeTestFile(t, repo, "README.md", "hello\nthere\n")
+	writeTestFile(t, repo, "new.txt", "new\n")
+	diff, err = WorkingDiff(repo, 1<<20)
+	if err != nil || !strings.Contains(diff.Diff, "-world\n+there") || len(diff.Untracked) != 1 || diff.Untracked[0] != "new.txt" {
+		t.Fatalf("working diff: %+v (%v)", diff, err)
+	}
+	if diff, _ := WorkingDiff(repo, 20); !diff.Truncated || len(diff.Diff) > 20 {
+		t.Fatalf("expected a truncated diff, got %+v", diff)
+	}
+}
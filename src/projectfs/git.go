@@ -2,6 +2,7 @@ package projectfs
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -14,8 +15,13 @@ type CommitResult struct {
 	Branch   string `json:"branch"`
 	Remote   string `json:"remote,omitempty"`
 	Pushed   bool   `json:"pushed"`
+	PushedTo string `json:"pushedTo,omitempty"`
 }
 
+// CommitWorkspaceChanges stages and commits everything in the workspace.
+// It does not push; the project's push policy decides that. It holds
+// worktreeMu so a commit never lands in the middle of a sync, merge or
+// revert.
 func CommitWorkspaceChanges(workspacePath, message string) (*CommitResult, error) {
 	if workspacePath == "" {
 		return nil, nil
@@ -24,6 +30,9 @@ func CommitWorkspaceChanges(workspacePath, message string) (*CommitResult, error
 		return nil, nil
 	}
 
+	worktreeMu.Lock()
+	defer worktreeMu.Unlock()
+
 	clean, err := isTreeClean(workspacePath)
 	if err != nil || clean {
 		return nil, err
@@ -42,21 +51,11 @@ func CommitWorkspaceChanges(workspacePath, message string) (*CommitResult, error
 	branch, _ := gitOutput(workspacePath, "rev-parse", "--abbrev-ref", "HEAD")
 	remote, _ := gitOutput(workspacePath, "config", "--get", "remote.origin.url")
 
-	result := &CommitResult{
+	return &CommitResult{
 		CommitID: strings.TrimSpace(commitID),
 		Branch:   strings.TrimSpace(branch),
 		Remote:   strings.TrimSpace(remote),
-	}
-
-	if result.Remote != "" && result.Branch != "" {
-		if err := runGit(workspacePath, "push", "origin", result.Branch); err == nil {
-			result.Pushed = true
-		} else {
-			return result, fmt.Errorf("git push failed: %w", err)
-		}
-	}
-
-	return result, nil
+	}, nil
 }
 
 func isTreeClean(path string) (bool, error) {
@@ -110,3 +109,25 @@ func gitOutput(path string, args ...string) (string, error) {
 	}
 	return stdout.String(), nil
 }
+
+// DiffTrees returns the unified diff between the oldDir and newDir
+// subdirectories of dir, with paths shown as a/<file> and b/<file>. The
+// directories need not be repositories.
+func DiffTrees(dir, oldDir, newDir string) (string, error) {
+	if err := ensureGitBinary(); err != nil {
+		return "", err
+	}
+	cmd := exec.Command("git", "diff", "--no-index", "--no-prefix", "--no-color", "--no-renames", "--no-ext-diff", oldDir, newDir)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Exit status 1 only means the trees differ.
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			return "", fmt.Errorf("%v (%s)", err, strings.TrimSpace(stderr.String()))
+		}
+	}
+	return stdout.String(), nil
+}
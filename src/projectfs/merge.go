@@ -0,0 +1,172 @@
+package projectfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	MergeStrategyMerge  = "merge"
+	MergeStrategyRebase = "rebase"
+)
+
+var (
+	ErrDirtyWorkspace  = errors.New("workspace has uncommitted changes")
+	ErrDetachedHead    = errors.New("workspace is not on a branch")
+	ErrMissingWorktree = errors.New("the issue's worktree is missing")
+)
+
+// MergeResult describes how landing a branch went. A non-empty Conflicts
+// means nothing was changed: the merge or rebase was aborted.
+type MergeResult struct {
+	Strategy  string   `json:"strategy"`
+	Branch    string   `json:"branch"`
+	Target    string   `json:"target"`
+	CommitID  string   `json:"commitId,omitempty"`
+	UpToDate  bool     `json:"upToDate,omitempty"`
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// DefaultBranch returns the branch checked out in the project workspace,
+// which is where issue branches land.
+func DefaultBranch(workspacePath string) (string, error) {
+	out, err := gitOutput(workspacePath, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	branch := strings.TrimSpace(out)
+	if branch == "HEAD" {
+		return "", ErrDetachedHead
+	}
+	return branch, nil
+}
+
+// MergeBranch lands branch on the workspace's default branch. The merge
+// strategy records a merge commit; rebase replays the branch onto the
+// default branch inside its worktree and then fast-forwards. On conflicts
+// the operation is aborted and the conflicting paths are returned in the
+// result rather than as an error.
+func MergeBranch(workspacePath, worktreePath, branch, strategy string) (*MergeResult, error) {
+	if !IsRepository(workspacePath) {
+		return nil, ErrNoRepository
+	}
+	if strategy == "" {
+		strategy = MergeStrategyMerge
+	}
+	if strategy != MergeStrategyMerge && strategy != MergeStrategyRebase {
+		return nil, fmt.Errorf("unknown merge strategy %q", strategy)
+	}
+
+	worktreeMu.Lock()
+	defer worktreeMu.Unlock()
+
+	target, err := DefaultBranch(workspacePath)
+	if err != nil {
+		return nil, err
+	}
+	result := &MergeResult{Strategy: strategy, Branch: branch, Target: target}
+
+	if clean, err := isTreeClean(workspacePath); err != nil {
+		return nil, err
+	} else if !clean {
+		return nil, ErrDirtyWorkspace
+	}
+
+	ahead, err := gitOutput(workspacePath, "rev-list", "--count", "HEAD.."+branch)
+	if err != nil {
+		return nil, fmt.Errorf("unknown branch %s: %w", branch, err)
+	}
+	if strings.TrimSpace(ahead) == "0" {
+		result.UpToDate = true
+		return result, nil
+	}
+
+	switch strategy {
+	case MergeStrategyRebase:
+		if !IsRepository(worktreePath) {
+			return nil, ErrMissingWorktree
+		}
+		if clean, err := isTreeClean(worktreePath); err != nil {
+			return nil, err
+		} else if !clean {
+			return nil, fmt.Errorf("worktree of %s: %w", branch, ErrDirtyWorkspace)
+		}
+		if err := runGit(worktreePath, "rebase", target); err != nil {
+			result.Conflicts = conflictedPaths(worktreePath)
+			if abortErr := runGit(worktreePath, "rebase", "--abort"); abortErr != nil {
+				return nil, fmt.Errorf("git rebase --abort failed: %w", abortErr)
+			}
+			if len(result.Conflicts) == 0 {
+				return nil, fmt.Errorf("git rebase failed: %w", err)
+			}
+			return result, nil
+		}
+		if err := runGit(workspacePath, "merge", "--ff-only", branch); err != nil {
+			return nil, fmt.Errorf("git merge --ff-only failed: %w", err)
+		}
+	default:
+		message := fmt.Sprintf("Merge branch '%s'", branch)
+		if err := runGit(workspacePath, "merge", "--no-ff", "--no-edit", "-m", message, branch); err != nil {
+			result.Conflicts = conflictedPaths(workspacePath)
+			if abortErr := runGit(workspacePath, "merge", "--abort"); abortErr != nil {
+				return nil, fmt.Errorf("git merge --abort failed: %w", abortErr)
+			}
+			if len(result.Conflicts) == 0 {
+				return nil, fmt.Errorf("git merge failed: %w", err)
+			}
+			return result, nil
+		}
+	}
+
+	commitID, _ := gitOutput(workspacePath, "rev-parse", "HEAD")
+	result.CommitID = strings.TrimSpace(commitID)
+	return result, nil
+}
+
+// StartConflictMerge merges the default branch into the issue's worktree
+// and leaves the conflicts in place, with markers in the files, so an agent
+// can resolve them; committing the worktree concludes the merge. It returns
+// the conflicting paths, or none when the branches now merge cleanly.
+func StartConflictMerge(workspacePath, worktreePath string) ([]string, error) {
+	if !IsRepository(worktreePath) {
+		return nil, ErrMissingWorktree
+	}
+
+	worktreeMu.Lock()
+	defer worktreeMu.Unlock()
+
+	target, err := DefaultBranch(workspacePath)
+	if err != nil {
+		return nil, err
+	}
+	if clean, err := isTreeClean(worktreePath); err != nil {
+		return nil, err
+	} else if !clean {
+		return nil, ErrDirtyWorkspace
+	}
+
+	if err := runGit(worktreePath, "merge", "--no-edit", target); err != nil {
+		conflicts := conflictedPaths(worktreePath)
+		if len(conflicts) == 0 {
+			runGit(worktreePath, "merge", "--abort")
+			return nil, fmt.Errorf("git merge failed: %w", err)
+		}
+		return conflicts, nil
+	}
+	return nil, nil
+}
+
+func conflictedPaths(path string) []string {
+	out, err := gitOutput(path, "diff", "--name-only", "--diff-filter=U")
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,115 @@
+package projectfs
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func initTestRepo(t *testing.T, repo string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	writeTestFile(t, repo, "README.md", "hello\n")
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"config", "user.email", "test@example.com"},
+		{"config", "user.name", "Test"},
+		{"add", "-A"},
+		{"commit", "-q", "-m", "init"},
+	} {
+		if err := runGit(repo, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func commitTestFile(t *testing.T, dir, rel, content string) {
+	t.Helper()
+	writeTestFile(t, dir, rel, content)
+	if _, err := CommitWorkspaceChanges(dir, "Update "+rel); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeBranchStrategies(t *testing.T) {
+	for _, strategy := range []string{MergeStrategyMerge, MergeStrategyRebase} {
+		t.Run(strategy, func(t *testing.T) {
+			root := t.TempDir()
+			repo, tree := filepath.Join(root, "repo"), filepath.Join(root, "worktrees", "one")
+			initTestRepo(t, repo)
+			if err := EnsureWorktree(repo, tree, "agent/one"); err != nil {
+				t.Fatal(err)
+			}
+			commitTestFile(t, tree, "one.txt", "1\n")
+			commitTestFile(t, repo, "main.txt", "main\n")
+
+			result, err := MergeBranch(repo, tree, "agent/one", strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Conflicts) != 0 || result.CommitID == "" {
+				t.Fatalf("unexpected result %+v", result)
+			}
+			if _, err := os.Stat(filepath.Join(repo, "one.txt")); err != nil {
+				t.Fatal("branch changes should be on the default branch")
+			}
+			if commits, _ := BranchCommits(repo, "agent/one", 10); len(commits) != 0 {
+				t.Fatalf("branch should be fully merged, %d commits left", len(commits))
+			}
+
+			again, err := MergeBranch(repo, tree, "agent/one", strategy)
+			if err != nil || !again.UpToDate {
+				t.Fatalf("second merge should be a no-op, got %+v (%v)", again, err)
+			}
+		})
+	}
+}
+
+func TestMergeBranchReportsConflicts(t *testing.T) {
+	root := t.TempDir()
+	repo, tree := filepath.Join(root, "repo"), filepath.Join(root, "worktrees", "one")
+	initTestRepo(t, repo)
+	if err := EnsureWorktree(repo, tree, "agent/one"); err != nil {
+		t.Fatal(err)
+	}
+	commitTestFile(t, tree, "README.md", "from the agent\n")
+	commitTestFile(t, repo, "README.md", "from main\n")
+
+	for _, strategy := range []string{MergeStrategyMerge, MergeStrategyRebase} {
+		result, err := MergeBranch(repo, tree, "agent/one", strategy)
+		if err != nil {
+			t.Fatalf("%s: %v", strategy, err)
+		}
+		if !reflect.DeepEqual(result.Conflicts, []string{"README.md"}) || result.CommitID != "" {
+			t.Fatalf("%s: unexpected result %+v", strategy, result)
+		}
+		for _, dir := range []string{repo, tree} {
+			if clean, _ := isTreeClean(dir); !clean {
+				t.Fatalf("%s: %s should be left clean", strategy, dir)
+			}
+		}
+	}
+
+	conflicts, err := StartConflictMerge(repo, tree)
+	if err != nil || !reflect.DeepEqual(conflicts, []string{"README.md"}) {
+		t.Fatalf("conflicts %v (%v)", conflicts, err)
+	}
+	content, _ := os.ReadFile(filepath.Join(tree, "README.md"))
+	if !strings.Contains(string(content), "<<<<<<<") {
+		t.Fatalf("conflict markers expected, got %q", content)
+	}
+
+	commitTestFile(t, tree, "README.md", "from both\n")
+	result, err := MergeBranch(repo, tree, "agent/one", MergeStrategyMerge)
+	if err != nil || len(result.Conflicts) != 0 {
+		t.Fatalf("resolved branch should merge, got %+v (%v)", result, err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(repo, "README.md")); string(content) != "from both\n" {
+		t.Fatalf("README.md = %q", content)
+	}
+}
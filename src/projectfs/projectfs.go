@@ -10,6 +10,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+
+	"replychat/src/llm"
 )
 
 const baseDir = "data/projects"
@@ -18,6 +20,30 @@ type Settings struct {
 	WorkspacePath string `json:"workspacePath"`
 	RepoType      string `json:"repoType,omitempty"`
 	RepoURL       string `json:"repoUrl,omitempty"`
+
+	// Model is the project-wide LLM selection; AgentModels overrides it per
+	// agent type. Empty fields fall back to the server defaults.
+	Model       llm.ModelConfig            `json:"model,omitempty"`
+	AgentModels map[string]llm.ModelConfig `json:"agentModels,omitempty"`
+
+	// ReviewChanges holds agent changes as pending change sets until a
+	// teammate approves them, instead of writing and committing them.
+	ReviewChanges bool `json:"reviewChanges,omitempty"`
+
+	// PushPolicy decides when commits are pushed to origin; see the Push*
+	// constants. PushBranchPrefix namespaces the remote branches used by
+	// the dedicated-branch policy.
+	PushPolicy       string `json:"pushPolicy,omitempty"`
+	PushBranchPrefix string `json:"pushBranchPrefix,omitempty"`
+
+	// SyncStrategy decides how the workspace catches up with origin when
+	// both have new commits: SyncFastForward or SyncRebase.
+	SyncStrategy string `json:"syncStrategy,omitempty"`
+}
+
+// ModelFor returns the effective model configuration for agentType.
+func (s Settings) ModelFor(agentType string) llm.ModelConfig {
+	return s.Model.Merge(s.AgentModels[agentType])
 }
 
 func WorkspacePath(projectID string) string {
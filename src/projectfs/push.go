@@ -0,0 +1,146 @@
+package projectfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Push policies decide when workspace commits reach the origin remote.
+const (
+	// PushNever keeps every commit local; even manual pushes are refused.
+	PushNever = "never"
+	// PushManual pushes only when someone asks for it. It is the default.
+	PushManual = "manual"
+	// PushOnIssueComplete pushes an issue's branch when the issue is done,
+	// and the default branch after an issue branch is merged into it.
+	PushOnIssueComplete = "on_issue_complete"
+	// PushDedicatedBranch pushes after every commit, but only to branches
+	// under the project's push prefix, never to the branch committed on.
+	PushDedicatedBranch = "branch"
+)
+
+// DefaultPushBranchPrefix namespaces the remote branches used by the
+// PushDedicatedBranch policy: main is pushed as replychat/main.
+const DefaultPushBranchPrefix = "replychat/"
+
+// Events that may trigger a push.
+const (
+	PushAfterCommit = "commit"
+	PushAfterIssue  = "issue"
+	PushAfterMerge  = "merge"
+	PushRequested   = "manual"
+)
+
+var (
+	ErrNoRemote     = errors.New("no origin remote configured")
+	ErrPushDisabled = errors.New("pushing is disabled for this project")
+)
+
+// PushResult describes a push of a workspace's current branch.
+type PushResult struct {
+	Branch       string `json:"branch"`
+	RemoteBranch string `json:"remoteBranch"`
+	Remote       string `json:"remote,omitempty"`
+	CommitID     string `json:"commitId"`
+	Trigger      string `json:"trigger"`
+	Pushed       bool   `json:"pushed"`
+}
+
+// ValidPushPolicy reports whether policy is one of the known push policies.
+func ValidPushPolicy(policy string) bool {
+	switch policy {
+	case PushNever, PushManual, PushOnIssueComplete, PushDedicatedBranch:
+		return true
+	}
+	return false
+}
+
+// PushPolicyOrDefault returns the configured push policy, or PushManual.
+func (s Settings) PushPolicyOrDefault() string {
+	if ValidPushPolicy(s.PushPolicy) {
+		return s.PushPolicy
+	}
+	return PushManual
+}
+
+// PushBranchPrefixOrDefault returns the configured push branch prefix, or
+// DefaultPushBranchPrefix.
+func (s Settings) PushBranchPrefixOrDefault() string {
+	if s.PushBranchPrefix != "" {
+		return s.PushBranchPrefix
+	}
+	return DefaultPushBranchPrefix
+}
+
+// PushTarget returns the remote branch that localBranch goes to when
+// trigger happens, or false when the policy does not push on trigger.
+func (s Settings) PushTarget(trigger, localBranch string) (string, bool) {
+	if localBranch == "" {
+		return "", false
+	}
+	policy := s.PushPolicyOrDefault()
+	switch policy {
+	case PushNever:
+		return "", false
+	case PushDedicatedBranch:
+		if trigger != PushAfterCommit && trigger != PushAfterMerge && trigger != PushRequested {
+			return "", false
+		}
+		return s.PushBranchPrefixOrDefault() + localBranch, true
+	case PushOnIssueComplete:
+		if trigger == PushAfterCommit {
+			return "", false
+		}
+	default:
+		if trigger != PushRequested {
+			return "", false
+		}
+	}
+	return localBranch, true
+}
+
+// PushWorkspace pushes the branch checked out at workspacePath to
+// remoteBranch on origin. It holds worktreeMu so the branch does not move
+// under the push, and refuses while a rebase or merge is unfinished.
+func PushWorkspace(workspacePath, remoteBranch string) (*PushResult, error) {
+	if !IsRepository(workspacePath) {
+		return nil, ErrNoRepository
+	}
+
+	worktreeMu.Lock()
+	defer worktreeMu.Unlock()
+
+	if InConflict(workspacePath) {
+		return nil, ErrUnfinishedSync
+	}
+	branch, err := DefaultBranch(workspacePath)
+	if err != nil {
+		return nil, err
+	}
+	remote, _ := gitOutput(workspacePath, "config", "--get", "remote.origin.url")
+	commitID, _ := gitOutput(workspacePath, "rev-parse", "HEAD")
+
+	result := &PushResult{
+		Branch:       branch,
+		RemoteBranch: remoteBranch,
+		Remote:       strings.TrimSpace(remote),
+		CommitID:     strings.TrimSpace(commitID),
+	}
+	if result.Remote == "" {
+		return result, ErrNoRemote
+	}
+	if err := runGit(workspacePath, "push", "origin", "HEAD:refs/heads/"+remoteBranch); err != nil {
+		return result, fmt.Errorf("git push failed: %w", err)
+	}
+	result.Pushed = true
+	return result, nil
+}
+
+// ValidPushBranchPrefix reports whether prefix can start a branch name.
+func ValidPushBranchPrefix(prefix string) bool {
+	if prefix == "" || strings.HasPrefix(prefix, "-") {
+		return false
+	}
+	return runGit(".", "check-ref-format", "refs/heads/"+prefix+"main") == nil
+}
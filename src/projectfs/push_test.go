@@ -0,0 +1,68 @@
+package projectfs
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPushTarget(t *testing.T) {
+	cases := []struct {
+		policy, trigger, want string
+	}{
+		{"", PushAfterCommit, ""},
+		{"", PushRequested, "main"},
+		{PushNever, PushRequested, ""},
+		{PushManual, PushAfterIssue, ""},
+		{PushOnIssueComplete, PushAfterCommit, ""},
+		{PushOnIssueComplete, PushAfterIssue, "main"},
+		{PushOnIssueComplete, PushAfterMerge, "main"},
+		{PushDedicatedBranch, PushAfterCommit, "replychat/main"},
+		{PushDedicatedBranch, PushAfterIssue, ""},
+		{"bogus", PushAfterCommit, ""},
+	}
+	for _, tc := range cases {
+		got, ok := Settings{PushPolicy: tc.policy}.PushTarget(tc.trigger, "main")
+		if got != tc.want || ok != (tc.want != "") {
+			t.Errorf("%q on %s: got %q (%v), want %q", tc.policy, tc.trigger, got, ok, tc.want)
+		}
+	}
+
+	custom := Settings{PushPolicy: PushDedicatedBranch, PushBranchPrefix: "bots/"}
+	if got, _ := custom.PushTarget(PushAfterCommit, "agent/1234-fix"); got != "bots/agent/1234-fix" {
+		t.Errorf("custom prefix: got %q", got)
+	}
+}
+
+func TestPushWorkspace(t *testing.T) {
+	root := t.TempDir()
+	repo, remote := filepath.Join(root, "repo"), filepath.Join(root, "remote.git")
+	initTestRepo(t, repo)
+
+	if _, err := PushWorkspace(repo, "main"); !errors.Is(err, ErrNoRemote) {
+		t.Fatalf("expected ErrNoRemote, got %v", err)
+	}
+
+	if err := runGit(root, "init", "-q", "--bare", remote); err != nil {
+		t.Fatal(err)
+	}
+	if err := configureRemote(repo, remote); err != nil {
+		t.Fatal(err)
+	}
+	result, err := PushWorkspace(repo, "replychat/main")
+	if err != nil || !result.Pushed {
+		t.Fatalf("push: %+v (%v)", result, err)
+	}
+	out, err := gitOutput(remote, "rev-parse", "refs/heads/replychat/main")
+	if err != nil || strings.TrimSpace(out) != result.CommitID {
+		t.Fatalf("remote branch at %q (%v), want %s", out, err, result.CommitID)
+	}
+	if _, err := gitOutput(remote, "rev-parse", "--verify", "--quiet", "refs/heads/"+result.Branch); err == nil {
+		t.Fatalf("%s must not be pushed", result.Branch)
+	}
+
+	if !ValidPushBranchPrefix("replychat/") || ValidPushBranchPrefix("bad..prefix/") || ValidPushBranchPrefix("-x") {
+		t.Fatal("unexpected prefix validation")
+	}
+}
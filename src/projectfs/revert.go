@@ -0,0 +1,112 @@
+package projectfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrCommitNotOnBranch = errors.New("commit is not on the workspace's current branch")
+	ErrMergeCommit       = errors.New("merge commits cannot be reverted")
+)
+
+// RevertResult describes a revert commit.
+type RevertResult struct {
+	Reverted string `json:"reverted"`
+	Subject  string `json:"subject"`
+	CommitID string `json:"commitId"`
+	Branch   string `json:"branch"`
+}
+
+// DependentCommitsError refuses a revert because later commits changed the
+// same files and may build on the reverted work.
+type DependentCommitsError struct {
+	Commit     string
+	Dependents []Commit
+}
+
+func (e *DependentCommitsError) Error() string {
+	ids := make([]string, 0, len(e.Dependents))
+	for _, c := range e.Dependents {
+		ids = append(ids, shortID(c.ID))
+	}
+	return fmt.Sprintf("later commits touch the same files as %s: %s", shortID(e.Commit), strings.Join(ids, ", "))
+}
+
+// RevertCommit records a commit undoing commitID on the branch checked out at
+// workspacePath. It refuses when the workspace has uncommitted changes, when
+// the commit is not on the branch, and when later commits touch any file the
+// commit changed; those have to be reverted first.
+func RevertCommit(workspacePath, commitID string) (*RevertResult, error) {
+	if !IsRepository(workspacePath) {
+		return nil, ErrNoRepository
+	}
+
+	worktreeMu.Lock()
+	defer worktreeMu.Unlock()
+
+	full, err := gitOutput(workspacePath, "rev-parse", "--verify", "--quiet", commitID+"^{commit}")
+	if err != nil {
+		return nil, fmt.Errorf("unknown commit %s", commitID)
+	}
+	commitID = strings.TrimSpace(full)
+
+	if err := runGit(workspacePath, "merge-base", "--is-ancestor", commitID, "HEAD"); err != nil {
+		return nil, ErrCommitNotOnBranch
+	}
+	parents, err := gitOutput(workspacePath, "rev-list", "--parents", "-n", "1", commitID)
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.Fields(parents)) > 2 {
+		return nil, ErrMergeCommit
+	}
+	if clean, err := isTreeClean(workspacePath); err != nil {
+		return nil, err
+	} else if !clean {
+		return nil, ErrDirtyWorkspace
+	}
+
+	out, err := gitOutput(workspacePath, "diff-tree", "-z", "--no-commit-id", "--name-only", "-r", "--root", commitID)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range strings.Split(out, "\x00") {
+		if name != "" {
+			files = append(files, name)
+		}
+	}
+	if len(files) > 0 {
+		dependents, err := logCommits(workspacePath, append([]string{commitID + "..HEAD", "--"}, files...)...)
+		if err != nil {
+			return nil, err
+		}
+		if len(dependents) > 0 {
+			return nil, &DependentCommitsError{Commit: commitID, Dependents: dependents}
+		}
+	}
+
+	subject, _ := gitOutput(workspacePath, "log", "-1", "--format=%s", commitID)
+	if err := runGit(workspacePath, "revert", "--no-edit", commitID); err != nil {
+		runGit(workspacePath, "revert", "--abort")
+		return nil, fmt.Errorf("git revert failed: %w", err)
+	}
+
+	head, _ := gitOutput(workspacePath, "rev-parse", "HEAD")
+	branch, _ := gitOutput(workspacePath, "rev-parse", "--abbrev-ref", "HEAD")
+	return &RevertResult{
+		Reverted: commitID,
+		Subject:  strings.TrimSpace(subject),
+		CommitID: strings.TrimSpace(head),
+		Branch:   strings.TrimSpace(branch),
+	}, nil
+}
+
+func shortID(id string) string {
+	if len(id) > 7 {
+		return id[:7]
+	}
+	return id
+}
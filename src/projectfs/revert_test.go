@@ -0,0 +1,43 @@
+package projectfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRevertCommitGuardsDependentCommits(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "repo")
+	initTestRepo(t, repo)
+
+	commitTestFile(t, repo, "app.js", "v1\n")
+	first, _ := gitOutput(repo, "rev-parse", "HEAD")
+	commitTestFile(t, repo, "app.js", "v2\n")
+	second, _ := gitOutput(repo, "rev-parse", "HEAD")
+	commitTestFile(t, repo, "other file.txt", "x\n")
+
+	var depErr *DependentCommitsError
+	if _, err := RevertCommit(repo, first[:10]); !errors.As(err, &depErr) || len(depErr.Dependents) != 1 {
+		t.Fatalf("expected the second commit to block the revert, got %v", err)
+	}
+
+	result, err := RevertCommit(repo, second[:10])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Subject != "Update app.js" || result.CommitID == "" || result.Reverted == result.CommitID {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if content, _ := os.ReadFile(filepath.Join(repo, "app.js")); string(content) != "v1\n" {
+		t.Fatalf("app.js = %q after revert", content)
+	}
+
+	if _, err := RevertCommit(repo, "0123456789abcdef"); err == nil {
+		t.Fatal("unknown commits must be refused")
+	}
+	writeTestFile(t, repo, "dirty.txt", "wip\n")
+	if _, err := RevertCommit(repo, result.CommitID); !errors.Is(err, ErrDirtyWorkspace) {
+		t.Fatalf("expected ErrDirtyWorkspace, got %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package projectfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Sync strategies decide what happens when both the workspace and the
+// remote have new commits.
+const (
+	// SyncFastForward only fast-forwards and reports divergence. It is the
+	// default.
+	SyncFastForward = "ff-only"
+	// SyncRebase replays local commits onto the remote branch. A conflict
+	// leaves the rebase in progress for someone to resolve or abort.
+	SyncRebase = "rebase"
+)
+
+var ErrUnfinishedSync = errors.New("workspace has an unfinished rebase or merge")
+
+// SyncResult describes a sync of the workspace's branch with origin. Ahead
+// and Behind count the commits only on the workspace and only on origin
+// before the sync.
+type SyncResult struct {
+	Strategy  string   `json:"strategy"`
+	Branch    string   `json:"branch"`
+	Upstream  string   `json:"upstream,omitempty"`
+	Ahead     int      `json:"ahead"`
+	Behind    int      `json:"behind"`
+	Updated   bool     `json:"updated"`
+	Diverged  bool     `json:"diverged,omitempty"`
+	Conflicts []string `json:"conflicts,omitempty"`
+	CommitID  string   `json:"commitId,omitempty"`
+}
+
+// ValidSyncStrategy reports whether strategy is a known sync strategy.
+func ValidSyncStrategy(strategy string) bool {
+	return strategy == SyncFastForward || strategy == SyncRebase
+}
+
+// SyncStrategyOrDefault returns the configured sync strategy, or
+// SyncFastForward.
+func (s Settings) SyncStrategyOrDefault() string {
+	if ValidSyncStrategy(s.SyncStrategy) {
+		return s.SyncStrategy
+	}
+	return SyncFastForward
+}
+
+// InConflict reports whether a rebase or merge is in progress in the
+// checkout at path.
+func InConflict(path string) bool {
+	if !IsRepository(path) {
+		return false
+	}
+	for _, name := range []string{"rebase-merge", "rebase-apply", "MERGE_HEAD"} {
+		out, err := gitOutput(path, "rev-parse", "--git-path", name)
+		if err != nil {
+			continue
+		}
+		p := strings.TrimSpace(out)
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(path, p)
+		}
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ConflictedPaths lists the files with unresolved conflicts at path.
+func ConflictedPaths(path string) []string {
+	return conflictedPaths(path)
+}
+
+// SyncWorkspace fetches origin and brings the workspace's branch up to date
+// with its remote counterpart. The workspace must be clean and must not be
+// in the middle of a rebase or merge.
+func SyncWorkspace(workspacePath, strategy string) (*SyncResult, error) {
+	if !IsRepository(workspacePath) {
+		return nil, ErrNoRepository
+	}
+	if !ValidSyncStrategy(strategy) {
+		return nil, fmt.Errorf("unknown sync strategy %q", strategy)
+	}
+	remote, _ := gitOutput(workspacePath, "config", "--get", "remote.origin.url")
+	if strings.TrimSpace(remote) == "" {
+		return nil, ErrNoRemote
+	}
+
+	worktreeMu.Lock()
+	defer worktreeMu.Unlock()
+
+	if InConflict(workspacePath) {
+		return nil, ErrUnfinishedSync
+	}
+	branch, err := DefaultBranch(workspacePath)
+	if err != nil {
+		return nil, err
+	}
+	if clean, err := isTreeClean(workspacePath); err != nil {
+		return nil, err
+	} else if !clean {
+		return nil, ErrDirtyWorkspace
+	}
+
+	if err := runGit(workspacePath, "fetch", "--prune", "origin"); err != nil {
+		return nil, fmt.Errorf("git fetch failed: %w", err)
+	}
+
+	result := &SyncResult{Strategy: strategy, Branch: branch}
+	upstream := "refs/remotes/origin/" + branch
+	if _, err := gitOutput(workspacePath, "rev-parse", "--verify", "--quiet", upstream); err != nil {
+		// origin has no such branch yet; nothing to sync with.
+		return result, nil
+	}
+	result.Upstream = "origin/" + branch
+
+	counts, err := gitOutput(workspacePath, "rev-list", "--left-right", "--count", "HEAD..."+upstream)
+	if err != nil {
+		return nil, err
+	}
+	if fields := strings.Fields(counts); len(fields) == 2 {
+		result.Ahead, _ = strconv.Atoi(fields[0])
+		result.Behind, _ = strconv.Atoi(fields[1])
+	}
+
+	switch {
+	case result.Behind == 0:
+		return result, nil
+	case result.Ahead == 0:
+		if err := runGit(workspacePath, "merge", "--ff-only", upstream); err != nil {
+			return nil, fmt.Errorf("git merge --ff-only failed: %w", err)
+		}
+	case strategy == SyncRebase:
+		if err := runGit(workspacePath, "rebase", upstream); err != nil {
+			result.Conflicts = conflictedPaths(workspacePath)
+			if len(result.Conflicts) == 0 {
+				runGit(workspacePath, "rebase", "--abort")
+				return nil, fmt.Errorf("git rebase failed: %w", err)
+			}
+			return result, nil
+		}
+	default:
+		result.Diverged = true
+		return result, nil
+	}
+
+	head, _ := gitOutput(workspacePath, "rev-parse", "HEAD")
+	result.CommitID = strings.TrimSpace(head)
+	result.Updated = true
+	return result, nil
+}
+
+// AbortSync abandons a rebase or merge in progress at workspacePath.
+func AbortSync(workspacePath string) error {
+	worktreeMu.Lock()
+	defer worktreeMu.Unlock()
+
+	if !InConflict(workspacePath) {
+		return nil
+	}
+	if err := runGit(workspacePath, "rebase", "--abort"); err == nil {
+		return nil
+	}
+	if err := runGit(workspacePath, "merge", "--abort"); err != nil {
+		return fmt.Errorf("git merge --abort failed: %w", err)
+	}
+	return nil
+}
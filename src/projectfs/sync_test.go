@@ -0,0 +1,113 @@
+package projectfs
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// cloneTestRemote publishes a fresh repository as a bare remote and returns
+// the upstream checkout and a clone of it acting as the workspace.
+func cloneTestRemote(t *testing.T, root string) (string, string) {
+	t.Helper()
+	upstream, remote, workspace := filepath.Join(root, "upstream"), filepath.Join(root, "remote.git"), filepath.Join(root, "workspace")
+	initTestRepo(t, upstream)
+	branch, err := DefaultBranch(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct {
+		dir  string
+		args []string
+	}{
+		{root, []string{"init", "-q", "--bare", remote}},
+		{upstream, []string{"remote", "add", "origin", remote}},
+		{upstream, []string{"push", "-q", "origin", "HEAD:refs/heads/" + branch}},
+		{root, []string{"clone", "-q", "-b", branch, remote, workspace}},
+		{workspace, []string{"config", "user.email", "test@example.com"}},
+		{workspace, []string{"config", "user.name", "Test"}},
+	} {
+		if err := runGit(step.dir, step.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return upstream, workspace
+}
+
+func pushTestFile(t *testing.T, upstream, rel, content string) {
+	t.Helper()
+	commitTestFile(t, upstream, rel, content)
+	if err := runGit(upstream, "push", "-q", "origin", "HEAD"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncWorkspaceFastForwards(t *testing.T) {
+	upstream, workspace := cloneTestRemote(t, t.TempDir())
+
+	result, err := SyncWorkspace(workspace, SyncFastForward)
+	if err != nil || result.Updated || result.Behind != 0 || result.Upstream == "" {
+		t.Fatalf("up to date: %+v (%v)", result, err)
+	}
+
+	pushTestFile(t, upstream, "remote.txt", "remote\n")
+	result, err = SyncWorkspace(workspace, SyncFastForward)
+	if err != nil || !result.Updated || result.Behind != 1 || result.Ahead != 0 {
+		t.Fatalf("fast-forward: %+v (%v)", result, err)
+	}
+	if file, err := ReadFile(workspace, "remote.txt", 1024); err != nil || file.Content != "remote\n" {
+		t.Fatalf("remote.txt after sync: %+v (%v)", file, err)
+	}
+
+	writeTestFile(t, workspace, "dirty.txt", "wip\n")
+	if _, err := SyncWorkspace(workspace, SyncFastForward); !errors.Is(err, ErrDirtyWorkspace) {
+		t.Fatalf("expected ErrDirtyWorkspace, got %v", err)
+	}
+}
+
+func TestSyncWorkspaceDivergence(t *testing.T) {
+	upstream, workspace := cloneTestRemote(t, t.TempDir())
+	pushTestFile(t, upstream, "README.md", "remote\n")
+	commitTestFile(t, workspace, "README.md", "local\n")
+
+	result, err := SyncWorkspace(workspace, SyncFastForward)
+	if err != nil || !result.Diverged || result.Updated || result.Ahead != 1 || result.Behind != 1 {
+		t.Fatalf("ff-only: %+v (%v)", result, err)
+	}
+
+	result, err = SyncWorkspace(workspace, SyncRebase)
+	if err != nil || len(result.Conflicts) != 1 || result.Conflicts[0] != "README.md" {
+		t.Fatalf("rebase: %+v (%v)", result, err)
+	}
+	if !InConflict(workspace) {
+		t.Fatal("expected the workspace to be mid-rebase")
+	}
+	if _, err := SyncWorkspace(workspace, SyncRebase); !errors.Is(err, ErrUnfinishedSync) {
+		t.Fatalf("expected ErrUnfinishedSync, got %v", err)
+	}
+	if _, err := PushWorkspace(workspace, "main"); !errors.Is(err, ErrUnfinishedSync) {
+		t.Fatalf("push mid-rebase: expected ErrUnfinishedSync, got %v", err)
+	}
+
+	if err := AbortSync(workspace); err != nil {
+		t.Fatal(err)
+	}
+	if InConflict(workspace) {
+		t.Fatal("abort left the workspace mid-rebase")
+	}
+}
+
+func TestSyncWorkspaceRebasesLocalCommits(t *testing.T) {
+	upstream, workspace := cloneTestRemote(t, t.TempDir())
+	pushTestFile(t, upstream, "remote.txt", "remote\n")
+	commitTestFile(t, workspace, "local.txt", "local\n")
+
+	result, err := SyncWorkspace(workspace, SyncRebase)
+	if err != nil || !result.Updated || result.Ahead != 1 || result.Behind != 1 || len(result.Conflicts) != 0 {
+		t.Fatalf("rebase: %+v (%v)", result, err)
+	}
+	commits, err := Log(workspace, "", 10)
+	if err != nil || len(commits) != 3 || commits[0].Subject != "Update local.txt" || commits[1].Subject != "Update remote.txt" {
+		t.Fatalf("log after rebase: %+v (%v)", commits, err)
+	}
+}
@@ -0,0 +1,215 @@
+package projectfs
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxListedFiles bounds ListFiles so a huge checkout cannot stall an agent.
+const maxListedFiles = 5000
+
+var errTooManyFiles = errors.New("too many files")
+
+// ListFiles returns the workspace's files as slash-separated paths relative to
+// workspacePath, sorted, skipping .git and anything matched by .gitignore.
+// Git itself is asked when the workspace is a repository; otherwise the tree
+// is walked and .gitignore files are applied directly.
+func ListFiles(workspacePath string) ([]string, error) {
+	if workspacePath == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(filepath.Join(workspacePath, ".git")); err == nil {
+		if files, err := listGitFiles(workspacePath); err == nil {
+			return files, nil
+		}
+	}
+	return walkFiles(workspacePath)
+}
+
+func listGitFiles(workspacePath string) ([]string, error) {
+	out, err := gitOutput(workspacePath, "ls-files", "--cached", "--others", "--exclude-standard", "-z")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range strings.Split(out, "\x00") {
+		if name == "" {
+			continue
+		}
+		// ls-files still reports tracked files that were deleted on disk.
+		// Symlinks are left out: they may point outside the workspace.
+		if info, err := os.Lstat(filepath.Join(workspacePath, filepath.FromSlash(name))); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, name)
+		if len(files) >= maxListedFiles {
+			break
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func walkFiles(workspacePath string) ([]string, error) {
+	root := filepath.Clean(workspacePath)
+	rules := map[string][]ignoreRule{}
+	var files []string
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, relErr := filepath.Rel(root, p)
+		if relErr != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if rel != "." && ignored(rules, rel, true) {
+				return filepath.SkipDir
+			}
+			if parsed := readIgnoreFile(filepath.Join(p, ".gitignore")); len(parsed) > 0 {
+				rules[rel] = parsed
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || ignored(rules, rel, false) {
+			return nil
+		}
+		files = append(files, rel)
+		if len(files) >= maxListedFiles {
+			return errTooManyFiles
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errTooManyFiles) {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// ignoreRule is one line of a .gitignore file.
+type ignoreRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+func readIgnoreFile(name string) []ignoreRule {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreLine(scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func parseIgnoreLine(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	line = strings.TrimPrefix(line, `\`)
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A slash anywhere but the end anchors the pattern to its .gitignore.
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	rule.pattern = line
+	return rule, true
+}
+
+// ignored applies every .gitignore from the root down to rel's directory;
+// later (deeper, later-listed) rules win.
+func ignored(rules map[string][]ignoreRule, rel string, isDir bool) bool {
+	result := false
+	dirs := []string{"."}
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		dirs = append(dirs, strings.Join(parts[:i], "/"))
+	}
+	for _, dir := range dirs {
+		local := rel
+		if dir != "." {
+			local = strings.TrimPrefix(rel, dir+"/")
+		}
+		for _, rule := range rules[dir] {
+			if rule.matches(local, isDir) {
+				result = !rule.negate
+			}
+		}
+	}
+	return result
+}
+
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.anchored {
+		return matchGlob(r.pattern, rel)
+	}
+	return matchGlob(r.pattern, path.Base(rel))
+}
+
+// matchGlob matches slash-separated name against pattern, where "**" spans
+// any number of directories.
+func matchGlob(pattern, name string) bool {
+	patParts := strings.Split(pattern, "/")
+	nameParts := strings.Split(name, "/")
+	return matchParts(patParts, nameParts)
+}
+
+func matchParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			for i := 0; i <= len(name); i++ {
+				if matchParts(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
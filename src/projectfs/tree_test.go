@@ -0,0 +1,84 @@
+package projectfs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, root, rel, content string) {
+	t.Helper()
+	full := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(full, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalkFilesRespectsGitignore(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, ".gitignore", "# build output\nnode_modules/\n*.log\n/dist\n!keep.log\n")
+	writeTestFile(t, root, "src/app.js", "")
+	writeTestFile(t, root, "src/debug.log", "")
+	writeTestFile(t, root, "src/keep.log", "")
+	writeTestFile(t, root, "node_modules/lib/index.js", "")
+	writeTestFile(t, root, "dist/bundle.js", "")
+	writeTestFile(t, root, "src/dist/util.js", "")
+	writeTestFile(t, root, "docs/.gitignore", "drafts/**\n")
+	writeTestFile(t, root, "docs/guide.md", "")
+	writeTestFile(t, root, "docs/drafts/wip/notes.md", "")
+	writeTestFile(t, root, ".git/HEAD", "")
+
+	files, err := walkFiles(root)
+	if err != nil {
+		t.Fatalf("walkFiles: %v", err)
+	}
+	want := []string{".gitignore", "docs/.gitignore", "docs/guide.md", "src/app.js", "src/dist/util.js", "src/keep.log"}
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("files = %v, want %v", files, want)
+	}
+}
+
+func TestListFilesSkipsSymlinks(t *testing.T) {
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo")
+	initTestRepo(t, repo)
+	writeTestFile(t, root, "secret.txt", "outside\n")
+	if err := os.Symlink(filepath.Join(root, "secret.txt"), filepath.Join(repo, "notes.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := runGit(repo, "add", "-A"); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ListFiles(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"README.md"}; !reflect.DeepEqual(files, want) {
+		t.Fatalf("files = %v, want %v", files, want)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.go", "main.go", true},
+		{"src/*.go", "src/main.go", true},
+		{"src/*.go", "src/pkg/main.go", false},
+		{"**/gen", "a/b/gen", true},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**", "a/x/y", true},
+	}
+	for _, tc := range cases {
+		if got := matchGlob(tc.pattern, tc.name); got != tc.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package projectfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSlugLength bounds the title part of an issue branch name.
+const maxSlugLength = 40
+
+// worktreeMu serializes worktree changes and commits; git locks its
+// worktree metadata and concurrent adds in one repository fail, and a
+// commit must not land mid-rebase.
+var worktreeMu sync.Mutex
+
+// Commit is one entry of a branch's history.
+type Commit struct {
+	ID      string    `json:"id"`
+	Subject string    `json:"subject"`
+	Author  string    `json:"author"`
+	Time    time.Time `json:"time"`
+}
+
+// IsRepository reports whether path is a git checkout or worktree.
+func IsRepository(path string) bool {
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(path, ".git"))
+	return err == nil
+}
+
+// IssueBranch names the branch agents use for an issue:
+// agent/<first 8 characters of the id>-<slugified title>.
+func IssueBranch(issueID, title string) string {
+	id := issueID
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	name := "agent/" + id
+	if slug := slugify(title); slug != "" {
+		name += "-" + slug
+	}
+	return name
+}
+
+func slugify(text string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(text) {
+		if b.Len() >= maxSlugLength {
+			break
+		}
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+			dash = false
+		case b.Len() > 0 && !dash:
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+// WorktreePath is where an issue's worktree is checked out, next to the
+// project's main workspace.
+func WorktreePath(projectID, issueID string) string {
+	return filepath.Join(baseDir, projectID, "worktrees", issueID)
+}
+
+// EnsureWorktree checks out branch in its own worktree at path. The branch
+// is created from the workspace's HEAD the first time; an existing worktree
+// is reused as is. A repository without commits gets an empty initial
+// commit so there is something to branch from.
+func EnsureWorktree(workspacePath, path, branch string) error {
+	if !IsRepository(workspacePath) {
+		return ErrNoRepository
+	}
+	if IsRepository(path) {
+		return nil
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	worktreeMu.Lock()
+	defer worktreeMu.Unlock()
+
+	if _, err := gitOutput(workspacePath, "rev-parse", "--verify", "HEAD"); err != nil {
+		if err := runGit(workspacePath, "commit", "--allow-empty", "-m", "Initialize workspace"); err != nil {
+			return fmt.Errorf("failed to create initial commit: %w", err)
+		}
+	}
+	// Forget worktrees whose directories were removed by hand.
+	if err := runGit(workspacePath, "worktree", "prune"); err != nil {
+		return fmt.Errorf("git worktree prune failed: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(absPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create worktree dir: %w", err)
+	}
+
+	args := []string{"worktree", "add", absPath, branch}
+	if _, err := gitOutput(workspacePath, "rev-parse", "--verify", "--quiet", "refs/heads/"+branch); err != nil {
+		args = []string{"worktree", "add", "-b", branch, absPath, "HEAD"}
+	}
+	if err := runGit(workspacePath, args...); err != nil {
+		return fmt.Errorf("git worktree add failed: %w", err)
+	}
+	return nil
+}
+
+// RemoveWorktree deletes the worktree at path, discarding uncommitted
+// changes. The branch and its commits are kept.
+func RemoveWorktree(workspacePath, path string) error {
+	if !IsRepository(workspacePath) || !IsRepository(path) {
+		return nil
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	worktreeMu.Lock()
+	defer worktreeMu.Unlock()
+	if err := runGit(workspacePath, "worktree", "remove", "--force", absPath); err != nil {
+		return fmt.Errorf("git worktree remove failed: %w", err)
+	}
+	return nil
+}
+
+// BranchCommits lists up to limit commits on branch that the workspace's
+// HEAD does not contain, newest first.
+func BranchCommits(workspacePath, branch string, limit int) ([]Commit, error) {
+	if !IsRepository(workspacePath) || branch == "" {
+		return nil, nil
+	}
+	return logCommits(workspacePath, fmt.Sprintf("--max-count=%d", limit), "HEAD.."+branch, "--")
+}
+
+// logCommits runs git log with args and parses the commits it lists.
+func logCommits(path string, args ...string) ([]Commit, error) {
+	out, err := gitOutput(path, append([]string{"log", "--format=%H%x1f%s%x1f%an%x1f%aI"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []Commit
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		when, _ := time.Parse(time.RFC3339, fields[3])
+		commits = append(commits, Commit{ID: fields[0], Subject: fields[1], Author: fields[2], Time: when})
+	}
+	return commits, nil
+}
@@ -0,0 +1,78 @@
+package projectfs
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestIssueBranch(t *testing.T) {
+	cases := map[string]string{
+		"Add login page!":  "agent/0123abcd-add-login-page",
+		"  ":               "agent/0123abcd",
+		"Fix: API /v2 bug": "agent/0123abcd-fix-api-v2-bug",
+		"A very long title that keeps on going well past the limit": "agent/0123abcd-a-very-long-title-that-keeps-on-going-we",
+	}
+	for title, want := range cases {
+		if got := IssueBranch("0123abcd-ffff-4444", title); got != want {
+			t.Errorf("IssueBranch(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
+
+func TestWorktreesIsolateIssueBranches(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo")
+	writeTestFile(t, repo, "README.md", "hello\n")
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"config", "user.email", "test@example.com"},
+		{"config", "user.name", "Test"},
+		{"add", "-A"},
+		{"commit", "-q", "-m", "init"},
+	} {
+		if err := runGit(repo, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, second := filepath.Join(root, "worktrees", "one"), filepath.Join(root, "worktrees", "two")
+	if err := EnsureWorktree(repo, first, "agent/one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureWorktree(repo, second, "agent/two"); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureWorktree(repo, first, "agent/one"); err != nil {
+		t.Fatalf("reusing a worktree should succeed: %v", err)
+	}
+
+	writeTestFile(t, first, "one.txt", "1\n")
+	if _, err := CommitWorkspaceChanges(first, "Add one"); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ListFiles(second); len(files) != 1 {
+		t.Fatalf("second worktree sees first's files: %v", files)
+	}
+
+	commits, err := BranchCommits(repo, "agent/one", 10)
+	if err != nil || len(commits) != 1 || commits[0].Subject != "Add one" {
+		t.Fatalf("commits %+v (%v)", commits, err)
+	}
+	if commits, _ := BranchCommits(repo, "agent/two", 10); len(commits) != 0 {
+		t.Fatalf("agent/two should have no commits, got %+v", commits)
+	}
+
+	if err := RemoveWorktree(repo, first); err != nil {
+		t.Fatal(err)
+	}
+	if IsRepository(first) {
+		t.Fatal("worktree should be removed")
+	}
+	if commits, _ := BranchCommits(repo, "agent/one", 10); len(commits) != 1 {
+		t.Fatal("removing the worktree must keep the branch")
+	}
+}
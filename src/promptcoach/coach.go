@@ -9,14 +9,12 @@ import (
 	"strings"
 	"time"
 
-	openai "github.com/openai/openai-go/v3"
-	"github.com/openai/openai-go/v3/option"
-	"github.com/openai/openai-go/v3/responses"
+	"replychat/src/llm"
 )
 
 // Coach provides prompt analysis and rewrites.
 type Coach struct {
-	client *openai.Client
+	config llm.ModelConfig
 }
 
 // Result holds the structured response returned to the UI.
@@ -25,14 +23,16 @@ type Result struct {
 	ImprovedPrompt string `json:"improved_prompt"`
 }
 
-// New creates a Coach backed by OpenAI (reusing the existing API key).
+// New creates a Coach using PROMPT_COACH_PROVIDER and PROMPT_COACH_MODEL,
+// or the server's default LLM provider when they are unset.
 func New() *Coach {
-	apiKey := strings.TrimSpace(os.Getenv("OPENAI_API_KEY"))
-	if apiKey == "" {
-		return &Coach{}
-	}
-	client := openai.NewClient(option.WithAPIKey(apiKey))
-	return &Coach{client: &client}
+	temperature := 0.3
+	return &Coach{config: llm.ModelConfig{
+		Provider:    strings.TrimSpace(os.Getenv("PROMPT_COACH_PROVIDER")),
+		Model:       strings.TrimSpace(os.Getenv("PROMPT_COACH_MODEL")),
+		Temperature: &temperature,
+		MaxTokens:   400,
+	}}
 }
 
 // ImprovePrompt critiques the provided prompt and offers a refined alternative.
@@ -42,29 +42,30 @@ func (c *Coach) ImprovePrompt(ctx context.Context, prompt string) (*Result, erro
 		return nil, errors.New("prompt required")
 	}
 
-	if c.client == nil {
+	provider, err := llm.Resolve(c.config)
+	if errors.Is(err, llm.ErrNotConfigured) {
 		return fallbackResult(cleaned), nil
 	}
+	if err != nil {
+		return nil, fmt.Errorf("prompt coach unavailable: %w", err)
+	}
 
 	coachSystemPrompt := `You are Clippy, a friendly but direct prompt coach.
 You must respond strictly with a compact JSON object matching:
 {"analysis":"one sentence critique","improved_prompt":"rewritten prompt"}
 Keep the improved prompt actionable and under 120 words.`
 
-	resp, err := c.client.Responses.New(ctx, responses.ResponseNewParams{
-		Model: openai.ResponsesModel(openai.ChatModelGPT4oMini),
-		Input: responses.ResponseNewParamsInputUnion{OfInputItemList: responses.ResponseInputParam{
-			responses.ResponseInputItemParamOfMessage(coachSystemPrompt, responses.EasyInputMessageRoleSystem),
-			responses.ResponseInputItemParamOfMessage(cleaned, responses.EasyInputMessageRoleUser),
-		}},
-		MaxOutputTokens: openai.Int(400),
-		Temperature:     openai.Float(0.3),
-	})
+	resp, err := provider.Generate(ctx, c.config.Apply(llm.Request{
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: coachSystemPrompt},
+			{Role: llm.RoleUser, Content: cleaned},
+		},
+	}))
 	if err != nil {
 		return nil, fmt.Errorf("prompt coach failed: %w", err)
 	}
 
-	payload := strings.TrimSpace(resp.OutputText())
+	payload := strings.TrimSpace(resp.Text)
 	if payload == "" {
 		return fallbackResult(cleaned), nil
 	}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"replychat/src/agents"
+	"replychat/src/projectfs"
+)
+
+const (
+	defaultActivityLimit = 50
+	maxActivityLimit     = 200
+)
+
+// projectPushHandler pushes the project workspace's branch, or an issue's
+// branch when issueId is given, to origin on request. Every push policy but
+// "never" allows it; the dedicated-branch policy still picks the remote
+// branch.
+func projectPushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	access := accessFromRequest(r)
+	if !requirePermission(w, access, permPushRemote) {
+		return
+	}
+
+	var req struct {
+		IssueID string `json:"issueId"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	settings, err := projectfs.LoadSettings(db, access.ProjectID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	workspacePath := settings.WorkspacePath
+	if req.IssueID != "" {
+		var worktreePath sql.NullString
+		err := db.QueryRow(`SELECT worktree_path FROM issues WHERE id = ? AND project_id = ?`, req.IssueID, access.ProjectID).Scan(&worktreePath)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "issue not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if worktreePath.String == "" {
+			http.Error(w, "issue has no branch yet", http.StatusConflict)
+			return
+		}
+		workspacePath = worktreePath.String
+	}
+
+	result, err := agents.PushWorkspace(db, hubPublisher(), access.ProjectID, workspacePath, projectfs.PushRequested, access.UserID)
+	switch {
+	case errors.Is(err, projectfs.ErrPushDisabled), errors.Is(err, projectfs.ErrNoRemote),
+		errors.Is(err, projectfs.ErrDetachedHead), errors.Is(err, projectfs.ErrUnfinishedSync):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	case result == nil:
+		http.Error(w, "workspace is not a git repository", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"push": result,
+	})
+}
+
+// projectActivityHandler lists the project's recent activity, newest first.
+func projectActivityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultActivityLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxActivityLimit)
+	}
+
+	activity, err := agents.ListActivity(db, accessFromRequest(r).ProjectID, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"activity": activity,
+	})
+}
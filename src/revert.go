@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"replychat/src/agents"
+	"replychat/src/projectfs"
+)
+
+var (
+	errMessageNotFound  = errors.New("message not found")
+	errNoAgentCommit    = errors.New("message has no agent commit")
+	errAlreadyReverted  = errors.New("commit was already reverted")
+	errForeignWorkspace = errors.New("commit was made outside this project's workspaces")
+)
+
+// revertMessageCommit reverts the commit recorded in an agent message's git
+// metadata, in the workspace the agent committed to, and marks the message
+// as reverted. Successes and refusals from git are posted as system
+// messages; an unknown message or one without a commit is only reported to
+// the caller.
+func revertMessageCommit(projectID, messageID, userID string) (*projectfs.RevertResult, error) {
+	var (
+		senderType, senderID string
+		rawMetadata          sql.NullString
+	)
+	err := db.QueryRow(`SELECT sender_type, sender_id, metadata FROM messages WHERE id = ? AND project_id = ?`, messageID, projectID).
+		Scan(&senderType, &senderID, &rawMetadata)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]interface{}{}
+	if rawMetadata.Valid && rawMetadata.String != "" {
+		if err := json.Unmarshal([]byte(rawMetadata.String), &metadata); err != nil {
+			return nil, fmt.Errorf("invalid message metadata: %w", err)
+		}
+	}
+	gitInfo, _ := metadata["git"].(map[string]interface{})
+	commitID, _ := gitInfo["commitId"].(string)
+	if senderType != "agent" || commitID == "" {
+		return nil, errNoAgentCommit
+	}
+	if _, reverted := metadata["reverted"]; reverted {
+		return nil, errAlreadyReverted
+	}
+
+	workspacePath, err := messageWorkspace(projectID, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := projectfs.RevertCommit(workspacePath, commitID)
+	if err != nil {
+		log.Printf("git: %s could not revert %s in project %s: %v", userID, commitID, projectID, err)
+		sendSystemMessage(projectID, fmt.Sprintf("Could not revert %s's commit %s: %v.", agentDisplayName(senderID, "agent"), shortCommit(commitID), err))
+		return nil, err
+	}
+	log.Printf("git: %s reverted %s in project %s as %s", userID, commitID, projectID, result.CommitID)
+
+	pushed, pushErr := agents.PushWorkspace(db, hubPublisher(), projectID, workspacePath, projectfs.PushAfterCommit, userID)
+
+	metadata["reverted"] = map[string]interface{}{
+		"commitId":   result.CommitID,
+		"revertedBy": userID,
+		"revertedAt": time.Now(),
+	}
+	if raw, err := json.Marshal(metadata); err != nil {
+		log.Printf("db: failed to encode metadata for message %s: %v", messageID, err)
+	} else if _, err := db.Exec(`UPDATE messages SET metadata = ? WHERE id = ?`, string(raw), messageID); err != nil {
+		log.Printf("db: failed to mark message %s reverted: %v", messageID, err)
+	}
+	publishMessageUpdate(projectID, messageID, metadata)
+
+	text := fmt.Sprintf("Reverted %s's commit %s (%s) on %s with %s.",
+		agentDisplayName(senderID, "agent"), shortCommit(commitID), result.Subject, result.Branch, shortCommit(result.CommitID))
+	switch {
+	case pushErr != nil:
+		text += " Pushing to origin failed; see the project activity."
+	case pushed != nil && pushed.Pushed:
+		text += fmt.Sprintf(" Pushed to origin/%s.", pushed.RemoteBranch)
+	}
+	sendSystemMessage(projectID, text)
+	return result, nil
+}
+
+// messageWorkspace returns the workspace an agent message's commit was made
+// in: the project workspace or one of its issue worktrees.
+func messageWorkspace(projectID string, metadata map[string]interface{}) (string, error) {
+	settings, err := projectfs.LoadSettings(db, projectID)
+	if err != nil {
+		return "", err
+	}
+	path, _ := metadata["workspacePath"].(string)
+	if path == "" || path == settings.WorkspacePath {
+		return settings.WorkspacePath, nil
+	}
+	worktrees := filepath.Dir(projectfs.WorktreePath(projectID, "issue"))
+	if filepath.Dir(filepath.Clean(path)) != worktrees {
+		return "", errForeignWorkspace
+	}
+	return path, nil
+}
+
+// publishMessageUpdate tells clients that a message's metadata changed.
+func publishMessageUpdate(projectID, messageID string, metadata map[string]interface{}) {
+	if globalHub == nil {
+		return
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"type": "message.updated",
+		"payload": map[string]interface{}{
+			"message": map[string]interface{}{
+				"id":        messageID,
+				"projectId": projectID,
+				"metadata":  metadata,
+			},
+		},
+	})
+	if err == nil {
+		globalHub.Publish(projectID, data)
+	}
+}
+
+// messageAPIHandler serves POST /api/messages/{id}/revert.
+func messageAPIHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/messages/"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "revert" {
+		http.Error(w, "Invalid endpoint", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	access := accessFromRequest(r)
+	if !requirePermission(w, access, permRevertCommits) {
+		return
+	}
+
+	result, err := revertMessageCommit(access.ProjectID, parts[0], access.UserID)
+	var depErr *projectfs.DependentCommitsError
+	switch {
+	case err == nil:
+	case errors.Is(err, errMessageNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errNoAgentCommit), errors.Is(err, errForeignWorkspace):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errAlreadyReverted), errors.As(err, &depErr),
+		errors.Is(err, projectfs.ErrDirtyWorkspace), errors.Is(err, projectfs.ErrCommitNotOnBranch),
+		errors.Is(err, projectfs.ErrMergeCommit):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revert": result,
+	})
+}
+
+// handleRevertCommand serves the commit.revert WebSocket command, whose
+// payload names the agent message to revert. Results reach every client as
+// system messages.
+func handleRevertCommand(c *Client, msg map[string]interface{}) {
+	payload, _ := msg["payload"].(map[string]interface{})
+	messageID, _ := payload["messageId"].(string)
+	if messageID == "" {
+		return
+	}
+	role, err := lookupProjectRole(c.projectID, c.userID)
+	if err != nil || !role.can(permRevertCommits) {
+		log.Printf("ws: %s may not revert commits in project %s", c.userID, c.projectID)
+		return
+	}
+	if _, err := revertMessageCommit(c.projectID, messageID, c.userID); err != nil {
+		log.Printf("ws: revert of message %s failed: %v", messageID, err)
+	}
+}
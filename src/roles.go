@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type projectRole string
+
+const (
+	roleOwner      projectRole = "owner"
+	roleMaintainer projectRole = "maintainer"
+	roleMember     projectRole = "member"
+	roleViewer     projectRole = "viewer"
+)
+
+var roleRank = map[projectRole]int{
+	roleViewer:     1,
+	roleMember:     2,
+	roleMaintainer: 3,
+	roleOwner:      4,
+}
+
+type projectPermission string
+
+const (
+	permManageIssues   projectPermission = "manage_issues"
+	permDeleteIssues   projectPermission = "delete_issues"
+	permRespondDialog  projectPermission = "respond_dialogs"
+	permCreateInvites  projectPermission = "create_invites"
+	permRunAgents      projectPermission = "run_agents"
+	permManageMembers  projectPermission = "manage_members"
+	permManageModels   projectPermission = "manage_models"
+	permManageSettings projectPermission = "manage_settings"
+	permReviewChanges  projectPermission = "review_changes"
+	permMergeBranches  projectPermission = "merge_branches"
+	permPushRemote     projectPermission = "push_remote"
+	permRevertCommits  projectPermission = "revert_commits"
+	permSyncWorkspace  projectPermission = "sync_workspace"
+)
+
+// permissionMinRole lists the least privileged role allowed to perform each
+// action. Roles inherit every permission of the roles ranked below them.
+var permissionMinRole = map[projectPermission]projectRole{
+	permManageIssues:   roleMember,
+	permRespondDialog:  roleMember,
+	permRunAgents:      roleMember,
+	permRevertCommits:  roleMember,
+	permDeleteIssues:   roleMaintainer,
+	permCreateInvites:  roleMaintainer,
+	permManageMembers:  roleMaintainer,
+	permManageModels:   roleMaintainer,
+	permManageSettings: roleMaintainer,
+	permReviewChanges:  roleMaintainer,
+	permMergeBranches:  roleMaintainer,
+	permPushRemote:     roleMaintainer,
+	permSyncWorkspace:  roleMaintainer,
+}
+
+var errPermissionDenied = errors.New("insufficient project role")
+
+func parseProjectRole(raw string) (projectRole, bool) {
+	role := projectRole(strings.ToLower(strings.TrimSpace(raw)))
+	_, ok := roleRank[role]
+	return role, ok
+}
+
+func (role projectRole) atLeast(other projectRole) bool {
+	return roleRank[role] >= roleRank[other]
+}
+
+func (role projectRole) can(permission projectPermission) bool {
+	minRole, ok := permissionMinRole[permission]
+	if !ok {
+		return false
+	}
+	return role.atLeast(minRole)
+}
+
+// requirePermission writes a 403 and returns false when the caller's role does
+// not grant permission.
+func requirePermission(w http.ResponseWriter, access requestAccess, permission projectPermission) bool {
+	if access.Role.can(permission) {
+		return true
+	}
+	http.Error(w, "Forbidden: your project role does not allow this action", http.StatusForbidden)
+	return false
+}
+
+// lookupProjectRole returns the caller's role in a project. The project owner
+// is always roleOwner regardless of what project_members says; unknown or
+// malformed member roles degrade to viewer. Missing projects are reported as
+// errNotProjectMember so callers cannot probe for project IDs.
+func lookupProjectRole(projectID, userID string) (projectRole, error) {
+	if projectID == "" {
+		return "", errProjectRequired
+	}
+
+	var ownerID string
+	var memberRole sql.NullString
+	err := db.QueryRow(`
+		SELECT p.owner_id, pm.role
+		FROM projects p
+		LEFT JOIN project_members pm ON pm.project_id = p.id AND pm.user_id = ?
+		WHERE p.id = ?
+	`, userID, projectID).Scan(&ownerID, &memberRole)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errNotProjectMember
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if ownerID == userID {
+		return roleOwner, nil
+	}
+	if !memberRole.Valid {
+		return "", errNotProjectMember
+	}
+	role, ok := parseProjectRole(memberRole.String)
+	if !ok || role == roleOwner {
+		log.Printf("access: unexpected role %q for user %s in project %s", memberRole.String, userID, projectID)
+		return roleViewer, nil
+	}
+	return role, nil
+}
+
+// projectAPIHandler dispatches /api/projects/{id}/... sub-resources.
+func projectAPIHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/projects/"), "/"), "/")
+	if len(parts) < 2 {
+		http.Error(w, "Invalid endpoint", http.StatusBadRequest)
+		return
+	}
+
+	switch parts[1] {
+	case "invite":
+		projectInviteHandler(w, r)
+	case "members":
+		memberID := ""
+		if len(parts) > 2 {
+			memberID = parts[2]
+		}
+		projectMembersHandler(w, r, memberID)
+	case "models":
+		projectModelsHandler(w, r)
+	case "settings":
+		projectSettingsHandler(w, r)
+	case "push":
+		projectPushHandler(w, r)
+	case "activity":
+		projectActivityHandler(w, r)
+	case "sync":
+		projectSyncHandler(w, r)
+	case "workspace":
+		action := ""
+		if len(parts) > 2 {
+			action = parts[2]
+		}
+		workspaceAPIHandler(w, r, action)
+	default:
+		http.Error(w, "Invalid endpoint", http.StatusBadRequest)
+	}
+}
+
+func projectMembersHandler(w http.ResponseWriter, r *http.Request, memberUserID string) {
+	if memberUserID == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		listProjectMembersHandler(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut, http.MethodPatch:
+		updateProjectMemberHandler(w, r, memberUserID)
+	case http.MethodDelete:
+		removeProjectMemberHandler(w, r, memberUserID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listProjectMembersHandler(w http.ResponseWriter, r *http.Request) {
+	projectID := accessFromRequest(r).ProjectID
+
+	var ownerID string
+	if err := db.QueryRow(`SELECT owner_id FROM projects WHERE id = ?`, projectID).Scan(&ownerID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT pm.user_id, pm.role, pm.joined_at, u.name, u.email
+		FROM project_members pm
+		JOIN users u ON u.id = pm.user_id
+		WHERE pm.project_id = ?
+		ORDER BY pm.joined_at ASC
+	`, projectID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	members := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var userID, role, name, email string
+		var joinedAt time.Time
+		if err := rows.Scan(&userID, &role, &joinedAt, &name, &email); err != nil {
+			continue
+		}
+		if userID == ownerID {
+			role = string(roleOwner)
+		}
+		members = append(members, map[string]interface{}{
+			"user_id":   userID,
+			"name":      name,
+			"email":     email,
+			"role":      role,
+			"joined_at": joinedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"members": members,
+	})
+}
+
+func updateProjectMemberHandler(w http.ResponseWriter, r *http.Request, memberUserID string) {
+	access := accessFromRequest(r)
+	if !requirePermission(w, access, permManageMembers) {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	newRole, ok := parseProjectRole(req.Role)
+	if !ok || newRole == roleOwner {
+		http.Error(w, "role must be one of maintainer, member or viewer", http.StatusBadRequest)
+		return
+	}
+
+	currentRole, err := lookupProjectRole(access.ProjectID, memberUserID)
+	if err != nil {
+		if errors.Is(err, errNotProjectMember) {
+			http.Error(w, "member not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Only the owner may grant or revoke maintainer rights, and nobody can
+	// demote the owner through this endpoint.
+	if currentRole == roleOwner {
+		http.Error(w, "the project owner's role cannot be changed", http.StatusForbidden)
+		return
+	}
+	if (currentRole == roleMaintainer || newRole == roleMaintainer) && access.Role != roleOwner {
+		http.Error(w, "only the project owner can manage maintainers", http.StatusForbidden)
+		return
+	}
+
+	if _, err := db.Exec(`UPDATE project_members SET role = ? WHERE project_id = ? AND user_id = ?`,
+		string(newRole), access.ProjectID, memberUserID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("members: %s changed role of %s in project %s to %s", access.UserID, memberUserID, access.ProjectID, newRole)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": memberUserID,
+		"role":    newRole,
+	})
+}
+
+func removeProjectMemberHandler(w http.ResponseWriter, r *http.Request, memberUserID string) {
+	access := accessFromRequest(r)
+	leaving := memberUserID == access.UserID
+	if !leaving && !requirePermission(w, access, permManageMembers) {
+		return
+	}
+
+	currentRole, err := lookupProjectRole(access.ProjectID, memberUserID)
+	if err != nil {
+		if errors.Is(err, errNotProjectMember) {
+			http.Error(w, "member not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if currentRole == roleOwner {
+		http.Error(w, "the project owner cannot be removed", http.StatusForbidden)
+		return
+	}
+	if !leaving && currentRole == roleMaintainer && access.Role != roleOwner {
+		http.Error(w, "only the project owner can remove maintainers", http.StatusForbidden)
+		return
+	}
+
+	if _, err := db.Exec(`DELETE FROM project_members WHERE project_id = ? AND user_id = ?`,
+		access.ProjectID, memberUserID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("members: %s removed %s from project %s", access.UserID, memberUserID, access.ProjectID)
+	disconnectProjectMember(access.ProjectID, memberUserID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// disconnectProjectMember closes the WebSocket connections userID has open on
+// projectID after they were removed from it, so they stop receiving its
+// events.
+func disconnectProjectMember(projectID, userID string) {
+	if globalHub == nil {
+		return
+	}
+	if n := globalHub.closeClients(func(c *Client) bool { return c.projectID == projectID && c.userID == userID }); n > 0 {
+		log.Printf("members: closed %d connection(s) of %s on project %s", n, userID, projectID)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRolePermissions(t *testing.T) {
+	cases := []struct {
+		role       projectRole
+		permission projectPermission
+		want       bool
+	}{
+		{roleViewer, permManageIssues, false},
+		{roleViewer, permRespondDialog, false},
+		{roleViewer, permRunAgents, false},
+		{roleMember, permManageIssues, true},
+		{roleMember, permRunAgents, true},
+		{roleMember, permDeleteIssues, false},
+		{roleMember, permCreateInvites, false},
+		{roleMaintainer, permDeleteIssues, true},
+		{roleMaintainer, permManageMembers, true},
+		{roleMember, permReviewChanges, false},
+		{roleMaintainer, permReviewChanges, true},
+		{roleMember, permMergeBranches, false},
+		{roleMaintainer, permMergeBranches, true},
+		{roleMember, permPushRemote, false},
+		{roleMaintainer, permPushRemote, true},
+		{roleMember, permSyncWorkspace, false},
+		{roleMaintainer, permSyncWorkspace, true},
+		{roleViewer, permRevertCommits, false},
+		{roleMember, permRevertCommits, true},
+		{roleOwner, permCreateInvites, true},
+		{projectRole(""), permManageIssues, false},
+		{roleOwner, projectPermission("unknown"), false},
+	}
+
+	for _, tc := range cases {
+		if got := tc.role.can(tc.permission); got != tc.want {
+			t.Errorf("%q.can(%q) = %v, want %v", tc.role, tc.permission, got, tc.want)
+		}
+	}
+}
+
+func TestParseProjectRole(t *testing.T) {
+	if role, ok := parseProjectRole(" Maintainer "); !ok || role != roleMaintainer {
+		t.Fatalf("expected maintainer, got %q (ok=%v)", role, ok)
+	}
+	if _, ok := parseProjectRole("admin"); ok {
+		t.Fatal("expected unknown role to be rejected")
+	}
+}
+
+func TestDisconnectProjectMemberClosesOnlyTheirSockets(t *testing.T) {
+	serverConns := make(chan *websocket.Conn, 3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		serverConns <- conn
+	}))
+	defer srv.Close()
+
+	hub := newHub()
+	previous := globalHub
+	globalHub = hub
+	defer func() { globalHub = previous }()
+
+	dial := func(projectID, userID string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		client := &Client{conn: <-serverConns, projectID: projectID, userID: userID, send: make(chan []byte, 1), hub: hub}
+		hub.clients[client] = true
+		return conn
+	}
+	removed := dial("p1", "bob")
+	otherProject := dial("p2", "bob")
+	otherMember := dial("p1", "alice")
+
+	disconnectProjectMember("p1", "bob")
+
+	removed.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := removed.ReadMessage(); err == nil {
+		t.Fatal("the removed member's socket should be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("the removed member's socket is still open")
+	}
+	for client := range hub.clients {
+		if client.projectID == "p1" && client.userID == "bob" {
+			continue
+		}
+		if err := client.conn.WriteMessage(websocket.TextMessage, []byte("ping")); err != nil {
+			t.Fatalf("socket of %s on %s was closed: %v", client.userID, client.projectID, err)
+		}
+	}
+	for _, conn := range []*websocket.Conn{otherProject, otherMember} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, data, err := conn.ReadMessage(); err != nil || string(data) != "ping" {
+			t.Fatalf("other socket should stay open: %q, %v", data, err)
+		}
+	}
+}
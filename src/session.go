@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	sessionCookieName = "session_id"
+	csrfHeaderName    = "X-CSRF-Token"
+	csrfFormField     = "csrf_token"
+
+	// last_seen_at is only rewritten once per interval so busy pages don't
+	// turn every request into a write.
+	sessionTouchInterval = time.Minute
+)
+
+var (
+	sessionIdleTimeout     = 24 * time.Hour
+	sessionAbsoluteTimeout = 7 * 24 * time.Hour
+
+	// wsAllowedOrigins holds extra origins (scheme://host[:port]) allowed to
+	// open WebSockets in addition to the server's own host.
+	wsAllowedOrigins = map[string]bool{}
+)
+
+var (
+	errNoSession      = errors.New("no session")
+	errSessionExpired = errors.New("session expired")
+	errInvalidCSRF    = errors.New("invalid CSRF token")
+)
+
+type sessionRecord struct {
+	ID         string
+	UserID     string
+	AuthMethod string
+	CSRFToken  string
+	UserAgent  string
+	IPAddress  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+// configureSessions reads SESSION_IDLE_TIMEOUT, SESSION_ABSOLUTE_TIMEOUT and
+// WS_ALLOWED_ORIGINS. Invalid durations keep the defaults.
+func configureSessions() {
+	if d, ok := envDuration("SESSION_IDLE_TIMEOUT"); ok {
+		sessionIdleTimeout = d
+	}
+	if d, ok := envDuration("SESSION_ABSOLUTE_TIMEOUT"); ok {
+		sessionAbsoluteTimeout = d
+	}
+	for _, origin := range strings.Split(os.Getenv("WS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			wsAllowedOrigins[strings.ToLower(origin)] = true
+		}
+	}
+}
+
+func envDuration(key string) (time.Duration, bool) {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return 0, false
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		log.Printf("config: ignoring invalid %s=%q", key, raw)
+		return 0, false
+	}
+	return d, true
+}
+
+// startSession issues a fresh session for userID and sets the cookie. Any
+// session presented with the request is destroyed first so a pre-login
+// session ID can never be promoted to an authenticated one.
+func startSession(w http.ResponseWriter, r *http.Request, userID, method string) error {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		if _, err := db.Exec(`DELETE FROM sessions WHERE id = ?`, cookie.Value); err != nil {
+			log.Printf("db: failed to drop previous session: %v", err)
+		}
+	}
+
+	csrfToken, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	sessionID := uuid.New().String()
+	_, err = db.Exec(`
+		INSERT INTO sessions (id, user_id, auth_method, csrf_token, user_agent, ip_address, created_at, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, sessionID, userID, method, csrfToken, truncate(r.UserAgent(), 255), clientIP(r), now, now, now.Add(sessionAbsoluteTimeout))
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionID,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(sessionAbsoluteTimeout.Seconds()),
+	})
+	return nil
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   sessionCookieName,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+// loadSession resolves the request's session cookie, enforcing the idle and
+// absolute timeouts. Expired sessions are deleted on sight.
+func loadSession(r *http.Request) (*sessionRecord, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, errNoSession
+	}
+
+	var s sessionRecord
+	var authMethod, csrfToken, userAgent, ipAddress sql.NullString
+	var lastSeen, expiresAt sql.NullTime
+	err = db.QueryRow(`
+		SELECT id, user_id, auth_method, csrf_token, user_agent, ip_address, created_at, last_seen_at, expires_at
+		FROM sessions WHERE id = ?
+	`, cookie.Value).Scan(&s.ID, &s.UserID, &authMethod, &csrfToken, &userAgent, &ipAddress, &s.CreatedAt, &lastSeen, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNoSession
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.AuthMethod = authMethod.String
+	s.CSRFToken = csrfToken.String
+	s.UserAgent = userAgent.String
+	s.IPAddress = ipAddress.String
+	s.LastSeenAt = s.CreatedAt
+	if lastSeen.Valid {
+		s.LastSeenAt = lastSeen.Time
+	}
+	// Rows created before expiry tracking fall back to created_at.
+	s.ExpiresAt = s.CreatedAt.Add(sessionAbsoluteTimeout)
+	if expiresAt.Valid {
+		s.ExpiresAt = expiresAt.Time
+	}
+
+	now := time.Now()
+	if sessionExpired(&s, now) {
+		db.Exec(`DELETE FROM sessions WHERE id = ?`, s.ID)
+		return nil, errSessionExpired
+	}
+
+	if s.CSRFToken == "" {
+		// Legacy session without a CSRF token: mint one in place.
+		if token, err := randomToken(32); err == nil {
+			s.CSRFToken = token
+			db.Exec(`UPDATE sessions SET csrf_token = ? WHERE id = ?`, token, s.ID)
+		}
+	}
+	if now.Sub(s.LastSeenAt) >= sessionTouchInterval {
+		if _, err := db.Exec(`UPDATE sessions SET last_seen_at = ? WHERE id = ?`, now, s.ID); err == nil {
+			s.LastSeenAt = now
+		}
+	}
+	return &s, nil
+}
+
+func sessionExpired(s *sessionRecord, now time.Time) bool {
+	return !now.Before(s.ExpiresAt) || now.Sub(s.LastSeenAt) >= sessionIdleTimeout
+}
+
+func currentUserID(r *http.Request) (string, error) {
+	s, err := loadSession(r)
+	if err != nil {
+		return "", err
+	}
+	return s.UserID, nil
+}
+
+func requiresCSRF(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	default:
+		return true
+	}
+}
+
+// checkCSRF accepts the token from the X-CSRF-Token header (fetch calls) or
+// the csrf_token form field (plain HTML forms).
+func checkCSRF(r *http.Request, s *sessionRecord) error {
+	token := r.Header.Get(csrfHeaderName)
+	if token == "" {
+		contentType := r.Header.Get("Content-Type")
+		if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") || strings.HasPrefix(contentType, "multipart/form-data") {
+			token = r.PostFormValue(csrfFormField)
+		}
+	}
+	if token == "" || s.CSRFToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRFToken)) != 1 {
+		return errInvalidCSRF
+	}
+	return nil
+}
+
+// checkWebSocketOrigin allows same-origin upgrades plus anything listed in
+// WS_ALLOWED_ORIGINS. Requests without an Origin header come from non-browser
+// clients, which can't be driven cross-site, and are allowed.
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	if strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+	if wsAllowedOrigins[strings.ToLower(strings.TrimRight(origin, "/"))] {
+		return true
+	}
+	log.Printf("ws: rejected upgrade from origin %s", origin)
+	return false
+}
+
+// sessionsAPIHandler lists the caller's active sessions (GET) or signs them
+// out everywhere (DELETE), including the current browser.
+func sessionsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	access := accessFromRequest(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		listSessionsHandler(w, access)
+	case http.MethodDelete:
+		res, err := db.Exec(`DELETE FROM sessions WHERE user_id = ?`, access.UserID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		revoked, _ := res.RowsAffected()
+		log.Printf("auth: %s signed out everywhere (%d sessions)", access.UserID, revoked)
+		disconnectUserSessions(access.UserID)
+		clearSessionCookie(w)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"revoked": revoked,
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listSessionsHandler(w http.ResponseWriter, access requestAccess) {
+	rows, err := db.Query(`
+		SELECT id, auth_method, user_agent, ip_address, created_at, last_seen_at, expires_at
+		FROM sessions WHERE user_id = ?
+		ORDER BY created_at DESC
+	`, access.UserID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	sessions := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var s sessionRecord
+		var authMethod, userAgent, ipAddress sql.NullString
+		var lastSeen, expiresAt sql.NullTime
+		if err := rows.Scan(&s.ID, &authMethod, &userAgent, &ipAddress, &s.CreatedAt, &lastSeen, &expiresAt); err != nil {
+			continue
+		}
+		s.LastSeenAt = s.CreatedAt
+		if lastSeen.Valid {
+			s.LastSeenAt = lastSeen.Time
+		}
+		s.ExpiresAt = s.CreatedAt.Add(sessionAbsoluteTimeout)
+		if expiresAt.Valid {
+			s.ExpiresAt = expiresAt.Time
+		}
+		if sessionExpired(&s, now) {
+			continue
+		}
+
+		// Session IDs are bearer credentials, so only a derived handle is
+		// exposed to the browser.
+		sessions = append(sessions, map[string]interface{}{
+			"id":           sessionHandle(s.ID),
+			"current":      s.ID == access.SessionID,
+			"auth_method":  authMethod.String,
+			"user_agent":   userAgent.String,
+			"ip_address":   ipAddress.String,
+			"created_at":   s.CreatedAt,
+			"last_seen_at": s.LastSeenAt,
+			"expires_at":   s.ExpiresAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions": sessions,
+	})
+}
+
+// sessionAPIHandler revokes a single session by the handle returned from the
+// list endpoint.
+func sessionAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	access := accessFromRequest(r)
+	handle := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sessions/"), "/")
+	if handle == "" {
+		http.Error(w, "session id required", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(`SELECT id FROM sessions WHERE user_id = ?`, access.UserID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var target string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil && sessionHandle(id) == handle {
+			target = id
+		}
+	}
+	rows.Close()
+
+	if target == "" {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if _, err := db.Exec(`DELETE FROM sessions WHERE id = ?`, target); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	disconnectSession(target)
+	if target == access.SessionID {
+		clearSessionCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// disconnectSession closes the WebSocket connections opened with a revoked
+// session, which would otherwise stay authorized until they drop.
+func disconnectSession(sessionID string) {
+	if globalHub == nil {
+		return
+	}
+	if n := globalHub.closeClients(func(c *Client) bool { return c.sessionID == sessionID }); n > 0 {
+		log.Printf("auth: closed %d connection(s) of a revoked session", n)
+	}
+}
+
+// disconnectUserSessions closes every WebSocket connection of userID after
+// all their sessions were revoked.
+func disconnectUserSessions(userID string) {
+	if globalHub == nil {
+		return
+	}
+	if n := globalHub.closeClients(func(c *Client) bool { return c.userID == userID }); n > 0 {
+		log.Printf("auth: closed %d connection(s) of %s", n, userID)
+	}
+}
+
+func sessionHandle(sessionID string) string {
+	return hashToken(sessionID)[:16]
+}
+
+// startSessionJanitor periodically deletes expired sessions and spent reset
+// tokens.
+func startSessionJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			res, err := db.Exec(`
+				DELETE FROM sessions
+				WHERE (expires_at IS NOT NULL AND expires_at <= ?)
+				   OR COALESCE(last_seen_at, created_at) <= ?
+			`, now, now.Add(-sessionIdleTimeout))
+			if err != nil {
+				log.Printf("auth: failed to prune sessions: %v", err)
+			} else if n, _ := res.RowsAffected(); n > 0 {
+				log.Printf("auth: pruned %d expired sessions", n)
+			}
+			if _, err := db.Exec(`DELETE FROM password_resets WHERE expires_at <= ? OR used_at IS NOT NULL`, now); err != nil {
+				log.Printf("auth: failed to prune password resets: %v", err)
+			}
+		}
+	}
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max]
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionExpired(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name    string
+		session sessionRecord
+		want    bool
+	}{
+		{"active", sessionRecord{LastSeenAt: now.Add(-time.Minute), ExpiresAt: now.Add(time.Hour)}, false},
+		{"idle", sessionRecord{LastSeenAt: now.Add(-sessionIdleTimeout), ExpiresAt: now.Add(time.Hour)}, true},
+		{"absolute", sessionRecord{LastSeenAt: now, ExpiresAt: now}, true},
+	}
+	for _, tc := range cases {
+		if got := sessionExpired(&tc.session, now); got != tc.want {
+			t.Errorf("%s: sessionExpired = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCheckCSRF(t *testing.T) {
+	session := &sessionRecord{CSRFToken: "tok"}
+
+	req := httptest.NewRequest("POST", "/api/issues", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	if err := checkCSRF(req, session); err == nil {
+		t.Fatal("expected missing token to be rejected")
+	}
+
+	req.Header.Set(csrfHeaderName, "tok")
+	if err := checkCSRF(req, session); err != nil {
+		t.Fatalf("header token rejected: %v", err)
+	}
+
+	form := url.Values{csrfFormField: {"tok"}}
+	req = httptest.NewRequest("POST", "/api/issues", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := checkCSRF(req, session); err != nil {
+		t.Fatalf("form token rejected: %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "/api/issues", nil)
+	req.Header.Set(csrfHeaderName, "other")
+	if err := checkCSRF(req, session); err == nil {
+		t.Fatal("expected mismatched token to be rejected")
+	}
+}
+
+func TestCheckWebSocketOrigin(t *testing.T) {
+	wsAllowedOrigins = map[string]bool{"https://chat.example.com": true}
+	t.Cleanup(func() { wsAllowedOrigins = map[string]bool{} })
+
+	cases := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://replychat.local:8080", true},
+		{"https://chat.example.com", true},
+		{"https://evil.example.com", false},
+		{"null", false},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "http://replychat.local:8080/ws", nil)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if got := checkWebSocketOrigin(req); got != tc.want {
+			t.Errorf("origin %q: got %v, want %v", tc.origin, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"replychat/src/projectfs"
+)
+
+// projectSettingsHandler reads (GET) or updates (PUT) a project's workflow
+// settings. Fields left out of a PUT keep their current value.
+func projectSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	access := accessFromRequest(r)
+
+	settings, err := projectfs.LoadSettings(db, access.ProjectID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !requirePermission(w, access, permManageSettings) {
+			return
+		}
+		var req struct {
+			ReviewChanges    *bool   `json:"reviewChanges"`
+			PushPolicy       *string `json:"pushPolicy"`
+			PushBranchPrefix *string `json:"pushBranchPrefix"`
+			SyncStrategy     *string `json:"syncStrategy"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.ReviewChanges != nil {
+			settings.ReviewChanges = *req.ReviewChanges
+		}
+		if req.PushPolicy != nil {
+			if !projectfs.ValidPushPolicy(*req.PushPolicy) {
+				http.Error(w, "pushPolicy must be never, manual, on_issue_complete or branch", http.StatusBadRequest)
+				return
+			}
+			settings.PushPolicy = *req.PushPolicy
+		}
+		if req.PushBranchPrefix != nil {
+			if *req.PushBranchPrefix != "" && !projectfs.ValidPushBranchPrefix(*req.PushBranchPrefix) {
+				http.Error(w, "pushBranchPrefix is not a valid branch name prefix", http.StatusBadRequest)
+				return
+			}
+			settings.PushBranchPrefix = *req.PushBranchPrefix
+		}
+		if req.SyncStrategy != nil {
+			if !projectfs.ValidSyncStrategy(*req.SyncStrategy) {
+				http.Error(w, "syncStrategy must be ff-only or rebase", http.StatusBadRequest)
+				return
+			}
+			settings.SyncStrategy = *req.SyncStrategy
+		}
+		if err := projectfs.SaveSettings(db, access.ProjectID, settings); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("settings: %s updated settings for project %s (reviewChanges=%v, pushPolicy=%s)",
+			access.UserID, access.ProjectID, settings.ReviewChanges, settings.PushPolicyOrDefault())
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reviewChanges":    settings.ReviewChanges,
+		"pushPolicy":       settings.PushPolicyOrDefault(),
+		"pushBranchPrefix": settings.PushBranchPrefixOrDefault(),
+		"syncStrategy":     settings.SyncStrategyOrDefault(),
+		"canManage":        access.Role.can(permManageSettings),
+	})
+}
@@ -96,6 +96,12 @@ function handleWebSocketMessage(data) {
         case "message.received":
             addMessage(data.payload.message);
             break;
+        case "message.delta":
+            handleMessageDelta(data.payload);
+            break;
+        case "message.completed":
+            handleMessageCompleted(data.payload.message);
+            break;
         case "issue.created":
             handleIssueCreated(data.payload);
             break;
@@ -114,6 +120,14 @@ function handleWebSocketMessage(data) {
         case "agent.status":
             updateAgentStatus(data.payload);
             break;
+        case "changeset.created":
+            break;
+        case "message.updated":
+            handleMessageUpdated(data.payload.message);
+            break;
+        case "changeset.updated":
+            ChangeSets.updateBadges(data.payload.changeSet);
+            break;
         default:
             console.log("Unknown message type:", data.type);
     }
@@ -127,8 +141,22 @@ function renderMessage(message, scrollToBottom) {
     if (!message || seenMessageIds.has(message.id)) {
         return;
     }
+    messagesArea.appendChild(buildMessageElement(message));
+    if (scrollToBottom) {
+        messagesArea.scrollTop = messagesArea.scrollHeight;
+    }
+    seenMessageIds.add(message.id);
+}
+
+function buildMessageElement(message) {
     const messageEl = document.createElement("div");
     messageEl.className = `message ${message.senderType}`;
+    if (message.messageType === "error") {
+        messageEl.classList.add("error");
+    }
+    if (message.id) {
+        messageEl.dataset.messageId = message.id;
+    }
 
     const avatarEl = document.createElement("div");
     avatarEl.className = "message-avatar";
@@ -154,21 +182,81 @@ function renderMessage(message, scrollToBottom) {
 
     const textEl = document.createElement("div");
     textEl.className = "message-text";
-    textEl.innerHTML = formatMessageContent(message);
+    if (message.streaming) {
+        textEl.textContent = message.content || "";
+    } else {
+        textEl.innerHTML = formatMessageContent(message);
+    }
 
     contentEl.appendChild(senderEl);
     contentEl.appendChild(textEl);
 
     messageEl.appendChild(avatarEl);
     messageEl.appendChild(contentEl);
+    return messageEl;
+}
 
-    messagesArea.appendChild(messageEl);
-    if (scrollToBottom) {
+// Streamed agent replies arrive as message.delta events keyed by a
+// placeholder ID, then a message.completed event with the persisted message.
+const streamingMessages = new Map();
+
+function handleMessageDelta(payload) {
+    if (!payload || !payload.messageId || seenMessageIds.has(payload.messageId)) {
+        return;
+    }
+    const nearBottom = messagesArea.scrollHeight - messagesArea.scrollTop - messagesArea.clientHeight < 80;
+    let entry = streamingMessages.get(payload.messageId);
+    if (!entry) {
+        const element = buildMessageElement({
+            id: payload.messageId,
+            senderId: payload.senderId,
+            senderType: payload.senderType || "agent",
+            senderName: payload.senderName,
+            content: "",
+            streaming: true,
+        });
+        element.classList.add("streaming");
+        messagesArea.appendChild(element);
+        entry = { element, textEl: element.querySelector(".message-text"), text: "" };
+        streamingMessages.set(payload.messageId, entry);
+    }
+    entry.text += payload.delta || "";
+    entry.textEl.textContent = entry.text;
+    if (nearBottom) {
         messagesArea.scrollTop = messagesArea.scrollHeight;
     }
+}
+
+function handleMessageCompleted(message) {
+    if (!message || !message.id) {
+        return;
+    }
+    const entry = streamingMessages.get(message.id);
+    if (!entry) {
+        addMessage(message);
+        return;
+    }
+    streamingMessages.delete(message.id);
+    entry.element.replaceWith(buildMessageElement(message));
     seenMessageIds.add(message.id);
 }
 
+// message.updated carries new metadata for a rendered message, such as a
+// reverted commit; only its git summary depends on it.
+function handleMessageUpdated(update) {
+    if (!update || !update.id) {
+        return;
+    }
+    const element = messagesArea.querySelector(`[data-message-id="${CSS.escape(update.id)}"]`);
+    const gitEl = element && element.querySelector(".message-git");
+    const gitInfo = update.metadata?.git;
+    if (!gitEl || !gitInfo) {
+        return;
+    }
+    const message = { id: update.id, senderType: "agent", metadata: update.metadata };
+    gitEl.outerHTML = renderGitSummary(gitInfo, message);
+}
+
 function addSystemMessage(text) {
     const messageEl = document.createElement("div");
     messageEl.className = "system-message";
@@ -248,6 +336,10 @@ function extractPlanSummary(message) {
     return {
         files: normalizePathList(planSource.files || []),
         mutations: normalizePathList(planSource.mutations || []),
+        patches: normalizePathList(planSource.patches || []),
+        renames: normalizePathList(planSource.renames || []),
+        chmods: normalizePathList(planSource.chmods || []),
+        deletes: normalizePathList(planSource.deletes || []),
     };
 }
 
@@ -314,14 +406,14 @@ function shortCommit(commitId) {
     return value.length > 7 ? value.slice(0, 7) : value;
 }
 
-function renderGitSummary(gitInfo) {
+function renderGitSummary(gitInfo, message) {
     const commitLabel = shortCommit(gitInfo.commitId || "");
     const branch = gitInfo.branch || "HEAD";
     let status;
     if (gitInfo.pushed) {
-        status = `Pushed to origin/${escapeHtml(branch)}`;
+        status = `Pushed to origin/${escapeHtml(gitInfo.pushedTo || branch)}`;
     } else if ((gitInfo.remote || "").trim()) {
-        status = `Commit on ${escapeHtml(branch)} (push pending)`;
+        status = `Commit on ${escapeHtml(branch)} (not pushed)`;
     } else {
         status = `Commit on ${escapeHtml(branch)} (no remote)`;
     }
@@ -333,15 +425,54 @@ function renderGitSummary(gitInfo) {
                 <span class="badge badge-dark">${escapeHtml(commitLabel)}</span>
                 <span class="git-branch">@ ${escapeHtml(branch)}</span>
                 <span class="git-status">${status}</span>
+                ${renderRevertControl(gitInfo, message)}
             </div>
         </div>
     `;
 }
 
+function renderRevertControl(gitInfo, message) {
+    const reverted = message?.metadata?.reverted;
+    if (reverted) {
+        return `<span class="git-reverted" title="Reverted by ${escapeHtml(shortCommit(reverted.commitId))}">Reverted</span>`;
+    }
+    if (!message?.id || message.senderType !== "agent" || !gitInfo.commitId) {
+        return "";
+    }
+    return `<button type="button" class="git-revert" data-revert-message="${escapeHtml(message.id)}">Revert</button>`;
+}
+
+// renderRunControls offers to retry or re-run an agent run that failed or
+// was cancelled.
+function renderRunControls(message) {
+    const metadata = message?.metadata || {};
+    const status = metadata.outcome?.status;
+    if (message.senderType !== "agent" || !metadata.runId || (status !== "failed" && status !== "cancelled")) {
+        return "";
+    }
+    const retry = metadata.issueId && status === "failed"
+        ? `<button type="button" data-retry-issue="${escapeHtml(metadata.issueId)}">Retry</button>`
+        : "";
+    return `
+        <div class="message-run">
+            ${retry}
+            <button type="button" data-rerun="${escapeHtml(metadata.runId)}">Edit &amp; re-run</button>
+        </div>
+    `;
+}
+
+const PLAN_OPERATIONS = [
+    { key: "patches", title: "Patches", singular: "patch", plural: "patches" },
+    { key: "renames", title: "Renames", singular: "rename", plural: "renames" },
+    { key: "chmods", title: "Permissions", singular: "chmod", plural: "chmods" },
+    { key: "deletes", title: "Deleted", singular: "delete", plural: "deletes" },
+];
+
 function renderPlanSummary(summary) {
     const hasFiles = summary.files.length > 0;
     const hasMutations = summary.mutations.length > 0;
-    if (!hasFiles && !hasMutations) {
+    const operations = PLAN_OPERATIONS.filter((op) => (summary[op.key] || []).length > 0);
+    if (!hasFiles && !hasMutations && !operations.length) {
         return "";
     }
 
@@ -352,6 +483,10 @@ function renderPlanSummary(summary) {
     if (hasMutations) {
         counts.push(`${summary.mutations.length} mutation${summary.mutations.length === 1 ? "" : "s"}`);
     }
+    operations.forEach((op) => {
+        const count = summary[op.key].length;
+        counts.push(`${count} ${count === 1 ? op.singular : op.plural}`);
+    });
 
     const sections = [];
     if (hasFiles) {
@@ -378,6 +513,18 @@ function renderPlanSummary(summary) {
         `);
     }
 
+    operations.forEach((op) => {
+        const list = summary[op.key]
+            .map((entry) => `<li><code>${escapeHtml(entry)}</code></li>`)
+            .join("");
+        sections.push(`
+            <div class="plan-section">
+                <div class="plan-section-title">${op.title}</div>
+                <ul class="plan-list plan-list-mutations">${list}</ul>
+            </div>
+        `);
+    });
+
     const countBadges = counts
         .map((label) => `<span class="plan-count">${escapeHtml(label)}</span>`)
         .join("");
@@ -398,7 +545,7 @@ function parseWorkspaceSummary(content) {
         return null;
     }
     const match = content.match(
-        /^.+?\s+updated\s+workspace\s+.+?\s+\(files=\d+,\s*mutations=\d+\)(?:;\s*notes:\s*(.+))?$/i
+        /^.+?\s+(?:updated\s+workspace|proposed\s+changes\s+for\s+review|could\s+not\s+apply\s+its\s+changes)\s+\(files=\d+,\s*mutations=\d+(?:,\s*[a-z]+=\d+)*\)(?:;\s*notes:\s*(.+))?$/i
     );
     if (!match) {
         return null;
@@ -495,13 +642,43 @@ function formatMessageContent(message) {
         `);
     }
 
+    const contextFiles = Array.isArray(message.metadata?.contextFiles) ? message.metadata.contextFiles : [];
+    if (contextFiles.length) {
+        segments.push(`
+            <div class="message-meta">
+                <span class="meta-label">Read</span>
+                <span class="meta-value" title="${escapeHtml(contextFiles.join("\n"))}">${contextFiles.length} file${contextFiles.length === 1 ? "" : "s"}</span>
+            </div>
+        `);
+    }
+
+    const skippedChanges = Array.isArray(message.metadata?.skippedChanges) ? message.metadata.skippedChanges : [];
+    if (skippedChanges.length) {
+        const details = skippedChanges.map((change) => `${change.path}: ${change.reason}`).join("\n");
+        segments.push(`
+            <div class="message-meta warning">
+                <span class="meta-label">Not applied</span>
+                <span class="meta-value" title="${escapeHtml(details)}">${skippedChanges.length} change${skippedChanges.length === 1 ? "" : "s"}</span>
+            </div>
+        `);
+    }
+
+    if (message.metadata?.changeSet) {
+        segments.push(ChangeSets.renderBadge(message.metadata.changeSet));
+    }
+
     const planMarkup = renderPlanSummary(planSummary);
     if (planMarkup) {
         segments.push(planMarkup);
     }
 
     if (gitInfo) {
-        segments.push(renderGitSummary(gitInfo));
+        segments.push(renderGitSummary(gitInfo, message));
+    }
+
+    const runControls = renderRunControls(message);
+    if (runControls) {
+        segments.push(runControls);
     }
 
     const shouldRenderContent =
@@ -566,6 +743,10 @@ function updateAgentStatus(data) {
         return;
     }
 
+    if (data.command) {
+        handleAgentCommandResult(data.command);
+    }
+
     const statuses = data.statuses || [];
     statuses.forEach((stat) => {
         updateAgentCardFromQueue(stat);
@@ -580,6 +761,25 @@ function updateAgentStatus(data) {
     });
 }
 
+// Every agent.command is answered with an agent.status event carrying its
+// result. Refusals are only shown to whoever sent the command.
+function handleAgentCommandResult(result) {
+    if (result.ok) {
+        addSystemMessage(result.message);
+    } else if (result.actorId === window.userData.userId) {
+        addSystemMessage(`Could not ${result.command || "run the command"}: ${result.error}`);
+    }
+}
+
+function sendAgentCommand(payload) {
+    if (!ws || ws.readyState !== WebSocket.OPEN) {
+        addSystemMessage("Not connected to server");
+        return false;
+    }
+    ws.send(JSON.stringify({ type: "agent.command", payload }));
+    return true;
+}
+
 function handleIssueCreated(data) {
     console.log("Issue created:", data);
     addSystemMessage(`New task proposed: ${data.issue.title}`);
@@ -619,9 +819,18 @@ function updateAgentCardFromQueue(stat) {
     if (entry.statusEl) {
         const status = stat.status || (stat.queue_depth > 0 ? "queued" : "idle");
         entry.statusEl.textContent = formatAgentStatus(status);
-        entry.statusEl.classList.remove("idle", "working", "waiting", "queued");
+        entry.statusEl.classList.remove("idle", "working", "waiting", "queued", "paused");
         entry.statusEl.classList.add(status);
     }
+
+    if (entry.pauseBtn) {
+        entry.pauseBtn.dataset.agentCommand = stat.paused ? "resume" : "pause";
+        entry.pauseBtn.textContent = stat.paused ? "Resume" : "Pause";
+        entry.pauseBtn.title = stat.paused ? "Start queued tasks again" : "Hold queued tasks; running work continues";
+    }
+    if (entry.stopBtn) {
+        entry.stopBtn.disabled = !(stat.run_ids && stat.run_ids.length);
+    }
 }
 
 function handleDialogRequest(data) {
@@ -654,7 +863,20 @@ function initAgentCards() {
             statusEl: card.querySelector(".agent-status"),
             queueEl: card.querySelector(".agent-queue-count"),
             taskEl: card.querySelector(".agent-task"),
+            pauseBtn: card.querySelector('[data-agent-command="pause"]'),
+            stopBtn: card.querySelector('[data-agent-command="cancel"]'),
         };
+        card.addEventListener("click", (e) => {
+            const button = e.target.closest("[data-agent-command]");
+            if (!button) {
+                return;
+            }
+            const command = button.dataset.agentCommand;
+            if (command === "cancel" && !confirm(`Stop ${formatAgentName(agentId)}'s current work?`)) {
+                return;
+            }
+            sendAgentCommand({ command, agentId });
+        });
     });
 }
 
@@ -732,6 +954,8 @@ function formatAgentStatus(status) {
     switch (status) {
         case "working":
             return "Working";
+        case "paused":
+            return "Paused";
         case "queued":
         case "waiting":
             return "Queued";
@@ -784,6 +1008,7 @@ async function fetchMessages() {
         const data = await response.json();
         (data.messages || []).forEach((msg) => renderMessage(msg, false));
         messagesArea.scrollTop = messagesArea.scrollHeight;
+        ChangeSets.refreshBadges(projectId);
     } catch (err) {
         console.error("Failed to load messages", err);
     }
@@ -1126,6 +1351,87 @@ document.addEventListener("click", (e) => {
     }
 });
 
+messagesArea.addEventListener("click", (e) => {
+    const badge = e.target.closest("[data-change-set]");
+    if (badge) {
+        ChangeSets.open(badge.dataset.changeSet);
+    }
+    const revert = e.target.closest("[data-revert-message]");
+    if (revert) {
+        revertMessageCommit(revert);
+    }
+    const retry = e.target.closest("[data-retry-issue]");
+    if (retry && sendAgentCommand({ command: "retry", issueId: retry.dataset.retryIssue })) {
+        retry.disabled = true;
+    }
+    const rerun = e.target.closest("[data-rerun]");
+    if (rerun) {
+        openRerunEditor(rerun);
+    }
+});
+
+// openRerunEditor shows the prompt of the run behind button for editing and
+// sends the edited prompt with the rerun command.
+async function openRerunEditor(button) {
+    const container = button.closest(".message-run");
+    if (!container || container.querySelector(".rerun-editor")) {
+        return;
+    }
+    const runId = button.dataset.rerun;
+    let prompt = "";
+    try {
+        const response = await fetch(`/api/agent-runs/${encodeURIComponent(runId)}`);
+        if (response.ok) {
+            prompt = (await response.json()).run?.prompt || "";
+        }
+    } catch (err) {
+        console.error("Failed to load agent run", err);
+    }
+
+    const editor = document.createElement("div");
+    editor.className = "rerun-editor";
+    editor.innerHTML = `
+        <textarea rows="4"></textarea>
+        <div class="rerun-actions">
+            <button type="button" class="rerun-cancel">Cancel</button>
+            <button type="button" class="rerun-send">Re-run</button>
+        </div>
+    `;
+    const textarea = editor.querySelector("textarea");
+    textarea.value = prompt;
+    editor.querySelector(".rerun-cancel").onclick = () => editor.remove();
+    editor.querySelector(".rerun-send").onclick = () => {
+        const edited = textarea.value.trim();
+        if (!edited) {
+            textarea.focus();
+            return;
+        }
+        if (sendAgentCommand({ command: "rerun", runId, prompt: edited })) {
+            editor.remove();
+        }
+    };
+    container.appendChild(editor);
+    textarea.focus();
+}
+
+function revertMessageCommit(button) {
+    if (!ws || ws.readyState !== WebSocket.OPEN) {
+        addSystemMessage("Not connected to server");
+        return;
+    }
+    if (!confirm("Revert this commit? A new commit undoing it will be added.")) {
+        return;
+    }
+    // A successful revert re-renders the summary; a refusal arrives as a
+    // system message, after which the button can be used again.
+    button.disabled = true;
+    setTimeout(() => (button.disabled = false), 5000);
+    ws.send(JSON.stringify({
+        type: "commit.revert",
+        payload: { messageId: button.dataset.revertMessage },
+    }));
+}
+
 messageForm.addEventListener("submit", async (e) => {
     e.preventDefault();
 
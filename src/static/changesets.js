@@ -0,0 +1,224 @@
+// Review UI for agent change sets, shared by the chat and kanban views.
+// Opens a modal with each file's diff and lets the reviewer approve all,
+// some or none of the files.
+const ChangeSets = (function () {
+    const statusLabels = {
+        pending: "Awaiting review",
+        approved: "Approved",
+        partially_approved: "Partially approved",
+        rejected: "Rejected",
+        applying: "Applying",
+    };
+    let modal = null;
+    let current = null;
+    let onReviewed = null;
+
+    function escape(text) {
+        const div = document.createElement("div");
+        div.textContent = text == null ? "" : String(text);
+        return div.innerHTML;
+    }
+
+    function statusLabel(status) {
+        return statusLabels[status] || status;
+    }
+
+    function ensureModal() {
+        if (modal) {
+            return modal;
+        }
+        modal = document.createElement("div");
+        modal.className = "modal changeset-modal";
+        modal.style.display = "none";
+        modal.innerHTML = `
+            <div class="modal-content changeset-content">
+                <div class="modal-header">
+                    <h2 class="changeset-title">Review changes</h2>
+                    <button type="button" class="modal-close" data-changeset-close>&times;</button>
+                </div>
+                <div class="modal-body changeset-body"></div>
+            </div>
+        `;
+        modal.addEventListener("click", (event) => {
+            if (event.target === modal || event.target.closest("[data-changeset-close]")) {
+                close();
+            }
+        });
+        document.body.appendChild(modal);
+        return modal;
+    }
+
+    function close() {
+        if (modal) {
+            modal.style.display = "none";
+        }
+        current = null;
+    }
+
+    async function open(id, reviewed) {
+        onReviewed = reviewed || null;
+        const root = ensureModal();
+        root.querySelector(".changeset-body").innerHTML = `<p class="changeset-empty">Loading…</p>`;
+        root.style.display = "flex";
+        try {
+            const response = await fetch(`/api/change-sets/${encodeURIComponent(id)}`);
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            const data = await response.json();
+            current = data.changeSet;
+            render(data.changeSet, data.canReview);
+        } catch (err) {
+            root.querySelector(".changeset-body").innerHTML = `<p class="changeset-error">${escape(err.message || "Failed to load change set")}</p>`;
+        }
+    }
+
+    function render(changeSet, canReview) {
+        const root = ensureModal();
+        const pending = changeSet.status === "pending";
+        root.querySelector(".changeset-title").textContent = changeSet.title || "Review changes";
+
+        const files = (changeSet.files || [])
+            .map(
+                (file, index) => `
+            <details class="changeset-file" ${index === 0 ? "open" : ""}>
+                <summary>
+                    ${pending && canReview ? `<input type="checkbox" class="changeset-select" value="${escape(file.path)}" checked />` : ""}
+                    <span class="changeset-file-status ${escape(file.status)}">${escape(file.status)}</span>
+                    <span class="changeset-file-path">${escape(file.path)}</span>
+                    ${file.decision ? `<span class="changeset-decision ${escape(file.decision)}">${escape(file.decision)}</span>` : ""}
+                </summary>
+                <pre class="changeset-diff">${renderDiff(file.diff)}</pre>
+            </details>
+        `
+            )
+            .join("");
+
+        const reviewer = changeSet.approvedBy || changeSet.rejectedBy;
+        const reviewedAt = changeSet.approvedAt || changeSet.rejectedAt;
+        root.querySelector(".changeset-body").innerHTML = `
+            <div class="changeset-summary">
+                <span class="changeset-status ${escape(changeSet.status)}">${escape(statusLabel(changeSet.status))}</span>
+                <span>${escape(changeSet.agentName || changeSet.agentId)} · ${escape(changeSet.summary || "")}</span>
+            </div>
+            ${reviewer ? `<p class="changeset-reviewed">Reviewed ${reviewedAt ? new Date(reviewedAt).toLocaleString() : ""}</p>` : ""}
+            <div class="changeset-files">${files || `<p class="changeset-empty">No file changes.</p>`}</div>
+            ${
+                pending && canReview
+                    ? `<div class="task-actions changeset-actions">
+                    <button type="button" class="btn-approve" data-changeset-approve>✓ Approve selected</button>
+                    <button type="button" class="btn-reject" data-changeset-reject>✗ Reject all</button>
+                </div>`
+                    : ""
+            }
+            ${pending && !canReview ? `<p class="changeset-empty">Only maintainers can approve changes.</p>` : ""}
+            <p class="changeset-error" hidden></p>
+        `;
+
+        const approve = root.querySelector("[data-changeset-approve]");
+        if (approve) {
+            approve.addEventListener("click", () => {
+                const paths = Array.from(root.querySelectorAll(".changeset-select:checked")).map((input) => input.value);
+                review(changeSet.id, "approve", { paths });
+            });
+            root.querySelector("[data-changeset-reject]").addEventListener("click", () => review(changeSet.id, "reject"));
+        }
+    }
+
+    function renderDiff(diff) {
+        if (!diff) {
+            return `<span class="diff-meta">No diff available.</span>`;
+        }
+        return diff
+            .replace(/\n$/, "")
+            .split("\n")
+            .map((line) => {
+                let cls = "";
+                if (line.startsWith("+++") || line.startsWith("---") || line.startsWith("diff ") || line.startsWith("index ")) {
+                    cls = "diff-meta";
+                } else if (line.startsWith("@@")) {
+                    cls = "diff-hunk";
+                } else if (line.startsWith("+")) {
+                    cls = "diff-add";
+                } else if (line.startsWith("-")) {
+                    cls = "diff-del";
+                }
+                return cls ? `<span class="${cls}">${escape(line)}</span>` : escape(line);
+            })
+            .join("\n");
+    }
+
+    async function review(id, action, body) {
+        const root = ensureModal();
+        const errorEl = root.querySelector(".changeset-error");
+        root.querySelectorAll(".changeset-actions button").forEach((button) => (button.disabled = true));
+        try {
+            const response = await fetch(`/api/change-sets/${encodeURIComponent(id)}/${action}`, {
+                method: "POST",
+                headers: { "Content-Type": "application/json" },
+                body: JSON.stringify(body || {}),
+            });
+            if (!response.ok) {
+                throw new Error((await response.text()).trim() || "Review failed");
+            }
+            const data = await response.json();
+            current = data.changeSet;
+            render(data.changeSet, data.canReview);
+            if (onReviewed) {
+                onReviewed(data.changeSet);
+            }
+        } catch (err) {
+            errorEl.textContent = err.message;
+            errorEl.hidden = false;
+            root.querySelectorAll(".changeset-actions button").forEach((button) => (button.disabled = false));
+        }
+    }
+
+    // listPending returns the project's pending change sets.
+    async function listPending(projectId) {
+        const response = await fetch(`/api/change-sets?project_id=${encodeURIComponent(projectId)}&status=pending`);
+        if (!response.ok) {
+            return [];
+        }
+        const data = await response.json();
+        return data.changeSets || [];
+    }
+
+    // refreshBadges brings badges rendered from message history up to date.
+    async function refreshBadges(projectId) {
+        const response = await fetch(`/api/change-sets?project_id=${encodeURIComponent(projectId)}`);
+        if (!response.ok) {
+            return;
+        }
+        const data = await response.json();
+        (data.changeSets || []).forEach(updateBadges);
+    }
+
+    // renderBadge returns markup for a button that opens changeSet.
+    function renderBadge(changeSet) {
+        const count = (changeSet.files || []).length;
+        return `
+            <button type="button" class="changeset-badge ${escape(changeSet.status)}" data-change-set="${escape(changeSet.id)}">
+                <span class="meta-label">Changes</span>
+                <span class="changeset-badge-status">${escape(statusLabel(changeSet.status))}</span>
+                <span>${count} file${count === 1 ? "" : "s"}</span>
+            </button>
+        `;
+    }
+
+    // updateBadges refreshes every rendered badge for changeSet.
+    function updateBadges(changeSet) {
+        document.querySelectorAll(`[data-change-set="${CSS.escape(changeSet.id)}"]`).forEach((badge) => {
+            badge.className = `changeset-badge ${changeSet.status}`;
+            const status = badge.querySelector(".changeset-badge-status");
+            if (status) {
+                status.textContent = statusLabel(changeSet.status);
+            }
+        });
+        if (current && current.id === changeSet.id && changeSet.status !== current.status) {
+            open(changeSet.id, onReviewed);
+        }
+    }
+
+    return { open, close, listPending, refreshBadges, renderBadge, updateBadges, statusLabel };
+})();
@@ -0,0 +1,21 @@
+// Attaches the session's CSRF token to every state-changing same-origin fetch.
+(function () {
+    const meta = document.querySelector('meta[name="csrf-token"]');
+    const token = meta ? meta.getAttribute('content') : '';
+    if (!token || !window.fetch) return;
+
+    const safeMethods = ['GET', 'HEAD', 'OPTIONS'];
+    const originalFetch = window.fetch.bind(window);
+
+    window.fetch = function (input, init = {}) {
+        const method = (init.method || (input instanceof Request ? input.method : 'GET')).toUpperCase();
+        const url = new URL(input instanceof Request ? input.url : input, window.location.href);
+
+        if (!safeMethods.includes(method) && url.origin === window.location.origin) {
+            const headers = new Headers(init.headers || (input instanceof Request ? input.headers : undefined));
+            headers.set('X-CSRF-Token', token);
+            init = { ...init, headers };
+        }
+        return originalFetch(input, init);
+    };
+})();
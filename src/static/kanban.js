@@ -1,4 +1,5 @@
 let tasks = [];
+let pendingChangeSets = {};
 let draggedTask = null;
 const agentQueueSummary = document.getElementById('agent-queue-summary');
 
@@ -22,6 +23,7 @@ async function loadTasks() {
         const response = await fetch(`/api/issues?project_id=${projectId}`);
         const data = await response.json();
         tasks = data.issues || [];
+        await loadPendingChangeSets(projectId);
         renderTasks();
         await loadAgentQueues();
     } catch (err) {
@@ -29,9 +31,28 @@ async function loadTasks() {
     }
 }
 
+// loadPendingChangeSets groups change sets awaiting review by issue.
+async function loadPendingChangeSets(projectId) {
+    pendingChangeSets = {};
+    try {
+        const sets = await ChangeSets.listPending(projectId);
+        sets.forEach(changeSet => {
+            if (!changeSet.issueId) return;
+            (pendingChangeSets[changeSet.issueId] = pendingChangeSets[changeSet.issueId] || []).push(changeSet);
+        });
+    } catch (err) {
+        console.error('Failed to load change sets:', err);
+    }
+}
+
+function openChangeSet(id) {
+    closeTaskModal();
+    ChangeSets.open(id, () => loadTasks());
+}
+
 function renderTasks() {
     // Clear all columns
-    const statuses = ['proposed', 'todo', 'inProgress', 'review', 'done'];
+    const statuses = ['proposed', 'todo', 'inProgress', 'blocked', 'review', 'done'];
     statuses.forEach(status => {
         const column = document.getElementById(`column-${status}`);
         column.innerHTML = '';
@@ -53,7 +74,7 @@ function renderTasks() {
     // Render tasks in columns
     filteredTasks.forEach(task => {
         const card = createTaskCard(task);
-        const column = document.getElementById(`column-${task.status}`);
+        const column = document.getElementById(`column-${columnFor(task.status)}`);
         if (column) {
             column.appendChild(card);
         }
@@ -61,7 +82,7 @@ function renderTasks() {
 
     // Update counts
     statuses.forEach(status => {
-        const count = filteredTasks.filter(t => t.status === status).length;
+        const count = filteredTasks.filter(t => columnFor(t.status) === status).length;
         const countEl = document.getElementById(`count-${status}`);
         if (countEl) {
             countEl.textContent = count;
@@ -69,6 +90,27 @@ function renderTasks() {
     });
 }
 
+// Failed issues share the Blocked column; both need someone to step in.
+function columnFor(status) {
+    return status === 'failed' ? 'blocked' : status;
+}
+
+// runNote explains why an agent's last run on the task did not finish it.
+function runNote(task) {
+    if (!task.last_error) return '';
+    if (task.status === 'failed') {
+        return `Failed after ${task.attempts} attempt${task.attempts === 1 ? '' : 's'}: ${task.last_error}`;
+    }
+    if (task.status === 'todo' && task.queued_agent_id) {
+        // Unset times come back as Go's zero time.
+        const retryAt = new Date(task.retry_at);
+        return retryAt.getFullYear() > 1
+            ? `Retrying at ${retryAt.toLocaleTimeString()}: ${task.last_error}`
+            : `Retrying: ${task.last_error}`;
+    }
+    return task.last_error;
+}
+
 function createTaskCard(task) {
     const card = document.createElement('div');
     card.className = 'task-card';
@@ -96,6 +138,9 @@ function createTaskCard(task) {
         <div class="task-title">${escapeHtml(task.title)}</div>
         <div class="task-description">${escapeHtml(task.description || '')}</div>
         ${task.queued_agent_id ? `<div class="task-queue-badge">Queued → ${formatAgentName(task.queued_agent_id)}</div>` : ''}
+        ${task.branch ? `<div class="task-branch" title="${escapeHtml(task.branch)}">⎇ ${escapeHtml(task.branch)}</div>` : ''}
+        ${runNote(task) ? `<div class="task-run-note ${task.status}">${escapeHtml(runNote(task))}</div>` : ''}
+        ${(pendingChangeSets[task.id] || []).map(changeSet => ChangeSets.renderBadge(changeSet)).join('')}
         <div class="task-meta">
             <div class="task-agent">
                 ${task.assigned_agent_id ? `
@@ -107,6 +152,13 @@ function createTaskCard(task) {
         </div>
     `;
 
+    card.querySelectorAll('[data-change-set]').forEach(badge => {
+        badge.addEventListener('click', (e) => {
+            e.stopPropagation();
+            openChangeSet(badge.dataset.changeSet);
+        });
+    });
+
     return card;
 }
 
@@ -273,6 +325,12 @@ function openTaskModal(task) {
                 <label>Assigned To</label>
                 <p>${task.assigned_agent_id ? agentFullNames[task.assigned_agent_id] : 'Unassigned'}</p>
             </div>
+            ${runNote(task) ? `
+                <div class="form-group">
+                    <label>Last Run</label>
+                    <p class="task-run-note ${task.status}">${escapeHtml(runNote(task))}</p>
+                </div>
+            ` : ''}
             <div class="form-group">
                 <label>Queue Status</label>
                 <p>${task.queued_agent_id ? `Queued → ${formatAgentName(task.queued_agent_id)}` : 'Not queued'}</p>
@@ -281,6 +339,28 @@ function openTaskModal(task) {
                 <label>Created</label>
                 <p>${formatDate(task.created_at)}</p>
             </div>
+            ${task.branch ? `
+                <div class="form-group">
+                    <label>Branch</label>
+                    <p><code>${escapeHtml(task.branch)}</code></p>
+                    <ul class="task-commits" id="task-commits"><li>Loading commits…</li></ul>
+                    <div class="task-actions task-merge-actions" id="task-merge-actions" hidden>
+                        <button class="btn-secondary small" onclick="mergeTaskBranch('${task.id}', 'merge')">Merge</button>
+                        <button class="btn-secondary small" onclick="mergeTaskBranch('${task.id}', 'rebase')">Rebase &amp; fast-forward</button>
+                    </div>
+                    <div class="task-merge-result" id="task-merge-result" hidden></div>
+                </div>
+            ` : ''}
+            ${(pendingChangeSets[task.id] || []).length ? `
+                <div class="form-group">
+                    <label>Changes Awaiting Review</label>
+                    <div class="task-actions">
+                        ${pendingChangeSets[task.id].map(changeSet => `
+                            <button class="btn-secondary small" onclick="openChangeSet('${changeSet.id}')">Review ${changeSet.files.length} file${changeSet.files.length === 1 ? '' : 's'}</button>
+                        `).join('')}
+                    </div>
+                </div>
+            ` : ''}
             ${task.status === 'proposed' ? `
                 <div class="task-actions">
                     <button class="btn-approve" onclick="approveTask('${task.id}')">✓ Approve</button>
@@ -291,6 +371,86 @@ function openTaskModal(task) {
     `;
 
     modal.style.display = 'flex';
+
+    if (task.branch) {
+        loadTaskCommits(task.id);
+    }
+}
+
+async function loadTaskCommits(taskId) {
+    const list = document.getElementById('task-commits');
+    try {
+        const response = await fetch(`/api/issues/${taskId}`);
+        if (!response.ok) throw new Error(await response.text());
+        const data = await response.json();
+        const commits = (data.issue && data.issue.commits) || [];
+        const mergeActions = document.getElementById('task-merge-actions');
+        if (mergeActions) {
+            mergeActions.hidden = !data.canMerge || commits.length === 0;
+        }
+        list.innerHTML = commits.length
+            ? commits.map(commit => `
+                <li><code>${escapeHtml(commit.id.slice(0, 7))}</code> ${escapeHtml(commit.subject)} <span class="task-commit-date">${formatDate(commit.time)}</span></li>
+            `).join('')
+            : '<li>No commits yet</li>';
+    } catch (err) {
+        console.error('Failed to load commits:', err);
+        list.innerHTML = '<li>Commits unavailable</li>';
+    }
+}
+
+async function mergeTaskBranch(taskId, strategy) {
+    const actions = document.getElementById('task-merge-actions');
+    const resultEl = document.getElementById('task-merge-result');
+    actions.querySelectorAll('button').forEach(button => (button.disabled = true));
+    resultEl.hidden = false;
+    resultEl.className = 'task-merge-result';
+    resultEl.textContent = strategy === 'rebase' ? 'Rebasing…' : 'Merging…';
+
+    try {
+        const response = await fetch(`/api/issues/${taskId}/merge`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ strategy })
+        });
+        if (!response.ok) throw new Error((await response.text()).trim() || 'Merge failed');
+        const result = (await response.json()).result;
+
+        if (result.conflicts && result.conflicts.length) {
+            resultEl.classList.add('conflict');
+            resultEl.innerHTML = `
+                <p>Conflicts with <code>${escapeHtml(result.target)}</code> in:</p>
+                <ul>${result.conflicts.map(path => `<li><code>${escapeHtml(path)}</code></li>`).join('')}</ul>
+                <button class="btn-secondary small" onclick="assignConflicts('${taskId}')">Assign to agent</button>
+            `;
+        } else if (result.upToDate) {
+            resultEl.textContent = `Nothing new to land on ${result.target}.`;
+        } else {
+            resultEl.textContent = `Landed on ${result.target} (${result.commitId.slice(0, 7)}).`;
+            loadTaskCommits(taskId);
+        }
+    } catch (err) {
+        resultEl.classList.add('conflict');
+        resultEl.textContent = err.message;
+    } finally {
+        actions.querySelectorAll('button').forEach(button => (button.disabled = false));
+    }
+}
+
+async function assignConflicts(taskId) {
+    const resultEl = document.getElementById('task-merge-result');
+    try {
+        const response = await fetch(`/api/issues/${taskId}/resolve-conflicts`, { method: 'POST' });
+        if (!response.ok) throw new Error((await response.text()).trim() || 'Failed to assign conflicts');
+        const data = await response.json();
+        resultEl.classList.remove('conflict');
+        resultEl.textContent = data.issueId
+            ? 'Queued a task for the agent to resolve the conflicts.'
+            : 'The branch now merges cleanly; try again.';
+        await loadTasks();
+    } catch (err) {
+        resultEl.textContent = err.message;
+    }
 }
 
 function closeTaskModal() {
@@ -354,6 +514,8 @@ function formatStatus(status) {
         'proposed': 'Proposed',
         'todo': 'To Do',
         'inProgress': 'In Progress',
+        'blocked': 'Blocked',
+        'failed': 'Failed',
         'review': 'Review',
         'done': 'Done'
     };
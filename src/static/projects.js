@@ -12,9 +12,28 @@ function setupEventListeners() {
     document.getElementById('create-project-btn').addEventListener('click', openCreateModal);
     document.getElementById('create-project-form').addEventListener('submit', handleCreateProject);
     document.getElementById('repo-option').addEventListener('change', handleWorkspaceSourceChange);
+    document.getElementById('sign-out-everywhere-btn').addEventListener('click', signOutEverywhere);
     handleWorkspaceSourceChange();
 }
 
+async function signOutEverywhere() {
+    if (!confirm('Sign out of ReplyChat on every device, including this one?')) {
+        return;
+    }
+
+    try {
+        const response = await fetch('/api/sessions', { method: 'DELETE' });
+        if (!response.ok) {
+            alert('Failed to sign out everywhere');
+            return;
+        }
+        window.location.href = '/';
+    } catch (err) {
+        console.error('Failed to sign out everywhere:', err);
+        alert('Failed to sign out everywhere');
+    }
+}
+
 async function loadProjects() {
     console.log('Loading projects...');
     try {
@@ -59,12 +78,14 @@ function createProjectCard(project) {
     const card = document.createElement('div');
     card.className = 'project-card';
 
-    const isOwner = project.owner_id === window.userData.userId;
+    const role = project.role || (project.owner_id === window.userData.userId ? 'owner' : 'member');
+    const isOwner = role === 'owner';
+    const canInvite = role === 'owner' || role === 'maintainer';
 
     card.innerHTML = `
         <div class="project-card-header">
             <h3 class="project-name">${escapeHtml(project.name)}</h3>
-            <span class="project-role ${isOwner ? 'owner' : ''}">${isOwner ? 'Owner' : 'Member'}</span>
+            <span class="project-role ${isOwner ? 'owner' : ''}">${formatRole(role)}</span>
         </div>
         <p class="project-description">${escapeHtml(project.description || 'No description')}</p>
         <div class="project-meta">
@@ -77,7 +98,7 @@ function createProjectCard(project) {
         </div>
         <div class="project-actions">
             <button class="btn-enter" onclick="enterProject('${project.id}')">Open Project</button>
-            ${isOwner ? `<button class="btn-invite" onclick="openInviteModal('${project.id}')">Invite</button>` : ''}
+            ${canInvite ? `<button class="btn-invite" onclick="openInviteModal('${project.id}')">Invite</button>` : ''}
         </div>
     `;
 
@@ -207,6 +228,16 @@ function copyInviteLink() {
     alert('Invite link copied to clipboard!');
 }
 
+function formatRole(role) {
+    const labels = {
+        owner: 'Owner',
+        maintainer: 'Maintainer',
+        member: 'Member',
+        viewer: 'Viewer'
+    };
+    return labels[role] || 'Member';
+}
+
 function escapeHtml(text) {
     const div = document.createElement('div');
     div.textContent = text;
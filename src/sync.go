@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"replychat/src/agents"
+	"replychat/src/projectfs"
+)
+
+const defaultWorkspaceSyncInterval = 10 * time.Minute
+
+// syncNotices remembers the last problem posted per project by the
+// scheduled sync so an unchanged divergence is not announced every tick.
+var (
+	syncNoticesMu sync.Mutex
+	syncNotices   = map[string]string{}
+)
+
+// syncProjectWorkspace fetches origin into the project workspace and brings
+// its branch up to date with strategy, or the project's sync strategy when
+// strategy is empty. New commits, divergence, conflicts and failures are
+// posted as system messages and recorded in the project activity; scheduled
+// syncs only repeat a problem once it has changed.
+func syncProjectWorkspace(projectID, strategy, actorID string, scheduled bool) (*projectfs.SyncResult, error) {
+	settings, err := projectfs.LoadSettings(db, projectID)
+	if err != nil {
+		return nil, err
+	}
+	if strategy == "" {
+		strategy = settings.SyncStrategyOrDefault()
+	}
+
+	result, err := projectfs.SyncWorkspace(settings.WorkspacePath, strategy)
+	if scheduled && (errors.Is(err, projectfs.ErrNoRemote) || errors.Is(err, projectfs.ErrNoRepository) ||
+		errors.Is(err, projectfs.ErrDirtyWorkspace) || errors.Is(err, projectfs.ErrUnfinishedSync)) {
+		// Nothing to sync with, an agent is mid-edit, or the conflicts
+		// were already announced.
+		return nil, err
+	}
+
+	activity := agents.Activity{
+		ProjectID: projectID,
+		Kind:      "sync",
+		ActorID:   actorID,
+		Details: map[string]interface{}{
+			"strategy":  strategy,
+			"scheduled": scheduled,
+		},
+	}
+	var notice string
+	switch {
+	case err != nil:
+		activity.Status = agents.ActivityFailed
+		activity.Summary = "Failed to sync the workspace with origin"
+		activity.Error = err.Error()
+		notice = fmt.Sprintf("Could not sync the workspace with origin: %v.", err)
+		log.Printf("git: sync of project %s failed: %v", projectID, err)
+	case result.Upstream == "":
+		activity.Summary = fmt.Sprintf("Fetched origin; it has no %s branch", result.Branch)
+	case len(result.Conflicts) > 0:
+		activity.Status = agents.ActivityFailed
+		activity.Summary = fmt.Sprintf("Rebasing %s onto %s stopped on conflicts", result.Branch, result.Upstream)
+		notice = fmt.Sprintf("Rebasing %s onto %s stopped on conflicts in %s. Queued agent tasks wait until the conflicts are resolved in the workspace or the sync is aborted.",
+			result.Branch, result.Upstream, strings.Join(result.Conflicts, ", "))
+	case result.Diverged:
+		activity.Status = agents.ActivityFailed
+		activity.Summary = fmt.Sprintf("%s has diverged from %s", result.Branch, result.Upstream)
+		notice = fmt.Sprintf("%s has diverged from %s (%d local, %d remote commits). Sync with the rebase strategy or reconcile the branches by hand; agents keep working on the local branch.",
+			result.Branch, result.Upstream, result.Ahead, result.Behind)
+	case result.Updated:
+		activity.Summary = fmt.Sprintf("Synced %s with %s", result.Branch, result.Upstream)
+		text := fmt.Sprintf("Synced %s with %s: pulled %d commit(s)", result.Branch, result.Upstream, result.Behind)
+		if result.Ahead > 0 {
+			text += fmt.Sprintf(" and replayed %d local commit(s) on top", result.Ahead)
+		}
+		sendSystemMessage(projectID, text+".")
+	default:
+		activity.Summary = fmt.Sprintf("%s is up to date with %s", result.Branch, result.Upstream)
+	}
+	if result != nil {
+		activity.Details["branch"] = result.Branch
+		activity.Details["ahead"] = result.Ahead
+		activity.Details["behind"] = result.Behind
+		if result.CommitID != "" {
+			activity.Details["commitId"] = result.CommitID
+		}
+		if len(result.Conflicts) > 0 {
+			activity.Details["conflicts"] = result.Conflicts
+		}
+	}
+
+	syncNoticesMu.Lock()
+	repeated := scheduled && notice != "" && syncNotices[projectID] == notice
+	syncNotices[projectID] = notice
+	syncNoticesMu.Unlock()
+
+	if !scheduled || (result != nil && result.Updated) || (notice != "" && !repeated) {
+		agents.RecordActivity(db, hubPublisher(), activity)
+	}
+	if notice != "" && !repeated {
+		sendSystemMessage(projectID, notice)
+	}
+	return result, err
+}
+
+// abortProjectSync abandons a sync left mid-rebase by conflicts.
+func abortProjectSync(projectID, actorID string) error {
+	settings, err := projectfs.LoadSettings(db, projectID)
+	if err != nil {
+		return err
+	}
+	if !projectfs.InConflict(settings.WorkspacePath) {
+		return nil
+	}
+	if err := projectfs.AbortSync(settings.WorkspacePath); err != nil {
+		return err
+	}
+
+	syncNoticesMu.Lock()
+	delete(syncNotices, projectID)
+	syncNoticesMu.Unlock()
+
+	agents.RecordActivity(db, hubPublisher(), agents.Activity{
+		ProjectID: projectID,
+		Kind:      "sync",
+		ActorID:   actorID,
+		Summary:   "Aborted the unfinished sync",
+	})
+	sendSystemMessage(projectID, fmt.Sprintf("%s aborted the unfinished sync; queued agent tasks resume.", lookupUserName(actorID)))
+	return nil
+}
+
+// projectWorkspaceBlocked reports whether the project workspace is stuck
+// mid-rebase or mid-merge, in which case queued agent tasks must wait.
+func projectWorkspaceBlocked(projectID string) bool {
+	settings, err := projectfs.LoadSettings(db, projectID)
+	if err != nil {
+		return false
+	}
+	return projectfs.InConflict(settings.WorkspacePath)
+}
+
+// projectSyncHandler reports whether the workspace is mid-conflict (GET), or
+// syncs it with origin (POST). A POST may override the project's strategy
+// or, with abort, abandon a sync that stopped on conflicts.
+func projectSyncHandler(w http.ResponseWriter, r *http.Request) {
+	access := accessFromRequest(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		settings, err := projectfs.LoadSettings(db, access.ProjectID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		inConflict := projectfs.InConflict(settings.WorkspacePath)
+		response := map[string]interface{}{
+			"strategy":   settings.SyncStrategyOrDefault(),
+			"inConflict": inConflict,
+			"canSync":    access.Role.can(permSyncWorkspace),
+		}
+		if inConflict {
+			response["conflicts"] = projectfs.ConflictedPaths(settings.WorkspacePath)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !requirePermission(w, access, permSyncWorkspace) {
+		return
+	}
+	var req struct {
+		Strategy string `json:"strategy"`
+		Abort    bool   `json:"abort"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Strategy != "" && !projectfs.ValidSyncStrategy(req.Strategy) {
+		http.Error(w, "strategy must be ff-only or rebase", http.StatusBadRequest)
+		return
+	}
+
+	if req.Abort {
+		if err := abortProjectSync(access.ProjectID, access.UserID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	result, err := syncProjectWorkspace(access.ProjectID, req.Strategy, access.UserID, false)
+	switch {
+	case err == nil:
+	case errors.Is(err, projectfs.ErrNoRemote), errors.Is(err, projectfs.ErrNoRepository),
+		errors.Is(err, projectfs.ErrDirtyWorkspace), errors.Is(err, projectfs.ErrUnfinishedSync),
+		errors.Is(err, projectfs.ErrDetachedHead):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sync": result,
+	})
+}
+
+// workspaceSyncInterval reads WORKSPACE_SYNC_INTERVAL. "off" disables the
+// scheduled sync.
+func workspaceSyncInterval() time.Duration {
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("WORKSPACE_SYNC_INTERVAL")), "off") {
+		return 0
+	}
+	if d, ok := envDuration("WORKSPACE_SYNC_INTERVAL"); ok {
+		return d
+	}
+	return defaultWorkspaceSyncInterval
+}
+
+// startWorkspaceSync periodically syncs every project workspace that has a
+// remote.
+func startWorkspaceSync(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		log.Println("git: scheduled workspace sync is disabled")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			projectIDs, err := listProjectIDs()
+			if err != nil {
+				log.Printf("db: failed to list projects for sync: %v", err)
+				continue
+			}
+			for _, projectID := range projectIDs {
+				if ctx.Err() != nil {
+					return
+				}
+				syncProjectWorkspace(projectID, "", "", true)
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strconv"
+
+	"replychat/src/projectfs"
+)
+
+const (
+	maxWorkspaceFileBytes = 1 << 20
+	maxWorkspaceDiffBytes = 2 << 20
+	defaultLogLimit       = 50
+	maxLogLimit           = 500
+)
+
+// workspaceAPIHandler serves the read-only workspace browser under
+// /api/projects/{id}/workspace/: tree, file?path=, log and diff?commit=.
+// An issue_id parameter switches to that issue's worktree.
+func workspaceAPIHandler(w http.ResponseWriter, r *http.Request, action string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	access := accessFromRequest(r)
+	query := r.URL.Query()
+
+	workspacePath, err := browsedWorkspace(access.ProjectID, query.Get("issue_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "issue not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var response map[string]interface{}
+	switch action {
+	case "tree":
+		var entries []projectfs.TreeEntry
+		entries, err = projectfs.Tree(workspacePath)
+		response = map[string]interface{}{"files": entries}
+	case "file":
+		path := query.Get("path")
+		if path == "" {
+			http.Error(w, "path is required", http.StatusBadRequest)
+			return
+		}
+		var file *projectfs.FileContent
+		file, err = projectfs.ReadFile(workspacePath, path, maxWorkspaceFileBytes)
+		response = map[string]interface{}{"file": file}
+	case "log":
+		limit := defaultLogLimit
+		if raw := query.Get("limit"); raw != "" {
+			n, convErr := strconv.Atoi(raw)
+			if convErr != nil || n <= 0 {
+				http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxLogLimit)
+		}
+		var commits []projectfs.Commit
+		commits, err = projectfs.Log(workspacePath, query.Get("path"), limit)
+		response = map[string]interface{}{"commits": commits}
+	case "diff":
+		var diff *projectfs.Diff
+		if commit := query.Get("commit"); commit != "" {
+			diff, err = projectfs.CommitDiff(workspacePath, commit, maxWorkspaceDiffBytes)
+		} else {
+			diff, err = projectfs.WorkingDiff(workspacePath, maxWorkspaceDiffBytes)
+		}
+		response = map[string]interface{}{"diff": diff}
+	default:
+		http.Error(w, "Invalid endpoint", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case err == nil:
+	case errors.Is(err, projectfs.ErrPathEscapes):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, projectfs.ErrUnknownRef):
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	case errors.Is(err, projectfs.ErrNoRepository):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, projectfs.ErrNotAFile):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// browsedWorkspace returns the project's workspace, or the worktree of
+// issueID when it is set and belongs to the project.
+func browsedWorkspace(projectID, issueID string) (string, error) {
+	if issueID != "" {
+		var worktreePath sql.NullString
+		err := db.QueryRow(`SELECT worktree_path FROM issues WHERE id = ? AND project_id = ?`, issueID, projectID).Scan(&worktreePath)
+		if err != nil {
+			return "", err
+		}
+		if worktreePath.String != "" {
+			return worktreePath.String, nil
+		}
+	}
+
+	settings, err := projectfs.LoadSettings(db, projectID)
+	if err != nil {
+		return "", err
+	}
+	if settings.WorkspacePath != "" {
+		return settings.WorkspacePath, nil
+	}
+	return projectfs.WorkspacePath(projectID), nil
+}